@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth constants
+const (
+	DevicesFileName  = "devices.json" // Device token store inside the data directory
+	TokenQueryParam  = "token"        // Query parameter accepted on streaming and QR endpoints
+	TokenHashPrefix  = "sha256:"      // Prefix for pre-hashed tokens in config
+	DeviceTokenBytes = 32             // Random bytes in a generated device token
+	DeviceTokenTag   = "doze_"        // Prefix on generated device tokens (for secret scanners)
+)
+
+// Principal identifies who made an authenticated request.
+type Principal struct {
+	Kind     string `json:"kind"`                // "api", "device", or "anonymous" (auth disabled)
+	DeviceID string `json:"device_id,omitempty"` // Set when Kind is "device"
+}
+
+// DeviceToken is a per-device credential.
+//
+// Only the SHA-256 hash of the token is stored; the plaintext is returned
+// once when the token is issued.
+type DeviceToken struct {
+	ID         string    `json:"id"`                     // Random device ID
+	Name       string    `json:"name"`                   // Human-readable label (e.g. "iPhone")
+	Hash       string    `json:"hash"`                   // Hex SHA-256 of the token
+	CreatedAt  time.Time `json:"created_at"`             // When the token was issued
+	LastUsedAt time.Time `json:"last_used_at,omitempty"` // Last successful authentication
+}
+
+// Authenticator validates API and device tokens.
+//
+// API tokens come from config (auth.tokens or DOZE_AUTH_TOKEN) and can't be
+// revoked at runtime. Device tokens are issued over the API (or by pairing)
+// and persisted as hashes in devices.json. Auth is enforced as soon as any
+// token exists; with no tokens at all the server is open (local development).
+//
+// Since the first token locks out everyone without one, an open server
+// doesn't issue credentials over the API (see requireCredential): the first
+// device pairs with the code printed at startup (auth.pair_on_start).
+type Authenticator struct {
+	mu        sync.RWMutex
+	apiHashes [][]byte                // SHA-256 hashes of configured API tokens
+	devices   map[string]*DeviceToken // Device tokens by ID
+	path      string                  // Path to devices.json ("" = in-memory only)
+}
+
+// principalKey is the context key for the request's Principal.
+type principalKey struct{}
+
+// authenticator is the global authenticator, set up by main().
+var authenticator = &Authenticator{devices: make(map[string]*DeviceToken)}
+
+// NewAuthenticator creates an authenticator from configured API tokens and
+// loads device tokens from dataDir.
+//
+// Each API token is either plaintext or "sha256:<hex>" (so config files don't
+// need to contain the secret itself).
+func NewAuthenticator(apiTokens []string, dataDir string) (*Authenticator, error) {
+	a := &Authenticator{
+		devices: make(map[string]*DeviceToken),
+		path:    filepath.Join(dataDir, DevicesFileName),
+	}
+
+	for _, token := range apiTokens {
+		if token == "" {
+			continue
+		}
+		if strings.HasPrefix(token, TokenHashPrefix) {
+			hash, err := hex.DecodeString(strings.TrimPrefix(token, TokenHashPrefix))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid token hash %q", token)
+			}
+			a.apiHashes = append(a.apiHashes, hash)
+			continue
+		}
+		sum := sha256.Sum256([]byte(token))
+		a.apiHashes = append(a.apiHashes, sum[:])
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read device tokens: %w", err)
+	}
+	if len(data) > 0 {
+		var devices []*DeviceToken
+		if err := json.Unmarshal(data, &devices); err != nil {
+			return nil, fmt.Errorf("failed to parse device tokens: %w", err)
+		}
+		for _, d := range devices {
+			a.devices[d.ID] = d
+		}
+	}
+
+	return a, nil
+}
+
+// Enabled reports whether requests must be authenticated.
+func (a *Authenticator) Enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return len(a.apiHashes) > 0 || len(a.devices) > 0
+}
+
+// Authenticate checks a plaintext token against all API and device tokens.
+//
+// Every stored hash is compared in constant time, and the loop doesn't exit
+// early, so timing doesn't reveal which (if any) token matched.
+func (a *Authenticator) Authenticate(token string) (Principal, bool) {
+	if token == "" {
+		return Principal{}, false
+	}
+	sum := sha256.Sum256([]byte(token))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var principal Principal
+	matched := 0
+	for _, hash := range a.apiHashes {
+		if subtle.ConstantTimeCompare(sum[:], hash) == 1 {
+			principal = Principal{Kind: "api"}
+			matched = 1
+		}
+	}
+	for _, d := range a.devices {
+		hash, err := hex.DecodeString(d.Hash)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(sum[:], hash) == 1 {
+			principal = Principal{Kind: "device", DeviceID: d.ID}
+			matched = 1
+			d.LastUsedAt = time.Now()
+		}
+	}
+
+	return principal, matched == 1
+}
+
+// IssueDeviceToken creates and persists a new device token.
+//
+// Returns the plaintext token (shown to the caller once) and its metadata.
+func (a *Authenticator) IssueDeviceToken(name string) (string, DeviceToken, error) {
+	secret := make([]byte, DeviceTokenBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", DeviceToken{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := DeviceTokenTag + hex.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(token))
+
+	if name == "" {
+		name = "device"
+	}
+	device := &DeviceToken{
+		ID:        newSessionID(),
+		Name:      name,
+		Hash:      hex.EncodeToString(sum[:]),
+		CreatedAt: time.Now(),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.devices[device.ID] = device
+	if err := a.saveLocked(); err != nil {
+		delete(a.devices, device.ID)
+		return "", DeviceToken{}, err
+	}
+
+	slog.Info("device token issued", "device_id", device.ID, "name", name)
+	return token, *device, nil
+}
+
+// ListDevices returns all device tokens ordered by creation time.
+func (a *Authenticator) ListDevices() []DeviceToken {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	list := make([]DeviceToken, 0, len(a.devices))
+	for _, d := range a.devices {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// RevokeDevice deletes a device token. Returns false if the ID is unknown.
+func (a *Authenticator) RevokeDevice(id string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	device, ok := a.devices[id]
+	if !ok {
+		return false, nil
+	}
+	delete(a.devices, id)
+	if err := a.saveLocked(); err != nil {
+		a.devices[id] = device
+		return true, err
+	}
+
+	slog.Info("device token revoked", "device_id", id, "name", device.Name)
+	return true, nil
+}
+
+// saveLocked writes device tokens to disk. The caller must hold a.mu.
+func (a *Authenticator) saveLocked() error {
+	if a.path == "" {
+		return nil
+	}
+
+	list := make([]*DeviceToken, 0, len(a.devices))
+	for _, d := range a.devices {
+		list = append(list, d)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal device tokens: %w", err)
+	}
+
+	tmpPath := a.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write device tokens: %w", err)
+	}
+	return os.Rename(tmpPath, a.path)
+}
+
+// Middleware rejects unauthenticated requests to API endpoints.
+//
+// Credentials are read from, in order:
+//  1. Authorization: Bearer <token>
+//  2. The ?token= query parameter (streaming endpoints and /pair/qr only,
+//     since EventSource and <img> can't set headers)
+//
+// Cookies are deliberately not accepted: a browser would attach them to
+// cross-site requests too.
+//
+// Public routes (health check, web UI assets, and anything in publicPatterns)
+// pass through. The authenticated Principal is stored in the request context.
+func (a *Authenticator) Middleware(mux *http.ServeMux, publicPatterns []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next.ServeHTTP(w, withPrincipal(r, Principal{Kind: "anonymous"}))
+			return
+		}
+
+		_, pattern := mux.Handler(r)
+		if slices.Contains(publicPatterns, pattern) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, ok := a.Authenticate(requestToken(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="doze"`)
+			respondError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, withPrincipal(r, principal))
+	})
+}
+
+// requestToken extracts the credential from a request (see Middleware).
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	if allowsQueryToken(r.URL.Path) {
+		return r.URL.Query().Get(TokenQueryParam)
+	}
+	return ""
+}
+
+// allowsQueryToken reports whether a path may authenticate with a query
+// token. Limited to endpoints loaded by browser APIs that can't set headers
+// (EventSource, WebSocket, <img>), to keep tokens out of ordinary request logs.
+func allowsQueryToken(path string) bool {
+	return path == "/stream" || strings.HasSuffix(path, "/stream") ||
+		path == "/ws" || strings.HasSuffix(path, "/ws") ||
+		path == "/pair/qr"
+}
+
+// withPrincipal returns r with the principal attached to its context.
+func withPrincipal(r *http.Request, p Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// principalFromRequest returns the authenticated principal for a request.
+func principalFromRequest(r *http.Request) (Principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// requireCredential rejects requests that didn't authenticate, i.e. any
+// request while auth is disabled. Endpoints that hand out credentials use it:
+// on an open server, the first device token would otherwise let anyone who
+// can reach it lock every other client out. Returns false if it responded.
+func requireCredential(w http.ResponseWriter, r *http.Request) bool {
+	if p, ok := principalFromRequest(r); ok && p.Kind != "anonymous" {
+		return true
+	}
+	respondError(w, http.StatusForbidden, "auth is disabled: set an API token (DOZE_AUTH_TOKEN) or pair a device with the code printed at startup")
+	return false
+}
+
+// corsMiddleware adds CORS headers for allowlisted origins.
+//
+// Only origins listed in auth.cors_origins get Access-Control-Allow-Origin;
+// other cross-origin requests are served without CORS headers, so browsers
+// block them. Preflight (OPTIONS) requests are answered directly. Clients
+// authenticate with a bearer token, so credentialed requests aren't allowed.
+func corsMiddleware(origins []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && slices.Contains(origins, origin)
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleListDevices lists issued device tokens (hashes omitted).
+//
+// GET /auth/devices
+//
+// Response:
+//
+//	{
+//	  "devices": [{"id": "...", "name": "iPhone", "created_at": "...", "last_used_at": "..."}]
+//	}
+func handleListDevices(w http.ResponseWriter, r *http.Request) {
+	devices := authenticator.ListDevices()
+	result := make([]map[string]interface{}, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, map[string]interface{}{
+			"id":           d.ID,
+			"name":         d.Name,
+			"created_at":   d.CreatedAt,
+			"last_used_at": d.LastUsedAt,
+		})
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"devices": result,
+	})
+}
+
+// handleIssueDevice issues a new device token. Refused while auth is
+// disabled (see requireCredential).
+//
+// POST /auth/devices
+// Request body (optional):
+//
+//	{
+//	  "name": "iPhone"
+//	}
+//
+// Response (201). The token is only ever returned here:
+//
+//	{
+//	  "id": "3f9a1c2b4d5e6f70",
+//	  "name": "iPhone",
+//	  "token": "doze_..."
+//	}
+func handleIssueDevice(w http.ResponseWriter, r *http.Request) {
+	if !requireCredential(w, r) {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Warn("failed to decode issue device request body", "error", err)
+		// Continue with empty req - name is optional
+	}
+
+	token, device, err := authenticator.IssueDeviceToken(req.Name)
+	if err != nil {
+		slog.Error("failed to issue device token", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to issue device token")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":         device.ID,
+		"name":       device.Name,
+		"token":      token,
+		"created_at": device.CreatedAt,
+	})
+}
+
+// handleRevokeDevice revokes a device token.
+//
+// DELETE /auth/devices/{id}
+func handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	found, err := authenticator.RevokeDevice(r.PathValue("id"))
+	if err != nil {
+		slog.Error("failed to revoke device token", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to revoke device token")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "device not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// handleWhoAmI returns the principal the request authenticated as.
+//
+// GET /auth/whoami
+func handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromRequest(r)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"auth_enabled": authenticator.Enabled(),
+		"principal":    principal,
+	})
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/seamus/doze/notify"
+)
+
+// Budget settings
+const (
+	EventTypeBudgetExceeded = "budget_exceeded"
+
+	// Budget scopes
+	BudgetScopeSession = "session" // cfg.Budgets.Session (or the session's override)
+	BudgetScopeDaily   = "daily"   // cfg.Budgets.Daily, across sessions
+)
+
+// ErrBudgetExceeded is matched by the *BudgetExceeded sendMessage returns
+// when the session is over budget.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// BudgetUsage is what counts against a budget.
+type BudgetUsage struct {
+	CostUSD       float64 `json:"cost_usd"`
+	Turns         int     `json:"turns"`
+	ActiveSeconds float64 `json:"active_seconds"`
+}
+
+// BudgetExceeded names the limit a session hit. It's the content of a
+// budget_exceeded event and the error refused messages get.
+type BudgetExceeded struct {
+	Scope string  `json:"scope"` // See BudgetScope*
+	Limit string  `json:"limit"` // max_cost_usd, max_turns or max_active_seconds
+	Max   float64 `json:"max"`
+	Used  float64 `json:"used"`
+}
+
+func (e *BudgetExceeded) Error() string {
+	return fmt.Sprintf("%s budget exceeded: %s is %g, used %g", e.Scope, e.Limit, e.Max, e.Used)
+}
+
+func (e *BudgetExceeded) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// exceeded returns the first limit used is at or over, or nil.
+func (b BudgetLimits) exceeded(scope string, used BudgetUsage) *BudgetExceeded {
+	switch {
+	case b.MaxCostUSD > 0 && used.CostUSD >= b.MaxCostUSD:
+		return &BudgetExceeded{Scope: scope, Limit: "max_cost_usd", Max: b.MaxCostUSD, Used: used.CostUSD}
+	case b.MaxTurns > 0 && used.Turns >= b.MaxTurns:
+		return &BudgetExceeded{Scope: scope, Limit: "max_turns", Max: float64(b.MaxTurns), Used: float64(used.Turns)}
+	case b.MaxActiveSeconds > 0 && used.ActiveSeconds >= float64(b.MaxActiveSeconds):
+		return &BudgetExceeded{Scope: scope, Limit: "max_active_seconds", Max: float64(b.MaxActiveSeconds), Used: used.ActiveSeconds}
+	}
+	return nil
+}
+
+// activeAllowance returns how much more active time the limits allow, or
+// false if they don't cap it.
+func (b BudgetLimits) activeAllowance(used BudgetUsage) (time.Duration, bool) {
+	if b.MaxActiveSeconds == 0 {
+		return 0, false
+	}
+	return time.Duration((float64(b.MaxActiveSeconds) - used.ActiveSeconds) * float64(time.Second)), true
+}
+
+// budgeted reports whether any budget applies to the session. The caller
+// must hold s.mu.
+func (s *Session) budgeted() bool {
+	return s.Budget != (BudgetLimits{}) || cfg.Budgets.Daily != (BudgetLimits{})
+}
+
+// limitsActiveTime reports whether a max_active_seconds limit applies to the
+// session. The caller must hold s.mu.
+func (s *Session) limitsActiveTime() bool {
+	return s.Budget.MaxActiveSeconds > 0 || cfg.Budgets.Daily.MaxActiveSeconds > 0
+}
+
+// budgetTotals returns what the session has used over its lifetime, counting
+// the active state it may be in up to now. The caller must hold s.mu.
+func (s *Session) budgetTotals(now time.Time) BudgetUsage {
+	active := s.activeTime
+	if s.State == StateActive && !s.stateSince.IsZero() {
+		active += now.Sub(s.stateSince)
+	}
+	return BudgetUsage{CostUSD: s.Usage.CostUSD, Turns: s.Usage.Turns, ActiveSeconds: active.Seconds()}
+}
+
+// sessionBudgetUsage returns what counts against the session budget: usage
+// since the session started or its budget was last overridden. The caller
+// must hold s.mu.
+func (s *Session) sessionBudgetUsage(now time.Time) BudgetUsage {
+	total := s.budgetTotals(now)
+	return BudgetUsage{
+		CostUSD:       total.CostUSD - s.budgetBase.CostUSD,
+		Turns:         total.Turns - s.budgetBase.Turns,
+		ActiveSeconds: total.ActiveSeconds - s.budgetBase.ActiveSeconds,
+	}
+}
+
+// dailyBudgetUsage returns what all sessions have used today (server-local
+// day). The caller must NOT hold any session's mu.
+func dailyBudgetUsage(now time.Time) BudgetUsage {
+	today := now.Format(time.DateOnly)
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+
+	usage := usageLedger.Day(today)
+	active := computeLedger.StateTime(today, StateActive)
+	for _, s := range sessions.List() {
+		s.mu.RLock()
+		if s.State == StateActive && !s.stateSince.IsZero() {
+			active += now.Sub(later(s.stateSince, midnight))
+		}
+		s.mu.RUnlock()
+	}
+	return BudgetUsage{CostUSD: usage.CostUSD, Turns: usage.Turns, ActiveSeconds: active.Seconds()}
+}
+
+// later returns the later of two times.
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// checkBudget returns the limit the session is over, or nil if it may take
+// another message. The first time a limit is hit, the session is blocked
+// until overrideBudget and clients get a budget_exceeded event.
+//
+// The caller must NOT hold s.mu.
+func (s *Session) checkBudget() *BudgetExceeded {
+	now := time.Now()
+	s.mu.RLock()
+	block := s.budgetBlock
+	limits := s.Budget
+	used := s.sessionBudgetUsage(now)
+	exempt := s.budgetExemptDay == now.Format(time.DateOnly)
+	s.mu.RUnlock()
+
+	if block != nil {
+		return block
+	}
+	ev := limits.exceeded(BudgetScopeSession, used)
+	if ev == nil && !exempt && cfg.Budgets.Daily != (BudgetLimits{}) {
+		ev = cfg.Budgets.Daily.exceeded(BudgetScopeDaily, dailyBudgetUsage(now))
+	}
+	if ev == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.budgetBlock != nil {
+		return s.budgetBlock
+	}
+	s.budgetBlock = ev
+	s.persist()
+	slog.Warn("budget exceeded", "id", s.ID, "scope", ev.Scope, "limit", ev.Limit, "max", ev.Max, "used", ev.Used)
+	if data, err := json.Marshal(ev); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypeBudgetExceeded, Content: string(data)})
+	}
+	s.notify(notify.EventError, "Budget exceeded", ev.Error())
+	return ev
+}
+
+// armBudgetTimer schedules enforceActiveBudget for when the turn that just
+// started would use up the active-time allowance. Does nothing if no
+// max_active_seconds limit applies. The caller must NOT hold s.mu.
+func (s *Session) armBudgetTimer() {
+	now := time.Now()
+	s.mu.RLock()
+	limits := s.Budget
+	used := s.sessionBudgetUsage(now)
+	exempt := s.budgetExemptDay == now.Format(time.DateOnly)
+	s.mu.RUnlock()
+
+	allowance, limited := limits.activeAllowance(used)
+	if !exempt {
+		if daily, ok := cfg.Budgets.Daily.activeAllowance(dailyBudgetUsage(now)); ok && (!limited || daily < allowance) {
+			allowance, limited = daily, true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelBudgetTimer()
+	if !limited || s.State != StateActive {
+		return
+	}
+	s.budgetTimer = time.AfterFunc(max(allowance, 0), s.enforceActiveBudget)
+}
+
+// cancelBudgetTimer stops a pending active-time check. The caller must hold
+// s.mu.
+func (s *Session) cancelBudgetTimer() {
+	if s.budgetTimer != nil {
+		s.budgetTimer.Stop()
+		s.budgetTimer = nil
+	}
+}
+
+// enforceActiveBudget interrupts the current turn once the session is over
+// budget. Other sessions use the daily allowance too, so if the limit isn't
+// reached yet the check is rescheduled.
+func (s *Session) enforceActiveBudget() {
+	if s.checkBudget() == nil {
+		s.armBudgetTimer()
+		return
+	}
+	if err := s.interrupt(); err != nil && !errors.Is(err, ErrNotActive) {
+		slog.Error("failed to interrupt over-budget turn", "id", s.ID, "error", err)
+	}
+}
+
+// overrideBudget lifts a budget block: the session budget starts over from
+// the current usage (with new limits, if given) and the daily budget no
+// longer applies to the session until midnight. Queued messages are then
+// delivered.
+func (s *Session) overrideBudget(limits *BudgetLimits) {
+	now := time.Now()
+	s.mu.Lock()
+	if limits != nil {
+		s.Budget = *limits
+	}
+	s.budgetBase = s.budgetTotals(now)
+	s.budgetExemptDay = now.Format(time.DateOnly)
+	s.budgetBlock = nil
+	s.persist()
+	slog.Info("budget overridden", "id", s.ID, "max_cost_usd", s.Budget.MaxCostUSD,
+		"max_turns", s.Budget.MaxTurns, "max_active_seconds", s.Budget.MaxActiveSeconds)
+	s.mu.Unlock()
+
+	go s.deliverNext()
+}
+
+// handleBudget reports a session's budget: the limits, what counts against
+// them, and the limit that blocked the session, if any.
+//
+// GET /budget
+// GET /sessions/{id}/budget
+//
+// Response:
+//
+//	{
+//	  "limits": {"session": {"max_cost_usd": 5, "max_turns": 0, "max_active_seconds": 0}, "daily": {...}},
+//	  "used": {"session": {"cost_usd": 5.12, "turns": 14, "active_seconds": 1830}, "daily": {...}},
+//	  "daily_exempt": false,
+//	  "exceeded": {"scope": "session", "limit": "max_cost_usd", "max": 5, "used": 5.12}
+//	}
+func handleBudget(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	s.mu.RLock()
+	limits := s.Budget
+	used := s.sessionBudgetUsage(now)
+	exempt := s.budgetExemptDay == now.Format(time.DateOnly)
+	block := s.budgetBlock
+	s.mu.RUnlock()
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"limits":       map[string]BudgetLimits{BudgetScopeSession: limits, BudgetScopeDaily: cfg.Budgets.Daily},
+		"used":         map[string]BudgetUsage{BudgetScopeSession: used, BudgetScopeDaily: dailyBudgetUsage(now)},
+		"daily_exempt": exempt,
+		"exceeded":     block,
+	})
+}
+
+// handleOverrideBudget lets an over-budget session continue.
+//
+// POST /budget/override
+// POST /sessions/{id}/budget/override
+//
+// The session budget starts over from the current usage and the daily budget
+// stops applying to the session until midnight. The optional body replaces
+// the session's limits:
+//
+//	{"session": {"max_cost_usd": 10, "max_turns": 0, "max_active_seconds": 3600}}
+//
+// Response:
+//
+//	{"success": true, "limits": {"max_cost_usd": 10, ...}}
+func handleOverrideBudget(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Session *BudgetLimits `json:"session"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if req.Session != nil {
+		if errs := req.Session.validate("session"); len(errs) > 0 {
+			respondError(w, http.StatusBadRequest, errors.Join(errs...).Error())
+			return
+		}
+	}
+
+	s.overrideBudget(req.Session)
+
+	s.mu.RLock()
+	limits := s.Budget
+	s.mu.RUnlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"limits":  limits,
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxPromptPreview is the longest first prompt GET /claude-sessions returns.
+const MaxPromptPreview = 200
+
+// claudeSessionIDPattern matches the IDs Claude names its transcripts with,
+// so an ID from a URL can't point outside the projects directory.
+var claudeSessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// adoptMu serializes adoptions so a Claude session can't be adopted twice.
+var adoptMu sync.Mutex
+
+// claudeSessionCache holds transcript summaries so listing doesn't re-read
+// every transcript on each request. An entry is used only while the file's
+// size and modification time are unchanged; Claude only ever appends.
+var claudeSessionCache = struct {
+	sync.Mutex
+	entries map[string]cachedClaudeSession // Keyed by transcript path
+}{entries: make(map[string]cachedClaudeSession)}
+
+// cachedClaudeSession is a transcript summary and the file it was read from.
+type cachedClaudeSession struct {
+	size    int64
+	modTime time.Time
+	info    ClaudeSession
+}
+
+// ClaudeSession describes a conversation Claude Code saved under
+// ~/.claude/projects, whether or not Doze started it.
+type ClaudeSession struct {
+	ID           string    `json:"id"`                     // Claude session ID (for --resume)
+	RepoPath     string    `json:"repo_path"`              // Working directory the session ran in
+	FirstPrompt  string    `json:"first_prompt,omitempty"` // First user message, shortened
+	Messages     int       `json:"messages"`               // User and assistant messages
+	LastActivity time.Time `json:"last_activity"`
+	DozeSession  string    `json:"doze_session,omitempty"` // Doze session that owns it, if any
+}
+
+// readClaudeSession summarizes a Claude transcript. Messages Claude marks as
+// meta (e.g. command caveats) or as belonging to a sub-agent aren't counted.
+//
+// Lines are read whole however long they get: a large tool result must not
+// hide the rest of the conversation.
+func readClaudeSession(path string) (ClaudeSession, error) {
+	info := ClaudeSession{ID: strings.TrimSuffix(filepath.Base(path), ".jsonl")}
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReaderSize(f, ScannerInitialBuffer)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			info.addLine(data)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return info, err
+		}
+	}
+
+	if info.LastActivity.IsZero() {
+		if stat, err := f.Stat(); err == nil {
+			info.LastActivity = stat.ModTime()
+		}
+	}
+	return info, nil
+}
+
+// summarizeClaudeSession returns the summary of a transcript, reading it
+// only if it changed since it was last summarized.
+func summarizeClaudeSession(path string) (ClaudeSession, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		claudeSessionCache.Lock()
+		delete(claudeSessionCache.entries, path)
+		claudeSessionCache.Unlock()
+		return ClaudeSession{}, err
+	}
+
+	claudeSessionCache.Lock()
+	cached, ok := claudeSessionCache.entries[path]
+	claudeSessionCache.Unlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.info, nil
+	}
+
+	info, err := readClaudeSession(path)
+	if err != nil {
+		return info, err
+	}
+	claudeSessionCache.Lock()
+	claudeSessionCache.entries[path] = cachedClaudeSession{size: stat.Size(), modTime: stat.ModTime(), info: info}
+	claudeSessionCache.Unlock()
+	return info, nil
+}
+
+// claudeSessionAt summarizes the transcript at path and reports whether it is
+// a conversation that ran in repoPath (any repo, if empty).
+func claudeSessionAt(path, repoPath string) (ClaudeSession, bool) {
+	info, err := summarizeClaudeSession(path)
+	if err != nil {
+		slog.Warn("failed to read Claude transcript", "path", path, "error", err)
+		return info, false
+	}
+	if info.Messages == 0 {
+		return info, false // Summaries or sub-agent logs, not a conversation
+	}
+	if info.RepoPath == "" {
+		info.RepoPath = repoPath // Older transcripts don't record cwd
+	}
+	if repoPath != "" && info.RepoPath != repoPath {
+		return info, false
+	}
+	return info, true
+}
+
+// addLine counts a transcript line towards the summary.
+func (info *ClaudeSession) addLine(data []byte) {
+	var line struct {
+		Type        string    `json:"type"`
+		Cwd         string    `json:"cwd"`
+		Timestamp   time.Time `json:"timestamp"`
+		IsMeta      bool      `json:"isMeta"`
+		IsSidechain bool      `json:"isSidechain"`
+		Message     struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(data, &line); err != nil {
+		return // Skip lines we don't understand
+	}
+	if (line.Type != MessageTypeUser && line.Type != MessageTypeAssistant) || line.IsMeta || line.IsSidechain {
+		return
+	}
+
+	info.Messages++
+	if line.Cwd != "" {
+		info.RepoPath = line.Cwd
+	}
+	if line.Timestamp.After(info.LastActivity) {
+		info.LastActivity = line.Timestamp
+	}
+	if info.FirstPrompt == "" && line.Type == MessageTypeUser {
+		// Tool results are user messages too, but have no text
+		if text := transcriptText(line.Message.Content); text != "" {
+			if len(text) > MaxPromptPreview {
+				text = strings.ToValidUTF8(text[:MaxPromptPreview], "") + "…"
+			}
+			info.FirstPrompt = text
+		}
+	}
+}
+
+// scanClaudeSessions lists the conversations in Claude's projects directory,
+// most recently active first. With repoPath, only sessions that ran there are
+// listed.
+//
+// Claude names each project directory after its working directory with
+// every non-alphanumeric character replaced, so different paths can share a
+// directory; the cwd Claude records in the transcript settles which repo a
+// session belongs to.
+func scanClaudeSessions(repoPath string) ([]ClaudeSession, error) {
+	root := claudeProjectsDir()
+	if root == "" {
+		return nil, nil
+	}
+
+	var dirs []string
+	if repoPath != "" {
+		dirs = []string{filepath.Join(root, nonAlphanumeric.ReplaceAllString(repoPath, "-"))}
+	} else {
+		entries, err := os.ReadDir(root)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				dirs = append(dirs, filepath.Join(root, e.Name()))
+			}
+		}
+	}
+
+	var list []ClaudeSession
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if info, ok := claudeSessionAt(path, repoPath); ok {
+				list = append(list, info)
+			}
+		}
+	}
+
+	slices.SortFunc(list, func(a, b ClaudeSession) int {
+		return b.LastActivity.Compare(a.LastActivity)
+	})
+	return list, nil
+}
+
+// findClaudeSession looks up a Claude session by ID, in repoPath's project
+// directory if given or else in all of them. Only the transcripts named after
+// the ID are read. id must match claudeSessionIDPattern.
+func findClaudeSession(id, repoPath string) (ClaudeSession, bool, error) {
+	root := claudeProjectsDir()
+	if root == "" {
+		return ClaudeSession{}, false, nil
+	}
+
+	dir := "*"
+	if repoPath != "" {
+		dir = nonAlphanumeric.ReplaceAllString(repoPath, "-")
+	}
+	paths, err := filepath.Glob(filepath.Join(root, dir, id+".jsonl"))
+	if err != nil {
+		return ClaudeSession{}, false, err
+	}
+
+	// The same ID in several projects is unusual; prefer the latest
+	var found ClaudeSession
+	ok := false
+	for _, path := range paths {
+		info, match := claudeSessionAt(path, repoPath)
+		if match && (!ok || info.LastActivity.After(found.LastActivity)) {
+			found, ok = info, true
+		}
+	}
+	return found, ok, nil
+}
+
+// dozeSessionsByClaudeID maps the Claude session IDs Doze sessions resume to
+// the Doze session IDs.
+func dozeSessionsByClaudeID() map[string]string {
+	owners := make(map[string]string)
+	for _, s := range sessions.List() {
+		s.mu.RLock()
+		if s.ClaudeSessionID != "" {
+			owners[s.ClaudeSessionID] = s.ID
+		}
+		s.mu.RUnlock()
+	}
+	return owners
+}
+
+// handleListClaudeSessions lists the conversations Claude Code saved on this
+// machine, including ones started outside Doze (e.g. in a terminal).
+//
+// GET /claude-sessions?repo=
+//
+// repo limits the list to sessions that ran in that directory. Sessions are
+// sorted by last activity, newest first; doze_session names the Doze session
+// that already resumes one.
+//
+// Response:
+//
+//	{
+//	  "sessions": [{
+//	    "id": "0b7e6c1e-...", "repo_path": "/workspace/app", "first_prompt": "Fix the login bug",
+//	    "messages": 24, "last_activity": "...", "doze_session": "9f2c..."
+//	  }]
+//	}
+func handleListClaudeSessions(w http.ResponseWriter, r *http.Request) {
+	repoPath := r.URL.Query().Get("repo")
+	if repoPath != "" {
+		repoPath = filepath.Clean(repoPath)
+	}
+
+	list, err := scanClaudeSessions(repoPath)
+	if err != nil {
+		slog.Error("failed to scan Claude sessions", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to read Claude sessions")
+		return
+	}
+	owners := dozeSessionsByClaudeID()
+	for i := range list {
+		list[i].DozeSession = owners[list[i].ID]
+	}
+	if list == nil {
+		list = []ClaudeSession{}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": list,
+	})
+}
+
+// handleAdoptClaudeSession creates a Doze session that continues a
+// conversation Claude Code saved, so it can be picked up from another device.
+//
+// POST /claude-sessions/{claude_id}/adopt
+// Request body (optional):
+//
+//	{"repo_path": "/workspace/app"}
+//
+// The new session starts out stopped: the next message resumes the
+// conversation through resumeClaudeProcess. Returns 404 if no such session
+// is saved (in repo_path, if given) and 409 if a Doze session already
+// resumes it.
+//
+// Response (201): the new session's status, as GET /sessions/{id}.
+func handleAdoptClaudeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("claude_id")
+	if !claudeSessionIDPattern.MatchString(id) {
+		respondError(w, http.StatusBadRequest, "invalid Claude session ID")
+		return
+	}
+
+	var req struct {
+		RepoPath string `json:"repo_path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if req.RepoPath != "" {
+		req.RepoPath = filepath.Clean(req.RepoPath)
+	}
+
+	adoptMu.Lock()
+	defer adoptMu.Unlock()
+
+	if owner, ok := dozeSessionsByClaudeID()[id]; ok {
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":   "Claude session already adopted",
+			"session": owner,
+		})
+		return
+	}
+
+	info, found, err := findClaudeSession(id, req.RepoPath)
+	if err != nil {
+		slog.Error("failed to scan Claude sessions", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to read Claude sessions")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "Claude session not found")
+		return
+	}
+	if info.RepoPath == "" {
+		respondError(w, http.StatusBadRequest, "repo_path is required (the transcript doesn't record it)")
+		return
+	}
+	if stat, err := os.Stat(info.RepoPath); err != nil || !stat.IsDir() {
+		respondError(w, http.StatusBadRequest, "repo_path is not a directory: "+info.RepoPath)
+		return
+	}
+
+	branch := currentBranch(info.RepoPath)
+	s := sessions.Create()
+	s.mu.Lock()
+	s.ClaudeSessionID = info.ID
+	s.RepoPath = info.RepoPath
+	s.Branch = branch
+	s.InitialPrompt = info.FirstPrompt
+	s.LastActivity = info.LastActivity
+	s.setState(StateStopped) // Persists the session
+	s.mu.Unlock()
+
+	slog.Info("adopted Claude session", "id", s.ID, "session_id", info.ID, "repo_path", info.RepoPath)
+	respondJSON(w, http.StatusCreated, s.statusSnapshot())
+}
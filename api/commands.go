@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EventTypeCommand carries a slash command's result (a CommandResult as JSON).
+const EventTypeCommand = "command"
+
+// Command is a slash command handled by Doze instead of being sent to Claude.
+type Command struct {
+	Name        string // Without the slash, e.g. "status"
+	Usage       string // e.g. "/branch <name>"
+	Description string // One line for /help
+	PassThrough bool   // Also send the message to Claude after running
+
+	// Run executes the command. Errors are reported to the user in the
+	// command's result, not as request failures.
+	Run func(ctx CommandContext) (CommandResult, error)
+}
+
+// CommandContext is what a command runs against.
+type CommandContext struct {
+	Session  *Session
+	Args     string           // Everything after the command name, trimmed
+	Registry *CommandRegistry // For /help
+}
+
+// CommandResult is a command's output, broadcast as a command event and
+// returned to the sender.
+type CommandResult struct {
+	Command string                 `json:"command"`         // Command name
+	Text    string                 `json:"text"`            // Human-readable result
+	Data    map[string]interface{} `json:"data,omitempty"`  // Structured result
+	Error   string                 `json:"error,omitempty"` // Why the command failed
+}
+
+// CommandRegistry maps slash command names to commands.
+type CommandRegistry struct {
+	commands map[string]*Command
+}
+
+// commands is the registry consulted for every user message.
+var commands = NewCommandRegistry(builtinCommands...)
+
+// NewCommandRegistry creates a registry with the given commands.
+func NewCommandRegistry(cmds ...*Command) *CommandRegistry {
+	r := &CommandRegistry{commands: make(map[string]*Command)}
+	for _, cmd := range cmds {
+		r.Register(cmd)
+	}
+	return r
+}
+
+// Register adds a command, replacing any with the same name.
+func (r *CommandRegistry) Register(cmd *Command) {
+	r.commands[cmd.Name] = cmd
+}
+
+// Lookup parses a message as a slash command. Returns false if the message
+// isn't a command or the command isn't registered (so it should go to Claude
+// as is).
+func (r *CommandRegistry) Lookup(content string) (*Command, string, bool) {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "/") {
+		return nil, "", false
+	}
+	name, args, _ := strings.Cut(content[1:], " ")
+	cmd, ok := r.commands[name]
+	if !ok {
+		return nil, "", false
+	}
+	return cmd, strings.TrimSpace(args), true
+}
+
+// List returns the registered commands sorted by name.
+func (r *CommandRegistry) List() []*Command {
+	list := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// runCommand runs a slash command and broadcasts its result as a command
+// event.
+// The caller must NOT hold s.mu.
+func (s *Session) runCommand(r *CommandRegistry, cmd *Command, args string) CommandResult {
+	result, err := cmd.Run(CommandContext{Session: s, Args: args, Registry: r})
+	result.Command = cmd.Name
+	if err != nil {
+		result.Error = err.Error()
+		if result.Text == "" {
+			result.Text = fmt.Sprintf("/%s failed: %v", cmd.Name, err)
+		}
+	}
+	slog.Info("slash command", "id", s.ID, "command", cmd.Name, "args", args, "error", result.Error)
+
+	if data, err := json.Marshal(result); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypeCommand, Content: string(data)})
+	}
+	return result
+}
+
+// builtinCommands are the slash commands Doze handles itself.
+var builtinCommands = []*Command{
+	{
+		Name:        "help",
+		Usage:       "/help",
+		Description: "List Doze commands",
+		Run:         runHelpCommand,
+	},
+	{
+		Name:        "status",
+		Usage:       "/status",
+		Description: "Show session state, repo, branch and model",
+		Run:         runStatusCommand,
+	},
+	{
+		Name:        "stop",
+		Usage:       "/stop",
+		Description: "Stop the idle Claude process now (resumes on the next message)",
+		Run:         runStopCommand,
+	},
+	{
+		Name:        "new",
+		Usage:       "/new",
+		Description: "Create a fresh session in the same repo",
+		Run:         runNewCommand,
+	},
+	{
+		Name:        "model",
+		Usage:       "/model <name>",
+		Description: "Show or set the Claude model (applies from the next start or resume)",
+		Run:         runModelCommand,
+	},
+	{
+		Name:        "cost",
+		Usage:       "/cost",
+		Description: "Show the cost Claude reported for this session",
+		Run:         runCostCommand,
+	},
+	{
+		Name:        "diff",
+		Usage:       "/diff",
+		Description: "Summarize uncommitted changes in the repo",
+		Run:         runDiffCommand,
+	},
+	{
+		Name:        "branch",
+		Usage:       "/branch <name>",
+		Description: "Show the git branch, or switch to (creating if needed) another",
+		Run:         runBranchCommand,
+	},
+	{
+		Name:        "clear",
+		Usage:       "/clear",
+		Description: "Clear the replay buffer (Claude clears its context too)",
+		PassThrough: true,
+		Run:         runClearCommand,
+	},
+}
+
+func runHelpCommand(ctx CommandContext) (CommandResult, error) {
+	var lines []string
+	var list []map[string]interface{}
+	for _, cmd := range ctx.Registry.List() {
+		lines = append(lines, fmt.Sprintf("%s - %s", cmd.Usage, cmd.Description))
+		list = append(list, map[string]interface{}{"name": cmd.Name, "usage": cmd.Usage, "description": cmd.Description})
+	}
+	lines = append(lines, "Other /commands are sent to Claude.")
+	return CommandResult{
+		Text: strings.Join(lines, "\n"),
+		Data: map[string]interface{}{"commands": list},
+	}, nil
+}
+
+func runStatusCommand(ctx CommandContext) (CommandResult, error) {
+	status := ctx.Session.statusSnapshot()
+	text := fmt.Sprintf("State: %s", status["state"])
+	if repo, _ := status["repo_path"].(string); repo != "" {
+		text += "\nRepo: " + repo
+	}
+	if branch, _ := status["branch"].(string); branch != "" {
+		text += "\nBranch: " + branch
+	}
+	if model, _ := status["model"].(string); model != "" {
+		text += "\nModel: " + model
+	}
+	text += fmt.Sprintf("\nPermissions: %s", status["permission_mode"])
+	return CommandResult{Text: text, Data: status}, nil
+}
+
+func runStopCommand(ctx CommandContext) (CommandResult, error) {
+	s := ctx.Session
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	if err := s.stopSession(); err != nil {
+		return CommandResult{}, err
+	}
+	return CommandResult{
+		Text: "Stopping Claude. The next message resumes the conversation.",
+		Data: map[string]interface{}{"state": StateShuttingDown},
+	}, nil
+}
+
+func runNewCommand(ctx CommandContext) (CommandResult, error) {
+	s := ctx.Session
+	s.mu.RLock()
+	repoPath, mode, model := s.RepoPath, s.PermissionMode, s.Model
+	s.mu.RUnlock()
+
+	created := sessions.Create()
+	created.mu.Lock()
+	created.RepoPath = repoPath
+	created.PermissionMode = mode
+	created.Model = model
+	created.persist()
+	created.mu.Unlock()
+
+	return CommandResult{
+		Text: fmt.Sprintf("Created session %s. It starts with its first message.", created.ID),
+		Data: map[string]interface{}{
+			"id":        created.ID,
+			"repo_path": repoPath,
+			"url":       sessionURL(created.ID),
+		},
+	}, nil
+}
+
+// modelNamePattern limits model names to what the CLI accepts (aliases like
+// "sonnet" or full IDs like "claude-sonnet-4-5-20250929").
+var modelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._\[\]-]*$`)
+
+func runModelCommand(ctx CommandContext) (CommandResult, error) {
+	s := ctx.Session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ctx.Args == "" {
+		model := s.Model
+		text := "Model: " + model
+		if model == "" {
+			text = "Model: Claude's default"
+		}
+		return CommandResult{Text: text, Data: map[string]interface{}{"model": model}}, nil
+	}
+	if !modelNamePattern.MatchString(ctx.Args) {
+		return CommandResult{}, fmt.Errorf("invalid model name %q", ctx.Args)
+	}
+
+	s.Model = ctx.Args
+	s.persist()
+	running := s.proc != nil
+	text := "Model set to " + s.Model + "."
+	if running {
+		text += " It applies after the session restarts (/stop, then send a message)."
+	}
+	return CommandResult{
+		Text: text,
+		Data: map[string]interface{}{"model": s.Model, "restart_required": running},
+	}, nil
+}
+
+func runCostCommand(ctx CommandContext) (CommandResult, error) {
+	s := ctx.Session
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return CommandResult{
+		Text: fmt.Sprintf("$%.4f over %d turns, %d input / %d output tokens (as reported by Claude)",
+			s.Usage.CostUSD, s.Usage.Turns, s.Usage.InputTokens, s.Usage.OutputTokens),
+		Data: map[string]interface{}{"cost_usd": s.Usage.CostUSD, "turns": s.Usage.Turns, "usage": s.Usage},
+	}, nil
+}
+
+func runDiffCommand(ctx CommandContext) (CommandResult, error) {
+	repoPath, err := ctx.Session.repoPath()
+	if err != nil {
+		return CommandResult{}, err
+	}
+
+	status, err := git(repoPath, "status", "--short")
+	if err != nil {
+		return CommandResult{}, err
+	}
+	if status == "" {
+		return CommandResult{Text: "No uncommitted changes.", Data: map[string]interface{}{"files": []string{}}}, nil
+	}
+	stat, _ := git(repoPath, "diff", "HEAD", "--stat")
+
+	files := strings.Split(status, "\n")
+	text := stat
+	if text == "" {
+		text = status // e.g. only untracked files, or no commits yet
+	}
+	return CommandResult{
+		Text: text,
+		Data: map[string]interface{}{"files": files, "stat": stat},
+	}, nil
+}
+
+// branchNamePattern is a conservative subset of valid git branch names.
+var branchNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+func runBranchCommand(ctx CommandContext) (CommandResult, error) {
+	s := ctx.Session
+	repoPath, err := s.repoPath()
+	if err != nil {
+		return CommandResult{}, err
+	}
+
+	if ctx.Args == "" {
+		branch := currentBranch(repoPath)
+		if branch == "" {
+			return CommandResult{}, errors.New("not on a git branch")
+		}
+		return CommandResult{Text: "Branch: " + branch, Data: map[string]interface{}{"branch": branch}}, nil
+	}
+
+	name := ctx.Args
+	if !branchNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return CommandResult{}, fmt.Errorf("invalid branch name %q", name)
+	}
+	s.mu.RLock()
+	state := s.State
+	s.mu.RUnlock()
+	if state == StateActive || state == StateStarting {
+		return CommandResult{}, errors.New("Claude is working; switch branches when it's waiting")
+	}
+
+	created := false
+	if _, err := git(repoPath, "switch", name); err != nil {
+		if _, err := git(repoPath, "switch", "-c", name); err != nil {
+			return CommandResult{}, err
+		}
+		created = true
+	}
+
+	s.mu.Lock()
+	s.Branch = name
+	s.persist()
+	s.mu.Unlock()
+
+	text := "Switched to branch " + name
+	if created {
+		text = "Switched to a new branch " + name
+	}
+	return CommandResult{Text: text, Data: map[string]interface{}{"branch": name, "created": created}}, nil
+}
+
+func runClearCommand(ctx CommandContext) (CommandResult, error) {
+	s := ctx.Session
+	s.mu.Lock()
+	s.outputBuffer = NewRingBuffer(cfg.BufferSize())
+	s.mu.Unlock()
+	return CommandResult{Text: "Cleared the output buffer."}, nil
+}
+
+// repoPath returns the session's working directory (falling back like new
+// sessions do). The caller must NOT hold s.mu.
+func (s *Session) repoPath() (string, error) {
+	s.mu.RLock()
+	repoPath := s.RepoPath
+	s.mu.RUnlock()
+	return resolveRepoPath(repoPath)
+}
+
+// gitCommandTimeout bounds git commands run by slash commands.
+const gitCommandTimeout = 10 * time.Second
+
+// git runs a git command in dir and returns its trimmed output. Errors
+// include git's stderr.
+func git(dir string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Compute accounting settings
+const (
+	ComputeFileName          = "compute.jsonl" // State time and resume log inside the data directory
+	DefaultComputeHourlyRate = 0.10            // USD per hour a Claude process keeps its machine busy
+)
+
+// runningStates are the states in which a Claude process is alive (and the
+// machine it runs on can't hibernate).
+var runningStates = []SessionState{StateStarting, StateActive, StateWaiting, StateShuttingDown}
+
+// hibernatedStates are the states in which a conversation exists but no
+// process runs, i.e. the time Doze saves.
+var hibernatedStates = []SessionState{StateStopped, StateCrashed}
+
+// ComputeSpan is a stretch of time a session spent in one state.
+type ComputeSpan struct {
+	SessionID string       `json:"session_id"`
+	Repo      string       `json:"repo"`
+	State     SessionState `json:"state"`
+	Start     time.Time    `json:"start"`
+	End       time.Time    `json:"end"`
+}
+
+// ResumeSample records a stopped session coming back for a new message.
+type ResumeSample struct {
+	SessionID string    `json:"session_id"`
+	Repo      string    `json:"repo"`
+	At        time.Time `json:"at"`
+	Path      string    `json:"path"`                 // See ResumePath*
+	LatencyMS int64     `json:"latency_ms,omitempty"` // --resume until Claude's first output (resumed path only)
+}
+
+// computeEntry is a single line in the compute log: either a span or a
+// resume.
+type computeEntry struct {
+	Span   *ComputeSpan  `json:"span,omitempty"`
+	Resume *ResumeSample `json:"resume,omitempty"`
+}
+
+// recordSpan logs the time spent in the state the session is leaving and
+// starts timing the next one. Time in StateNone isn't recorded. Called by
+// setState; the caller must hold s.mu.
+func (s *Session) recordSpan(from SessionState, now time.Time) {
+	if from == StateActive && !s.stateSince.IsZero() {
+		s.activeTime += now.Sub(s.stateSince)
+	}
+	if !s.stateSince.IsZero() && from != StateNone {
+		span := ComputeSpan{SessionID: s.ID, Repo: s.RepoPath, State: from, Start: s.stateSince, End: now}
+		if err := computeLedger.RecordSpan(span); err != nil {
+			slog.Error("failed to record compute time", "id", s.ID, "error", err)
+		}
+	}
+	s.stateSince = now
+}
+
+// recordResume logs how a stopped session came back. latency is only
+// measured for ResumePathResumed. The caller must hold s.mu.
+func (s *Session) recordResume(path string, latency time.Duration) {
+	sample := ResumeSample{
+		SessionID: s.ID,
+		Repo:      s.RepoPath,
+		At:        time.Now(),
+		Path:      path,
+		LatencyMS: latency.Milliseconds(),
+	}
+	if err := computeLedger.RecordResume(sample); err != nil {
+		slog.Error("failed to record resume", "id", s.ID, "error", err)
+	}
+}
+
+// computeLedger logs state time and resumes for GET /stats/compute. Replaced
+// by main() with one backed by the data directory.
+var computeLedger = NewComputeLedger()
+
+// ComputeLedger aggregates state time and resumes by day, optionally backed
+// by an append-only JSONL log so the history survives restarts. Spans that
+// cross midnight are split between the days.
+//
+// Safe for concurrent use. A nil ledger records nothing.
+type ComputeLedger struct {
+	mu   sync.Mutex
+	file *os.File               // Log opened for appending (nil = memory only)
+	days map[string]*computeDay // Totals by local day (YYYY-MM-DD)
+}
+
+// computeDay holds one day's totals.
+type computeDay struct {
+	time      map[SessionState]time.Duration
+	resumes   map[string]int // By resume path
+	latency   time.Duration  // Sum of measured resume latencies
+	latencies int            // Resumes with a measured latency
+}
+
+// NewComputeLedger creates an in-memory ledger.
+func NewComputeLedger() *ComputeLedger {
+	return &ComputeLedger{days: make(map[string]*computeDay)}
+}
+
+// OpenComputeLedger opens (or creates) the compute log in dir and loads its
+// history.
+func OpenComputeLedger(dir string) (*ComputeLedger, error) {
+	l := NewComputeLedger()
+	file, err := openLedger(dir, ComputeFileName, func(line []byte) error {
+		var entry computeEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		if entry.Span != nil {
+			l.addSpan(*entry.Span)
+		}
+		if entry.Resume != nil {
+			l.addResume(*entry.Resume)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// RecordSpan adds time spent in a state and appends it to the log.
+func (l *ComputeLedger) RecordSpan(span ComputeSpan) error {
+	if l == nil || !span.End.After(span.Start) {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.addSpan(span)
+	return appendLine(l.file, computeEntry{Span: &span})
+}
+
+// RecordResume adds a resume and appends it to the log.
+func (l *ComputeLedger) RecordResume(sample ResumeSample) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.addResume(sample)
+	return appendLine(l.file, computeEntry{Resume: &sample})
+}
+
+// day returns the totals for the local day containing t, creating them if
+// needed. The caller must hold l.mu (or own l).
+func (l *ComputeLedger) day(t time.Time) *computeDay {
+	key := t.Local().Format(time.DateOnly)
+	d, ok := l.days[key]
+	if !ok {
+		d = &computeDay{time: make(map[SessionState]time.Duration), resumes: make(map[string]int)}
+		l.days[key] = d
+	}
+	return d
+}
+
+// addSpan folds a span into the daily totals, split at local midnight. The
+// caller must hold l.mu (or own l).
+func (l *ComputeLedger) addSpan(span ComputeSpan) {
+	start, end := span.Start.Local(), span.End.Local()
+	for start.Before(end) {
+		y, m, d := start.Date()
+		stop := time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+		if stop.After(end) {
+			stop = end
+		}
+		l.day(start).time[span.State] += stop.Sub(start)
+		start = stop
+	}
+}
+
+// addResume folds a resume into the daily totals. The caller must hold l.mu
+// (or own l).
+func (l *ComputeLedger) addResume(sample ResumeSample) {
+	d := l.day(sample.At)
+	d.resumes[sample.Path]++
+	if sample.Path == ResumePathResumed {
+		d.latency += time.Duration(sample.LatencyMS) * time.Millisecond
+		d.latencies++
+	}
+}
+
+// StateTime returns the recorded time all sessions spent in state on a local
+// day (YYYY-MM-DD). Spans still in progress aren't included.
+func (l *ComputeLedger) StateTime(day string, state SessionState) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if d, ok := l.days[day]; ok {
+		return d.time[state]
+	}
+	return 0
+}
+
+// ComputeStats is the compute report for a day, or the total over all days.
+type ComputeStats struct {
+	Day                string                   `json:"day,omitempty"`
+	Seconds            map[SessionState]float64 `json:"seconds"`               // Time spent in each state
+	RunningSeconds     float64                  `json:"running_seconds"`       // Time a Claude process was alive
+	HibernatedSeconds  float64                  `json:"hibernated_seconds"`    // Time stopped or crashed
+	CostUSD            float64                  `json:"cost_usd"`              // RunningSeconds at compute.hourly_rate_usd
+	SavedUSD           float64                  `json:"saved_usd"`             // HibernatedSeconds at the same rate
+	Resumes            int                      `json:"resumes"`               // Stopped sessions brought back
+	ResumesByPath      map[string]int           `json:"resumes_by_path"`       // See ResumePath*
+	AvgResumeLatencyMS int64                    `json:"avg_resume_latency_ms"` // --resume until first output
+}
+
+// Report returns per-day stats, oldest first, and the total. open holds the
+// spans still in progress (the current state of each session), which are
+// counted but not recorded.
+func (l *ComputeLedger) Report(open []ComputeSpan, hourlyRate float64) ([]ComputeStats, ComputeStats) {
+	scratch := NewComputeLedger()
+	if l != nil {
+		l.mu.Lock()
+		for key, d := range l.days {
+			scratch.days[key] = &computeDay{
+				time:      maps.Clone(d.time),
+				resumes:   maps.Clone(d.resumes),
+				latency:   d.latency,
+				latencies: d.latencies,
+			}
+		}
+		l.mu.Unlock()
+	}
+	for _, span := range open {
+		scratch.addSpan(span)
+	}
+
+	total := &computeDay{time: make(map[SessionState]time.Duration), resumes: make(map[string]int)}
+	days := []ComputeStats{}
+	for _, key := range slices.Sorted(maps.Keys(scratch.days)) {
+		d := scratch.days[key]
+		stats := d.stats(hourlyRate)
+		stats.Day = key
+		days = append(days, stats)
+
+		for state, dur := range d.time {
+			total.time[state] += dur
+		}
+		for path, n := range d.resumes {
+			total.resumes[path] += n
+		}
+		total.latency += d.latency
+		total.latencies += d.latencies
+	}
+	return days, total.stats(hourlyRate)
+}
+
+// stats renders the totals as a report row.
+func (d *computeDay) stats(hourlyRate float64) ComputeStats {
+	stats := ComputeStats{
+		Seconds:       make(map[SessionState]float64, len(d.time)),
+		ResumesByPath: d.resumes,
+	}
+	var running, hibernated time.Duration
+	for state, dur := range d.time {
+		stats.Seconds[state] = dur.Seconds()
+		if slices.Contains(runningStates, state) {
+			running += dur
+		} else if slices.Contains(hibernatedStates, state) {
+			hibernated += dur
+		}
+	}
+	stats.RunningSeconds = running.Seconds()
+	stats.HibernatedSeconds = hibernated.Seconds()
+	stats.CostUSD = running.Hours() * hourlyRate
+	stats.SavedUSD = hibernated.Hours() * hourlyRate
+	for _, n := range d.resumes {
+		stats.Resumes += n
+	}
+	if d.latencies > 0 {
+		stats.AvgResumeLatencyMS = (d.latency / time.Duration(d.latencies)).Milliseconds()
+	}
+	return stats
+}
+
+// Close closes the log file.
+func (l *ComputeLedger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// handleComputeStats reports how long sessions spent running vs hibernated,
+// what that cost, and how quickly stopped sessions came back, by day.
+//
+// GET /stats/compute
+//
+// Days are in the server's time zone. Current states count up to now.
+//
+// Response:
+//
+//	{
+//	  "hourly_rate_usd": 0.1,
+//	  "idle_timeout_seconds": 180,
+//	  "days": [{
+//	    "day": "2026-02-14",
+//	    "seconds": {"active": 1260, "waiting": 2700, "stopped": 61200, ...},
+//	    "running_seconds": 3990, "hibernated_seconds": 61200,
+//	    "cost_usd": 0.11, "saved_usd": 1.7,
+//	    "resumes": 9, "resumes_by_path": {"resumed": 8, "transcript": 1},
+//	    "avg_resume_latency_ms": 2350
+//	  }],
+//	  "total": {...}
+//	}
+func handleComputeStats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var open []ComputeSpan
+	for _, s := range sessions.List() {
+		s.mu.RLock()
+		if !s.stateSince.IsZero() && s.State != StateNone {
+			open = append(open, ComputeSpan{SessionID: s.ID, Repo: s.RepoPath, State: s.State, Start: s.stateSince, End: now})
+		}
+		s.mu.RUnlock()
+	}
+
+	days, total := computeLedger.Report(open, cfg.Compute.HourlyRateUSD)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"hourly_rate_usd":      cfg.Compute.HourlyRateUSD,
+		"idle_timeout_seconds": int(cfg.IdleTimeout().Seconds()),
+		"days":                 days,
+		"total":                total,
+	})
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seamus/doze/notify"
+	"github.com/seamus/doze/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigPath is the config file loaded when neither -config nor
+// DOZE_CONFIG is set. It's optional: a missing default file is not an error.
+const DefaultConfigPath = "config.yml"
+
+// Config is the server configuration.
+//
+// Values are layered in order of increasing precedence:
+//  1. Built-in defaults (DefaultConfig)
+//  2. YAML config file (config.yml)
+//  3. Environment variables
+//  4. Command-line flags
+type Config struct {
+	Repo          RepoConfig          `yaml:"repo" json:"repo"`
+	Timeouts      TimeoutsConfig      `yaml:"timeouts" json:"timeouts"`
+	Server        ServerConfig        `yaml:"server" json:"server"`
+	Auth          AuthConfig          `yaml:"auth" json:"auth"`
+	Runner        RunnerConfig        `yaml:"runner" json:"runner"`
+	Permissions   PermissionsConfig   `yaml:"permissions" json:"permissions"`
+	Policy        PolicyConfig        `yaml:"policy" json:"policy"`
+	Notifications NotificationsConfig `yaml:"notifications" json:"notifications"`
+	Recovery      RecoveryConfig      `yaml:"recovery" json:"recovery"`
+	Compute       ComputeConfig       `yaml:"compute" json:"compute"`
+	Budgets       BudgetsConfig       `yaml:"budgets" json:"budgets"`
+
+	file string // Config file that was loaded ("" if none)
+}
+
+// RepoConfig describes the repository Claude works in by default.
+type RepoConfig struct {
+	Name string `yaml:"name" json:"name"` // Display name
+	Path string `yaml:"path" json:"path"` // Default working directory ("" = current directory)
+}
+
+// TimeoutsConfig holds session lifecycle timeouts, in seconds.
+type TimeoutsConfig struct {
+	IdleSeconds    int `yaml:"idle_seconds" json:"idle_seconds"`       // Idle time in StateWaiting before stopping
+	HibernateGrace int `yaml:"hibernate_grace" json:"hibernate_grace"` // Time between SIGTERM and SIGKILL
+	ResumeTimeout  int `yaml:"resume_timeout" json:"resume_timeout"`   // Max time to wait for a resume
+	InterruptGrace int `yaml:"interrupt_grace" json:"interrupt_grace"` // Time for a turn to end after an interrupt
+}
+
+// ServerConfig holds HTTP server and storage settings.
+type ServerConfig struct {
+	Port            int    `yaml:"port" json:"port"`                           // HTTP listen port
+	BufferSizeKB    int    `yaml:"buffer_size_kb" json:"buffer_size_kb"`       // Output ring buffer size per session
+	WebPath         string `yaml:"web_path" json:"web_path"`                   // Directory of the built web UI
+	DataDir         string `yaml:"data_dir" json:"data_dir"`                   // Where session metadata is persisted
+	PublicURL       string `yaml:"public_url" json:"public_url"`               // Externally reachable base URL (for pairing links)
+	JournalSize     int    `yaml:"journal_size" json:"journal_size"`           // Events kept per session for Last-Event-ID replay
+	DeltaIntervalMS int    `yaml:"delta_interval_ms" json:"delta_interval_ms"` // Streamed text coalescing window (0 = send every delta)
+}
+
+// AuthConfig holds authentication and CORS settings.
+type AuthConfig struct {
+	Tokens      []string `yaml:"tokens" json:"tokens"`               // API tokens, plaintext or "sha256:<hex>"
+	CORSOrigins []string `yaml:"cors_origins" json:"cors_origins"`   // Origins allowed to make cross-origin requests
+	PairingTTL  int      `yaml:"pairing_ttl" json:"pairing_ttl"`     // Seconds a pairing code stays valid
+	PairOnStart bool     `yaml:"pair_on_start" json:"pair_on_start"` // Print a pairing code and QR code at startup
+}
+
+// RunnerConfig selects how Claude processes are launched.
+type RunnerConfig struct {
+	Type            string   `yaml:"type" json:"type"`                         // Runner backend ("local")
+	Path            string   `yaml:"path" json:"path"`                         // Claude binary (name on PATH or absolute path)
+	Args            []string `yaml:"args" json:"args"`                         // Extra arguments appended to every invocation
+	PartialMessages bool     `yaml:"partial_messages" json:"partial_messages"` // Stream responses token by token (--include-partial-messages)
+}
+
+// PermissionsConfig controls how Claude asks for permission to use tools.
+type PermissionsConfig struct {
+	Mode    string `yaml:"mode" json:"mode"`       // Default mode for new sessions: skip, prompt or plan
+	Timeout int    `yaml:"timeout" json:"timeout"` // Seconds before an unanswered request is denied
+}
+
+// PolicyConfig holds server-enforced tool-use rules (see package policy).
+type PolicyConfig struct {
+	Rules []policy.Rule `yaml:"rules" json:"rules"` // Evaluated for every tool call that asks for permission
+}
+
+// RecoveryConfig controls resuming Claude after it crashes.
+type RecoveryConfig struct {
+	MaxRetries   int `yaml:"max_retries" json:"max_retries"`       // Resume attempts before giving up (0 = never resume)
+	BackoffMS    int `yaml:"backoff_ms" json:"backoff_ms"`         // Delay before the first attempt, doubled for each retry
+	MaxBackoffMS int `yaml:"max_backoff_ms" json:"max_backoff_ms"` // Longest delay between attempts
+}
+
+// ComputeConfig holds the figures used to estimate compute cost.
+type ComputeConfig struct {
+	HourlyRateUSD float64 `yaml:"hourly_rate_usd" json:"hourly_rate_usd"` // Cost of an hour with a Claude process running
+}
+
+// BudgetsConfig holds the spending guardrails enforced by the session
+// manager (see checkBudget). Zero limits are unlimited.
+type BudgetsConfig struct {
+	Session       BudgetLimits `yaml:"session" json:"session"`                 // Per session (until overridden)
+	Daily         BudgetLimits `yaml:"daily" json:"daily"`                     // All sessions, per server-local day
+	MaxAgentTurns int          `yaml:"max_agent_turns" json:"max_agent_turns"` // --max-turns for each message (0 = Claude's default)
+}
+
+// BudgetLimits caps what a session (or all sessions in a day) may use.
+type BudgetLimits struct {
+	MaxCostUSD       float64 `yaml:"max_cost_usd" json:"max_cost_usd"`             // Cost reported by Claude
+	MaxTurns         int     `yaml:"max_turns" json:"max_turns"`                   // Completed turns
+	MaxActiveSeconds int     `yaml:"max_active_seconds" json:"max_active_seconds"` // Wall-clock time in the active state
+}
+
+// validate reports negative limits, naming them under prefix.
+func (b BudgetLimits) validate(prefix string) []error {
+	var errs []error
+	if b.MaxCostUSD < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_cost_usd must not be negative, got %g", prefix, b.MaxCostUSD))
+	}
+	if b.MaxTurns < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_turns must not be negative, got %d", prefix, b.MaxTurns))
+	}
+	if b.MaxActiveSeconds < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_active_seconds must not be negative, got %d", prefix, b.MaxActiveSeconds))
+	}
+	return errs
+}
+
+// NotificationsConfig controls push notifications (see package notify).
+type NotificationsConfig struct {
+	Triggers   []string         `yaml:"triggers" json:"triggers"`       // Events to notify about (turn_complete, error, stopped, permission)
+	QuietHours QuietHoursConfig `yaml:"quiet_hours" json:"quiet_hours"` // Daily window without notifications
+	Ntfy       NtfyConfig       `yaml:"ntfy" json:"ntfy"`
+	Webhooks   []WebhookConfig  `yaml:"webhooks" json:"webhooks"`
+	WebPush    WebPushConfig    `yaml:"web_push" json:"web_push"`
+}
+
+// QuietHoursConfig is a daily window, e.g. 22:00 to 07:00, in which only the
+// Except events are delivered.
+type QuietHoursConfig struct {
+	Start    string   `yaml:"start" json:"start"`       // "HH:MM" ("" = no quiet hours)
+	End      string   `yaml:"end" json:"end"`           // "HH:MM"
+	Timezone string   `yaml:"timezone" json:"timezone"` // IANA zone ("" = server local time)
+	Except   []string `yaml:"except" json:"except"`     // Events delivered anyway
+}
+
+// NtfyConfig publishes notifications to an ntfy topic.
+type NtfyConfig struct {
+	Server string `yaml:"server" json:"server"` // ntfy server ("" = https://ntfy.sh)
+	Topic  string `yaml:"topic" json:"topic"`   // Topic to publish to ("" = disabled)
+	Token  string `yaml:"token" json:"token"`   // Optional access token
+}
+
+// WebhookConfig POSTs notifications as JSON to a URL.
+type WebhookConfig struct {
+	URL     string            `yaml:"url" json:"url"`
+	Headers map[string]string `yaml:"headers" json:"headers"` // Extra headers, e.g. Authorization
+}
+
+// WebPushConfig sends notifications to browsers that subscribed through
+// POST /push/subscriptions.
+type WebPushConfig struct {
+	Enabled         bool   `yaml:"enabled" json:"enabled"`
+	Subject         string `yaml:"subject" json:"subject"`                     // Contact for push services ("mailto:you@example.com")
+	VAPIDPrivateKey string `yaml:"vapid_private_key" json:"vapid_private_key"` // base64url P-256 key ("" = generated in data_dir)
+}
+
+// cfg is the effective server configuration.
+//
+// Replaced by main() after loading; defaults apply until then (and in tests).
+var cfg = DefaultConfig()
+
+// DefaultConfig returns the built-in configuration.
+func DefaultConfig() Config {
+	return Config{
+		Timeouts: TimeoutsConfig{
+			IdleSeconds:    int(DefaultIdleTimeout / time.Second),
+			HibernateGrace: int(GracefulShutdownTimeout / time.Second),
+			ResumeTimeout:  int(DefaultResumeTimeout / time.Second),
+			InterruptGrace: int(DefaultInterruptGrace / time.Second),
+		},
+		Server: ServerConfig{
+			Port:            DefaultPort,
+			BufferSizeKB:    RingBufferSize / 1024,
+			WebPath:         DefaultWebPath,
+			DataDir:         DefaultDataDir,
+			JournalSize:     DefaultJournalSize,
+			DeltaIntervalMS: int(DefaultDeltaInterval / time.Millisecond),
+		},
+		Auth: AuthConfig{
+			PairingTTL: int(DefaultPairingTTL / time.Second),
+		},
+		Runner: RunnerConfig{
+			Type:            RunnerTypeLocal,
+			Path:            DefaultClaudePath,
+			PartialMessages: true,
+		},
+		Permissions: PermissionsConfig{
+			Mode:    string(DefaultPermissionMode),
+			Timeout: int(DefaultPermissionTimeout / time.Second),
+		},
+		Notifications: NotificationsConfig{
+			Triggers: []string{
+				string(notify.EventTurnComplete),
+				string(notify.EventError),
+				string(notify.EventPermission),
+			},
+			WebPush: WebPushConfig{
+				Subject: DefaultWebPushSubject,
+			},
+		},
+		Recovery: RecoveryConfig{
+			MaxRetries:   DefaultCrashRetries,
+			BackoffMS:    int(DefaultCrashBackoff / time.Millisecond),
+			MaxBackoffMS: int(MaxCrashBackoff / time.Millisecond),
+		},
+		Compute: ComputeConfig{
+			HourlyRateUSD: DefaultComputeHourlyRate,
+		},
+	}
+}
+
+// IdleTimeout returns how long a waiting session stays up before stopping.
+func (c Config) IdleTimeout() time.Duration {
+	return time.Duration(c.Timeouts.IdleSeconds) * time.Second
+}
+
+// ShutdownGrace returns how long to wait after SIGTERM before SIGKILL.
+func (c Config) ShutdownGrace() time.Duration {
+	return time.Duration(c.Timeouts.HibernateGrace) * time.Second
+}
+
+// ResumeTimeout returns the maximum time to wait for a resumed session.
+func (c Config) ResumeTimeout() time.Duration {
+	return time.Duration(c.Timeouts.ResumeTimeout) * time.Second
+}
+
+// InterruptGrace returns how long a turn gets to end after an interrupt
+// request before the process is stopped instead.
+func (c Config) InterruptGrace() time.Duration {
+	return time.Duration(c.Timeouts.InterruptGrace) * time.Second
+}
+
+// CrashBackoff returns the delay before the given (1-based) resume attempt
+// after a crash: recovery.backoff_ms, doubling per attempt up to
+// recovery.max_backoff_ms.
+func (c Config) CrashBackoff(attempt int) time.Duration {
+	delay := time.Duration(c.Recovery.BackoffMS) * time.Millisecond
+	limit := time.Duration(c.Recovery.MaxBackoffMS) * time.Millisecond
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// PairingTTL returns how long a pairing code stays valid.
+func (c Config) PairingTTL() time.Duration {
+	return time.Duration(c.Auth.PairingTTL) * time.Second
+}
+
+// PermissionTimeout returns how long a permission request waits for an answer.
+func (c Config) PermissionTimeout() time.Duration {
+	return time.Duration(c.Permissions.Timeout) * time.Second
+}
+
+// DeltaInterval returns how long streamed text is collected before it's sent
+// as an output_delta event.
+func (c Config) DeltaInterval() time.Duration {
+	return time.Duration(c.Server.DeltaIntervalMS) * time.Millisecond
+}
+
+// BufferSize returns the per-session output ring buffer size in bytes.
+func (c Config) BufferSize() int {
+	return c.Server.BufferSizeKB * 1024
+}
+
+// Redacted returns a copy of the config that is safe to expose over HTTP.
+//
+// Secrets are replaced with "[redacted]" so the effective config can be
+// inspected without leaking credentials.
+func (c Config) Redacted() Config {
+	tokens := make([]string, len(c.Auth.Tokens))
+	for i, token := range c.Auth.Tokens {
+		if strings.HasPrefix(token, TokenHashPrefix) {
+			tokens[i] = token // Hashes aren't secret
+		} else {
+			tokens[i] = "[redacted]"
+		}
+	}
+	c.Auth.Tokens = tokens
+
+	if c.Notifications.Ntfy.Token != "" {
+		c.Notifications.Ntfy.Token = "[redacted]"
+	}
+	if c.Notifications.WebPush.VAPIDPrivateKey != "" {
+		c.Notifications.WebPush.VAPIDPrivateKey = "[redacted]"
+	}
+	webhooks := make([]WebhookConfig, len(c.Notifications.Webhooks))
+	for i, wh := range c.Notifications.Webhooks {
+		webhooks[i] = WebhookConfig{URL: wh.URL}
+		if len(wh.Headers) > 0 {
+			webhooks[i].Headers = make(map[string]string, len(wh.Headers))
+			for k := range wh.Headers {
+				webhooks[i].Headers[k] = "[redacted]"
+			}
+		}
+	}
+	c.Notifications.Webhooks = webhooks
+	return c
+}
+
+// Validate checks that all values are in range.
+//
+// Returns all problems joined into a single error, or nil if the config is valid.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port must be between 1 and 65535, got %d", c.Server.Port))
+	}
+	if c.Server.BufferSizeKB < 1 || c.Server.BufferSizeKB > MaxBufferSizeKB {
+		errs = append(errs, fmt.Errorf("server.buffer_size_kb must be between 1 and %d, got %d", MaxBufferSizeKB, c.Server.BufferSizeKB))
+	}
+	if c.Server.JournalSize < 1 {
+		errs = append(errs, fmt.Errorf("server.journal_size must be positive, got %d", c.Server.JournalSize))
+	}
+	if c.Server.DeltaIntervalMS < 0 {
+		errs = append(errs, fmt.Errorf("server.delta_interval_ms must not be negative, got %d", c.Server.DeltaIntervalMS))
+	}
+	if c.Server.DataDir == "" {
+		errs = append(errs, errors.New("server.data_dir must not be empty"))
+	}
+	if c.Timeouts.IdleSeconds < 1 {
+		errs = append(errs, fmt.Errorf("timeouts.idle_seconds must be positive, got %d", c.Timeouts.IdleSeconds))
+	}
+	if c.Timeouts.HibernateGrace < 0 {
+		errs = append(errs, fmt.Errorf("timeouts.hibernate_grace must not be negative, got %d", c.Timeouts.HibernateGrace))
+	}
+	if c.Timeouts.ResumeTimeout < 1 {
+		errs = append(errs, fmt.Errorf("timeouts.resume_timeout must be positive, got %d", c.Timeouts.ResumeTimeout))
+	}
+	if c.Timeouts.InterruptGrace < 1 {
+		errs = append(errs, fmt.Errorf("timeouts.interrupt_grace must be positive, got %d", c.Timeouts.InterruptGrace))
+	}
+	if c.Auth.PairingTTL < 1 {
+		errs = append(errs, fmt.Errorf("auth.pairing_ttl must be positive, got %d", c.Auth.PairingTTL))
+	}
+	for _, origin := range c.Auth.CORSOrigins {
+		if origin == "*" {
+			errs = append(errs, errors.New("auth.cors_origins must list explicit origins, not \"*\""))
+		}
+	}
+	if c.Runner.Type != RunnerTypeLocal {
+		errs = append(errs, fmt.Errorf("runner.type must be %q, got %q", RunnerTypeLocal, c.Runner.Type))
+	}
+	if c.Runner.Path == "" {
+		errs = append(errs, errors.New("runner.path must not be empty"))
+	}
+	if _, err := ParsePermissionMode(c.Permissions.Mode); err != nil {
+		errs = append(errs, fmt.Errorf("permissions.mode: %w", err))
+	}
+	if c.Permissions.Timeout <= 0 {
+		errs = append(errs, errors.New("permissions.timeout must be positive"))
+	}
+	if c.Compute.HourlyRateUSD < 0 {
+		errs = append(errs, fmt.Errorf("compute.hourly_rate_usd must not be negative, got %g", c.Compute.HourlyRateUSD))
+	}
+	errs = append(errs, c.Budgets.Session.validate("budgets.session")...)
+	errs = append(errs, c.Budgets.Daily.validate("budgets.daily")...)
+	if c.Budgets.MaxAgentTurns < 0 {
+		errs = append(errs, fmt.Errorf("budgets.max_agent_turns must not be negative, got %d", c.Budgets.MaxAgentTurns))
+	}
+	if c.Recovery.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("recovery.max_retries must not be negative, got %d", c.Recovery.MaxRetries))
+	}
+	if c.Recovery.BackoffMS < 0 || c.Recovery.MaxBackoffMS < c.Recovery.BackoffMS {
+		errs = append(errs, fmt.Errorf("recovery: need 0 <= backoff_ms <= max_backoff_ms, got %d and %d",
+			c.Recovery.BackoffMS, c.Recovery.MaxBackoffMS))
+	}
+	if _, err := policy.New(c.Policy.Rules); err != nil {
+		errs = append(errs, fmt.Errorf("policy.rules: %w", err))
+	}
+	for _, trigger := range append(c.Notifications.Triggers, c.Notifications.QuietHours.Except...) {
+		if !slices.Contains(notify.Events, notify.Event(trigger)) {
+			errs = append(errs, fmt.Errorf("notifications: unknown event %q", trigger))
+		}
+	}
+	qh := c.Notifications.QuietHours
+	if _, err := notify.ParseQuietHours(qh.Start, qh.End, qh.Timezone, nil); err != nil {
+		errs = append(errs, fmt.Errorf("notifications.quiet_hours: %w", err))
+	}
+	for i, wh := range c.Notifications.Webhooks {
+		if wh.URL == "" {
+			errs = append(errs, fmt.Errorf("notifications.webhooks[%d].url must not be empty", i))
+		}
+	}
+	if key := c.Notifications.WebPush.VAPIDPrivateKey; key != "" {
+		if _, err := notify.ParseVAPIDKeys(key); err != nil {
+			errs = append(errs, fmt.Errorf("notifications.web_push: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadConfig builds the effective configuration from defaults, the config
+// file, environment variables, and command-line args (without the program name).
+//
+// The config file is taken from -config, then DOZE_CONFIG, then
+// DefaultConfigPath. An explicitly requested file must exist; the default
+// one is optional.
+func LoadConfig(args []string) (Config, error) {
+	c := DefaultConfig()
+
+	fs := flag.NewFlagSet("doze", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to config file (default "+DefaultConfigPath+")")
+	port := fs.Int("port", 0, "HTTP listen port")
+	repoPath := fs.String("repo-path", "", "default working directory for Claude")
+	webPath := fs.String("web-path", "", "directory of the built web UI")
+	dataDir := fs.String("data-dir", "", "directory for persisted session metadata")
+	claudePath := fs.String("claude-path", "", "Claude binary to run (name on PATH or absolute path)")
+	idleTimeout := fs.Duration("idle-timeout", 0, "idle time before stopping a waiting session (e.g. 3m)")
+	pair := fs.Bool("pair", false, "print a pairing code and QR code at startup")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	// 2. Config file
+	path, required := *configPath, true
+	if path == "" {
+		path = os.Getenv("DOZE_CONFIG")
+	}
+	if path == "" {
+		path, required = DefaultConfigPath, false
+	}
+	if err := c.loadFile(path); err != nil {
+		if required || !errors.Is(err, os.ErrNotExist) {
+			return c, err
+		}
+	}
+
+	// 3. Environment variables
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+
+	// 4. Flags (only the ones explicitly set)
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			c.Server.Port = *port
+		case "repo-path":
+			c.Repo.Path = *repoPath
+		case "web-path":
+			c.Server.WebPath = *webPath
+		case "data-dir":
+			c.Server.DataDir = *dataDir
+		case "claude-path":
+			c.Runner.Path = *claudePath
+		case "idle-timeout":
+			c.Timeouts.IdleSeconds = int(idleTimeout.Seconds())
+		case "pair":
+			c.Auth.PairOnStart = *pair
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return c, fmt.Errorf("invalid config: %w", err)
+	}
+	return c, nil
+}
+
+// loadFile merges a YAML config file into c. Keys missing from the file keep
+// their current values; unknown (e.g. misspelled) keys are an error.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	c.file = path
+	return nil
+}
+
+// applyEnv overrides c with any environment variables that are set.
+//
+// Supported variables:
+//   - PORT: HTTP listen port
+//   - REPO_PATH: Default working directory for Claude
+//   - WEB_PATH: Directory of the built web UI
+//   - DOZE_DATA_DIR: Directory for persisted session metadata
+//   - DOZE_PUBLIC_URL: Externally reachable base URL
+//   - IDLE_TIMEOUT: Idle timeout as a duration ("3m") or seconds ("180")
+//   - DOZE_HIBERNATE_GRACE: Seconds between SIGTERM and SIGKILL
+//   - DOZE_RESUME_TIMEOUT: Max seconds to wait for a resume
+//   - DOZE_INTERRUPT_GRACE: Seconds for a turn to end after an interrupt
+//   - DOZE_BUFFER_SIZE_KB: Output ring buffer size per session
+//   - DOZE_JOURNAL_SIZE: Events kept per session for SSE replay
+//   - DOZE_AUTH_TOKEN: API token (added to auth.tokens)
+//   - DOZE_CORS_ORIGINS: Comma-separated CORS allowlist (replaces auth.cors_origins)
+//   - DOZE_CLAUDE_PATH: Claude binary to run
+//   - DOZE_PERMISSION_MODE: skip, prompt or plan
+//   - DOZE_PERMISSION_TIMEOUT: Seconds to wait for a permission answer
+//   - DOZE_CRASH_RETRIES: Resume attempts after a crash
+//   - DOZE_COMPUTE_RATE: Hourly rate in USD for compute cost estimates
+//   - DOZE_NTFY_SERVER, DOZE_NTFY_TOPIC, DOZE_NTFY_TOKEN: ntfy notifications
+func (c *Config) applyEnv() error {
+	var errs []error
+
+	envString := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	envInt := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+
+	envInt("PORT", &c.Server.Port)
+	envString("REPO_PATH", &c.Repo.Path)
+	envString("WEB_PATH", &c.Server.WebPath)
+	envString("DOZE_DATA_DIR", &c.Server.DataDir)
+	envString("DOZE_PUBLIC_URL", &c.Server.PublicURL)
+	envInt("DOZE_HIBERNATE_GRACE", &c.Timeouts.HibernateGrace)
+	envInt("DOZE_RESUME_TIMEOUT", &c.Timeouts.ResumeTimeout)
+	envInt("DOZE_INTERRUPT_GRACE", &c.Timeouts.InterruptGrace)
+	envInt("DOZE_BUFFER_SIZE_KB", &c.Server.BufferSizeKB)
+	envInt("DOZE_JOURNAL_SIZE", &c.Server.JournalSize)
+	envString("DOZE_CLAUDE_PATH", &c.Runner.Path)
+	envString("DOZE_PERMISSION_MODE", &c.Permissions.Mode)
+	envInt("DOZE_PERMISSION_TIMEOUT", &c.Permissions.Timeout)
+	envInt("DOZE_CRASH_RETRIES", &c.Recovery.MaxRetries)
+	if v := os.Getenv("DOZE_COMPUTE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DOZE_COMPUTE_RATE: %w", err))
+		} else {
+			c.Compute.HourlyRateUSD = rate
+		}
+	}
+	envString("DOZE_NTFY_SERVER", &c.Notifications.Ntfy.Server)
+	envString("DOZE_NTFY_TOPIC", &c.Notifications.Ntfy.Topic)
+	envString("DOZE_NTFY_TOKEN", &c.Notifications.Ntfy.Token)
+
+	if v := os.Getenv("DOZE_AUTH_TOKEN"); v != "" {
+		c.Auth.Tokens = append(c.Auth.Tokens, v)
+	}
+	if v := os.Getenv("DOZE_CORS_ORIGINS"); v != "" {
+		c.Auth.CORSOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.Auth.CORSOrigins = append(c.Auth.CORSOrigins, origin)
+			}
+		}
+	}
+
+	if v := os.Getenv("IDLE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.Timeouts.IdleSeconds = int(d.Seconds())
+		} else if n, err := strconv.Atoi(v); err == nil {
+			c.Timeouts.IdleSeconds = n
+		} else {
+			errs = append(errs, fmt.Errorf("IDLE_TIMEOUT: invalid duration %q", v))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// handleConfig returns the effective configuration with secrets redacted.
+//
+// GET /config
+//
+// Response:
+//
+//	{
+//	  "file": "config.yml",
+//	  "config": {"repo": {...}, "timeouts": {...}, "server": {...}, "auth": {...}}
+//	}
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"file":   cfg.file,
+		"config": cfg.Redacted(),
+	})
+}
@@ -0,0 +1,2406 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/seamus/doze/notify"
+	"github.com/seamus/doze/policy"
+)
+
+// fakeClaudeBin is the fakeclaude binary built by TestMain.
+var fakeClaudeBin string
+
+// testTimeout bounds every wait in the end-to-end tests.
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "doze-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fakeClaudeBin = filepath.Join(dir, "fakeclaude")
+	build := exec.Command("go", "build", "-o", fakeClaudeBin, "./internal/fakeclaude")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build fakeclaude: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testEnv is a doze server wired to fakeclaude running a scenario.
+type testEnv struct {
+	t      *testing.T
+	srv    *httptest.Server
+	record string // fakeclaude --record log
+	runner Runner // Runs fakeclaude with the scenario
+	dir    string // Data directory
+	store  *FileStore
+}
+
+// newTestEnv starts a server whose sessions run fakeclaude with the named
+// scenario from testdata/scenarios. configure may adjust cfg before any
+// session is created.
+func newTestEnv(t *testing.T, scenario string, configure func(*Config)) *testEnv {
+	t.Helper()
+
+	dir := t.TempDir()
+	record := filepath.Join(dir, "record.jsonl")
+	scenarioPath, err := filepath.Abs(filepath.Join("testdata", "scenarios", scenario+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CLAUDE_CONFIG_DIR", t.TempDir()) // Where fakeclaude keeps transcripts
+	cfg = DefaultConfig()
+	cfg.Repo.Path = t.TempDir()
+	cfg.Timeouts.HibernateGrace = 2
+	cfg.Permissions.Mode = string(PermissionModeSkip) // Permission tests opt in to prompt
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	runner := NewLocalRunner(fakeClaudeBin, []string{"--scenario", scenarioPath, "--record", record})
+	sessions = NewSessionRegistry(nil, runner)
+	usageLedger, err = OpenUsageLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	computeLedger, err = OpenComputeLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcriptDir = filepath.Join(dir, TranscriptDirName)
+	authenticator = &Authenticator{devices: make(map[string]*DeviceToken)}
+	pairing = NewPairingManager(DefaultPairingTTL)
+
+	env := &testEnv{t: t, srv: httptest.NewServer(newHandler()), record: record, runner: runner, dir: dir}
+	engine, err := policy.New(cfg.Policy.Rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions = NewPermissionBroker(cfg.PermissionTimeout(), env.srv.URL, engine)
+	notifier, webPush, err = setupNotifications(cfg.Notifications, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, s := range sessions.List() {
+			s.end()
+		}
+		// Let exit handling finish before the next test replaces the globals
+		for _, s := range sessions.List() {
+			waitForProcessExit(s)
+		}
+		notifier.Wait()
+		if env.store != nil {
+			env.store.Close()
+		}
+		usageLedger.Close()
+		computeLedger.Close()
+		env.srv.Close()
+	})
+	return env
+}
+
+// restart simulates a server restart: running sessions are ended as if the
+// server died (nothing they do is persisted anymore) and the registry is
+// restored from the session log in the data directory. The first call
+// switches the env from an in-memory registry to the session log.
+func (env *testEnv) restart() {
+	env.t.Helper()
+
+	if env.store != nil {
+		env.store.Close()
+		for _, s := range sessions.List() {
+			s.end()
+			waitForProcessExit(s)
+		}
+	}
+
+	store, err := OpenFileStore(env.dir)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	env.store = store
+	sessions = NewSessionRegistry(store, env.runner)
+	if err := sessions.Restore(); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+// waitForProcessExit waits (up to testTimeout) until s has no Claude
+// process, so its exit handling is done before the next test replaces the
+// globals it uses.
+func waitForProcessExit(s *Session) {
+	for deadline := time.Now().Add(testTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mu.RLock()
+		running := s.proc != nil
+		s.mu.RUnlock()
+		if !running {
+			return
+		}
+	}
+}
+
+// post sends a JSON POST and decodes the JSON response.
+func (env *testEnv) post(path string, body interface{}) (int, map[string]interface{}) {
+	env.t.Helper()
+	return env.do(http.MethodPost, path, body, nil)
+}
+
+// do sends a JSON request with extra headers and decodes the JSON response.
+func (env *testEnv) do(method, path string, body interface{}, header http.Header) (int, map[string]interface{}) {
+	env.t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, env.srv.URL+path, bytes.NewReader(data))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		env.t.Fatalf("%s %s: invalid JSON response: %v", method, path, err)
+	}
+	return resp.StatusCode, result
+}
+
+// get fetches a JSON resource.
+func (env *testEnv) get(path string) map[string]interface{} {
+	env.t.Helper()
+
+	resp, err := http.Get(env.srv.URL + path)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		env.t.Fatalf("GET %s: invalid JSON response: %v", path, err)
+	}
+	return result
+}
+
+// waitForState polls the default session until it reaches state.
+func (env *testEnv) waitForState(state SessionState) {
+	env.t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if env.get("/status")["state"] == string(state) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	env.t.Fatalf("session did not reach state %s (last: %v)", state, env.get("/status")["state"])
+}
+
+// recorded returns the fakeclaude events with the given name, in order.
+func (env *testEnv) recorded(event string) []map[string]interface{} {
+	env.t.Helper()
+
+	data, err := os.ReadFile(env.record)
+	if err != nil && !os.IsNotExist(err) {
+		env.t.Fatal(err)
+	}
+	var events []map[string]interface{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			env.t.Fatalf("invalid record line %q: %v", line, err)
+		}
+		if e["event"] == event {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// sseStream is a parsed GET /stream connection.
+type sseStream struct {
+	t      *testing.T
+	events chan SSEEvent
+}
+
+// stream opens GET /stream, optionally resuming after lastEventID.
+func (env *testEnv) stream(lastEventID uint64) *sseStream {
+	env.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, env.srv.URL+"/stream", nil)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	if lastEventID != 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(lastEventID, 10))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	env.t.Cleanup(func() { resp.Body.Close() })
+
+	st := &sseStream{t: env.t, events: make(chan SSEEvent, 100)}
+	go func() {
+		defer close(st.events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var event SSEEvent
+			if err := json.Unmarshal([]byte(data), &event); err == nil {
+				st.events <- event
+			}
+		}
+	}()
+	return st
+}
+
+// next returns the next event.
+func (st *sseStream) next() SSEEvent {
+	st.t.Helper()
+
+	select {
+	case event, ok := <-st.events:
+		if !ok {
+			st.t.Fatal("stream closed")
+		}
+		return event
+	case <-time.After(testTimeout):
+		st.t.Fatal("timed out waiting for event")
+	}
+	return SSEEvent{}
+}
+
+// waitFor skips events until one matches.
+func (st *sseStream) waitFor(desc string, match func(SSEEvent) bool) SSEEvent {
+	st.t.Helper()
+
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-st.events:
+			if !ok {
+				st.t.Fatalf("stream closed waiting for %s", desc)
+			}
+			if match(event) {
+				return event
+			}
+		case <-deadline:
+			st.t.Fatalf("timed out waiting for %s", desc)
+		}
+	}
+}
+
+// waitForOutput waits for an output event containing text.
+func (st *sseStream) waitForOutput(text string) SSEEvent {
+	st.t.Helper()
+	return st.waitFor("output "+strconv.Quote(text), func(e SSEEvent) bool {
+		return e.Type == EventTypeOutput && strings.Contains(e.Content, text)
+	})
+}
+
+// waitForState waits for a state event.
+func (st *sseStream) waitForState(state SessionState) SSEEvent {
+	st.t.Helper()
+	return st.waitFor("state "+string(state), func(e SSEEvent) bool {
+		return e.Type == EventTypeState && e.State == string(state)
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, yml string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(yml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// defaults < file < environment < flags
+	path := write("config.yml", "server:\n  port: 3000\n  journal_size: 5\ntimeouts:\n  idle_seconds: 100\n")
+	t.Setenv("PORT", "4000")
+	t.Setenv("DOZE_JOURNAL_SIZE", "7")
+	c, err := LoadConfig([]string{"-config", path, "-port", "5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.BufferSizeKB != DefaultConfig().Server.BufferSizeKB || c.Timeouts.IdleSeconds != 100 ||
+		c.Server.JournalSize != 7 || c.Server.Port != 5000 {
+		t.Errorf("config = buffer %d, idle %d, journal %d, port %d; want the default, the file, the env and the flag",
+			c.Server.BufferSizeKB, c.Timeouts.IdleSeconds, c.Server.JournalSize, c.Server.Port)
+	}
+
+	t.Setenv("DOZE_JOURNAL_SIZE", "")
+	for _, tc := range []struct {
+		name, yml, env, want string
+	}{
+		{name: "unknown key", yml: "server:\n  prot: 3000\n", want: "field prot not found"},
+		{name: "invalid value", yml: "server:\n  journal_size: 0\n", want: "server.journal_size must be positive"},
+		{name: "bad env", env: "abc", want: "DOZE_JOURNAL_SIZE"},
+	} {
+		t.Setenv("DOZE_JOURNAL_SIZE", tc.env)
+		_, err := LoadConfig([]string{"-config", write(tc.name+".yml", tc.yml)})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+	t.Setenv("DOZE_JOURNAL_SIZE", "")
+	if _, err := LoadConfig([]string{"-config", filepath.Join(dir, "missing.yml")}); err == nil {
+		t.Error("missing -config file loaded without error")
+	}
+	if _, err := LoadConfig([]string{"-config", "config.yml"}); err != nil {
+		t.Errorf("example config.yml: %v", err)
+	}
+}
+
+func TestMessageStartsSessionAndStreams(t *testing.T) {
+	env := newTestEnv(t, "basic", nil)
+	stream := env.stream(0)
+
+	if first := stream.next(); first.Type != EventTypeState || first.State != string(StateNone) {
+		t.Fatalf("first event = %+v, want state none", first)
+	}
+
+	code, resp := env.post("/message", map[string]string{"content": "hi"})
+	if code != http.StatusOK || resp["started"] != true {
+		t.Fatalf("POST /message = %d %v, want 200 started", code, resp)
+	}
+
+	stream.waitForState(StateActive)
+	stream.waitForOutput("Hello from fake")
+	tool := stream.waitFor("tool_use", func(e SSEEvent) bool { return e.Type == EventTypeToolUse })
+	if !strings.Contains(tool.Content, `"tool":"Read"`) {
+		t.Errorf("tool_use content = %s, want Read", tool.Content)
+	}
+	stream.waitForOutput("Read it.")
+	stream.waitForState(StateWaiting)
+
+	status := env.get("/status")
+	if status["claude_session_id"] != "fake-basic" {
+		t.Errorf("claude_session_id = %v, want fake-basic", status["claude_session_id"])
+	}
+	if status["initial_prompt"] != "hi" {
+		t.Errorf("initial_prompt = %v, want hi", status["initial_prompt"])
+	}
+
+	// A second message goes to the running process over stdin
+	code, resp = env.post("/message", map[string]string{"content": "second"})
+	if code != http.StatusOK || resp["started"] == true || resp["state"] != string(StateActive) {
+		t.Fatalf("POST /message = %d %v, want 200 active", code, resp)
+	}
+	stream.waitForOutput("echo: second")
+	stream.waitForState(StateWaiting)
+
+	if starts := env.recorded("start"); len(starts) != 1 {
+		t.Errorf("fakeclaude started %d times, want 1", len(starts))
+	}
+	var messages []string
+	for _, e := range env.recorded("message") {
+		messages = append(messages, e["content"].(string))
+	}
+	if !slices.Equal(messages, []string{"hi", "second"}) {
+		t.Errorf("messages = %q, want [hi second]", messages)
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	env := newTestEnv(t, "basic", nil)
+
+	resp, err := http.Post(env.srv.URL+"/message", "application/json", strings.NewReader(`{"content":""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty content: status = %d, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.Get(env.srv.URL + "/message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestStreamReplaysFromLastEventID(t *testing.T) {
+	env := newTestEnv(t, "basic", nil)
+	stream := env.stream(0)
+	stream.next() // Initial state
+
+	env.post("/message", map[string]string{"content": "hi"})
+	active := stream.waitForState(StateActive)
+	stream.waitForState(StateWaiting)
+
+	// Reconnecting after the "active" event replays everything since, in order
+	replay := env.stream(active.ID)
+	first := replay.next()
+	if first.ID != active.ID+1 || first.Type != EventTypeOutput || first.Content != "Hello from fake" {
+		t.Errorf("first replayed event = %+v, want output %d", first, active.ID+1)
+	}
+	replay.waitForState(StateWaiting)
+
+	// An unknown ID falls back to the recent output and current state
+	fresh := env.stream(1)
+	if output := fresh.next(); output.Type != EventTypeOutput || !strings.Contains(output.Content, "Hello from fake") {
+		t.Errorf("snapshot output = %+v, want recent output", output)
+	}
+	if state := fresh.next(); state.State != string(StateWaiting) {
+		t.Errorf("snapshot state = %+v, want waiting", state)
+	}
+}
+
+// wsClient is a GET /ws connection.
+type wsClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// dial opens GET /ws without saying hello.
+func (env *testEnv) dial() *wsClient {
+	env.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(env.srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	conn.SetReadLimit(WSReadLimit)
+	env.t.Cleanup(func() { conn.CloseNow() })
+	return &wsClient{t: env.t, conn: conn}
+}
+
+// websocket opens GET /ws, optionally resuming after lastEventID, and
+// returns the server's hello.
+func (env *testEnv) websocket(lastEventID uint64) (*wsClient, WSFrame) {
+	env.t.Helper()
+
+	ws := env.dial()
+	ws.send(WSFrame{Type: FrameTypeHello, LastEventID: lastEventID})
+	hello := ws.next()
+	if hello.Type != FrameTypeHello {
+		env.t.Fatalf("first frame = %+v, want hello", hello)
+	}
+	return ws, hello
+}
+
+// send writes a client frame.
+func (ws *wsClient) send(frame WSFrame) {
+	ws.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := wsjson.Write(ctx, ws.conn, frame); err != nil {
+		ws.t.Fatal(err)
+	}
+}
+
+// read returns the next frame, or the error that closed the connection.
+func (ws *wsClient) read() (WSFrame, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	var frame WSFrame
+	err := wsjson.Read(ctx, ws.conn, &frame)
+	return frame, err
+}
+
+// next returns the next frame.
+func (ws *wsClient) next() WSFrame {
+	ws.t.Helper()
+
+	frame, err := ws.read()
+	if err != nil {
+		ws.t.Fatalf("reading frame: %v", err)
+	}
+	return frame
+}
+
+// waitFor skips frames until one matches.
+func (ws *wsClient) waitFor(desc string, match func(WSFrame) bool) WSFrame {
+	ws.t.Helper()
+
+	for {
+		frame, err := ws.read()
+		if err != nil {
+			ws.t.Fatalf("reading frame waiting for %s: %v", desc, err)
+		}
+		if match(frame) {
+			return frame
+		}
+	}
+}
+
+// waitForState waits for a state event.
+func (ws *wsClient) waitForState(state SessionState) SSEEvent {
+	ws.t.Helper()
+	frame := ws.waitFor("state "+string(state), func(f WSFrame) bool {
+		return f.Type == FrameTypeEvent && f.Event.Type == EventTypeState && f.Event.State == string(state)
+	})
+	return *frame.Event
+}
+
+// waitForClose reads until the server closes the connection and returns
+// the close status.
+func (ws *wsClient) waitForClose() websocket.StatusCode {
+	ws.t.Helper()
+
+	for {
+		if _, err := ws.read(); err != nil {
+			return websocket.CloseStatus(err)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	env := newTestEnv(t, "basic", func(c *Config) { c.Server.JournalSize = 100 })
+
+	// The first frame must be hello
+	rude := env.dial()
+	rude.send(WSFrame{Type: FrameTypePing, ID: "p0"})
+	if status := rude.waitForClose(); status != websocket.StatusPolicyViolation {
+		t.Errorf("close status without hello = %v, want %v", status, websocket.StatusPolicyViolation)
+	}
+
+	ws, hello := env.websocket(0)
+	if hello.SessionID != DefaultSessionID || hello.State != string(StateNone) {
+		t.Errorf("hello = %+v, want session %s in state %q", hello, DefaultSessionID, StateNone)
+	}
+	ws.waitForState(StateNone) // Initial state
+
+	// Messages are acknowledged with the client's frame ID
+	ws.send(WSFrame{Type: FrameTypeMessage, ID: "m1", Content: "hi"})
+	ack := ws.waitFor("ack m1", func(f WSFrame) bool { return f.Type == FrameTypeAck })
+	if ack.ID != "m1" || ack.Error != "" || ack.MessageID == "" || !ack.Started {
+		t.Errorf("ack = %+v, want m1 started with a message ID", ack)
+	}
+	active := ws.waitForState(StateActive)
+	ws.waitForState(StateWaiting)
+
+	ws.send(WSFrame{Type: FrameTypeMessage, ID: "m2"})
+	if ack := ws.next(); ack.Type != FrameTypeAck || ack.ID != "m2" || ack.Error != "content is required" {
+		t.Errorf("ack for empty message = %+v, want content is required", ack)
+	}
+	ws.send(WSFrame{Type: FrameTypePing, ID: "p1"})
+	if pong := ws.next(); pong.Type != FrameTypePong || pong.ID != "p1" {
+		t.Errorf("reply to ping = %+v, want pong p1", pong)
+	}
+
+	// Reconnecting after the "active" event replays everything since, in order
+	replay, hello := env.websocket(active.ID)
+	if hello.State != string(StateWaiting) {
+		t.Errorf("hello on reconnect = %+v, want state waiting", hello)
+	}
+	first := replay.next()
+	if first.Type != FrameTypeEvent || first.Event.ID != active.ID+1 || first.Event.Type != EventTypeOutput {
+		t.Errorf("first replayed frame = %+v, want output event %d", first, active.ID+1)
+	}
+	replay.waitForState(StateWaiting)
+	replay.conn.Close(websocket.StatusNormalClosure, "")
+
+	// A client that stops reading is closed once its buffer fills up, and
+	// can reconnect
+	s, _ := sessions.Get(DefaultSessionID)
+	big := strings.Repeat("x", 64*1024)
+	for i := 0; i < 1000; i++ {
+		s.broadcastEvent(SSEEvent{Type: EventTypeOutput, Content: big})
+	}
+	if status := ws.waitForClose(); status != websocket.StatusTryAgainLater {
+		t.Errorf("close status for lagging client = %v, want %v", status, websocket.StatusTryAgainLater)
+	}
+	ws, _ = env.websocket(0)
+	ws.send(WSFrame{Type: FrameTypePing, ID: "p2"})
+	ws.waitFor("pong p2", func(f WSFrame) bool { return f.Type == FrameTypePong && f.ID == "p2" })
+}
+
+func TestIdleStopAndResume(t *testing.T) {
+	env := newTestEnv(t, "echo", func(c *Config) { c.Timeouts.IdleSeconds = 1 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("echo: hi")
+	stream.waitForState(StateWaiting)
+
+	// Idle timeout stops the process
+	stream.waitForState(StateShuttingDown)
+	stream.waitForState(StateStopped)
+	if signals := env.recorded("signal"); len(signals) == 0 {
+		t.Error("fakeclaude was not signalled to stop")
+	}
+
+	// The next message resumes the conversation with --resume
+	code, resp := env.post("/message", map[string]string{"content": "again"})
+	if code != http.StatusOK || resp["resumed"] != true {
+		t.Fatalf("POST /message = %d %v, want 200 resumed", code, resp)
+	}
+	if ev := stream.waitForResume(); ev.Path != ResumePathResumed {
+		t.Errorf("resume path = %q, want %q", ev.Path, ResumePathResumed)
+	}
+	stream.waitForOutput("echo: again")
+	stream.waitForState(StateWaiting)
+
+	starts := env.recorded("start")
+	if len(starts) != 2 {
+		t.Fatalf("fakeclaude started %d times, want 2", len(starts))
+	}
+	if starts[1]["resume"] != "fake-echo" {
+		t.Errorf("second start resumed %v, want fake-echo", starts[1]["resume"])
+	}
+	if status := env.get("/status"); status["claude_session_id"] != "fake-echo" {
+		t.Errorf("claude_session_id = %v, want fake-echo", status["claude_session_id"])
+	}
+}
+
+func TestRestoreAfterRestart(t *testing.T) {
+	env := newTestEnv(t, "slow", nil)
+	env.restart()
+	stream := env.stream(0)
+
+	// The server dies mid-turn
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("working")
+	env.restart()
+
+	status := env.get("/status")
+	if status["state"] != string(StateStopped) || status["claude_session_id"] != "fake-slow" {
+		t.Fatalf("restored status = %v, want stopped with fake-slow", status)
+	}
+	records, err := env.store.LoadSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].State != StateStopped {
+		t.Errorf("stored records = %+v, want the session stored as stopped", records)
+	}
+
+	// The next message resumes the conversation
+	stream = env.stream(0)
+	code, resp := env.post("/message", map[string]string{"content": "again"})
+	if code != http.StatusOK || resp["resumed"] != true {
+		t.Fatalf("POST /message = %d %v, want 200 resumed", code, resp)
+	}
+	stream.waitForOutput("finished")
+	if starts := env.recorded("start"); len(starts) != 2 || starts[1]["resume"] != "fake-slow" {
+		t.Errorf("starts = %v, want a second start resuming fake-slow", starts)
+	}
+
+	// Compaction keeps only the recent history
+	for i := 0; i < MaxStoredTransitions; i++ {
+		env.store.RecordTransition(StateTransition{ID: DefaultSessionID, From: StateWaiting, To: StateActive, At: time.Now()})
+	}
+	env.restart()
+	data, err := os.ReadFile(filepath.Join(env.dir, SessionsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Plus the change to stopped Restore records after compacting
+	if n := strings.Count(string(data), `"op":"transition"`); n != MaxStoredTransitions+1 {
+		t.Errorf("compacted log has %d transitions, want %d", n, MaxStoredTransitions+1)
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	env := newTestEnv(t, "echo", func(c *Config) { c.Compute.HourlyRateUSD = 3600 }) // $1 per second
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForState(StateWaiting)
+	time.Sleep(50 * time.Millisecond)
+	env.post("/sessions/"+DefaultSessionID+"/stop", nil)
+	stream.waitForState(StateStopped)
+	time.Sleep(50 * time.Millisecond)
+	env.post("/message", map[string]string{"content": "again"})
+	stream.waitForResume()
+	stream.waitForState(StateWaiting)
+
+	stats := env.get("/stats/compute")
+	days := stats["days"].([]interface{})
+	if len(days) == 0 || days[len(days)-1].(map[string]interface{})["day"] != time.Now().Format(time.DateOnly) {
+		t.Fatalf("days = %v, want one ending today", days)
+	}
+	total := stats["total"].(map[string]interface{})
+	seconds := total["seconds"].(map[string]interface{})
+	for _, state := range []SessionState{StateActive, StateWaiting, StateStopped} {
+		if s, _ := seconds[string(state)].(float64); s <= 0 {
+			t.Errorf("seconds in %s = %v, want > 0", state, seconds[string(state)])
+		}
+	}
+	if _, ok := seconds[string(StateNone)]; ok {
+		t.Errorf("seconds = %v, want no time in none", seconds)
+	}
+	running, hibernated := total["running_seconds"].(float64), total["hibernated_seconds"].(float64)
+	if hibernated < 0.05 || running < 0.05 {
+		t.Errorf("running %vs, hibernated %vs, want at least 0.05s each", running, hibernated)
+	}
+	if cost := total["cost_usd"].(float64); cost < running*0.99 || cost > running*1.01 {
+		t.Errorf("cost_usd = %v, want running_seconds (%v) at $1/s", cost, running)
+	}
+	if total["resumes"] != 1.0 || total["resumes_by_path"].(map[string]interface{})[ResumePathResumed] != 1.0 {
+		t.Errorf("resumes = %v %v, want 1 resumed", total["resumes"], total["resumes_by_path"])
+	}
+}
+
+func TestStopSessionRequiresWaiting(t *testing.T) {
+	env := newTestEnv(t, "slow", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("working")
+
+	code, resp := env.post("/sessions/default/stop", nil)
+	if code != http.StatusConflict || resp["state"] != string(StateActive) {
+		t.Fatalf("stop while active = %d %v, want 409 active", code, resp)
+	}
+
+	stream.waitForOutput("finished")
+	stream.waitForState(StateWaiting)
+
+	code, resp = env.post("/sessions/default/stop", nil)
+	if code != http.StatusOK {
+		t.Fatalf("stop while waiting = %d %v, want 200", code, resp)
+	}
+	stream.waitForState(StateStopped)
+}
+
+func TestStopEscalatesToKill(t *testing.T) {
+	env := newTestEnv(t, "stubborn", func(c *Config) { c.Timeouts.HibernateGrace = 1 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForState(StateWaiting)
+
+	start := time.Now()
+	if code, resp := env.post("/sessions/default/stop", nil); code != http.StatusOK {
+		t.Fatalf("stop = %d %v, want 200", code, resp)
+	}
+	stream.waitForState(StateStopped)
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("stopped after %v, want SIGKILL after the 1s grace period", elapsed)
+	}
+	if signals := env.recorded("signal"); len(signals) == 0 {
+		t.Error("fakeclaude was not signalled before being killed")
+	}
+}
+
+func TestCrashBroadcastsError(t *testing.T) {
+	env := newTestEnv(t, "crash", func(c *Config) { c.Recovery.MaxRetries = 0 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForState(StateActive)
+
+	// stdout and stderr are read independently, so their order isn't fixed
+	var output string
+	stream.waitFor("state none", func(e SSEEvent) bool {
+		if e.Type == EventTypeOutput {
+			output += e.Content
+		}
+		return e.Type == EventTypeState && e.State == string(StateNone)
+	})
+	for _, want := range []string{"about to crash", "panic: something broke"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output %q does not contain %q", output, want)
+		}
+	}
+	stream.waitFor("error event", func(e SSEEvent) bool {
+		return e.Type == EventTypeError && strings.Contains(e.Content, "exited unexpectedly")
+	})
+}
+
+func TestErrorMessageIsBroadcast(t *testing.T) {
+	env := newTestEnv(t, "error", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("[Error] rate limited")
+	stream.waitForState(StateWaiting)
+}
+
+func TestResumeFailure(t *testing.T) {
+	env := newTestEnv(t, "resume_fail", func(c *Config) { c.Timeouts.IdleSeconds = 1 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForState(StateWaiting)
+	stream.waitForState(StateStopped)
+
+	// Resume is attempted, but the process exits immediately
+	code, resp := env.post("/message", map[string]string{"content": "again"})
+	if code != http.StatusOK || resp["resumed"] != true {
+		t.Fatalf("POST /message = %d %v, want 200 resumed", code, resp)
+	}
+	stream.waitForOutput("No conversation found")
+
+	// A fresh session picks up from Claude's transcript and gets the message
+	ev := stream.waitForResume()
+	if ev.Path != ResumePathTranscript || !strings.Contains(ev.Reason, "No conversation found") {
+		t.Errorf("resume event = %+v, want transcript path after No conversation found", ev)
+	}
+	stream.waitForOutput("echo: again")
+	stream.waitForState(StateWaiting)
+
+	starts := env.recorded("start")
+	if len(starts) != 3 {
+		t.Fatalf("fakeclaude started %d times, want 3", len(starts))
+	}
+	seed, _ := starts[2]["append_system_prompt"].(string)
+	if starts[2]["resume"] != "" || !strings.Contains(seed, "User: hi") || !strings.Contains(seed, "Claude: echo: hi") {
+		t.Errorf("fallback start = %v, want a fresh start seeded with the transcript", starts[2])
+	}
+}
+
+// waitForResume waits for a resume event and decodes it.
+func (st *sseStream) waitForResume() ResumeEvent {
+	st.t.Helper()
+	e := st.waitFor("resume event", func(e SSEEvent) bool { return e.Type == EventTypeResume })
+	var ev ResumeEvent
+	if err := json.Unmarshal([]byte(e.Content), &ev); err != nil {
+		st.t.Fatalf("invalid resume event %q: %v", e.Content, err)
+	}
+	return ev
+}
+
+func TestResumeWithoutTranscript(t *testing.T) {
+	env := newTestEnv(t, "echo", func(c *Config) { c.Timeouts.IdleSeconds = 1 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("echo: hi")
+	stream.waitForState(StateStopped)
+
+	transcripts, _ := filepath.Glob(filepath.Join(os.Getenv("CLAUDE_CONFIG_DIR"), "projects", "*", "fake-echo.jsonl"))
+	if len(transcripts) != 1 {
+		t.Fatalf("transcripts = %v, want one for fake-echo", transcripts)
+	}
+	os.Remove(transcripts[0])
+
+	// --resume isn't attempted; the fresh session gets Doze's summary
+	code, resp := env.post("/message", map[string]string{"content": "again"})
+	if code != http.StatusOK || resp["started"] != true {
+		t.Fatalf("POST /message = %d %v, want 200 started", code, resp)
+	}
+	if ev := stream.waitForResume(); ev.Path != ResumePathSummary || ev.PreviousSessionID != "fake-echo" {
+		t.Errorf("resume event = %+v, want summary path for fake-echo", ev)
+	}
+	stream.waitForOutput("echo: again")
+
+	starts := env.recorded("start")
+	if len(starts) != 2 || starts[1]["resume"] != "" {
+		t.Fatalf("starts = %v, want a second, fresh start", starts)
+	}
+	if seed, _ := starts[1]["append_system_prompt"].(string); !strings.Contains(seed, "First request from the user:\nhi") {
+		t.Errorf("seed = %q, want the first request", seed)
+	}
+}
+
+func TestSessionsAreIndependent(t *testing.T) {
+	env := newTestEnv(t, "basic", nil)
+
+	code, created := env.post("/sessions", map[string]string{"content": "first"})
+	if code != http.StatusCreated {
+		t.Fatalf("POST /sessions = %d %v, want 201", code, created)
+	}
+	id := created["id"].(string)
+
+	deadline := time.Now().Add(testTimeout)
+	for env.get("/sessions/" + id)["state"] != string(StateWaiting) {
+		if time.Now().After(deadline) {
+			t.Fatal("created session did not reach waiting")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if state := env.get("/status")["state"]; state != string(StateNone) {
+		t.Errorf("default session state = %v, want none", state)
+	}
+
+	s, _ := sessions.Get(id)
+	if code, _ := env.post("/sessions/"+id+"/end", nil); code != http.StatusOK {
+		t.Fatalf("end = %d, want 200", code)
+	}
+	waitForProcessExit(s) // Cleanup can't see ended sessions
+	resp, err := http.Get(env.srv.URL + "/sessions/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET ended session = %d, want 404", resp.StatusCode)
+	}
+}
+
+// promptMode configures sessions to ask for permission.
+func promptMode(c *Config) { c.Permissions.Mode = string(PermissionModePrompt) }
+
+// waitForPermission waits for a permission_request event and decodes it.
+func (st *sseStream) waitForPermission() PermissionRequest {
+	st.t.Helper()
+
+	event := st.waitFor("permission_request", func(e SSEEvent) bool { return e.Type == EventTypePermissionRequest })
+	var req PermissionRequest
+	if err := json.Unmarshal([]byte(event.Content), &req); err != nil {
+		st.t.Fatalf("invalid permission_request %s: %v", event.Content, err)
+	}
+	return req
+}
+
+func TestPermissionPromptAllowAlways(t *testing.T) {
+	env := newTestEnv(t, "permission", promptMode)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "run the tests"})
+	req := stream.waitForPermission()
+	if req.ToolName != "Bash" || req.Input["command"] != "go test ./..." {
+		t.Fatalf("permission request = %+v, want Bash go test ./...", req)
+	}
+
+	pending := env.get("/permissions")["requests"].([]interface{})
+	if len(pending) != 1 {
+		t.Fatalf("GET /permissions = %v, want 1 request", pending)
+	}
+
+	code, resp := env.post("/permissions/"+req.ID, map[string]interface{}{
+		"behavior": "allow", "always": true, "pattern": "Bash(go test *)",
+	})
+	if code != http.StatusOK || resp["rule"] != "Bash(go test *)" {
+		t.Fatalf("POST /permissions/{id} = %d %v, want 200 with rule", code, resp)
+	}
+	stream.waitForOutput("first done")
+	stream.waitForState(StateWaiting)
+
+	// Answering twice is a 404
+	if code, _ := env.post("/permissions/"+req.ID, map[string]string{"behavior": "allow"}); code != http.StatusNotFound {
+		t.Errorf("second answer = %d, want 404", code)
+	}
+
+	// The next matching call is allowed by the rule without asking
+	env.post("/message", map[string]string{"content": "again"})
+	stream.waitForOutput("second done")
+
+	decisions := env.recorded("permission")
+	if len(decisions) != 2 || decisions[0]["behavior"] != "allow" || decisions[1]["behavior"] != "allow" {
+		t.Errorf("recorded decisions = %v, want two allows", decisions)
+	}
+	if rules := env.get("/status")["allow_rules"]; fmt.Sprint(rules) != "[Bash(go test *)]" {
+		t.Errorf("allow_rules = %v, want [Bash(go test *)]", rules)
+	}
+}
+
+func TestPermissionPromptDeny(t *testing.T) {
+	env := newTestEnv(t, "permission", promptMode)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "run the tests"})
+	req := stream.waitForPermission()
+	env.post("/permissions/"+req.ID, map[string]string{"behavior": "deny", "message": "not on my phone"})
+	stream.waitFor("permission_resolved", func(e SSEEvent) bool { return e.Type == EventTypePermissionResolved })
+	stream.waitForState(StateWaiting)
+
+	decisions := env.recorded("permission")
+	if len(decisions) != 1 || decisions[0]["behavior"] != "deny" || decisions[0]["message"] != "not on my phone" {
+		t.Errorf("recorded decisions = %v, want deny with message", decisions)
+	}
+}
+
+func TestPermissionTimeoutDenies(t *testing.T) {
+	env := newTestEnv(t, "permission", func(c *Config) {
+		promptMode(c)
+		c.Permissions.Timeout = 1
+	})
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "run the tests"})
+	stream.waitForPermission()
+	stream.waitForState(StateWaiting)
+
+	decisions := env.recorded("permission")
+	if len(decisions) != 1 || decisions[0]["behavior"] != "deny" || !strings.Contains(decisions[0]["message"].(string), "timed out") {
+		t.Errorf("recorded decisions = %v, want timed out deny", decisions)
+	}
+	if pending := env.get("/permissions")["requests"].([]interface{}); len(pending) != 0 {
+		t.Errorf("GET /permissions = %v, want none pending", pending)
+	}
+}
+
+func TestSkipModeDoesNotPrompt(t *testing.T) {
+	env := newTestEnv(t, "permission", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "run the tests"})
+	stream.waitForOutput("first done")
+
+	args := fmt.Sprint(env.recorded("start")[0]["args"])
+	if !strings.Contains(args, "--dangerously-skip-permissions") || strings.Contains(args, "--permission-prompt-tool") {
+		t.Errorf("start args = %s, want skip permissions without a prompt tool", args)
+	}
+	if decisions := env.recorded("permission"); len(decisions) != 0 {
+		t.Errorf("recorded decisions = %v, want none", decisions)
+	}
+}
+
+func TestMCPRequiresSessionToken(t *testing.T) {
+	env := newTestEnv(t, "basic", nil)
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`
+	req, err := http.NewRequest(http.MethodPost, env.srv.URL+"/sessions/default/mcp", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST /sessions/default/mcp = %d, want 401", resp.StatusCode)
+	}
+	if _, ok := sessions.Get(DefaultSessionID); ok {
+		t.Error("an unauthenticated MCP request created the default session")
+	}
+}
+
+// raw sends a bodyless request with headers and returns the response with
+// its body closed.
+func (env *testEnv) raw(method, path string, header http.Header) *http.Response {
+	env.t.Helper()
+
+	req, err := http.NewRequest(method, env.srv.URL+path, nil)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	env := newTestEnv(t, "basic", func(c *Config) { c.Auth.CORSOrigins = []string{"https://app.example"} })
+
+	// An open server doesn't hand out credentials
+	if code, resp := env.post("/auth/devices", map[string]string{"name": "intruder"}); code != http.StatusForbidden {
+		t.Fatalf("POST /auth/devices while open = %d %v, want 403", code, resp)
+	}
+	if resp := env.raw(http.MethodGet, "/pair/qr", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /pair/qr while open = %d, want 403", resp.StatusCode)
+	}
+
+	// The first device token turns auth on
+	token, _, err := authenticator.IssueDeviceToken("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+
+	resp := env.raw(http.MethodGet, "/status", nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("GET /status without a token = %d %v, want 401 with WWW-Authenticate", resp.StatusCode, resp.Header)
+	}
+	if resp := env.raw(http.MethodGet, "/health", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /health = %d, want 200 (public)", resp.StatusCode)
+	}
+	if resp := env.raw(http.MethodGet, "/status", bearer(token)); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /status with a bearer token = %d, want 200", resp.StatusCode)
+	}
+	if resp := env.raw(http.MethodGet, "/status", bearer("doze_wrong")); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status with a wrong token = %d, want 401", resp.StatusCode)
+	}
+
+	// Query tokens only work where headers can't be set; cookies never do
+	if resp := env.raw(http.MethodGet, "/pair/qr?token="+token, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /pair/qr?token= = %d, want 200", resp.StatusCode)
+	}
+	if resp := env.raw(http.MethodGet, "/status?token="+token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status?token= = %d, want 401", resp.StatusCode)
+	}
+	if resp := env.raw(http.MethodGet, "/status", http.Header{"Cookie": {"doze_token=" + token}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status with a cookie = %d, want 401", resp.StatusCode)
+	}
+
+	// A revoked device token is rejected
+	code, issued := env.do(http.MethodPost, "/auth/devices", map[string]string{"name": "phone"}, bearer(token))
+	if code != http.StatusCreated {
+		t.Fatalf("POST /auth/devices = %d %v, want 201", code, issued)
+	}
+	phone := issued["token"].(string)
+	if resp := env.raw(http.MethodGet, "/status", bearer(phone)); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /status with the new device token = %d, want 200", resp.StatusCode)
+	}
+	if code, _ := env.do(http.MethodDelete, "/auth/devices/"+issued["id"].(string), nil, bearer(token)); code != http.StatusOK {
+		t.Fatalf("DELETE /auth/devices/{id} = %d, want 200", code)
+	}
+	if resp := env.raw(http.MethodGet, "/status", bearer(phone)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status with a revoked token = %d, want 401", resp.StatusCode)
+	}
+
+	// CORS preflights are only answered for allowlisted origins
+	preflight := func(origin string) *http.Response {
+		return env.raw(http.MethodOptions, "/message", http.Header{
+			"Origin":                        {origin},
+			"Access-Control-Request-Method": {http.MethodPost},
+		})
+	}
+	resp = preflight("https://evil.example")
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight from another origin = %d %v, want 403 without CORS headers", resp.StatusCode, resp.Header)
+	}
+	resp = preflight("https://app.example")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("preflight from the allowed origin = %d %v, want 204 allowing it without credentials", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestPairingCodes(t *testing.T) {
+	// Codes expire
+	pm := NewPairingManager(20 * time.Millisecond)
+	code, _, err := pm.NewCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := pm.Redeem(code, "10.0.0.1"); got != PairingInvalid {
+		t.Errorf("expired code redeemed = %v, want PairingInvalid", got)
+	}
+
+	// An address that keeps guessing is refused; others can still pair
+	pm = NewPairingManager(time.Minute)
+	code, _, _ = pm.NewCode()
+	for i := 0; i < PairingMaxFailures; i++ {
+		if got := pm.Redeem("AAAA-AAAA", "10.0.0.1"); got != PairingInvalid {
+			t.Fatalf("guess %d = %v, want PairingInvalid", i+1, got)
+		}
+	}
+	if got := pm.Redeem(code, "10.0.0.1"); got != PairingLimited {
+		t.Errorf("valid code from the guessing address = %v, want PairingLimited", got)
+	}
+	if got := pm.Redeem(strings.ToLower(code), "10.0.0.2"); got != PairingOK {
+		t.Errorf("valid code from another address = %v, want PairingOK", got)
+	}
+}
+
+func TestPairEndpoint(t *testing.T) {
+	env := newTestEnv(t, "basic", nil)
+	code, _, err := pairing.NewCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, resp := env.post("/pair", map[string]string{"code": code, "name": "phone"})
+	if status != http.StatusCreated || resp["token"] == nil {
+		t.Fatalf("POST /pair = %d %v, want 201 with a token", status, resp)
+	}
+	token := resp["token"].(string)
+	if resp := env.raw(http.MethodGet, "/status", http.Header{"Authorization": {"Bearer " + token}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /status with the paired token = %d, want 200", resp.StatusCode)
+	}
+
+	// Codes work once, and failures lock the address out
+	if status, _ := env.post("/pair", map[string]string{"code": code}); status != http.StatusUnauthorized {
+		t.Errorf("reused code = %d, want 401", status)
+	}
+	for i := 1; i < PairingMaxFailures; i++ {
+		env.post("/pair", map[string]string{"code": "AAAA-AAAA"})
+	}
+	next, _, _ := pairing.NewCode()
+	if status, resp := env.post("/pair", map[string]string{"code": next}); status != http.StatusTooManyRequests {
+		t.Errorf("POST /pair after %d failures = %d %v, want 429", PairingMaxFailures, status, resp)
+	}
+}
+
+// policyRules configures the rules from the policy package docs.
+func policyRules(c *Config) {
+	c.Policy.Rules = []policy.Rule{
+		{Name: "no-force-push", Tools: []string{"Bash"}, Match: `git\s+push\s+.*(--force|-f\b)`, Action: policy.ActionDeny},
+		{Name: "stay-in-repo", Tools: []string{"Write", "Edit"}, OutsideRepo: true, Action: policy.ActionDeny},
+		{Name: "env-files", Match: `(^|[/\s])\.env\b`, Action: policy.ActionAsk},
+	}
+}
+
+func TestPolicyEnforcedInSkipMode(t *testing.T) {
+	env := newTestEnv(t, "policy", policyRules)
+	stream := env.stream(0)
+
+	// Force push is denied before it runs
+	env.post("/message", map[string]string{"content": "push it"})
+	event := stream.waitFor("policy_violation", func(e SSEEvent) bool { return e.Type == EventTypePolicyViolation })
+	var v PolicyViolation
+	if err := json.Unmarshal([]byte(event.Content), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Rule != "no-force-push" || v.Action != policy.ActionDeny || v.Subject != "git push --force origin main" {
+		t.Errorf("violation = %+v, want no-force-push deny", v)
+	}
+	stream.waitForOutput("push attempted")
+	stream.waitForState(StateWaiting)
+
+	// Writing outside the repo is denied
+	env.post("/message", map[string]string{"content": "write it"})
+	stream.waitForOutput("write attempted")
+	stream.waitForState(StateWaiting)
+
+	// .env needs approval even in skip mode; other reads go straight through
+	env.post("/message", map[string]string{"content": "read it"})
+	req := stream.waitForPermission()
+	if req.Rule != "env-files" || req.Input["file_path"] != ".env" {
+		t.Fatalf("permission request = %+v, want .env by env-files", req)
+	}
+	env.post("/permissions/"+req.ID, map[string]string{"behavior": "allow"})
+	stream.waitForOutput("read attempted")
+
+	args := fmt.Sprint(env.recorded("start")[0]["args"])
+	if strings.Contains(args, "--dangerously-skip-permissions") || !strings.Contains(args, "--permission-prompt-tool") {
+		t.Errorf("start args = %s, want the permission prompt tool instead of skipping permissions", args)
+	}
+
+	var behaviors []string
+	for _, e := range env.recorded("permission") {
+		behaviors = append(behaviors, e["behavior"].(string))
+	}
+	if !slices.Equal(behaviors, []string{"deny", "deny", "allow", "allow"}) {
+		t.Errorf("recorded decisions = %q, want [deny deny allow allow]", behaviors)
+	}
+
+	violations := env.get("/sessions/default/violations")["violations"].([]interface{})
+	var rules []string
+	for _, v := range violations {
+		rules = append(rules, v.(map[string]interface{})["rule"].(string))
+	}
+	if !slices.Equal(rules, []string{"no-force-push", "stay-in-repo", "env-files"}) {
+		t.Errorf("violations = %q, want [no-force-push stay-in-repo env-files]", rules)
+	}
+}
+
+// webhookStandIn starts a local webhook receiver and configures
+// notifications to go to it.
+func webhookStandIn(t *testing.T, c *Config) <-chan notify.Notification {
+	received := make(chan notify.Notification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notify.Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("invalid webhook body: %v", err)
+		}
+		received <- n
+	}))
+	t.Cleanup(srv.Close)
+
+	c.Server.PublicURL = "https://doze.example.com"
+	c.Notifications.Webhooks = []WebhookConfig{{URL: srv.URL}}
+	c.Notifications.Triggers = []string{"turn_complete", "error", "stopped", "permission"}
+	return received
+}
+
+// waitForNotification waits for a notification about event.
+func waitForNotification(t *testing.T, received <-chan notify.Notification, event notify.Event) notify.Notification {
+	t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case n := <-received:
+			if n.Event == event {
+				return n
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for %s notification", event)
+		}
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	var received <-chan notify.Notification
+	env := newTestEnv(t, "permission", func(c *Config) {
+		promptMode(c)
+		received = webhookStandIn(t, c)
+		c.Timeouts.IdleSeconds = 1
+	})
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "run the tests"})
+	req := stream.waitForPermission()
+	n := waitForNotification(t, received, notify.EventPermission)
+	if n.SessionID != DefaultSessionID || n.URL != "https://doze.example.com/?session=default" || !strings.Contains(n.Body, "go test") {
+		t.Errorf("permission notification = %+v, want deep link and command", n)
+	}
+
+	env.post("/permissions/"+req.ID, map[string]string{"behavior": "allow"})
+	n = waitForNotification(t, received, notify.EventTurnComplete)
+	if !strings.Contains(n.Body, "first done") {
+		t.Errorf("turn_complete body = %q, want recent output", n.Body)
+	}
+
+	// Idle stop
+	waitForNotification(t, received, notify.EventStopped)
+}
+
+func TestNotificationQuietHours(t *testing.T) {
+	var received <-chan notify.Notification
+	env := newTestEnv(t, "echo", func(c *Config) {
+		received = webhookStandIn(t, c)
+		now := time.Now().UTC()
+		c.Notifications.QuietHours = QuietHoursConfig{
+			Start:    now.Add(-time.Hour).Format("15:04"),
+			End:      now.Add(time.Hour).Format("15:04"),
+			Timezone: "UTC",
+			Except:   []string{"error"},
+		}
+	})
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForState(StateWaiting)
+	notifier.Wait()
+
+	select {
+	case n := <-received:
+		t.Errorf("received %+v during quiet hours", n)
+	default:
+	}
+}
+
+func TestWebPushSubscriptions(t *testing.T) {
+	env := newTestEnv(t, "basic", func(c *Config) { c.Notifications.WebPush.Enabled = true })
+
+	key := env.get("/push/vapid-key")["public_key"].(string)
+	if len(key) != 87 {
+		t.Errorf("public_key = %q, want a base64url P-256 point", key)
+	}
+
+	code, _ := env.post("/push/subscriptions", map[string]interface{}{"endpoint": "https://push.example/x"})
+	if code != http.StatusBadRequest {
+		t.Errorf("subscribe without keys = %d, want 400", code)
+	}
+	code, _ = env.post("/push/subscriptions", map[string]interface{}{
+		"endpoint": "https://push.example/x",
+		"keys": map[string]string{
+			"p256dh": key, // Any P-256 point will do
+			"auth":   "AAAAAAAAAAAAAAAAAAAAAA",
+		},
+	})
+	if code != http.StatusCreated {
+		t.Fatalf("subscribe = %d, want 201", code)
+	}
+	if subs := webPush.subscriptions.List(); len(subs) != 1 || subs[0].Endpoint != "https://push.example/x" {
+		t.Errorf("subscriptions = %v, want the new one", subs)
+	}
+}
+
+// command sends a slash command and returns its result.
+func (env *testEnv) command(content string) map[string]interface{} {
+	env.t.Helper()
+
+	code, resp := env.post("/message", map[string]string{"content": content})
+	result, ok := resp["command"].(map[string]interface{})
+	if code != http.StatusOK || !ok || resp["queued"] != false {
+		env.t.Fatalf("POST /message %q = %d %v, want a command result", content, code, resp)
+	}
+	return result
+}
+
+// gitRepo turns the test repo into a git repository with one commit.
+func gitRepo(t *testing.T) {
+	t.Helper()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=Doze", "-c", "user.email=doze@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = cfg.Repo.Path
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+}
+
+func TestSlashCommandsAreHandledByDoze(t *testing.T) {
+	env := newTestEnv(t, "echo", nil)
+	stream := env.stream(0)
+
+	help := env.command("/help")
+	if !strings.Contains(help["text"].(string), "/branch <name>") {
+		t.Errorf("/help text = %q, want command list", help["text"])
+	}
+	event := stream.waitFor("command event", func(e SSEEvent) bool {
+		if e.Type == EventTypeInfo {
+			t.Errorf("info event %q for a command, want a command event", e.Content)
+		}
+		return e.Type == EventTypeCommand
+	})
+	var broadcast CommandResult
+	if err := json.Unmarshal([]byte(event.Content), &broadcast); err != nil || broadcast.Command != "help" {
+		t.Errorf("command event = %s, want help result", event.Content)
+	}
+
+	status := env.command("/status")
+	if data := status["data"].(map[string]interface{}); data["state"] != string(StateNone) {
+		t.Errorf("/status data = %v, want state none", data)
+	}
+
+	model := env.command("/model sonnet")
+	if data := model["data"].(map[string]interface{}); data["model"] != "sonnet" || data["restart_required"] != false {
+		t.Errorf("/model = %v, want sonnet without restart", model)
+	}
+	if bad := env.command("/model $(rm -rf)"); bad["error"] == nil {
+		t.Errorf("/model with shell metacharacters = %v, want error", bad)
+	}
+
+	// Unknown commands go to Claude, which starts with the chosen model
+	code, resp := env.post("/message", map[string]string{"content": "/compact"})
+	if code != http.StatusOK || resp["started"] != true || resp["command"] != nil {
+		t.Fatalf("POST /message /compact = %d %v, want started", code, resp)
+	}
+	stream.waitForOutput("echo: /compact")
+	stream.waitForState(StateWaiting)
+	if args := fmt.Sprint(env.recorded("start")[0]["args"]); !strings.Contains(args, "--model sonnet") {
+		t.Errorf("start args = %s, want --model sonnet", args)
+	}
+
+	// /clear runs in Doze and still reaches Claude
+	env.post("/message", map[string]string{"content": "/clear"})
+	stream.waitForOutput("echo: /clear")
+	stream.waitForState(StateWaiting)
+
+	var messages []string
+	for _, e := range env.recorded("message") {
+		messages = append(messages, e["content"].(string))
+	}
+	if !slices.Equal(messages, []string{"/compact", "/clear"}) {
+		t.Errorf("messages sent to Claude = %q, want [/compact /clear]", messages)
+	}
+
+	// /stop hibernates right away
+	if stop := env.command("/stop"); stop["error"] != nil {
+		t.Fatalf("/stop = %v", stop)
+	}
+	stream.waitForState(StateStopped)
+	if stop := env.command("/stop"); stop["error"] == nil {
+		t.Errorf("/stop while stopped = %v, want error", stop)
+	}
+}
+
+func TestSlashCommandsGitAndSessions(t *testing.T) {
+	env := newTestEnv(t, "echo", nil)
+	gitRepo(t)
+
+	if diff := env.command("/diff"); diff["text"] != "No uncommitted changes." {
+		t.Errorf("/diff = %v, want no changes", diff)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Repo.Path, "new.txt"), []byte("hi\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	diff := env.command("/diff")
+	if files := fmt.Sprint(diff["data"].(map[string]interface{})["files"]); !strings.Contains(files, "new.txt") {
+		t.Errorf("/diff files = %s, want new.txt", files)
+	}
+
+	branch := env.command("/branch feature-x")
+	if data := branch["data"].(map[string]interface{}); data["created"] != true {
+		t.Errorf("/branch = %v, want created", branch)
+	}
+	if got := currentBranch(cfg.Repo.Path); got != "feature-x" {
+		t.Errorf("checked out %q, want feature-x", got)
+	}
+	if branch := env.command("/branch main"); branch["data"].(map[string]interface{})["created"] != false {
+		t.Errorf("/branch main = %v, want existing branch", branch)
+	}
+	if status := env.get("/status"); status["branch"] != "main" {
+		t.Errorf("status branch = %v, want main", status["branch"])
+	}
+	if bad := env.command("/branch -D main"); bad["error"] == nil {
+		t.Errorf("/branch -D main = %v, want error", bad)
+	}
+
+	created := env.command("/new")
+	id := created["data"].(map[string]interface{})["id"].(string)
+	if s := env.get("/sessions/" + id); s["state"] != string(StateNone) {
+		t.Errorf("new session = %v, want state none", s)
+	}
+}
+
+func TestCostCommand(t *testing.T) {
+	env := newTestEnv(t, "cost", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "one"})
+	stream.waitForState(StateWaiting)
+	env.post("/message", map[string]string{"content": "two"})
+	stream.waitForOutput("two")
+	stream.waitForState(StateWaiting)
+
+	data := env.command("/cost")["data"].(map[string]interface{})
+	if data["cost_usd"] != 0.75 || data["turns"] != 2.0 {
+		t.Errorf("/cost = %v, want $0.75 over 2 turns", data)
+	}
+}
+
+func TestUsageAccounting(t *testing.T) {
+	env := newTestEnv(t, "cost", nil)
+	stream := env.stream(0)
+	waitForUsage := func() (turn, session UsageTotals) {
+		t.Helper()
+		e := stream.waitFor("usage", func(e SSEEvent) bool { return e.Type == EventTypeUsage })
+		var ev struct {
+			Turn    TurnUsage   `json:"turn"`
+			Session UsageTotals `json:"session"`
+		}
+		if err := json.Unmarshal([]byte(e.Content), &ev); err != nil {
+			t.Fatalf("bad usage event %q: %v", e.Content, err)
+		}
+		return UsageTotals{TokenUsage: ev.Turn.TokenUsage, CostUSD: ev.Turn.CostUSD, DurationMS: ev.Turn.DurationMS}, ev.Session
+	}
+
+	env.post("/message", map[string]string{"content": "one"})
+	if turn, _ := waitForUsage(); turn.CostUSD != 0.25 || turn.InputTokens != 600 || turn.DurationMS != 5400 {
+		t.Errorf("first turn usage = %+v, want $0.25, 600 input tokens, 5400ms", turn)
+	}
+	stream.waitForState(StateWaiting)
+	env.post("/message", map[string]string{"content": "two"})
+	turn, session := waitForUsage()
+	if turn.CostUSD != 0.5 || turn.OutputTokens != 220 {
+		t.Errorf("second turn usage = %+v, want $0.50 and 220 output tokens", turn)
+	}
+	if session.Turns != 2 || session.CostUSD != 0.75 || session.InputTokens != 1500 {
+		t.Errorf("session usage = %+v, want $0.75 and 1500 input tokens over 2 turns", session)
+	}
+	stream.waitForState(StateWaiting)
+
+	usage := env.get("/sessions/" + DefaultSessionID + "/usage")
+	if turns := usage["turns"].([]interface{}); len(turns) != 2 {
+		t.Errorf("turns = %v, want 2", turns)
+	}
+	status := env.get("/status")["usage"].(map[string]interface{})
+	if status["cost_usd"] != 0.75 || status["output_tokens"] != 340.0 {
+		t.Errorf("status usage = %v, want $0.75 and 340 output tokens", status)
+	}
+
+	byDay := env.get("/usage?group=day")["usage"].([]interface{})
+	if len(byDay) != 1 {
+		t.Fatalf("usage by day = %v, want one row", byDay)
+	}
+	row := byDay[0].(map[string]interface{})
+	if row["day"] != time.Now().Format(time.DateOnly) || row["repo"] != nil || row["turns"] != 2.0 {
+		t.Errorf("usage row = %v, want today's 2 turns", row)
+	}
+	if code, _ := env.do(http.MethodGet, "/usage?group=week", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("group=week: status %d, want 400", code)
+	}
+
+	// The totals survive a restart
+	reopened, err := OpenUsageLedger(filepath.Dir(env.record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if rows, total := reopened.Summary(true, true); len(rows) != 1 || rows[0].Repo != cfg.Repo.Path || total.CostUSD != 0.75 {
+		t.Errorf("reopened ledger = %+v (total %+v), want one row for %s costing $0.75", rows, total, cfg.Repo.Path)
+	}
+}
+
+// waitForBudgetExceeded waits for a budget_exceeded event.
+func (st *sseStream) waitForBudgetExceeded() BudgetExceeded {
+	st.t.Helper()
+	e := st.waitFor("budget_exceeded", func(e SSEEvent) bool { return e.Type == EventTypeBudgetExceeded })
+	var ev BudgetExceeded
+	if err := json.Unmarshal([]byte(e.Content), &ev); err != nil {
+		st.t.Fatalf("bad budget_exceeded event %q: %v", e.Content, err)
+	}
+	return ev
+}
+
+func TestBudgetBlocksMessagesUntilOverride(t *testing.T) {
+	env := newTestEnv(t, "cost", func(c *Config) {
+		c.Budgets.Session.MaxCostUSD = 0.25
+		c.Budgets.MaxAgentTurns = 5
+	})
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "one"})
+	stream.waitForState(StateWaiting)
+	if ev := stream.waitForBudgetExceeded(); ev.Scope != BudgetScopeSession || ev.Limit != "max_cost_usd" || ev.Used != 0.25 {
+		t.Errorf("budget_exceeded = %+v, want session max_cost_usd at $0.25", ev)
+	}
+
+	code, resp := env.post("/message", map[string]string{"content": "two"})
+	if code != http.StatusPaymentRequired || resp["budget_exceeded"] == nil {
+		t.Fatalf("POST /message over budget = %d %v, want 402", code, resp)
+	}
+	if status := env.get("/status"); status["budget_exceeded"] == nil {
+		t.Errorf("status = %v, want budget_exceeded", status)
+	}
+	// Doze's own commands still work
+	if cost := env.command("/cost"); cost["error"] != nil {
+		t.Errorf("/cost over budget = %v", cost)
+	}
+
+	code, resp = env.post("/budget/override", map[string]interface{}{"session": map[string]interface{}{"max_cost_usd": 1}})
+	if code != http.StatusOK {
+		t.Fatalf("override = %d %v", code, resp)
+	}
+	budget := env.get("/sessions/" + DefaultSessionID + "/budget")
+	if budget["exceeded"] != nil || budget["used"].(map[string]interface{})["session"].(map[string]interface{})["cost_usd"] != 0.0 {
+		t.Errorf("budget after override = %v, want a fresh session budget", budget)
+	}
+	if code, resp := env.post("/message", map[string]string{"content": "two"}); code != http.StatusOK {
+		t.Fatalf("POST /message after override = %d %v", code, resp)
+	}
+	stream.waitForOutput("two")
+
+	args := env.recorded("start")[0]["args"].([]interface{})
+	if !slices.Contains(args, "--max-turns") || !slices.Contains(args, "5") {
+		t.Errorf("claude args = %v, want --max-turns 5", args)
+	}
+}
+
+func TestBudgetSurvivesRestart(t *testing.T) {
+	env := newTestEnv(t, "cost", func(c *Config) { c.Budgets.Session.MaxCostUSD = 0.25 })
+	env.restart()
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "one"})
+	stream.waitForState(StateWaiting)
+	stream.waitForBudgetExceeded()
+
+	// Still blocked after a restart
+	env.restart()
+	budget := env.get("/budget")
+	used := budget["used"].(map[string]interface{})["session"].(map[string]interface{})
+	if budget["exceeded"] == nil || used["cost_usd"] != 0.25 || used["active_seconds"] == 0.0 {
+		t.Fatalf("budget after restart = %v, want still exceeded with the usage so far", budget)
+	}
+	if code, resp := env.post("/message", map[string]string{"content": "two"}); code != http.StatusPaymentRequired {
+		t.Fatalf("POST /message after restart = %d %v, want 402", code, resp)
+	}
+
+	// The override, its limits and the fresh start survive the next one
+	if code, resp := env.post("/budget/override", map[string]interface{}{"session": map[string]interface{}{"max_cost_usd": 1}}); code != http.StatusOK {
+		t.Fatalf("override = %d %v", code, resp)
+	}
+	env.restart()
+	budget = env.get("/budget")
+	limits := budget["limits"].(map[string]interface{})["session"].(map[string]interface{})
+	used = budget["used"].(map[string]interface{})["session"].(map[string]interface{})
+	if budget["exceeded"] != nil || limits["max_cost_usd"] != 1.0 || used["cost_usd"] != 0.0 || budget["daily_exempt"] != true {
+		t.Fatalf("budget after override and restart = %v, want the override kept", budget)
+	}
+	stream = env.stream(0)
+	if code, resp := env.post("/message", map[string]string{"content": "two"}); code != http.StatusOK {
+		t.Fatalf("POST /message after override and restart = %d %v", code, resp)
+	}
+	stream.waitForState(StateWaiting)
+}
+
+func TestBudgetInterruptsLongTurn(t *testing.T) {
+	env := newTestEnv(t, "slow", func(c *Config) { c.Budgets.Session.MaxActiveSeconds = 1 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("working")
+	if ev := stream.waitForBudgetExceeded(); ev.Limit != "max_active_seconds" {
+		t.Errorf("budget_exceeded = %+v, want max_active_seconds", ev)
+	}
+	stream.waitFor("interrupted event", func(e SSEEvent) bool {
+		if e.Type == EventTypeOutput && strings.Contains(e.Content, "finished") {
+			t.Error("turn finished despite the active-time budget")
+		}
+		return e.Type == EventTypeInterrupted
+	})
+	stream.waitForState(StateWaiting)
+
+	if code, _ := env.post("/message", map[string]string{"content": "more"}); code != http.StatusPaymentRequired {
+		t.Errorf("POST /message over budget = %d, want 402", code)
+	}
+}
+
+func TestTranscriptHistory(t *testing.T) {
+	env := newTestEnv(t, "tools", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "run the tests"})
+	stream.waitForOutput("Tests pass.")
+	stream.waitForState(StateWaiting)
+	env.post("/message", map[string]string{"content": "thanks"})
+	stream.waitForOutput("echo: thanks")
+	stream.waitForState(StateWaiting)
+
+	page := env.get("/sessions/" + DefaultSessionID + "/messages")
+	messages := page["messages"].([]interface{})
+	var kinds []string
+	for _, m := range messages {
+		kinds = append(kinds, m.(map[string]interface{})["kind"].(string))
+	}
+	want := []string{
+		EntryKindUser, EntryKindText, EntryKindToolUse, EntryKindToolResult, EntryKindToolUse,
+		EntryKindToolResult, EntryKindText, EntryKindUsage, EntryKindUser, EntryKindText, EntryKindUsage,
+	}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("transcript kinds = %v, want %v", kinds, want)
+	}
+	if page["has_more"] != false {
+		t.Errorf("has_more = %v, want false", page["has_more"])
+	}
+	bash, result := messages[2].(map[string]interface{}), messages[3].(map[string]interface{})
+	if bash["tool"] != "Bash" || bash["input"].(map[string]interface{})["command"] != "go test ./..." {
+		t.Errorf("tool_use entry = %v, want Bash with its command", bash)
+	}
+	if result["tool_use_id"] != bash["tool_use_id"] || !strings.HasPrefix(result["text"].(string), "ok") {
+		t.Errorf("tool_result entry = %v, want the Bash output", result)
+	}
+	if failed := messages[5].(map[string]interface{}); failed["is_error"] != true {
+		t.Errorf("failed tool_result = %v, want is_error", failed)
+	}
+
+	// Page backwards from the end
+	page = env.get("/messages?limit=4")
+	latest := page["messages"].([]interface{})
+	if len(latest) != 4 || latest[3].(map[string]interface{})["seq"] != 11.0 || page["has_more"] != true {
+		t.Fatalf("last page = %v, want seq 8-11 with more", page)
+	}
+	page = env.get(fmt.Sprintf("/messages?limit=4&before=%v", page["next_before"]))
+	earlier := page["messages"].([]interface{})
+	if len(earlier) != 4 || earlier[0].(map[string]interface{})["seq"] != 4.0 || page["next_before"] != 4.0 {
+		t.Fatalf("previous page = %v, want seq 4-7", page)
+	}
+	if code, _ := env.do(http.MethodGet, "/messages?limit=0", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("limit=0: status %d, want 400", code)
+	}
+
+	// The transcript is on disk
+	reopened, err := OpenTranscript(transcriptPath(DefaultSessionID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := reopened.Entries(); len(entries) != len(want) || entries[0].Text != "run the tests" {
+		t.Errorf("reopened transcript = %+v, want the same %d entries", entries, len(want))
+	}
+}
+
+func TestToolResultEvents(t *testing.T) {
+	env := newTestEnv(t, "subagent", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "check the tests"})
+	var uses []ToolUseEvent
+	var results []ToolResultEvent
+	var infos, output []string
+	stream.waitFor("end of turn", func(e SSEEvent) bool {
+		switch e.Type {
+		case EventTypeToolUse:
+			var ev ToolUseEvent
+			json.Unmarshal([]byte(e.Content), &ev)
+			uses = append(uses, ev)
+		case EventTypeToolResult:
+			var ev ToolResultEvent
+			json.Unmarshal([]byte(e.Content), &ev)
+			results = append(results, ev)
+		case EventTypeInfo:
+			infos = append(infos, e.Content)
+		case EventTypeOutput:
+			output = append(output, e.Content)
+		}
+		return e.Type == EventTypeState && e.State == string(StateWaiting)
+	})
+
+	if len(uses) != 2 || uses[0].Tool != "Task" || uses[0].ParentToolUseID != "" ||
+		uses[1].Tool != "Bash" || uses[1].ParentToolUseID != uses[0].ID {
+		t.Fatalf("tool_use events = %+v, want Task and the subagent's Bash", uses)
+	}
+	if !slices.Contains(infos, SubagentPrefix+"🔧 Bash: go test ./...") {
+		t.Errorf("info events = %q, want the subagent's Bash marked", infos)
+	}
+	if len(results) != 2 {
+		t.Fatalf("tool_result events = %+v, want 2", results)
+	}
+	bash, task := results[0], results[1]
+	if bash.ToolUseID != uses[1].ID || bash.Tool != "Bash" || !bash.IsError ||
+		bash.Content != "--- FAIL: TestLogin" || bash.ParentToolUseID != uses[0].ID {
+		t.Errorf("Bash result = %+v, want the failed run, linked to its call and Task", bash)
+	}
+	if task.ToolUseID != uses[0].ID || task.Tool != "Task" || task.IsError || task.ParentToolUseID != "" {
+		t.Errorf("Task result = %+v, want the subagent's report", task)
+	}
+	if joined := strings.Join(output, ""); strings.Contains(joined, "Running go test.") || !strings.Contains(joined, "found a failing test") {
+		t.Errorf("output = %q, want Claude's text without the subagent's", joined)
+	}
+
+	// The transcript keeps the subagent's entries, marked with their Task
+	s, _ := sessions.Get(DefaultSessionID)
+	var subagent []string
+	for _, e := range s.transcript().Entries() {
+		if e.ParentToolUseID == uses[0].ID {
+			subagent = append(subagent, e.Kind)
+		}
+	}
+	if want := []string{EntryKindText, EntryKindToolUse, EntryKindToolResult}; !slices.Equal(subagent, want) {
+		t.Errorf("subagent transcript entries = %v, want %v", subagent, want)
+	}
+
+	long := strconv.Quote(strings.Repeat("x", MaxToolResultBytes+10))
+	if text, truncated := toolResultText(json.RawMessage(long)); !truncated || !strings.HasSuffix(text, "(10 bytes truncated)") {
+		t.Errorf("long result = %q… truncated=%v, want cut with a note", text[:20], truncated)
+	}
+}
+
+func TestExport(t *testing.T) {
+	env := newTestEnv(t, "tools", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "run the <tests>"})
+	stream.waitForOutput("Tests pass.")
+	stream.waitForState(StateWaiting)
+
+	download := func(format string) (string, http.Header) {
+		t.Helper()
+		resp, err := http.Get(env.srv.URL + "/sessions/" + DefaultSessionID + "/export?format=" + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("export %s: status %d: %s", format, resp.StatusCode, body)
+		}
+		return string(body), resp.Header
+	}
+
+	md, header := download("md")
+	if want := `attachment; filename="doze-default.md"`; header.Get("Content-Disposition") != want {
+		t.Errorf("Content-Disposition = %q, want %q", header.Get("Content-Disposition"), want)
+	}
+	for _, want := range []string{"## User\n\nrun the <tests>", "**🔧 Bash: go test ./...**", "Tool error:", "Tests pass.", " out tokens · $"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("markdown export missing %q:\n%s", want, md)
+		}
+	}
+
+	html, _ := download("html")
+	if !strings.Contains(html, "run the &lt;tests&gt;") || !strings.Contains(html, "🔧 Bash: go test ./...") {
+		t.Errorf("html export = %s, want the escaped message and the tool call", html)
+	}
+
+	// JSONL round-trips
+	jsonl, _ := download("jsonl")
+	exported, entries, err := ReadExport(strings.NewReader(jsonl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.Session.ID != DefaultSessionID || exported.Session.Usage == nil || exported.Session.Usage.Turns != 1 {
+		t.Errorf("export header = %+v, want the session with its usage", exported)
+	}
+	s, _ := sessions.Get(DefaultSessionID)
+	got, _ := json.Marshal(entries)
+	want, _ := json.Marshal(s.transcript().Entries())
+	if !bytes.Equal(got, want) {
+		t.Errorf("re-imported entries = %s, want %s", got, want)
+	}
+
+	if code, _ := env.do(http.MethodGet, "/export?format=pdf", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("format=pdf: status %d, want 400", code)
+	}
+}
+
+func TestAdoptClaudeSession(t *testing.T) {
+	env := newTestEnv(t, "echo", nil)
+	other := t.TempDir()
+
+	// Sessions started with Claude Code outside Doze
+	writeClaudeTranscript := func(cwd, id string, lines ...map[string]interface{}) {
+		t.Helper()
+		dir := filepath.Join(os.Getenv("CLAUDE_CONFIG_DIR"), "projects", nonAlphanumeric.ReplaceAllString(cwd, "-"))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		for i, line := range lines {
+			line["cwd"] = cwd
+			line["sessionId"] = id
+			line["timestamp"] = time.Date(2026, 2, 14, 9, i, 0, 0, time.UTC)
+			b, _ := json.Marshal(line)
+			data = append(append(data, b...), '\n')
+		}
+		if err := os.WriteFile(filepath.Join(dir, id+".jsonl"), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := func(role string, content interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": role, "message": map[string]interface{}{"role": role, "content": content}}
+	}
+	meta := message("user", "Caveat: local command output follows")
+	meta["isMeta"] = true
+	writeClaudeTranscript(cfg.Repo.Path, "laptop-1",
+		map[string]interface{}{"type": "summary", "summary": "Login fix"},
+		meta,
+		message("user", "Fix the login bug"),
+		message("assistant", []map[string]interface{}{{"type": "tool_use", "id": "toolu_1", "name": "Read", "input": map[string]string{"file_path": "login.go"}}}),
+		message("user", []map[string]interface{}{{"type": "tool_result", "tool_use_id": "toolu_1", "content": "package main"}}),
+		message("assistant", []map[string]interface{}{{"type": "text", "text": "Fixed."}}),
+	)
+	writeClaudeTranscript(other, "laptop-2", message("user", "Unrelated"))
+
+	_, resp := env.do(http.MethodGet, "/claude-sessions?repo="+cfg.Repo.Path, nil, nil)
+	list := resp["sessions"].([]interface{})
+	if len(list) != 1 {
+		t.Fatalf("sessions in repo = %v, want laptop-1 only", list)
+	}
+	found := list[0].(map[string]interface{})
+	if found["id"] != "laptop-1" || found["first_prompt"] != "Fix the login bug" || found["messages"] != 4.0 ||
+		found["repo_path"] != cfg.Repo.Path || !strings.HasPrefix(found["last_activity"].(string), "2026-02-14T09:05:00") {
+		t.Errorf("laptop-1 = %v, want its first prompt, 4 messages and last activity", found)
+	}
+	if _, resp := env.do(http.MethodGet, "/claude-sessions", nil, nil); len(resp["sessions"].([]interface{})) != 2 {
+		t.Errorf("all sessions = %v, want both", resp["sessions"])
+	}
+
+	// Summaries are cached until the transcript changes
+	writeClaudeTranscript(other, "laptop-2", message("user", "Unrelated"), message("assistant", "Sure."))
+	_, resp = env.do(http.MethodGet, "/claude-sessions?repo="+other, nil, nil)
+	if list := resp["sessions"].([]interface{}); len(list) != 1 || list[0].(map[string]interface{})["messages"] != 2.0 {
+		t.Errorf("sessions in other repo = %v, want laptop-2 with 2 messages", list)
+	}
+	if code, _ := env.post("/claude-sessions/laptop-2/adopt", map[string]string{"repo_path": cfg.Repo.Path}); code != http.StatusNotFound {
+		t.Errorf("adopt from another repo: status %d, want 404", code)
+	}
+
+	// Adopting makes a stopped session that resumes the conversation
+	if code, _ := env.post("/claude-sessions/missing/adopt", nil); code != http.StatusNotFound {
+		t.Errorf("adopt missing: status %d, want 404", code)
+	}
+	code, adopted := env.post("/claude-sessions/laptop-1/adopt", nil)
+	if code != http.StatusCreated || adopted["state"] != string(StateStopped) || adopted["claude_session_id"] != "laptop-1" {
+		t.Fatalf("adopt = %d %v, want 201 stopped with the Claude session", code, adopted)
+	}
+	id := adopted["id"].(string)
+	if code, resp := env.post("/claude-sessions/laptop-1/adopt", nil); code != http.StatusConflict || resp["session"] != id {
+		t.Errorf("adopt twice = %d %v, want 409 naming %s", code, resp, id)
+	}
+	_, resp = env.do(http.MethodGet, "/claude-sessions?repo="+cfg.Repo.Path, nil, nil)
+	if owner := resp["sessions"].([]interface{})[0].(map[string]interface{})["doze_session"]; owner != id {
+		t.Errorf("doze_session = %v, want %s", owner, id)
+	}
+
+	code, resp = env.post("/sessions/"+id+"/message", map[string]string{"content": "and the logout bug"})
+	if code != http.StatusOK || resp["resumed"] != true {
+		t.Fatalf("POST message = %d %v, want 200 resumed", code, resp)
+	}
+	deadline := time.Now().Add(testTimeout)
+	for env.get("/sessions/" + id)["state"] != string(StateWaiting) {
+		if time.Now().After(deadline) {
+			t.Fatal("adopted session did not reach waiting")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if starts := env.recorded("start"); len(starts) != 1 || starts[0]["resume"] != "laptop-1" {
+		t.Errorf("starts = %v, want one --resume laptop-1", starts)
+	}
+}
+
+func TestInterruptKeepsSession(t *testing.T) {
+	env := newTestEnv(t, "slow", nil)
+	stream := env.stream(0)
+
+	if code, resp := env.post("/interrupt", nil); code != http.StatusConflict {
+		t.Fatalf("interrupt with no session = %d %v, want 409", code, resp)
+	}
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("working")
+
+	if code, resp := env.post("/interrupt", nil); code != http.StatusOK {
+		t.Fatalf("interrupt while active = %d %v, want 200", code, resp)
+	}
+	stream.waitFor("interrupted event", func(e SSEEvent) bool {
+		if e.Type == EventTypeOutput && strings.Contains(e.Content, "finished") {
+			t.Error("turn finished despite the interrupt")
+		}
+		return e.Type == EventTypeInterrupted
+	})
+	stream.waitForState(StateWaiting)
+	if interrupts := env.recorded("interrupt"); len(interrupts) != 1 {
+		t.Errorf("fakeclaude saw %d interrupts, want 1", len(interrupts))
+	}
+
+	code, resp := env.post("/sessions/default/interrupt", nil)
+	if code != http.StatusConflict || resp["state"] != string(StateWaiting) {
+		t.Fatalf("interrupt while waiting = %d %v, want 409 waiting", code, resp)
+	}
+
+	// The conversation continues on the same process
+	env.post("/message", map[string]string{"content": "again"})
+	stream.waitForOutput("echo: again")
+	stream.waitForState(StateWaiting)
+	if starts := env.recorded("start"); len(starts) != 1 {
+		t.Errorf("fakeclaude started %d times, want 1", len(starts))
+	}
+	if status := env.get("/status"); status["claude_session_id"] != "fake-slow" {
+		t.Errorf("claude_session_id = %v, want fake-slow", status["claude_session_id"])
+	}
+}
+
+func TestInterruptFallsBackToStop(t *testing.T) {
+	env := newTestEnv(t, "deaf", func(c *Config) { c.Timeouts.InterruptGrace = 1 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("working")
+
+	if code, resp := env.post("/interrupt", nil); code != http.StatusOK {
+		t.Fatalf("interrupt = %d %v, want 200", code, resp)
+	}
+	stream.waitFor("interrupted event", func(e SSEEvent) bool { return e.Type == EventTypeInterrupted })
+	stream.waitForState(StateStopped)
+	if signals := env.recorded("signal"); len(signals) == 0 {
+		t.Error("fakeclaude was not signalled after ignoring the interrupt")
+	}
+
+	// The next message resumes the same conversation
+	code, resp := env.post("/message", map[string]string{"content": "again"})
+	if code != http.StatusOK || resp["resumed"] != true {
+		t.Fatalf("POST /message = %d %v, want 200 resumed", code, resp)
+	}
+	stream.waitForOutput("working")
+	if starts := env.recorded("start"); len(starts) != 2 || starts[1]["resume"] != "fake-deaf" {
+		t.Errorf("starts = %v, want a second start resuming fake-deaf", starts)
+	}
+}
+
+func TestInterruptGraceIsPerInterrupt(t *testing.T) {
+	env := newTestEnv(t, "sluggish", func(c *Config) { c.Timeouts.InterruptGrace = 3 })
+	stream := env.stream(0)
+
+	// Each interrupt takes 2s to end the turn. The second one is still
+	// pending when the first one's grace would have run out.
+	for _, content := range []string{"hi", "again"} {
+		env.post("/message", map[string]string{"content": content})
+		stream.waitForOutput("working")
+		if code, resp := env.post("/interrupt", nil); code != http.StatusOK {
+			t.Fatalf("interrupt = %d %v, want 200", code, resp)
+		}
+		stream.waitFor("interrupted event", func(e SSEEvent) bool {
+			if e.Type == EventTypeState && e.State == string(StateStopped) {
+				t.Fatal("session stopped by an earlier interrupt's grace timer")
+			}
+			return e.Type == EventTypeInterrupted
+		})
+		stream.waitForState(StateWaiting)
+	}
+	if signals := env.recorded("signal"); len(signals) != 0 {
+		t.Errorf("fakeclaude was signalled %v, want interrupts only", signals)
+	}
+}
+
+func TestInterruptEscalatesToKill(t *testing.T) {
+	env := newTestEnv(t, "unstoppable", func(c *Config) {
+		c.Timeouts.InterruptGrace = 1
+		c.Timeouts.HibernateGrace = 1
+	})
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("working")
+
+	if code, resp := env.post("/interrupt", nil); code != http.StatusOK {
+		t.Fatalf("interrupt = %d %v, want 200", code, resp)
+	}
+	stream.waitFor("interrupted event", func(e SSEEvent) bool { return e.Type == EventTypeInterrupted })
+	stream.waitForState(StateStopped)
+	if signals := env.recorded("signal"); len(signals) == 0 {
+		t.Error("fakeclaude was not signalled before being killed")
+	}
+}
+
+func TestMessagesQueueDuringTurn(t *testing.T) {
+	env := newTestEnv(t, "slow", nil)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("working")
+
+	// Messages sent mid-turn wait their turn
+	code, second := env.post("/message", map[string]string{"content": "second"})
+	if code != http.StatusOK || second["queued"] != true || second["position"] != 1.0 {
+		t.Fatalf("second message = %d %v, want 200 at position 1", code, second)
+	}
+	retry := http.Header{"Idempotency-Key": {"third-1"}}
+	_, third := env.do(http.MethodPost, "/message", map[string]string{"content": "third"}, retry)
+	if third["position"] != 2.0 {
+		t.Fatalf("third message = %v, want position 2", third)
+	}
+	_, again := env.do(http.MethodPost, "/message", map[string]string{"content": "third"}, retry)
+	if again["duplicate"] != true || again["id"] != third["id"] || again["position"] != 2.0 {
+		t.Fatalf("retried message = %v, want duplicate of %v", again, third["id"])
+	}
+	if queue := env.get("/queue")["messages"].([]interface{}); len(queue) != 2 {
+		t.Fatalf("queue = %v, want 2 messages", queue)
+	}
+
+	// Cancel the third message before Claude sees it
+	path := "/queue/" + third["id"].(string)
+	if code, resp := env.do(http.MethodDelete, path, nil, nil); code != http.StatusOK {
+		t.Fatalf("DELETE %s = %d %v, want 200", path, code, resp)
+	}
+	if code, _ := env.do(http.MethodDelete, path, nil, nil); code != http.StatusNotFound {
+		t.Errorf("second DELETE %s = %d, want 404", path, code)
+	}
+
+	// The second message is delivered once the first turn ends
+	stream.waitForOutput("finished")
+	stream.waitForOutput("echo: second")
+	stream.waitForState(StateWaiting)
+
+	var contents []interface{}
+	for _, m := range env.recorded("message") {
+		contents = append(contents, m["content"])
+	}
+	if len(contents) != 2 || contents[0] != "hi" || contents[1] != "second" {
+		t.Errorf("fakeclaude received %v, want [hi second]", contents)
+	}
+	if queue := env.get("/sessions/default/queue")["messages"].([]interface{}); len(queue) != 0 {
+		t.Errorf("queue = %v, want empty", queue)
+	}
+}
+
+func TestFailedDeliveryRequeues(t *testing.T) {
+	env := newTestEnv(t, "echo", nil)
+	stream := env.stream(0)
+
+	// Claude can't be started: the message stays queued and keeps its key
+	s, _ := sessions.Get(DefaultSessionID)
+	s.mu.Lock()
+	working := s.runner
+	s.runner = NewLocalRunner(filepath.Join(t.TempDir(), "missing-claude"), nil)
+	s.mu.Unlock()
+
+	key := http.Header{"Idempotency-Key": {"retry-1"}}
+	code, resp := env.do(http.MethodPost, "/message", map[string]string{"content": "hello"}, key)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("POST /message = %d %v, want 500", code, resp)
+	}
+	queue := env.get("/queue")["messages"].([]interface{})
+	if len(queue) != 1 || queue[0].(map[string]interface{})["content"] != "hello" {
+		t.Fatalf("queue = %v, want the failed message back at its head", queue)
+	}
+	if state := env.get("/status")["state"]; state != string(StateNone) {
+		t.Errorf("state = %v, want %s", state, StateNone)
+	}
+
+	// A retry with the same key delivers it, once
+	s.mu.Lock()
+	s.runner = working
+	s.mu.Unlock()
+	code, resp = env.do(http.MethodPost, "/message", map[string]string{"content": "hello"}, key)
+	if code != http.StatusOK || resp["duplicate"] != true || resp["position"] != 0.0 {
+		t.Fatalf("retried POST /message = %d %v, want 200 duplicate, delivered", code, resp)
+	}
+	stream.waitForOutput("echo: hello")
+	stream.waitForState(StateWaiting)
+	if queue := env.get("/queue")["messages"].([]interface{}); len(queue) != 0 {
+		t.Errorf("queue = %v, want it empty", queue)
+	}
+	if messages := env.recorded("message"); len(messages) != 1 {
+		t.Errorf("Claude got %d messages, want 1", len(messages))
+	}
+}
+
+func TestQueuedMessageResumesStoppingSession(t *testing.T) {
+	env := newTestEnv(t, "stubborn", func(c *Config) { c.Timeouts.HibernateGrace = 1 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("echo: hi")
+	stream.waitForState(StateWaiting)
+
+	env.post("/sessions/default/stop", nil)
+	stream.waitForState(StateShuttingDown)
+
+	code, resp := env.post("/message", map[string]string{"content": "again"})
+	if code != http.StatusOK || resp["position"] != 1.0 {
+		t.Fatalf("message while shutting down = %d %v, want 200 queued", code, resp)
+	}
+
+	stream.waitForState(StateStopped)
+	stream.waitForOutput("echo: again")
+	if starts := env.recorded("start"); len(starts) != 2 || starts[1]["resume"] != "fake-stubborn" {
+		t.Errorf("starts = %v, want a second start resuming fake-stubborn", starts)
+	}
+}
+
+// fastRecovery retries crashed sessions almost immediately.
+func fastRecovery(c *Config) {
+	c.Recovery.BackoffMS = 50
+	c.Recovery.MaxBackoffMS = 100
+}
+
+func TestCrashRecovery(t *testing.T) {
+	env := newTestEnv(t, "crash_once", fastRecovery)
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForOutput("about to crash")
+	stream.waitForState(StateCrashed)
+	stream.waitFor("error event", func(e SSEEvent) bool {
+		return e.Type == EventTypeError && strings.Contains(e.Content, "attempt 1 of 3")
+	})
+
+	// The conversation is resumed and waits for the next message
+	stream.waitForState(StateWaiting)
+	if status := env.get("/status"); status["crashes"] != 1.0 || status["resume_attempts"] != 1.0 {
+		t.Errorf("status = %v, want 1 crash and 1 resume attempt", status)
+	}
+
+	env.post("/message", map[string]string{"content": "again"})
+	stream.waitForOutput("echo: again")
+	stream.waitForState(StateWaiting)
+	if starts := env.recorded("start"); len(starts) != 2 || starts[1]["resume"] != "fake-crash-once" {
+		t.Fatalf("starts = %v, want a second start resuming fake-crash-once", starts)
+	}
+	if status := env.get("/status"); status["crashes"] != 1.0 || status["resume_attempts"] != 0.0 {
+		t.Errorf("status = %v, want resume attempts reset after a turn", status)
+	}
+}
+
+func TestCrashRecoveryGivesUp(t *testing.T) {
+	env := newTestEnv(t, "crash", func(c *Config) {
+		fastRecovery(c)
+		c.Recovery.MaxRetries = 1
+	})
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForState(StateCrashed)
+	stream.waitForState(StateWaiting)
+
+	// The resumed process crashes on its first turn too; no retries are left
+	env.post("/message", map[string]string{"content": "again"})
+	stream.waitForState(StateNone)
+	stream.waitFor("error event", func(e SSEEvent) bool {
+		return e.Type == EventTypeError && strings.Contains(e.Content, "gave up after 1 resume attempts")
+	})
+	if status := env.get("/status"); status["crashes"] != 2.0 {
+		t.Errorf("crashes = %v, want 2", status["crashes"])
+	}
+}
+
+func TestMessageResumesCrashedSession(t *testing.T) {
+	env := newTestEnv(t, "crash_once", func(c *Config) { c.Recovery.BackoffMS = 60000 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "hi"})
+	stream.waitForState(StateCrashed)
+
+	// No need to wait out the backoff
+	code, resp := env.post("/message", map[string]string{"content": "again"})
+	if code != http.StatusOK || resp["resumed"] != true {
+		t.Fatalf("POST /message = %d %v, want 200 resumed", code, resp)
+	}
+	stream.waitForOutput("echo: again")
+	stream.waitForState(StateWaiting)
+}
+
+func TestOutputDeltas(t *testing.T) {
+	env := newTestEnv(t, "streaming", func(c *Config) { c.Server.DeltaIntervalMS = 50 })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "why does login fail?"})
+	var deltas []SSEEvent
+	output := stream.waitFor("output", func(e SSEEvent) bool {
+		if e.Type == EventTypeOutputDelta {
+			deltas = append(deltas, e)
+		}
+		return e.Type == EventTypeOutput
+	})
+	stream.waitForState(StateWaiting)
+
+	if args := fmt.Sprint(env.recorded("start")[0]["args"]); !strings.Contains(args, "--include-partial-messages") {
+		t.Errorf("start args = %s, want --include-partial-messages", args)
+	}
+	if output.MessageID == "" || !strings.Contains(output.Content, "wrong salt") {
+		t.Fatalf("output = %+v, want the complete message with its ID", output)
+	}
+
+	// Deltas are coalesced (one word each without), belong to the message
+	// and are superseded by its output event
+	words := len(strings.Fields(output.Content))
+	if len(deltas) == 0 || len(deltas) >= words {
+		t.Fatalf("got %d output_delta events for %d words, want them coalesced", len(deltas), words)
+	}
+	var streamed strings.Builder
+	for _, d := range deltas {
+		if d.MessageID != output.MessageID {
+			t.Errorf("output_delta message_id = %q, want %q", d.MessageID, output.MessageID)
+		}
+		streamed.WriteString(d.Content)
+	}
+	if !strings.HasPrefix(strings.TrimSuffix(output.Content, "\n"), streamed.String()) {
+		t.Errorf("streamed text %q isn't a prefix of the output %q", streamed.String(), output.Content)
+	}
+}
+
+func TestOutputDeltasDisabled(t *testing.T) {
+	env := newTestEnv(t, "streaming", func(c *Config) { c.Runner.PartialMessages = false })
+	stream := env.stream(0)
+
+	env.post("/message", map[string]string{"content": "why does login fail?"})
+	stream.waitFor("output", func(e SSEEvent) bool {
+		if e.Type == EventTypeOutputDelta {
+			t.Errorf("got output_delta %q with partial messages off", e.Content)
+		}
+		return e.Type == EventTypeOutput
+	})
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	ExportFormatMarkdown = "md"
+	ExportFormatJSONL    = "jsonl"
+	ExportFormatHTML     = "html"
+
+	ExportFormatName    = "doze-transcript" // ExportHeader.Format
+	ExportFormatVersion = 1                 // ExportHeader.Version
+)
+
+// exportContentTypes maps each export format to its Content-Type.
+var exportContentTypes = map[string]string{
+	ExportFormatMarkdown: "text/markdown; charset=utf-8",
+	ExportFormatJSONL:    "application/x-ndjson",
+	ExportFormatHTML:     "text/html; charset=utf-8",
+}
+
+// ExportHeader is the first line of a JSONL export. The rest of the file is
+// the session's TranscriptEntry values, one per line, exactly as recorded.
+type ExportHeader struct {
+	Format     string        `json:"format"`  // Always ExportFormatName
+	Version    int           `json:"version"` // Bumped on incompatible changes
+	ExportedAt time.Time     `json:"exported_at"`
+	Session    SessionRecord `json:"session"`
+}
+
+// writeExportJSONL writes a loss-less export that ReadExport can load back.
+func writeExportJSONL(w io.Writer, header ExportHeader, entries []TranscriptEntry) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadExport parses a JSONL export written by GET /sessions/{id}/export.
+func ReadExport(r io.Reader) (ExportHeader, []TranscriptEntry, error) {
+	var header ExportHeader
+	var entries []TranscriptEntry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, ScannerInitialBuffer), ScannerMaxBuffer)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if header.Format == "" {
+			if err := json.Unmarshal(line, &header); err != nil {
+				return header, nil, fmt.Errorf("invalid export header: %w", err)
+			}
+			if header.Format != ExportFormatName {
+				return header, nil, fmt.Errorf("not a doze export (format %q)", header.Format)
+			}
+			if header.Version > ExportFormatVersion {
+				return header, nil, fmt.Errorf("unsupported export version %d", header.Version)
+			}
+			continue
+		}
+		var entry TranscriptEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return header, nil, fmt.Errorf("line %d: invalid entry: %w", n, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, err
+	}
+	if header.Format == "" {
+		return header, nil, errors.New("empty export")
+	}
+	return header, entries, nil
+}
+
+// formatTurnUsage renders a turn's usage on one line.
+func formatTurnUsage(u *TurnUsage) string {
+	return fmt.Sprintf("%d in / %d out tokens · $%.4f · %.1fs",
+		u.InputTokens, u.OutputTokens, u.CostUSD, float64(u.DurationMS)/1000)
+}
+
+// formatFileSummary renders a changed file like `git status --short`, with
+// its line counts.
+func formatFileSummary(f FileSummary) string {
+	return fmt.Sprintf("%s %s (+%d −%d)", f.Status, f.Path, f.Added, f.Removed)
+}
+
+// fence returns a Markdown code fence longer than any backtick run in text.
+func fence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// subagentPrefix marks the entries of a subagent (Task).
+func subagentPrefix(e TranscriptEntry) string {
+	if e.ParentToolUseID != "" {
+		return SubagentPrefix
+	}
+	return ""
+}
+
+// writeExportMarkdown renders the conversation as Markdown.
+func writeExportMarkdown(w io.Writer, header ExportHeader, entries []TranscriptEntry) error {
+	var b strings.Builder
+	rec := header.Session
+	fmt.Fprintf(&b, "# Doze session %s\n\n", rec.ID)
+	if rec.RepoPath != "" {
+		fmt.Fprintf(&b, "- Repo: `%s`", rec.RepoPath)
+		if rec.Branch != "" {
+			fmt.Fprintf(&b, " (%s)", rec.Branch)
+		}
+		b.WriteString("\n")
+	}
+	if rec.ClaudeSessionID != "" {
+		fmt.Fprintf(&b, "- Claude session: `%s`\n", rec.ClaudeSessionID)
+	}
+	fmt.Fprintf(&b, "- Created: %s\n", rec.CreatedAt.Format(time.RFC3339))
+	if rec.Usage != nil {
+		fmt.Fprintf(&b, "- Usage: %d turns · %d in / %d out tokens · $%.4f\n",
+			rec.Usage.Turns, rec.Usage.InputTokens, rec.Usage.OutputTokens, rec.Usage.CostUSD)
+	}
+	fmt.Fprintf(&b, "- Exported: %s\n", header.ExportedAt.Format(time.RFC3339))
+
+	speaker := ""
+	for _, e := range entries {
+		// A heading each time the speaker changes
+		who := "Claude"
+		if e.Kind == EntryKindUser {
+			who = "User"
+		}
+		if who != speaker || e.Kind == EntryKindUser {
+			fmt.Fprintf(&b, "\n## %s\n\n", who)
+			speaker = who
+		}
+
+		switch e.Kind {
+		case EntryKindUser, EntryKindText:
+			fmt.Fprintf(&b, "%s%s\n\n", subagentPrefix(e), e.Text)
+		case EntryKindToolUse:
+			fmt.Fprintf(&b, "**%s%s**\n\n", subagentPrefix(e), formatToolUse(e.Tool, e.Input))
+		case EntryKindToolResult:
+			if e.IsError {
+				b.WriteString("Tool error:\n\n")
+			}
+			f := fence(e.Text)
+			fmt.Fprintf(&b, "%s\n%s\n%s\n\n", f, e.Text, f)
+		case EntryKindError:
+			fmt.Fprintf(&b, "> ⚠️ %s\n\n", strings.ReplaceAll(e.Text, "\n", "\n> "))
+		case EntryKindFileChanges:
+			b.WriteString("Changed files:\n\n")
+			for _, f := range e.Files {
+				fmt.Fprintf(&b, "- `%s`\n", formatFileSummary(f))
+			}
+			b.WriteString("\n")
+		case EntryKindUsage:
+			if e.Usage != nil {
+				fmt.Fprintf(&b, "*%s*\n\n", formatTurnUsage(e.Usage))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// exportHTML renders the conversation as a standalone page.
+var exportHTML = template.Must(template.New("export").Funcs(template.FuncMap{
+	"toolUse":   formatToolUse,
+	"subagent":  subagentPrefix,
+	"turnUsage": formatTurnUsage,
+	"file":      formatFileSummary,
+	"time":      func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Doze session {{.Header.Session.ID}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 52rem; margin: 2rem auto; padding: 0 1rem; line-height: 1.5; }
+pre { background: #f4f4f4; padding: .75rem; overflow-x: auto; white-space: pre-wrap; }
+.user { background: #eef4ff; padding: .5rem 1rem; border-radius: .5rem; }
+.tool { font-weight: 600; }
+.error { color: #b00020; }
+.usage, .meta { color: #666; font-size: .9em; }
+</style>
+</head>
+<body>
+<h1>Doze session {{.Header.Session.ID}}</h1>
+<ul class="meta">
+{{- with .Header.Session}}
+{{- if .RepoPath}}<li>Repo: <code>{{.RepoPath}}</code>{{if .Branch}} ({{.Branch}}){{end}}</li>{{end}}
+{{- if .ClaudeSessionID}}<li>Claude session: <code>{{.ClaudeSessionID}}</code></li>{{end}}
+<li>Created: {{time .CreatedAt}}</li>
+{{- with .Usage}}<li>Usage: {{.Turns}} turns · {{.InputTokens}} in / {{.OutputTokens}} out tokens · ${{printf "%.4f" .CostUSD}}</li>{{end}}
+{{- end}}
+<li>Exported: {{time .Header.ExportedAt}}</li>
+</ul>
+{{range .Entries}}
+{{- if eq .Kind "user"}}<div class="user"><pre>{{.Text}}</pre></div>
+{{else if eq .Kind "text"}}<pre>{{subagent .}}{{.Text}}</pre>
+{{else if eq .Kind "tool_use"}}<p class="tool">{{subagent .}}{{toolUse .Tool .Input}}</p>
+{{else if eq .Kind "tool_result"}}<pre{{if .IsError}} class="error"{{end}}>{{.Text}}</pre>
+{{else if eq .Kind "error"}}<p class="error">⚠️ {{.Text}}</p>
+{{else if eq .Kind "file_changes"}}<ul>{{range .Files}}<li><code>{{file .}}</code></li>{{end}}</ul>
+{{else if eq .Kind "usage"}}{{with .Usage}}<p class="usage">{{turnUsage .}}</p>{{end}}
+{{end}}
+{{- end}}
+</body>
+</html>
+`))
+
+// handleExport downloads a session's whole conversation.
+//
+// GET /export?format=md|jsonl|html
+// GET /sessions/{id}/export?format=md|jsonl|html
+//
+// format defaults to md. Markdown and HTML show tool calls as in the output
+// stream, plus file changes and per-turn usage. JSONL is loss-less: a header
+// line with the session's metadata, then every transcript entry as returned
+// by GET /sessions/{id}/messages, so it can be re-imported with ReadExport.
+//
+// The response is sent as an attachment named doze-{id}.{format}.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportFormatMarkdown
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "format must be md, jsonl or html")
+		return
+	}
+
+	s.mu.RLock()
+	header := ExportHeader{
+		Format:     ExportFormatName,
+		Version:    ExportFormatVersion,
+		ExportedAt: time.Now(),
+		Session:    s.record(),
+	}
+	s.mu.RUnlock()
+	entries := s.transcript().Entries()
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case ExportFormatMarkdown:
+		err = writeExportMarkdown(&buf, header, entries)
+	case ExportFormatJSONL:
+		err = writeExportJSONL(&buf, header, entries)
+	case ExportFormatHTML:
+		err = exportHTML.Execute(&buf, map[string]interface{}{"Header": header, "Entries": entries})
+	}
+	if err != nil {
+		slog.Error("failed to render export", "id", s.ID, "format", format, "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to render export")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="doze-%s.%s"`, s.ID, format))
+	w.Write(buf.Bytes())
+}
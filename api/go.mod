@@ -1,3 +1,9 @@
 module github.com/seamus/doze
 
 go 1.25.5
+
+require (
+	github.com/coder/websocket v1.8.15
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,665 @@
+// Command fakeclaude is a scriptable stand-in for the Claude CLI, used by the
+// end-to-end tests (and handy for local development without an account).
+//
+// It speaks the same stream-json protocol as
+// `claude --print --input-format=stream-json --output-format=stream-json`:
+// one JSON user message per stdin line in, one JSON message per stdout line
+// out. What it replies is driven by a scenario file:
+//
+//	fakeclaude --scenario testdata/scenarios/basic.json [--record log.jsonl] [--resume ID]
+//
+// Every other flag (--print, --verbose, ...) is accepted and ignored. Without
+// a scenario, every message gets an "echo: <message>" reply.
+//
+// With --mcp-config and --permission-prompt-tool, each tool_use step asks the
+// named MCP server for permission (a JSON-RPC tools/call over HTTP) and
+// replies with a tool_result, the way Claude does when it is not running
+// with --dangerously-skip-permissions.
+//
+// If CLAUDE_CONFIG_DIR is set, the conversation is also written to
+// $CLAUDE_CONFIG_DIR/projects/<encoded cwd>/<session ID>.jsonl like Claude
+// does, and --resume fails when that file is missing.
+//
+// Usage with doze:
+//
+//	go build -o /tmp/fakeclaude ./internal/fakeclaude
+//	DOZE_CLAUDE_PATH=/tmp/fakeclaude go run .
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultSessionID is reported when neither --resume nor the scenario sets one.
+const DefaultSessionID = "fake-session"
+
+// Scenario scripts the fake's behavior.
+type Scenario struct {
+	SessionID        string   `json:"session_id"`         // Session ID for new conversations
+	Turns            [][]Step `json:"turns"`              // Replies to successive user messages (then echo)
+	ResumeTurns      [][]Step `json:"resume_turns"`       // Replaces Turns after --resume, if set
+	ResumeError      string   `json:"resume_error"`       // If set, --resume fails with this message
+	IgnoreStop       bool     `json:"ignore_stop"`        // Ignore SIGINT/SIGTERM (forces a SIGKILL)
+	IgnoreInterrupt  bool     `json:"ignore_interrupt"`   // Acknowledge interrupt requests but keep going
+	InterruptDelayMS int      `json:"interrupt_delay_ms"` // Delay before an interrupt ends the turn
+	StopDelayMS      int      `json:"stop_delay_ms"`      // Delay before exiting on SIGINT/SIGTERM
+}
+
+// Step is a single scripted action within a turn.
+//
+// The Type field determines which other fields are used:
+//   - "system": Emit a system init message
+//   - "text": Emit an assistant text block (Text; "{{input}}" is replaced by the user message).
+//     With --include-partial-messages it is first streamed word by word as
+//     stream_event lines, MS milliseconds apart
+//   - "tool_use": Emit an assistant tool_use block (Name, Input)
+//   - "tool_result": Emit the result of the last tool_use still open (Text, IsError)
+//   - "error": Emit an error message (Text)
+//   - "result": Emit a result message, ending the turn (Text, CostUSD, InputTokens, OutputTokens, MS)
+//   - "stderr": Write Text to stderr
+//   - "raw": Write Text to stdout verbatim
+//   - "sleep": Pause for MS milliseconds (cut short by an interrupt)
+//   - "crash": Exit immediately with ExitCode (default 1)
+//
+// Text, tool_use and tool_result steps with Subagent set come from the
+// subagent of the last open Task tool_use (parent_tool_use_id).
+type Step struct {
+	Type     string                 `json:"type"`
+	Text     string                 `json:"text,omitempty"`
+	Name     string                 `json:"name,omitempty"`
+	Input    map[string]interface{} `json:"input,omitempty"`
+	MS       int                    `json:"ms,omitempty"`
+	ExitCode int                    `json:"exit_code,omitempty"`
+	CostUSD  float64                `json:"cost_usd,omitempty"`
+
+	InputTokens  int64 `json:"input_tokens,omitempty"`
+	OutputTokens int64 `json:"output_tokens,omitempty"`
+	IsError      bool  `json:"is_error,omitempty"`
+	Subagent     bool  `json:"subagent,omitempty"`
+}
+
+// fake holds the state of a running fake agent.
+type fake struct {
+	scenario  Scenario
+	sessionID string
+	turn      int // Index of the next scripted turn
+
+	outMu  sync.Mutex // Serializes stdout lines
+	record *os.File   // Invocation log (nil if not recording)
+	recMu  sync.Mutex // Serializes record lines
+	toolID int        // Counter for tool_use IDs
+	msgID  int        // Counter for assistant message IDs
+	open   []openTool // tool_use blocks without a result yet, oldest first
+	parent string     // parent_tool_use_id of the step being emitted
+	cost   float64    // Running total_cost_usd, like Claude reports it
+
+	transcript *os.File   // Claude-style session transcript (nil without CLAUDE_CONFIG_DIR)
+	cwd        string     // Working directory, recorded in transcript lines
+	transMu    sync.Mutex // Serializes transcript lines
+
+	mcpServers map[string]mcpServer // From --mcp-config
+	promptTool string               // --permission-prompt-tool (mcp__<server>__<tool>)
+	partial    bool                 // --include-partial-messages
+}
+
+// mcpServer is an HTTP MCP server entry from --mcp-config.
+type mcpServer struct {
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+func main() {
+	var scenarioPath, recordPath, resumeID, mcpConfig, promptTool, systemPrompt string
+	var partial bool
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		next := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch args[i] {
+		case "--scenario":
+			scenarioPath = next()
+		case "--record":
+			recordPath = next()
+		case "--resume":
+			resumeID = next()
+		case "--mcp-config":
+			mcpConfig = next()
+		case "--permission-prompt-tool":
+			promptTool = next()
+		case "--append-system-prompt":
+			systemPrompt = next()
+		case "--include-partial-messages":
+			partial = true
+		}
+	}
+
+	f := &fake{sessionID: DefaultSessionID}
+	if scenarioPath != "" {
+		data, err := os.ReadFile(scenarioPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fakeclaude: %v\n", err)
+			os.Exit(2)
+		}
+		if err := json.Unmarshal(data, &f.scenario); err != nil {
+			fmt.Fprintf(os.Stderr, "fakeclaude: invalid scenario %s: %v\n", scenarioPath, err)
+			os.Exit(2)
+		}
+	}
+	if f.scenario.SessionID != "" {
+		f.sessionID = f.scenario.SessionID
+	}
+	if mcpConfig != "" {
+		var config struct {
+			MCPServers map[string]mcpServer `json:"mcpServers"`
+		}
+		if err := json.Unmarshal([]byte(mcpConfig), &config); err != nil {
+			fmt.Fprintf(os.Stderr, "fakeclaude: invalid --mcp-config: %v\n", err)
+			os.Exit(2)
+		}
+		f.mcpServers = config.MCPServers
+	}
+	f.promptTool = promptTool
+	f.partial = partial
+	if recordPath != "" {
+		rec, err := os.OpenFile(recordPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fakeclaude: %v\n", err)
+			os.Exit(2)
+		}
+		defer rec.Close()
+		f.record = rec
+	}
+
+	f.recordEvent(map[string]interface{}{
+		"event": "start", "args": args, "resume": resumeID, "append_system_prompt": systemPrompt,
+	})
+
+	if resumeID != "" {
+		if f.scenario.ResumeError != "" {
+			fmt.Fprintf(os.Stderr, "%s %s\n", f.scenario.ResumeError, resumeID)
+			os.Exit(1)
+		}
+		f.sessionID = resumeID
+		if f.scenario.ResumeTurns != nil {
+			f.scenario.Turns = f.scenario.ResumeTurns
+		}
+	}
+	if err := f.openTranscript(resumeID != ""); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	f.handleSignals()
+	os.Exit(f.run())
+}
+
+// handleSignals exits on SIGINT/SIGTERM, like Claude does, unless the
+// scenario says to ignore them.
+func (f *fake) handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range sigs {
+			f.recordEvent(map[string]interface{}{"event": "signal", "signal": sig.String()})
+			if f.scenario.IgnoreStop {
+				continue
+			}
+			time.Sleep(time.Duration(f.scenario.StopDelayMS) * time.Millisecond)
+			os.Exit(0)
+		}
+	}()
+}
+
+// run reads stream-json input until EOF and plays a turn for each user
+// message. Returns the exit code.
+func (f *fake) run() int {
+	messages := make(chan string)
+	interrupts := make(chan struct{}, 1)
+
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var in struct {
+				Type      string `json:"type"`
+				RequestID string `json:"request_id"`
+				Message   struct {
+					Content string `json:"content"`
+				} `json:"message"`
+				Request struct {
+					Subtype string `json:"subtype"`
+				} `json:"request"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &in); err != nil {
+				fmt.Fprintf(os.Stderr, "fakeclaude: invalid input: %v\n", err)
+				continue
+			}
+
+			switch {
+			case in.Type == "user":
+				f.recordEvent(map[string]interface{}{"event": "message", "content": in.Message.Content})
+				f.writeTranscript("user", in.Message.Content)
+				messages <- in.Message.Content
+			case in.Type == "control_request" && in.Request.Subtype == "interrupt":
+				f.recordEvent(map[string]interface{}{"event": "interrupt"})
+				f.emit(map[string]interface{}{
+					"type":     "control_response",
+					"response": map[string]interface{}{"subtype": "success", "request_id": in.RequestID},
+				})
+				if f.scenario.IgnoreInterrupt {
+					continue
+				}
+				go func() {
+					time.Sleep(time.Duration(f.scenario.InterruptDelayMS) * time.Millisecond)
+					select {
+					case interrupts <- struct{}{}:
+					default:
+					}
+				}()
+			}
+		}
+	}()
+
+	first := true
+	for content := range messages {
+		if first {
+			f.emit(map[string]interface{}{"type": "system", "subtype": "init", "session_id": f.sessionID})
+			first = false
+		}
+
+		// Drop interrupts that arrived between turns
+		select {
+		case <-interrupts:
+		default:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-interrupts:
+				cancel()
+			case <-done:
+			}
+		}()
+		code, exit := f.playTurn(ctx, content)
+		close(done)
+		cancel()
+		if exit {
+			return code
+		}
+	}
+	return 0
+}
+
+// playTurn plays the next scripted turn (or an echo) in reply to content.
+// Returns exit=true if the fake should exit with code.
+func (f *fake) playTurn(ctx context.Context, content string) (code int, exit bool) {
+	steps := []Step{{Type: "text", Text: "echo: {{input}}"}, {Type: "result"}}
+	if f.turn < len(f.scenario.Turns) {
+		steps = f.scenario.Turns[f.turn]
+	}
+	f.turn++
+
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			// Interrupted: end the turn like Claude does
+			f.emit(map[string]interface{}{
+				"type": "result", "subtype": "error_during_execution", "is_error": true,
+				"session_id": f.sessionID,
+			})
+			return 0, false
+		}
+
+		text := strings.ReplaceAll(step.Text, "{{input}}", content)
+		f.parent = ""
+		if step.Subagent {
+			f.parent = f.openTask()
+		}
+		switch step.Type {
+		case "system":
+			f.emit(map[string]interface{}{"type": "system", "subtype": "init", "session_id": f.sessionID})
+		case "text":
+			if f.partial {
+				f.streamText(ctx, text, step.MS)
+			} else {
+				f.emitAssistant(map[string]interface{}{"type": "text", "text": text})
+			}
+		case "tool_use":
+			f.toolID++
+			id := fmt.Sprintf("toolu_fake_%d", f.toolID)
+			f.open = append(f.open, openTool{id: id, name: step.Name})
+			f.emitAssistant(map[string]interface{}{
+				"type":  "tool_use",
+				"id":    id,
+				"name":  step.Name,
+				"input": step.Input,
+			})
+			if f.promptTool != "" {
+				f.askPermission(ctx, id, step.Name, step.Input)
+			}
+		case "tool_result":
+			id := fmt.Sprintf("toolu_fake_%d", f.toolID)
+			if n := len(f.open); n > 0 {
+				id = f.open[n-1].id
+				f.open = f.open[:n-1]
+			}
+			f.emitToolResult(id, text, step.IsError)
+		case "error":
+			f.emit(map[string]interface{}{"type": "error", "result": text, "session_id": f.sessionID})
+		case "result":
+			f.cost += step.CostUSD
+			f.emit(map[string]interface{}{
+				"type": "result", "subtype": "success", "result": text,
+				"session_id": f.sessionID, "total_cost_usd": f.cost,
+				"duration_ms": step.MS, "num_turns": 1,
+				"usage": map[string]interface{}{
+					"input_tokens": step.InputTokens, "output_tokens": step.OutputTokens,
+				},
+			})
+		case "stderr":
+			fmt.Fprint(os.Stderr, text)
+		case "raw":
+			f.outMu.Lock()
+			fmt.Println(text)
+			f.outMu.Unlock()
+		case "sleep":
+			select {
+			case <-time.After(time.Duration(step.MS) * time.Millisecond):
+			case <-ctx.Done():
+			}
+		case "crash":
+			exitCode := step.ExitCode
+			if exitCode == 0 {
+				exitCode = 1
+			}
+			f.recordEvent(map[string]interface{}{"event": "crash", "exit_code": exitCode})
+			return exitCode, true
+		default:
+			fmt.Fprintf(os.Stderr, "fakeclaude: unknown step type %q\n", step.Type)
+		}
+	}
+	return 0, false
+}
+
+// askPermission calls the permission prompt tool for a tool_use block,
+// records the decision, and emits the tool_result Claude would produce.
+func (f *fake) askPermission(ctx context.Context, toolUseID, toolName string, input map[string]interface{}) {
+	behavior, message := "deny", ""
+	decision, err := f.callPromptTool(ctx, toolUseID, toolName, input)
+	if err != nil {
+		message = err.Error()
+	} else {
+		behavior, message = decision.Behavior, decision.Message
+	}
+	f.recordEvent(map[string]interface{}{
+		"event": "permission", "tool": toolName, "behavior": behavior, "message": message,
+	})
+
+	if behavior == "allow" {
+		f.emitToolResult(toolUseID, "ok", false)
+	} else {
+		f.emitToolResult(toolUseID, message, true)
+	}
+}
+
+// openTool is a tool_use waiting for its tool_result step.
+type openTool struct {
+	id, name string
+}
+
+// openTask returns the ID of the most recent Task tool_use still open, or "".
+func (f *fake) openTask() string {
+	for i := len(f.open) - 1; i >= 0; i-- {
+		if f.open[i].name == "Task" {
+			return f.open[i].id
+		}
+	}
+	return ""
+}
+
+// parentToolUseID returns the parent_tool_use_id for the step being emitted:
+// null for the main agent, like Claude reports it.
+func (f *fake) parentToolUseID() interface{} {
+	if f.parent == "" {
+		return nil
+	}
+	return f.parent
+}
+
+// emitToolResult emits the user message carrying a tool_result, as Claude
+// does after running (or being refused) a tool.
+func (f *fake) emitToolResult(toolUseID, content string, isError bool) {
+	result := map[string]interface{}{"type": "tool_result", "tool_use_id": toolUseID, "content": content}
+	if isError {
+		result["is_error"] = true
+	}
+	f.emit(map[string]interface{}{
+		"type":               "user",
+		"session_id":         f.sessionID,
+		"parent_tool_use_id": f.parentToolUseID(),
+		"message": map[string]interface{}{
+			"role":    "user",
+			"content": []interface{}{result},
+		},
+	})
+}
+
+// callPromptTool sends a JSON-RPC tools/call for the permission prompt tool
+// to its MCP server and decodes the decision.
+func (f *fake) callPromptTool(ctx context.Context, toolUseID, toolName string, input map[string]interface{}) (decision struct {
+	Behavior string `json:"behavior"`
+	Message  string `json:"message"`
+}, err error) {
+	// mcp__<server>__<tool>
+	parts := strings.SplitN(strings.TrimPrefix(f.promptTool, "mcp__"), "__", 2)
+	if len(parts) != 2 {
+		return decision, fmt.Errorf("invalid permission prompt tool %q", f.promptTool)
+	}
+	server, ok := f.mcpServers[parts[0]]
+	if !ok {
+		return decision, fmt.Errorf("unknown MCP server %q", parts[0])
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "tools/call",
+		"params": map[string]interface{}{
+			"name": parts[1],
+			"arguments": map[string]interface{}{
+				"tool_name":   toolName,
+				"input":       input,
+				"tool_use_id": toolUseID,
+			},
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range server.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("MCP server returned %s", resp.Status)
+	}
+
+	var rpc struct {
+		Result struct {
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"result"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rpc); err != nil {
+		return decision, err
+	}
+	if rpc.Error != nil {
+		return decision, fmt.Errorf("MCP error: %s", rpc.Error.Message)
+	}
+	if len(rpc.Result.Content) == 0 {
+		return decision, fmt.Errorf("empty MCP result")
+	}
+	err = json.Unmarshal([]byte(rpc.Result.Content[0].Text), &decision)
+	return decision, err
+}
+
+// emitAssistant writes an assistant message with a single content block.
+func (f *fake) emitAssistant(block map[string]interface{}) {
+	f.msgID++
+	f.emitMessage(fmt.Sprintf("msg_fake_%d", f.msgID), block)
+}
+
+// emitMessage writes the assistant message id with a single content block.
+func (f *fake) emitMessage(id string, block map[string]interface{}) {
+	f.emit(map[string]interface{}{
+		"type":               "assistant",
+		"session_id":         f.sessionID,
+		"parent_tool_use_id": f.parentToolUseID(),
+		"message": map[string]interface{}{
+			"id":      id,
+			"role":    "assistant",
+			"content": []interface{}{block},
+		},
+	})
+	f.writeTranscript("assistant", []interface{}{block})
+}
+
+// streamText emits a text block the way Claude does with
+// --include-partial-messages: message_start, a text_delta per word (ms
+// milliseconds apart), then the complete assistant message and
+// message_stop. An interrupt skips the remaining deltas.
+func (f *fake) streamText(ctx context.Context, text string, ms int) {
+	f.msgID++
+	id := fmt.Sprintf("msg_fake_%d", f.msgID)
+	event := func(ev map[string]interface{}) {
+		f.emit(map[string]interface{}{
+			"type":               "stream_event",
+			"session_id":         f.sessionID,
+			"parent_tool_use_id": f.parentToolUseID(),
+			"event":              ev,
+		})
+	}
+
+	event(map[string]interface{}{"type": "message_start", "message": map[string]interface{}{"id": id, "role": "assistant"}})
+	event(map[string]interface{}{"type": "content_block_start", "index": 0, "content_block": map[string]interface{}{"type": "text", "text": ""}})
+	for _, chunk := range strings.SplitAfter(text, " ") {
+		if chunk == "" || ctx.Err() != nil {
+			continue
+		}
+		event(map[string]interface{}{"type": "content_block_delta", "index": 0, "delta": map[string]interface{}{"type": "text_delta", "text": chunk}})
+		if ms > 0 {
+			select {
+			case <-time.After(time.Duration(ms) * time.Millisecond):
+			case <-ctx.Done():
+			}
+		}
+	}
+	event(map[string]interface{}{"type": "content_block_stop", "index": 0})
+	f.emitMessage(id, map[string]interface{}{"type": "text", "text": text})
+	event(map[string]interface{}{"type": "message_stop"})
+}
+
+// nonAlphanumeric matches the characters Claude replaces with "-" when it
+// names a project directory after its working directory.
+var nonAlphanumeric = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// openTranscript opens the session's transcript under CLAUDE_CONFIG_DIR for
+// appending. When resuming, the transcript must already exist.
+func (f *fake) openTranscript(resume bool) error {
+	configDir := os.Getenv("CLAUDE_CONFIG_DIR")
+	if configDir == "" {
+		return nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(configDir, "projects", nonAlphanumeric.ReplaceAllString(cwd, "-"))
+	path := filepath.Join(dir, f.sessionID+".jsonl")
+	if _, err := os.Stat(path); resume && err != nil {
+		return fmt.Errorf("No conversation found with session ID: %s", f.sessionID)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f.cwd = cwd
+	f.transcript, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// writeTranscript appends a user or assistant message to the transcript.
+func (f *fake) writeTranscript(role string, content interface{}) {
+	if f.transcript == nil {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      role,
+		"sessionId": f.sessionID,
+		"cwd":       f.cwd,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"message":   map[string]interface{}{"role": role, "content": content},
+	})
+	if err != nil {
+		return
+	}
+	f.transMu.Lock()
+	defer f.transMu.Unlock()
+	f.transcript.Write(append(data, '\n'))
+}
+
+// emit writes a single stream-json line to stdout.
+func (f *fake) emit(msg map[string]interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fakeclaude: %v\n", err)
+		return
+	}
+	f.outMu.Lock()
+	defer f.outMu.Unlock()
+	fmt.Printf("%s\n", data)
+}
+
+// recordEvent appends an event to the --record log, if any.
+func (f *fake) recordEvent(event map[string]interface{}) {
+	if f.record == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	f.recMu.Lock()
+	defer f.recMu.Unlock()
+	f.record.Write(append(data, '\n'))
+}
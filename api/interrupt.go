@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// EventTypeInterrupted tells clients the current turn was cancelled.
+const EventTypeInterrupted = "interrupted"
+
+// ErrNotActive is returned by interrupt when Claude isn't mid-turn.
+var ErrNotActive = errors.New("no turn in progress")
+
+// interrupt cancels the current turn without ending the conversation.
+//
+// It sends Claude's stream-json interrupt control request; Claude abandons the
+// turn and emits a result, which moves the session back to StateWaiting with
+// an interrupted event (see handleStdout). If the turn hasn't ended after
+// cfg.InterruptGrace(), or the request can't be sent, the process is stopped
+// with SIGINT instead (and killed if it ignores that), and the session becomes
+// StateStopped so the next message resumes the same conversation. Either way
+// ClaudeSessionID is kept.
+func (s *Session) interrupt() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.State != StateActive || s.proc == nil {
+		return ErrNotActive
+	}
+	if s.interrupting {
+		return nil // Already on its way
+	}
+
+	proc := s.proc
+	grace := cfg.ShutdownGrace()
+	s.interrupting = true
+	slog.Info("interrupting turn", "id", s.ID, "pid", proc.Pid())
+
+	if err := proc.Interrupt(); err != nil {
+		slog.Warn("failed to send interrupt request, stopping process", "id", s.ID, "error", err)
+		if err := s.stopInterrupted(proc, grace); err != nil {
+			s.interrupting = false
+			return err
+		}
+		return nil
+	}
+
+	s.cancelInterruptTimer()
+	var timer *time.Timer
+	timer = time.AfterFunc(cfg.InterruptGrace(), func() {
+		s.mu.Lock()
+		stuck := s.interruptTimer == timer && s.proc == proc
+		if stuck {
+			s.interruptTimer = nil
+		}
+		s.mu.Unlock()
+		if stuck {
+			slog.Warn("turn did not end after interrupt, stopping process", "id", s.ID, "pid", proc.Pid())
+			if err := s.stopInterrupted(proc, grace); err != nil {
+				slog.Error("failed to stop process", "id", s.ID, "error", err)
+			}
+		}
+	})
+	s.interruptTimer = timer
+	return nil
+}
+
+// cancelInterruptTimer stops the pending interrupt's grace timer, if any. The
+// caller must hold s.mu.
+func (s *Session) cancelInterruptTimer() {
+	if s.interruptTimer != nil {
+		s.interruptTimer.Stop()
+		s.interruptTimer = nil
+	}
+}
+
+// stopInterrupted stops proc when an interrupt couldn't end the turn. Like
+// stopSession, it sends SIGKILL if the process is still attached after grace.
+// The exit finishes the interrupt (see waitForExit).
+func (s *Session) stopInterrupted(proc Process, grace time.Duration) error {
+	if err := proc.Stop(); err != nil {
+		if killErr := proc.Kill(); killErr != nil {
+			return errors.Join(err, killErr)
+		}
+		return nil
+	}
+
+	time.AfterFunc(grace, func() {
+		s.mu.RLock()
+		running := s.proc == proc
+		s.mu.RUnlock()
+		if running {
+			slog.Warn("process ignored stop after interrupt, killing it", "id", s.ID, "pid", proc.Pid())
+			if err := proc.Kill(); err != nil {
+				slog.Debug("failed to force kill process (may have already exited)", "error", err, "pid", proc.Pid())
+			}
+		}
+	})
+	return nil
+}
+
+// finishInterrupt clears the interrupt flag and its grace timer, and tells
+// clients the turn was cancelled. Returns false if no interrupt was pending.
+// The caller must hold s.mu.
+func (s *Session) finishInterrupt() bool {
+	if !s.interrupting {
+		return false
+	}
+	s.interrupting = false
+	s.cancelInterruptTimer()
+	s.broadcastEvent(SSEEvent{Type: EventTypeInterrupted, Content: "Turn interrupted"})
+	return true
+}
+
+// handleInterrupt cancels Claude's current turn.
+//
+// POST /interrupt
+// POST /sessions/{id}/interrupt
+//
+// Response on success:
+//
+//	{
+//	  "success": true,
+//	  "state": "active"  // Becomes "waiting" once Claude ends the turn
+//	}
+//
+// Clients see an interrupted event followed by the state change. Returns 409
+// if no turn is in progress.
+func handleInterrupt(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.interrupt(); err != nil {
+		s.mu.RLock()
+		state := s.State
+		s.mu.RUnlock()
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"error": err.Error(),
+			"state": state,
+		})
+		return
+	}
+
+	s.mu.RLock()
+	state := s.State
+	s.mu.RUnlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"state":   state,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// DefaultJournalSize is the number of events kept per session for replay.
+const DefaultJournalSize = 1000
+
+// EventJournal is a bounded, ordered log of recently broadcast events.
+//
+// Every appended event gets a monotonically increasing ID, which is sent as
+// the SSE "id:" field. Reconnecting clients send it back as Last-Event-ID and
+// get exactly the events they missed, as long as those are still in the
+// journal.
+//
+// IDs are seeded from the clock (microseconds) when the journal is created,
+// so they keep increasing across server restarts and a stale Last-Event-ID
+// from before a restart is never mistaken for a recent one.
+//
+// EventJournal is not safe for concurrent use; Session guards it with sseMu.
+type EventJournal struct {
+	events []SSEEvent // Ring of events, oldest at start
+	start  int        // Index of the oldest event
+	count  int        // Number of events stored
+	lastID uint64     // ID of the newest event (or the seed if empty)
+}
+
+// NewEventJournal creates a journal that keeps the last capacity events.
+func NewEventJournal(capacity int) *EventJournal {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &EventJournal{
+		events: make([]SSEEvent, capacity),
+		lastID: uint64(time.Now().UnixMicro()),
+	}
+}
+
+// Append assigns the next ID to event, stores it, and returns it. The oldest
+// event is evicted when the journal is full.
+func (j *EventJournal) Append(event SSEEvent) SSEEvent {
+	j.lastID++
+	event.ID = j.lastID
+
+	if j.count < len(j.events) {
+		j.events[(j.start+j.count)%len(j.events)] = event
+		j.count++
+	} else {
+		j.events[j.start] = event
+		j.start = (j.start + 1) % len(j.events)
+	}
+	return event
+}
+
+// LastID returns the ID of the newest event.
+func (j *EventJournal) LastID() uint64 {
+	return j.lastID
+}
+
+// Since returns the events with IDs greater than id, oldest first.
+//
+// Returns ok=false if the journal can't provide an exact replay: either
+// events after id have already been evicted, or id is from the future
+// (e.g. issued by a different journal).
+func (j *EventJournal) Since(id uint64) ([]SSEEvent, bool) {
+	if id > j.lastID {
+		return nil, false
+	}
+	if id == j.lastID {
+		return nil, true
+	}
+
+	// Oldest ID still available is lastID - count + 1
+	oldest := j.lastID - uint64(j.count) + 1
+	if j.count == 0 || id+1 < oldest {
+		return nil, false
+	}
+
+	skip := int(id + 1 - oldest)
+	result := make([]SSEEvent, 0, j.count-skip)
+	for i := skip; i < j.count; i++ {
+		result = append(result, j.events[(j.start+i)%len(j.events)])
+	}
+	return result, true
+}
+
+// parseEventID parses a Last-Event-ID value. Returns 0 if empty or invalid.
+func parseEventID(value string) uint64 {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
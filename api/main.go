@@ -6,7 +6,7 @@
 // using Claude's stream-json format.
 //
 // Architecture:
-//   - Session state is managed in-memory (single session for MVP)
+//   - Sessions are kept in an in-memory registry keyed by ID
 //   - Claude Code runs as a child process
 //   - Output is buffered in a ring buffer for reconnection
 //   - SSE streams real-time output to connected clients
@@ -16,7 +16,9 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -25,20 +27,26 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/seamus/doze/notify"
+	"github.com/seamus/doze/policy"
 )
 
 // Constants for configuration and magic strings
 const (
 	// Server defaults
-	DefaultPort    = "2020"
+	DefaultPort    = 2020
 	DefaultWebPath = "../web/dist"
+	DefaultDataDir = "~/.doze" // Where session metadata is persisted
 
 	// Buffer sizes
 	RingBufferSize       = 10 * 1024   // 10KB ring buffer for output
+	MaxBufferSizeKB      = 1024        // Upper bound for the configurable ring buffer size
 	ScannerInitialBuffer = 64 * 1024   // 64KB initial scanner buffer
 	ScannerMaxBuffer     = 1024 * 1024 // 1MB max scanner buffer
 	SSEClientBufferSize  = 100         // Number of events to buffer per SSE client
@@ -47,6 +55,8 @@ const (
 	// Timeouts
 	DefaultIdleTimeout      = 30 * time.Second // Idle timeout before stopping session
 	GracefulShutdownTimeout = 10 * time.Second // Time to wait for SIGTERM before SIGKILL
+	DefaultResumeTimeout    = 30 * time.Second // Max time to wait for a resumed session
+	DefaultInterruptGrace   = 10 * time.Second // Time for a turn to end after an interrupt
 
 	// Message types from Claude stream-json
 	MessageTypeAssistant = "assistant"
@@ -54,10 +64,12 @@ const (
 	MessageTypeResult    = "result"
 	MessageTypeError     = "error"
 	MessageTypeSystem    = "system"
+	MessageTypeControl   = "control_response" // Reply to a control request (e.g. interrupt)
 
 	// Content block types
-	ContentTypeText    = "text"
-	ContentTypeToolUse = "tool_use"
+	ContentTypeText       = "text"
+	ContentTypeToolUse    = "tool_use"
+	ContentTypeToolResult = "tool_result"
 
 	// SSE event types
 	EventTypeOutput      = "output"
@@ -69,11 +81,6 @@ const (
 
 	// Display limits
 	StatusRecentOutputLimit = 500 // Characters of recent output to include in status endpoint
-
-	// Security settings
-	// Set to true for remote/production use (no permission prompts)
-	// Set to false for local development (safer, allows manual approval)
-	SkipPermissions = true
 )
 
 // SessionState represents the current state of a Claude Code session.
@@ -88,6 +95,7 @@ const (
 // - User message → StateActive (Claude processing)
 // - Response complete → StateWaiting (ready for next input)
 // - Idle timeout in StateWaiting → StateShuttingDown → StateStopped
+// - Crash → StateCrashed → (backoff) → resumed, or StateNone after recovery.max_retries
 type SessionState string
 
 const (
@@ -111,6 +119,10 @@ const (
 	// StateStopped indicates the session has been stopped and the process has exited.
 	// Can be resumed later by spawning a new process with --resume {session-id}.
 	StateStopped SessionState = "stopped"
+
+	// StateCrashed indicates the process exited unexpectedly and a --resume is
+	// scheduled (see recoverAfterCrash).
+	StateCrashed SessionState = "crashed"
 )
 
 // SSEClient represents a connected Server-Sent Events (SSE) client.
@@ -121,20 +133,26 @@ type SSEClient struct {
 	id     string        // Unique identifier for this client (timestamp-based)
 	events chan SSEEvent // Buffered channel for events to send to this client
 	done   chan struct{} // Closed when the client disconnects
+	lagged chan struct{} // Closed when the client fell behind and must reconnect
 }
 
 // SSEEvent is an event to send to SSE clients.
 //
-// Events are JSON-encoded and sent over the SSE connection. The Type field
-// determines which other fields are populated:
+// Events are JSON-encoded and sent over the SSE connection. ID is assigned by
+// the session's EventJournal when the event is broadcast and is sent as the
+// SSE "id:" field for Last-Event-ID replay. The Type field determines which
+// other fields are populated:
 //   - "output": Content contains Claude's output text
 //   - "state": State contains the new SessionState
 //   - "error": Content contains an error message
 //   - "info": Content contains informational text
 type SSEEvent struct {
+	ID      uint64 `json:"id,omitempty"`      // Journal ID (0 for events that aren't journaled)
 	Type    string `json:"type"`              // Event type: "output", "state", "error", "info"
 	Content string `json:"content,omitempty"` // Text content for output/error/info events
 	State   string `json:"state,omitempty"`   // SessionState for state change events
+
+	MessageID string `json:"message_id,omitempty"` // Claude message the text belongs to (output and output_delta events)
 }
 
 // RingBuffer is a thread-safe circular buffer for keeping recent output.
@@ -205,39 +223,108 @@ func (rb *RingBuffer) String() string {
 // connected SSE clients, and idle detection state. The session is protected by
 // multiple locks for different concerns:
 //   - mu: Protects session state and timestamps
-//   - sseMu: Protects the sseClients map (separate to avoid deadlocks during broadcasts)
+//   - sseMu: Protects the sseClients map and event journal (separate to avoid deadlocks during broadcasts)
 //
-// For the MVP, only a single global session is supported.
+// Each session owns its own process, output buffer, SSE clients, and idle
+// timer. Sessions are looked up by ID through the global SessionRegistry.
 type Session struct {
-	mu sync.RWMutex // Protects State, ClaudeSessionID, RepoPath, timestamps, and process fields
+	mu      sync.RWMutex // Protects State, ClaudeSessionID, RepoPath, timestamps, and process fields
+	startMu sync.Mutex   // Serializes start/stop operations on this session
+
+	// Identity
+	ID        string    // Doze session ID (registry key, "default" for the legacy endpoints)
+	CreatedAt time.Time // When the session was registered
 
 	// State tracking
 	State           SessionState // Current state of the session
 	ClaudeSessionID string       // Session ID from Claude Code (used for --resume)
 	RepoPath        string       // Working directory for the Claude process
+	Branch          string       // Git branch of RepoPath when the session started
+	InitialPrompt   string       // First message sent in the session
 	LastActivity    time.Time    // Last time user sent a message or Claude produced output
 	LastOutputAt    time.Time    // Last time Claude produced output (for timeout detection)
 
+	// Permissions
+	PermissionMode PermissionMode    // How Claude gets permission to use tools
+	AllowRules     []string          // Always-allow rules added from permission prompts
+	mcpToken       string            // Secret the Claude process uses to call the MCP endpoint
+	violations     []PolicyViolation // Recent policy rule matches (see recordViolation)
+
+	// Model and usage
+	Model       string      // --model for new processes ("" = Claude's default)
+	Usage       UsageTotals // Tokens, cost and time reported by Claude across processes
+	processCost float64     // total_cost_usd last reported by the current process
+	turnUsage   []TurnUsage // Recent turns, oldest first (see recordUsage)
+
+	interrupting   bool                   // An interrupt was requested and the turn hasn't ended yet
+	interruptTimer *time.Timer            // Stops the process if the interrupted turn doesn't end
+	pendingTools   map[string]pendingTool // Tool calls of the current turn awaiting results, by tool_use ID
+
+	resume        *resumeAttempt // Pending --resume, until Claude responds
+	resumeFailure string         // Why the last --resume failed ("" if it didn't)
+
+	transcriptOnce sync.Once   // Loads transcriptLog on first use (see transcript)
+	transcriptLog  *Transcript // Structured conversation history
+
+	stateSince time.Time     // When the session entered its current state (see recordSpan)
+	activeTime time.Duration // Time spent in StateActive, excluding the current stretch
+
+	// Budgets (see checkBudget)
+	Budget          BudgetLimits    // Session limits (budgets.session unless overridden)
+	budgetBase      BudgetUsage     // Usage when the session budget last started over
+	budgetExemptDay string          // Day (YYYY-MM-DD) the daily budget was overridden for
+	budgetBlock     *BudgetExceeded // Limit that blocks new messages, until overridden
+	budgetTimer     *time.Timer     // Checks the active-time allowance mid-turn
+
+	// Crash recovery (see recoverAfterCrash)
+	Crashes       int         // Unexpected exits over the session's lifetime
+	crashRetries  int         // Resume attempts since the last completed turn
+	recoveryTimer *time.Timer // Pending resume after a crash
+
+	// Message queue (see sendMessage)
+	queue           []QueuedMessage   // Messages waiting for Claude, oldest first
+	idempotencyKeys map[string]string // Recent Idempotency-Key → message ID
+	keyOrder        []string          // idempotencyKeys in the order they were seen
+
 	// Process management
-	cmd    *exec.Cmd      // The running Claude Code process
-	stdin  io.WriteCloser // Pipe to send messages to Claude
-	stdout io.ReadCloser  // Pipe to read Claude's JSON output
-	stderr io.ReadCloser  // Pipe to read Claude's error output
+	runner Runner  // Launches Claude processes for this session
+	proc   Process // The running Claude Code process (nil when none)
 
 	// Output handling
 	outputBuffer *RingBuffer           // Circular buffer of recent output for reconnecting clients
+	deltas       outputDeltas          // Streamed text not yet sent (see handleStreamEvent)
+	journal      *EventJournal         // Recent broadcast events for Last-Event-ID replay
 	sseClients   map[string]*SSEClient // Connected SSE clients by ID
-	sseMu        sync.RWMutex          // Protects sseClients map
+	sseMu        sync.RWMutex          // Protects sseClients and journal (held for the whole broadcast)
 
 	// Idle detection
 	idleTimer   *time.Timer   // Timer that fires when idle timeout is reached
 	idleTimeout time.Duration // How long to wait before stopping session (default: 3 minutes)
+
+	// Lifecycle
+	ended chan struct{} // Closed when the session is ended and removed from the registry
+	store SessionStore  // Persists metadata and state transitions (nil disables persistence)
 }
 
-// Global session (single session for MVP).
-// Protected by sessionMu during start/stop operations.
-var session *Session
-var sessionMu sync.Mutex
+// NewSession creates an idle session with the given ID.
+//
+// The session starts in StateNone with no process attached. Call
+// startClaudeProcess or startClaudeProcessWithMessage to spawn Claude.
+func NewSession(id string) *Session {
+	return &Session{
+		ID:             id,
+		CreatedAt:      time.Now(),
+		State:          StateNone,
+		PermissionMode: PermissionMode(cfg.Permissions.Mode),
+		mcpToken:       rand.Text(),
+		outputBuffer:   NewRingBuffer(cfg.BufferSize()),
+		journal:        NewEventJournal(cfg.Server.JournalSize),
+		sseClients:     make(map[string]*SSEClient),
+		idleTimeout:    cfg.IdleTimeout(),
+		Budget:         cfg.Budgets.Session,
+		ended:          make(chan struct{}),
+	}
+}
 
 // respondJSON sends a JSON response with the given status code.
 // Logs any errors that occur during encoding.
@@ -261,12 +348,6 @@ func respondError(w http.ResponseWriter, statusCode int, message string) {
 }
 
 func main() {
-	// Get port from environment or default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = DefaultPort
-	}
-
 	// Set up structured logging
 	// Use text handler for development, can switch to JSON for production
 	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
@@ -274,31 +355,102 @@ func main() {
 	})
 	slog.SetDefault(slog.New(logHandler))
 
-	slog.Info("doze api server starting", "port", port)
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "pair" {
+		if c, err := LoadConfig(nil); err == nil {
+			cfg = c // For the default server port
+		}
+		os.Exit(runPairCommand(os.Args[2:]))
+	}
 
-	// Initialize global session with defaults
-	session = &Session{
-		State:        StateNone,
-		outputBuffer: NewRingBuffer(RingBufferSize),
-		sseClients:   make(map[string]*SSEClient),
-		idleTimeout:  DefaultIdleTimeout, // TODO: Make configurable via env/config
+	// Load config: defaults < config.yml < env < flags
+	var err error
+	cfg, err = LoadConfig(os.Args[1:])
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
 	}
+	port := strconv.Itoa(cfg.Server.Port)
 
-	// API endpoints
-	http.HandleFunc("/health", handleHealth)   // GET: Health check endpoint
-	http.HandleFunc("/status", handleStatus)   // GET: Check session status
-	http.HandleFunc("/start", handleStart)     // POST: Start a new Claude session
-	http.HandleFunc("/stream", handleStream)   // GET: SSE stream of output and state
-	http.HandleFunc("/message", handleMessage) // POST: Send a message to Claude
-	http.HandleFunc("/diff", handleDiff)       // GET: Get git diff for a specific file
+	slog.Info("doze api server starting",
+		"port", port,
+		"config_file", cfg.file,
+		"idle_timeout", cfg.IdleTimeout(),
+		"shutdown_grace", cfg.ShutdownGrace())
 
-	// Serve web UI
-	http.HandleFunc("/", handleIndex)
+	// Open the session store and restore sessions from the last run
+	dataDir := expandHome(cfg.Server.DataDir)
+	store, err := OpenFileStore(dataDir)
+	if err != nil {
+		slog.Error("failed to open session store", "data_dir", dataDir, "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+	usageLedger, err = OpenUsageLedger(dataDir)
+	if err != nil {
+		slog.Error("failed to open usage log", "data_dir", dataDir, "error", err)
+		os.Exit(1)
+	}
+	defer usageLedger.Close()
+	computeLedger, err = OpenComputeLedger(dataDir)
+	if err != nil {
+		slog.Error("failed to open compute log", "data_dir", dataDir, "error", err)
+		os.Exit(1)
+	}
+	defer computeLedger.Close()
+	transcriptDir = filepath.Join(dataDir, TranscriptDirName)
+	runner, err := NewRunner(cfg.Runner)
+	if err != nil {
+		slog.Error("failed to set up runner", "error", err)
+		os.Exit(1)
+	}
+	sessions = NewSessionRegistry(store, runner)
+	// Claude processes call back into this server for permission prompts
+	engine, err := policy.New(cfg.Policy.Rules)
+	if err != nil {
+		slog.Error("invalid policy rules", "error", err)
+		os.Exit(1)
+	}
+	permissions = NewPermissionBroker(cfg.PermissionTimeout(), fmt.Sprintf("http://127.0.0.1:%d", cfg.Server.Port), engine)
+	if err := sessions.Restore(); err != nil {
+		slog.Error("failed to restore sessions", "error", err)
+	}
+
+	// Set up push notifications
+	notifier, webPush, err = setupNotifications(cfg.Notifications, dataDir)
+	if err != nil {
+		slog.Error("failed to set up notifications", "error", err)
+		os.Exit(1)
+	}
+
+	// Set up authentication (API tokens from config, device tokens from data dir)
+	authenticator, err = NewAuthenticator(cfg.Auth.Tokens, dataDir)
+	if err != nil {
+		slog.Error("failed to set up authentication", "error", err)
+		os.Exit(1)
+	}
+	if !authenticator.Enabled() {
+		slog.Warn("no auth tokens configured, API is open (set DOZE_AUTH_TOKEN for remote use)")
+	}
+
+	// Set up device pairing, optionally printing a code for the first device
+	pairing = NewPairingManager(cfg.PairingTTL())
+	if cfg.Auth.PairOnStart {
+		code, expiresAt, err := pairing.NewCode()
+		if err != nil {
+			slog.Error("failed to create pairing code", "error", err)
+		} else if err := printPairingCode(os.Stdout, code, expiresAt, pairingURL(code)); err != nil {
+			slog.Error("failed to print pairing code", "error", err)
+		}
+	}
+
+	// Register endpoints
+	handler := newHandler()
 
 	// Set up graceful shutdown
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: http.DefaultServeMux,
+		Handler: handler,
 	}
 
 	// Channel to listen for interrupt signals
@@ -307,7 +459,7 @@ func main() {
 
 	// Start server in a goroutine
 	go func() {
-		slog.Info("server listening", "port", port, "endpoints", []string{"/health", "/status", "/start", "/stream", "/message"})
+		slog.Info("server listening", "port", port, "endpoints", []string{"/health", "/status", "/start", "/stream", "/message", "/sessions"})
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			slog.Error("server error", "error", err)
 			os.Exit(1)
@@ -318,13 +470,22 @@ func main() {
 	sig := <-sigChan
 	slog.Info("received shutdown signal", "signal", sig)
 
-	// Gracefully stop Claude session if running
-	sessionMu.Lock()
-	if session.State == StateWaiting || session.State == StateActive {
-		slog.Info("stopping claude session before shutdown")
-		stopSession()
+	// Gracefully stop running Claude sessions (without resuming them for
+	// queued messages)
+	draining.Store(true)
+	for _, s := range sessions.List() {
+		s.startMu.Lock()
+		s.mu.RLock()
+		state := s.State
+		s.mu.RUnlock()
+		if state == StateWaiting || state == StateActive {
+			slog.Info("stopping claude session before shutdown", "id", s.ID)
+			if err := s.stopSession(); err != nil {
+				slog.Warn("failed to stop session", "id", s.ID, "error", err)
+			}
+		}
+		s.startMu.Unlock()
 	}
-	sessionMu.Unlock()
 
 	// Shutdown HTTP server with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -335,9 +496,94 @@ func main() {
 		os.Exit(1)
 	}
 
+	notifier.Wait() // Let in-flight notifications (e.g. "session stopped") finish
 	slog.Info("server shutdown complete")
 }
 
+// newHandler registers all endpoints on a new mux and wraps it with the CORS
+// and auth middleware.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Server endpoints
+	mux.HandleFunc("/health", handleHealth) // GET: Health check endpoint
+	mux.HandleFunc("/config", handleConfig) // GET: Effective (redacted) config
+
+	// Auth endpoints
+	mux.HandleFunc("GET /auth/whoami", handleWhoAmI)                // Current principal
+	mux.HandleFunc("GET /auth/devices", handleListDevices)          // List device tokens
+	mux.HandleFunc("POST /auth/devices", handleIssueDevice)         // Issue a device token
+	mux.HandleFunc("DELETE /auth/devices/{id}", handleRevokeDevice) // Revoke a device token
+
+	// Pairing endpoints
+	mux.HandleFunc("POST /pair", handlePair)                    // Exchange a pairing code for a device token (public)
+	mux.HandleFunc("POST /pair/codes", handleCreatePairingCode) // Issue a pairing code
+	mux.HandleFunc("GET /pair/qr", handlePairingQR)             // Issue a pairing code as a QR code PNG
+
+	// Legacy single-session endpoints (aliases for the "default" session)
+	mux.HandleFunc("/status", handleStatus)                       // GET: Check session status
+	mux.HandleFunc("/start", handleStart)                         // POST: Start a new Claude session
+	mux.HandleFunc("/stream", handleStream)                       // GET: SSE stream of output and state
+	mux.HandleFunc("GET /ws", handleWebSocket)                    // WebSocket: events, messages and acks
+	mux.HandleFunc("/message", handleMessage)                     // POST: Send a message to Claude
+	mux.HandleFunc("/diff", handleDiff)                           // GET: Get git diff for a specific file
+	mux.HandleFunc("POST /interrupt", handleInterrupt)            // Cancel the current turn
+	mux.HandleFunc("GET /queue", handleQueue)                     // Messages waiting for Claude
+	mux.HandleFunc("DELETE /queue/{message}", handleCancelQueued) // Cancel a queued message
+	mux.HandleFunc("GET /messages", handleMessages)               // Conversation history, paginated
+	mux.HandleFunc("GET /export", handleExport)                   // Download the conversation (md, jsonl, html)
+	mux.HandleFunc("GET /usage", handleUsage)                     // Tokens and cost by day and repo
+	mux.HandleFunc("GET /stats/compute", handleComputeStats)      // Running vs hibernated time by day
+	mux.HandleFunc("GET /budget", handleBudget)                   // Budget limits and usage
+	mux.HandleFunc("POST /budget/override", handleOverrideBudget) // Let an over-budget session continue
+
+	// Session resource endpoints
+	mux.HandleFunc("GET /sessions", handleListSessions)                         // List all sessions
+	mux.HandleFunc("POST /sessions", handleCreateSession)                       // Create and start a new session
+	mux.HandleFunc("GET /sessions/{id}", handleStatus)                          // Session status
+	mux.HandleFunc("/sessions/{id}/stream", handleStream)                       // SSE stream for a session
+	mux.HandleFunc("GET /sessions/{id}/ws", handleWebSocket)                    // WebSocket for a session
+	mux.HandleFunc("/sessions/{id}/message", handleMessage)                     // Send a message to a session
+	mux.HandleFunc("/sessions/{id}/diff", handleDiff)                           // Git diff in a session's repo
+	mux.HandleFunc("POST /sessions/{id}/stop", handleStopSession)               // Force an idle session to stop
+	mux.HandleFunc("POST /sessions/{id}/interrupt", handleInterrupt)            // Cancel the current turn
+	mux.HandleFunc("GET /sessions/{id}/queue", handleQueue)                     // Messages waiting for Claude
+	mux.HandleFunc("DELETE /sessions/{id}/queue/{message}", handleCancelQueued) // Cancel a queued message
+	mux.HandleFunc("GET /sessions/{id}/usage", handleSessionUsage)              // Tokens and cost per turn
+	mux.HandleFunc("GET /sessions/{id}/messages", handleMessages)               // Conversation history, paginated
+	mux.HandleFunc("GET /sessions/{id}/export", handleExport)                   // Download the conversation (md, jsonl, html)
+	mux.HandleFunc("GET /sessions/{id}/budget", handleBudget)                   // Budget limits and usage
+	mux.HandleFunc("POST /sessions/{id}/budget/override", handleOverrideBudget) // Let an over-budget session continue
+	mux.HandleFunc("POST /sessions/{id}/end", handleEndSession)                 // End a session and remove it
+
+	// Claude Code session endpoints
+	mux.HandleFunc("GET /claude-sessions", handleListClaudeSessions)                    // Conversations Claude saved on disk
+	mux.HandleFunc("POST /claude-sessions/{claude_id}/adopt", handleAdoptClaudeSession) // Continue one in a new session
+
+	// Permission endpoints
+	mux.HandleFunc("GET /permissions", handleListPermissions)                      // Pending requests, all sessions
+	mux.HandleFunc("POST /permissions/{id}", handleResolvePermission)              // Allow or deny a request
+	mux.HandleFunc("GET /sessions/{id}/permissions", handleListPermissions)        // Pending requests for a session
+	mux.HandleFunc("POST /sessions/{id}/permission-mode", handleSetPermissionMode) // Change a session's permission mode
+	mux.HandleFunc("GET /sessions/{id}/violations", handleListViolations)          // Policy rule matches for a session
+	mux.HandleFunc("GET /policy", handlePolicy)                                    // Policy rules in effect
+	mux.HandleFunc("POST /sessions/{id}/mcp", handleMCP)                           // Permission prompt MCP server (session token auth)
+
+	// Notification endpoints
+	mux.HandleFunc("GET /push/vapid-key", handleVAPIDKey)               // Web Push applicationServerKey
+	mux.HandleFunc("POST /push/subscriptions", handleSubscribePush)     // Register a browser for Web Push
+	mux.HandleFunc("DELETE /push/subscriptions", handleUnsubscribePush) // Unregister a browser
+	mux.HandleFunc("POST /notifications/test", handleTestNotification)  // Send a test notification
+
+	// Serve web UI
+	mux.HandleFunc("/", handleIndex)
+
+	// Wrap the mux with CORS (outermost, so preflights skip auth) and auth
+	publicPatterns := []string{"/health", "/", "POST /pair", "POST /sessions/{id}/mcp"}
+	return corsMiddleware(cfg.Auth.CORSOrigins,
+		authenticator.Middleware(mux, publicPatterns, mux))
+}
+
 // handleHealth returns a simple health check response.
 //
 // GET /health
@@ -353,33 +599,27 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 // handleStatus returns the current session status as JSON.
 //
 // GET /status
+// GET /sessions/{id}
 //
 // Response includes:
+//   - id: Doze session ID
 //   - state: Current SessionState
 //   - claude_session_id: Session ID for --resume (empty if not captured yet)
 //   - repo_path: Working directory of the Claude process
+//   - branch, initial_prompt: Where and how the session started
 //   - last_activity: Timestamp of last user message or Claude output
 //   - idle_seconds: Seconds since last activity
 //   - recent_output: Last 500 chars from the output buffer
 func handleStatus(w http.ResponseWriter, r *http.Request) {
-	session.mu.RLock()
-	defer session.mu.RUnlock()
-
-	status := map[string]interface{}{
-		"state":             session.State,
-		"claude_session_id": session.ClaudeSessionID,
-		"repo_path":         session.RepoPath,
-		"last_activity":     session.LastActivity,
-		"idle_seconds":      0,
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
 	}
 
-	// Calculate idle time if session has been active
-	if !session.LastActivity.IsZero() {
-		status["idle_seconds"] = int(time.Since(session.LastActivity).Seconds())
-	}
+	status := s.statusSnapshot()
 
 	// Include recent output for status endpoint
-	recentOutput := session.outputBuffer.String()
+	recentOutput := s.outputBuffer.String()
 	if len(recentOutput) > StatusRecentOutputLimit {
 		recentOutput = recentOutput[len(recentOutput)-StatusRecentOutputLimit:]
 	}
@@ -388,6 +628,41 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, status)
 }
 
+// statusSnapshot returns the session's metadata as a JSON-ready map.
+//
+// Shared by the status endpoint and the session list so both report the
+// same fields.
+func (s *Session) statusSnapshot() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := map[string]interface{}{
+		"id":                s.ID,
+		"state":             s.State,
+		"claude_session_id": s.ClaudeSessionID,
+		"repo_path":         s.RepoPath,
+		"branch":            s.Branch,
+		"initial_prompt":    s.InitialPrompt,
+		"permission_mode":   s.PermissionMode,
+		"allow_rules":       s.AllowRules,
+		"model":             s.Model,
+		"created_at":        s.CreatedAt,
+		"last_activity":     s.LastActivity,
+		"idle_seconds":      0,
+		"crashes":           s.Crashes,
+		"resume_attempts":   s.crashRetries,
+		"usage":             s.Usage,
+		"budget_exceeded":   s.budgetBlock,
+	}
+
+	// Calculate idle time if session has been active
+	if !s.LastActivity.IsZero() {
+		status["idle_seconds"] = int(time.Since(s.LastActivity).Seconds())
+	}
+
+	return status
+}
+
 // handleStart starts a new Claude Code session.
 //
 // POST /start
@@ -417,14 +692,18 @@ func handleStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
+	s := sessions.Default()
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
 
 	// Check if session already running
-	if session.State != StateNone && session.State != StateStopped {
+	s.mu.RLock()
+	state := s.State
+	s.mu.RUnlock()
+	if state != StateNone && state != StateStopped {
 		respondJSON(w, http.StatusConflict, map[string]interface{}{
 			"error": "session already active",
-			"state": session.State,
+			"state": state,
 		})
 		return
 	}
@@ -438,47 +717,66 @@ func handleStart(w http.ResponseWriter, r *http.Request) {
 		// Continue with empty req - repo path is optional
 	}
 
-	// Determine repo path: request > env > current directory
-	repoPath := req.RepoPath
+	repoPath, err := resolveRepoPath(req.RepoPath)
+	if err != nil {
+		slog.Error("failed to get current directory", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to determine working directory")
+		return
+	}
+
+	// Start Claude Code process
+	if err := s.startClaudeProcess(repoPath); err != nil {
+		slog.Error("failed to start claude process", "error", err)
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"state":     s.State,
+		"repo_path": s.RepoPath,
+	})
+}
+
+// resolveRepoPath determines the working directory for a new Claude process.
+//
+// Precedence is: requested path > configured repo.path (REPO_PATH env) >
+// current directory. A leading "~/" is expanded to the user's home directory.
+func resolveRepoPath(requested string) (string, error) {
+	repoPath := requested
 	if repoPath == "" {
-		repoPath = os.Getenv("REPO_PATH")
+		repoPath = cfg.Repo.Path
 	}
 	if repoPath == "" {
 		var err error
 		repoPath, err = os.Getwd()
 		if err != nil {
-			slog.Error("failed to get current directory", "error", err)
-			respondError(w, http.StatusInternalServerError, "failed to determine working directory")
-			return
+			return "", err
 		}
 	}
 
-	// Expand tilde in path (e.g., ~/code -> /home/user/code)
-	if strings.HasPrefix(repoPath, "~/") {
+	return expandHome(repoPath), nil
+}
+
+// expandHome expands a leading "~/" to the user's home directory
+// (e.g., ~/code -> /home/user/code).
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
 		homeDir, err := os.UserHomeDir()
 		if err == nil {
-			repoPath = filepath.Join(homeDir, repoPath[2:])
+			return filepath.Join(homeDir, path[2:])
 		}
 	}
-
-	// Start Claude Code process
-	if err := startClaudeProcess(repoPath); err != nil {
-		slog.Error("failed to start claude process", "error", err)
-		respondError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"success":   true,
-		"state":     session.State,
-		"repo_path": session.RepoPath,
-	})
+	return path
 }
 
 // startClaudeProcess spawns a new Claude Code process with stream-json I/O.
 //
-// The process is started in the specified repoPath directory. Uses Claude's
-// stream-json format for bidirectional communication:
+// The process is started in the specified repoPath directory through the
+// session's Runner. Uses Claude's stream-json format for bidirectional
+// communication:
 //   - Input: JSON objects sent to stdin, one per line
 //   - Output: JSON objects from stdout, one per line
 //
@@ -487,81 +785,35 @@ func handleStart(w http.ResponseWriter, r *http.Request) {
 //   - handleStderr: Captures diagnostic output
 //   - waitForExit: Handles process termination
 //
-// The session.mu lock must NOT be held when calling this function, as it
+// The s.mu lock must NOT be held when calling this function, as it
 // acquires the lock itself and spawns goroutines that also need it.
-func startClaudeProcess(repoPath string) error {
-	session.mu.Lock()
-	defer session.mu.Unlock()
-
-	session.State = StateStarting
-	session.RepoPath = repoPath
-	session.LastActivity = time.Now()
-
-	// Broadcast state change to connected clients
-	broadcastState(StateStarting)
-
-	// Build command - use stream-json for bidirectional streaming
-	// --print: Show output (don't suppress)
-	// --input-format=stream-json: Accept JSON messages on stdin
-	// --output-format=stream-json: Emit JSON messages on stdout
-	// --verbose: Include session metadata in output
-	args := []string{
-		"--print",
-		"--input-format=stream-json",
-		"--output-format=stream-json",
-		"--verbose",
-	}
-	if SkipPermissions {
-		args = append(args, "--dangerously-skip-permissions")
-	}
-	cmd := exec.Command("claude", args...)
-	cmd.Dir = repoPath
+func (s *Session) startClaudeProcess(repoPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Get pipes for stdin/stdout/stderr
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		session.State = StateNone
-		return fmt.Errorf("failed to get stdin pipe: %w", err)
-	}
+	s.RepoPath = repoPath
+	s.Branch = currentBranch(repoPath)
+	s.LastActivity = time.Now()
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		session.State = StateNone
-		return fmt.Errorf("failed to get stdout pipe: %w", err)
-	}
+	// Persist and broadcast state change to connected clients
+	s.setState(StateStarting)
 
-	stderr, err := cmd.StderrPipe()
+	proc, err := s.runner.Start(s.runOptions(repoPath))
 	if err != nil {
-		session.State = StateNone
-		return fmt.Errorf("failed to get stderr pipe: %w", err)
-	}
-
-	session.cmd = cmd
-	session.stdin = stdin
-	session.stdout = stdout
-	session.stderr = stderr
-
-	// Start the process
-	if err := cmd.Start(); err != nil {
-		session.State = StateNone
+		s.setState(StateNone)
 		return fmt.Errorf("failed to start claude: %w", err)
 	}
+	s.attach(proc)
 
-	slog.Info("claude process started", "pid", cmd.Process.Pid, "repo_path", repoPath)
-
-	// Start goroutines to handle I/O (these run until process exits)
-	go handleStdout()
-	go handleStderr()
-	go waitForExit()
+	slog.Info("claude process started", "pid", proc.Pid(), "repo_path", repoPath)
 
 	// Claude starts in waiting state (ready for first input)
 	// StateActive is only when Claude is actively processing
-	session.State = StateWaiting
-	broadcastState(StateWaiting)
+	s.setState(StateWaiting)
 
 	// Start idle timer immediately - session will stop if no activity
-	resetIdleTimer()
-	slog.Info("session ready", "state", StateWaiting, "idle_timeout", session.idleTimeout)
+	s.resetIdleTimer()
+	slog.Info("session ready", "state", StateWaiting, "idle_timeout", s.idleTimeout)
 
 	return nil
 }
@@ -572,89 +824,44 @@ func startClaudeProcess(repoPath string) error {
 // the provided message immediately after the process starts. This allows users to
 // "wake up" the application by sending a message directly from the welcome screen.
 //
-// The session.mu lock must NOT be held when calling this function.
-func startClaudeProcessWithMessage(repoPath, initialMessage string) error {
-	session.mu.Lock()
-	defer session.mu.Unlock()
-
-	session.State = StateStarting
-	session.RepoPath = repoPath
-	session.LastActivity = time.Now()
-
-	// Broadcast state change to connected clients
-	broadcastState(StateStarting)
+// The s.mu lock must NOT be held when calling this function.
+func (s *Session) startClaudeProcessWithMessage(repoPath, initialMessage string) error {
+	return s.startWithMessage(repoPath, initialMessage, "")
+}
 
-	// Build command - use stream-json for bidirectional streaming
-	args := []string{
-		"--print",
-		"--input-format=stream-json",
-		"--output-format=stream-json",
-		"--verbose",
-	}
-	if SkipPermissions {
-		args = append(args, "--dangerously-skip-permissions")
-	}
-	cmd := exec.Command("claude", args...)
-	cmd.Dir = repoPath
+// startWithMessage is startClaudeProcessWithMessage with an optional
+// --append-system-prompt. A seeded process continues an earlier conversation
+// (see startFallback), so it keeps the session's InitialPrompt.
+func (s *Session) startWithMessage(repoPath, initialMessage, systemPrompt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Get pipes for stdin/stdout/stderr
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		session.State = StateNone
-		return fmt.Errorf("failed to get stdin pipe: %w", err)
+	s.RepoPath = repoPath
+	s.Branch = currentBranch(repoPath)
+	if systemPrompt == "" || s.InitialPrompt == "" {
+		s.InitialPrompt = initialMessage
 	}
+	s.LastActivity = time.Now()
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		session.State = StateNone
-		return fmt.Errorf("failed to get stdout pipe: %w", err)
-	}
+	// Persist and broadcast state change to connected clients
+	s.setState(StateStarting)
 
-	stderr, err := cmd.StderrPipe()
+	opts := s.runOptions(repoPath)
+	opts.AppendSystemPrompt = systemPrompt
+	proc, err := s.runner.Start(opts)
 	if err != nil {
-		session.State = StateNone
-		return fmt.Errorf("failed to get stderr pipe: %w", err)
-	}
-
-	session.cmd = cmd
-	session.stdin = stdin
-	session.stdout = stdout
-	session.stderr = stderr
-
-	// Start the process
-	if err := cmd.Start(); err != nil {
-		session.State = StateNone
+		s.setState(StateNone)
 		return fmt.Errorf("failed to start claude: %w", err)
 	}
+	s.attach(proc)
 
-	slog.Info("claude process started with initial message", "pid", cmd.Process.Pid, "repo_path", repoPath)
-
-	// Start goroutines to handle I/O (these run until process exits)
-	go handleStdout()
-	go handleStderr()
-	go waitForExit()
+	slog.Info("claude process started with initial message", "pid", proc.Pid(), "repo_path", repoPath)
 
 	// Transition to active state (we're about to send a message)
-	session.State = StateActive
-	broadcastState(StateActive)
+	s.setState(StateActive)
 
 	// Send the initial message immediately
-	inputMsg := map[string]interface{}{
-		"type": MessageTypeUser,
-		"message": map[string]interface{}{
-			"role":    MessageTypeUser,
-			"content": initialMessage,
-		},
-	}
-	msgBytes, err := json.Marshal(inputMsg)
-	if err != nil {
-		slog.Error("failed to marshal initial message", "error", err)
-		return fmt.Errorf("failed to format initial message: %w", err)
-	}
-
-	// Write JSON message to stdin
-	_, err = fmt.Fprintf(stdin, "%s\n", msgBytes)
-	if err != nil {
+	if err := proc.Send(initialMessage); err != nil {
 		slog.Error("failed to write initial message to stdin", "error", err)
 		return fmt.Errorf("failed to send initial message: %w", err)
 	}
@@ -670,22 +877,24 @@ func startClaudeProcessWithMessage(repoPath, initialMessage string) error {
 // a previous conversation. The queued message is sent immediately after the
 // process starts.
 //
-// If resume fails (e.g., session ID not found), the process will exit quickly
-// and waitForExit will handle the error state.
+// If resume fails (e.g., session ID not found), the process exits quickly,
+// prints a known error or stays silent past cfg.ResumeTimeout(); waitForExit
+// then requeues the message and the next delivery falls back to a fresh
+// session (see resumeFailed and startFallback).
 //
-// The session.mu lock must NOT be held when calling this function.
-func resumeClaudeProcess(queuedMessage string) error {
-	session.mu.Lock()
-	defer session.mu.Unlock()
+// The s.mu lock must NOT be held when calling this function.
+func (s *Session) resumeClaudeProcess(msg QueuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if session.ClaudeSessionID == "" {
+	if s.ClaudeSessionID == "" {
 		return fmt.Errorf("no session ID available for resume")
 	}
 
-	sessionID := session.ClaudeSessionID
-	repoPath := session.RepoPath
+	sessionID := s.ClaudeSessionID
+	repoPath := s.RepoPath
 	if repoPath == "" {
-		// Fallback to current directory if session.RepoPath wasn't set
+		// Fallback to current directory if s.RepoPath wasn't set
 		var err error
 		repoPath, err = os.Getwd()
 		if err != nil {
@@ -693,85 +902,29 @@ func resumeClaudeProcess(queuedMessage string) error {
 		}
 	}
 
-	session.State = StateStarting
-	session.LastActivity = time.Now()
-
-	broadcastState(StateStarting)
-
-	// Build command with --resume flag
-	args := []string{
-		"--resume", sessionID,
-		"--print",
-		"--input-format=stream-json",
-		"--output-format=stream-json",
-		"--verbose",
-	}
-	if SkipPermissions {
-		args = append(args, "--dangerously-skip-permissions")
-	}
-	cmd := exec.Command("claude", args...)
-	cmd.Dir = repoPath
-
-	// Get pipes for stdin/stdout/stderr
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		session.State = StateStopped
-		return fmt.Errorf("failed to get stdin pipe: %w", err)
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		session.State = StateStopped
-		return fmt.Errorf("failed to get stdout pipe: %w", err)
-	}
+	s.LastActivity = time.Now()
+	s.setState(StateStarting)
 
-	stderr, err := cmd.StderrPipe()
+	proc, err := s.runner.Resume(sessionID, s.runOptions(repoPath))
 	if err != nil {
-		session.State = StateStopped
-		return fmt.Errorf("failed to get stderr pipe: %w", err)
-	}
-
-	session.cmd = cmd
-	session.stdin = stdin
-	session.stdout = stdout
-	session.stderr = stderr
-
-	// Start the process
-	if err := cmd.Start(); err != nil {
-		session.State = StateStopped
+		s.setState(StateStopped)
 		return fmt.Errorf("failed to resume claude: %w", err)
 	}
+	s.attach(proc)
+	s.resume = &resumeAttempt{proc: proc, msg: msg, started: time.Now()}
+	s.watchResume(s.resume)
 
-	slog.Info("claude process resumed", "pid", cmd.Process.Pid, "session_id", sessionID, "repo_path", repoPath)
-
-	// Start goroutines to handle I/O (these run until process exits)
-	go handleStdout()
-	go handleStderr()
-	go waitForExit()
+	slog.Info("claude process resumed", "pid", proc.Pid(), "session_id", sessionID, "repo_path", repoPath)
 
 	// Transition to active state (we're about to send a message)
-	session.State = StateActive
-	broadcastState(StateActive)
+	s.setState(StateActive)
 
-	// Send the queued message immediately
+	// Send the queued message in a goroutine to avoid blocking
 	// Claude will buffer it if not quite ready yet
-	inputMsg := map[string]interface{}{
-		"type": MessageTypeUser,
-		"message": map[string]interface{}{
-			"role":    MessageTypeUser,
-			"content": queuedMessage,
-		},
-	}
-	msgBytes, err := json.Marshal(inputMsg)
-	if err != nil {
-		slog.Error("failed to marshal queued message", "error", err)
-		return fmt.Errorf("failed to format queued message: %w", err)
-	}
-
-	// Write to stdin in a goroutine to avoid blocking
 	go func() {
-		if _, err := fmt.Fprintf(stdin, "%s\n", msgBytes); err != nil {
+		if err := proc.Send(msg.Content); err != nil {
 			slog.Error("failed to write queued message to stdin", "error", err)
+			return
 		}
 		slog.Info("queued message sent to resumed session")
 	}()
@@ -779,6 +932,59 @@ func resumeClaudeProcess(queuedMessage string) error {
 	return nil
 }
 
+// runOptions returns the runner options for a process in repoPath. The
+// caller must hold s.mu.
+func (s *Session) runOptions(repoPath string) RunOptions {
+	opts := RunOptions{
+		Dir:                    repoPath,
+		PermissionMode:         s.PermissionMode,
+		Model:                  s.Model,
+		MaxTurns:               cfg.Budgets.MaxAgentTurns,
+		IncludePartialMessages: cfg.Runner.PartialMessages,
+	}
+	if s.PermissionMode == PermissionModeSkip && permissions.Enforcing() {
+		// Policy rules only apply to calls that reach the permission prompt
+		// tool, so skip mode goes through it too; permissions.Request allows
+		// everything the rules don't stop
+		opts.PermissionMode = PermissionModePrompt
+	}
+	if opts.PermissionMode != PermissionModeSkip {
+		opts.MCPConfig = s.mcpConfig()
+		opts.PermissionPromptTool = PermissionPromptTool
+	}
+	return opts
+}
+
+// attach makes proc the session's process and starts the goroutines that
+// handle its output and exit (these run until the process exits). The caller
+// must hold s.mu.
+//
+// waitForExit only starts once both output streams are drained: Wait closes
+// the pipes, so calling it earlier would drop the last output of a process
+// that exits quickly (e.g. a failed --resume).
+func (s *Session) attach(proc Process) {
+	s.proc = proc
+	s.processCost = 0
+	s.pendingTools = nil
+	s.dropDeltas()
+	s.deltas.messageID = ""
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		s.handleStdout(proc.Stdout())
+	}()
+	go func() {
+		defer readers.Done()
+		s.handleStderr(proc.Stderr())
+	}()
+	go func() {
+		readers.Wait()
+		s.waitForExit(proc)
+	}()
+}
+
 // ClaudeStreamMessage represents a message from Claude's stream-json output.
 //
 // Claude emits several message types:
@@ -789,16 +995,23 @@ func resumeClaudeProcess(queuedMessage string) error {
 //   - "user": Echo of user input (including tool results and replay messages)
 //
 // The SessionID field is critical for resume functionality - it's captured
-// and stored in session.ClaudeSessionID for later use with --resume.
+// and stored in s.ClaudeSessionID for later use with --resume.
 //
 // The Message field uses json.RawMessage to handle different structures:
 //   - For "assistant" messages: {content: [{type, text}]}
 //   - For "user" messages: {role: "user", content: "text"}
 type ClaudeStreamMessage struct {
-	Type      string          `json:"type"`                 // Message type: "assistant", "result", "error", "system", "user"
-	SessionID string          `json:"session_id,omitempty"` // Session ID for --resume (appears in result messages)
-	Result    string          `json:"result,omitempty"`     // Final result text or error message
-	Message   json.RawMessage `json:"message,omitempty"`    // Raw message data (structure varies by type)
+	Type       string          `json:"type"`                     // Message type: "assistant", "result", "error", "system", "user"
+	SessionID  string          `json:"session_id,omitempty"`     // Session ID for --resume (appears in result messages)
+	Result     string          `json:"result,omitempty"`         // Final result text or error message
+	CostUSD    float64         `json:"total_cost_usd,omitempty"` // Running cost of this process (result messages)
+	Usage      *TokenUsage     `json:"usage,omitempty"`          // Tokens used by the turn (result messages)
+	DurationMS int64           `json:"duration_ms,omitempty"`    // Wall time of the turn (result messages)
+	NumTurns   int             `json:"num_turns,omitempty"`      // Agent round trips in the turn (result messages)
+	Message    json.RawMessage `json:"message,omitempty"`        // Raw message data (structure varies by type)
+
+	ParentToolUseID string          `json:"parent_tool_use_id,omitempty"` // Task call a subagent message belongs to
+	Event           json.RawMessage `json:"event,omitempty"`              // Partial message event (stream_event messages)
 }
 
 // ContentBlock represents a block of content in a message.
@@ -825,14 +1038,16 @@ type ContentBlock struct {
 //  6. Starts the idle timer when waiting for input
 //
 // Message types handled:
-//   - "assistant": Claude's response text (broadcast to clients)
+//   - "assistant": Claude's response text (broadcast to clients) and tool calls
+//   - "user": Tool results (sent as tool_result events, see finishTool)
+//   - "stream_event": Partial messages (sent as output_delta events, see handleStreamEvent)
 //   - "result": Response complete, transition to StateWaiting and start idle timer
 //   - "error": Error messages (broadcast with [Error] prefix)
 //   - "system": Internal messages (logged only, not shown to user)
 //
 // The scanner buffer is increased to handle large JSON messages (up to 1MB).
-func handleStdout() {
-	scanner := bufio.NewScanner(session.stdout)
+func (s *Session) handleStdout(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
 	// Increase buffer size for large JSON messages (Claude can send big responses)
 	buf := make([]byte, ScannerInitialBuffer)
 	scanner.Buffer(buf, ScannerMaxBuffer)
@@ -844,100 +1059,144 @@ func handleStdout() {
 		}
 
 		// Update activity timestamps
-		session.mu.Lock()
-		session.LastOutputAt = time.Now()
-		session.LastActivity = time.Now()
-		session.mu.Unlock()
+		s.mu.Lock()
+		s.LastOutputAt = time.Now()
+		s.LastActivity = time.Now()
+		s.mu.Unlock()
 
 		// Try to parse as JSON
 		var msg ClaudeStreamMessage
 		if err := json.Unmarshal([]byte(line), &msg); err != nil {
 			// Not JSON, broadcast as raw output (shouldn't happen with stream-json)
 			slog.Warn("received non-json stdout", "content", line)
-			session.mu.Lock()
-			if _, writeErr := session.outputBuffer.Write([]byte(line + "\n")); writeErr != nil {
+			s.mu.Lock()
+			if _, writeErr := s.outputBuffer.Write([]byte(line + "\n")); writeErr != nil {
 				slog.Error("failed to write to output buffer", "error", writeErr)
 			}
-			session.mu.Unlock()
-			broadcastOutput(line + "\n")
+			s.mu.Unlock()
+			s.broadcastOutput(line + "\n")
 			continue
 		}
+		s.confirmResume()
 
 		// Handle different message types
-		var content string
+		var content, messageID string
 		switch msg.Type {
 		case MessageTypeAssistant:
 			// Parse the message content (assistant messages have content blocks)
 			var assistantMsg struct {
+				ID      string         `json:"id"`
 				Content []ContentBlock `json:"content"`
 			}
 			if err := json.Unmarshal(msg.Message, &assistantMsg); err != nil {
 				slog.Warn("failed to parse assistant message", "error", err)
 				continue
 			}
+			if msg.ParentToolUseID == "" {
+				// The complete message replaces text streamed for it
+				messageID = assistantMsg.ID
+				s.mu.Lock()
+				s.dropDeltas()
+				s.mu.Unlock()
+			}
 
-			// Extract content from message content blocks
+			// Extract content from message content blocks. A subagent's
+			// (Task) text is kept in the transcript but not shown as
+			// Claude's reply; its final report arrives as the Task's result.
 			for _, c := range assistantMsg.Content {
 				switch c.Type {
 				case ContentTypeText:
-					content += c.Text
-				case ContentTypeToolUse:
-					// Tool usage - broadcast structured data for rich display
-					slog.Debug("tool use detected", "tool", c.Name, "input", c.Input)
-
-					// Send structured tool use event
-					toolData := map[string]interface{}{
-						"tool":  c.Name,
-						"input": c.Input,
+					if msg.ParentToolUseID == "" {
+						content += c.Text
 					}
-					toolJSON, err := json.Marshal(toolData)
-					if err == nil {
-						broadcastEvent(SSEEvent{Type: EventTypeToolUse, Content: string(toolJSON)})
+					if c.Text != "" {
+						s.transcribe(TranscriptEntry{Kind: EntryKindText, Text: c.Text, ParentToolUseID: msg.ParentToolUseID})
 					}
-
-					// Also send formatted message for backward compatibility
-					toolMsg := formatToolUse(c.Name, c.Input)
-					broadcastEvent(SSEEvent{Type: EventTypeInfo, Content: toolMsg})
+				case ContentTypeToolUse:
+					// Tool usage - broadcast structured data for rich display
+					slog.Debug("tool use detected", "tool", c.Name, "input", c.Input, "parent", msg.ParentToolUseID)
+					s.startTool(c, msg.ParentToolUseID)
 
 					// Track file edits in real-time
-					trackFileEdit(c.Name, c.Input)
+					s.trackFileEdit(c.Name, c.Input)
 				}
 			}
 			// Capture session ID if present (needed for --resume)
 			if msg.SessionID != "" {
-				session.mu.Lock()
-				session.ClaudeSessionID = msg.SessionID
-				session.mu.Unlock()
-				slog.Info("captured session id", "session_id", msg.SessionID)
+				s.setClaudeSessionID(msg.SessionID)
 			}
 
 		case MessageTypeResult:
 			// Result indicates Claude has finished responding
 			// Don't output the result text (already shown via assistant messages)
 			if msg.SessionID != "" {
-				session.mu.Lock()
-				session.ClaudeSessionID = msg.SessionID
-				session.mu.Unlock()
+				s.setClaudeSessionID(msg.SessionID)
 			}
 			// Transition to waiting state and start idle timer
-			session.mu.Lock()
-			if session.State == StateActive {
-				session.State = StateWaiting
-				slog.Info("state transition", "from", StateActive, "to", StateWaiting, "reason", "response_complete")
-				go broadcastState(StateWaiting)
-				go detectAndBroadcastFileChanges() // Check for git changes
-				resetIdleTimer()                   // Start countdown to session stop
+			s.mu.Lock()
+			s.crashRetries = 0 // Claude is healthy again
+			s.pendingTools = nil
+			s.dropDeltas()
+			s.recordUsage(msg)
+			if s.State == StateActive {
+				interrupted := s.finishInterrupt()
+				s.setState(StateWaiting)
+				reason := "response_complete"
+				if interrupted {
+					reason = "interrupted"
+				}
+				slog.Info("state transition", "from", StateActive, "to", StateWaiting, "reason", reason)
+				go s.detectAndBroadcastFileChanges() // Check for git changes
+				s.resetIdleTimer()                   // Start countdown to session stop
+				if len(s.queue) > 0 {
+					go s.deliverNext() // Next queued message gets the next turn
+				} else {
+					if !interrupted {
+						s.notify(notify.EventTurnComplete, "Claude is waiting", s.outputBuffer.String())
+					}
+					if s.budgeted() {
+						go s.checkBudget() // Tell clients now if this turn used up the budget
+					}
+				}
 			}
-			session.mu.Unlock()
+			s.mu.Unlock()
 			continue // Don't output the result text
 
 		case MessageTypeUser:
 			// Echo of user input (including tool results) - don't show this to user
-			// This is Claude Code echoing back our input, not user-facing content
+			// This is Claude Code echoing back our input, not user-facing content.
+			// Tool results are sent as tool_result events.
+			var userMsg struct {
+				Content json.RawMessage `json:"content"`
+			}
+			if err := json.Unmarshal(msg.Message, &userMsg); err != nil {
+				continue
+			}
+			var blocks []toolResultBlock
+			if err := json.Unmarshal(userMsg.Content, &blocks); err != nil {
+				continue // Plain-text echo of our own message
+			}
+			for _, b := range blocks {
+				if b.Type == ContentTypeToolResult {
+					s.finishTool(b, msg.ParentToolUseID)
+				}
+			}
 			continue
 
 		case MessageTypeError:
 			content = "[Error] " + msg.Result
+			s.transcribe(TranscriptEntry{Kind: EntryKindError, Text: msg.Result})
+			s.mu.RLock()
+			s.notify(notify.EventError, "Claude hit an error", msg.Result)
+			s.mu.RUnlock()
+
+		case MessageTypeStreamEvent:
+			s.handleStreamEvent(msg)
+			continue
+
+		case MessageTypeControl:
+			slog.Debug("control response received", "content", line)
+			continue
 
 		case MessageTypeSystem:
 			// System messages are for debugging, not user-facing
@@ -952,12 +1211,12 @@ func handleStdout() {
 
 		// Broadcast non-empty content to all connected SSE clients
 		if content != "" {
-			session.mu.Lock()
-			if _, err := session.outputBuffer.Write([]byte(content)); err != nil {
+			s.mu.Lock()
+			if _, err := s.outputBuffer.Write([]byte(content)); err != nil {
 				slog.Error("failed to write to output buffer", "error", err)
 			}
-			session.mu.Unlock()
-			broadcastOutput(content)
+			s.mu.Unlock()
+			s.broadcastEvent(SSEEvent{Type: EventTypeOutput, Content: content, MessageID: messageID})
 		}
 	}
 
@@ -977,8 +1236,8 @@ func handleStdout() {
 //  3. Broadcast to SSE clients
 //
 // This ensures users see the same output they would see in a terminal.
-func handleStderr() {
-	reader := bufio.NewReader(session.stderr)
+func (s *Session) handleStderr(stderr io.Reader) {
+	reader := bufio.NewReader(stderr)
 	buf := make([]byte, StderrReadBufferSize)
 
 	for {
@@ -995,32 +1254,36 @@ func handleStderr() {
 			slog.Debug("stderr output", "content", output)
 
 			// Broadcast stderr as output (users expect to see this in the terminal)
-			session.mu.Lock()
-			if _, err := session.outputBuffer.Write(buf[:n]); err != nil {
+			s.mu.Lock()
+			if _, err := s.outputBuffer.Write(buf[:n]); err != nil {
 				slog.Error("failed to write stderr to output buffer", "error", err)
 			}
-			session.mu.Unlock()
+			s.noteResumeStderr(output)
+			s.mu.Unlock()
 
-			broadcastOutput(output)
+			s.broadcastOutput(output)
 		}
 	}
 }
 
 // waitForExit waits for the Claude process to terminate and handles cleanup.
 //
-// This goroutine blocks on cmd.Wait() until the process exits. It then:
+// This goroutine blocks on proc.Wait() until the process exits. It then:
 //  1. Logs the exit status
 //  2. Transitions state based on why we exited:
 //     - StateShuttingDown → StateStopped (expected shutdown)
-//     - Any other state → StateNone (unexpected crash)
-//  3. Cleans up process handles
+//     - Resume pending → StateStopped, message requeued (resume failed)
+//     - Interrupt pending → StateStopped (the interrupt fallback stopped it)
+//     - Any other state → StateCrashed (unexpected crash, resume scheduled)
+//     or StateNone (no way to recover)
+//  3. Detaches the process from the session
 //
 // If the exit was unexpected, broadcasts an error event to connected clients.
-func waitForExit() {
-	err := session.cmd.Wait()
+func (s *Session) waitForExit(proc Process) {
+	err := proc.Wait()
 
-	session.mu.Lock()
-	defer session.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	if err != nil {
 		slog.Warn("claude process exited with error", "error", err)
@@ -1029,37 +1292,57 @@ func waitForExit() {
 	}
 
 	// If we were shutting down, this is expected
-	if session.State == StateShuttingDown {
-		session.State = StateStopped
-		slog.Info("session stopped successfully", "session_id", session.ClaudeSessionID)
-		broadcastState(StateStopped)
+	if s.State == StateShuttingDown {
+		s.setState(StateStopped)
+		slog.Info("session stopped successfully", "session_id", s.ClaudeSessionID)
+		select {
+		case <-s.ended:
+			// Ended on purpose; nothing to resume
+		default:
+			s.notify(notify.EventStopped, "Session stopped", "Send a message to resume.")
+		}
+	} else if s.resumeFailed(proc, err) {
+		// The next delivery starts a fresh session instead (see startFallback)
+	} else if s.finishInterrupt() {
+		// Stopped because the interrupt request didn't end the turn; the
+		// conversation resumes on the next message
+		s.setState(StateStopped)
+		slog.Info("session stopped after interrupt", "session_id", s.ClaudeSessionID)
 	} else {
 		// Unexpected exit (crash or user killed the process)
-		session.State = StateNone
-		slog.Error("unexpected process exit", "state", session.State, "session_id", session.ClaudeSessionID)
-		broadcastState(StateNone)
-		broadcastEvent(SSEEvent{Type: EventTypeError, Content: "Claude process exited unexpectedly"})
+		s.Crashes++
+		if !s.recoverAfterCrash() {
+			s.giveUpAfterCrash()
+		}
 	}
 
-	// Clean up process handles
-	session.cmd = nil
-	session.stdin = nil
-	session.stdout = nil
-	session.stderr = nil
+	// Detach the process (unless a new one has already been attached)
+	if s.proc == proc {
+		s.proc = nil
+	}
+	if s.resume != nil && s.resume.proc == proc {
+		s.resume = nil
+	}
+
+	// Messages queued while shutting down resume the session
+	if s.State == StateStopped && len(s.queue) > 0 {
+		go s.deliverNext()
+	}
 }
 
 // resetIdleTimer cancels any existing timer and starts a new one.
 //
 // Called when Claude transitions to StateWaiting after completing a response.
-// When the timer fires, stopSession() is called to shut down the idle session.
-//
-// TODO: Make timeout configurable via config file or environment variable.
-func resetIdleTimer() {
-	cancelIdleTimer()
-
-	session.idleTimer = time.AfterFunc(session.idleTimeout, func() {
-		slog.Info("idle timeout reached", "timeout", session.idleTimeout)
-		stopSession()
+// When the timer fires, s.stopSession() is called to shut down the idle session.
+// The timeout comes from timeouts.idle_seconds in the config.
+func (s *Session) resetIdleTimer() {
+	s.cancelIdleTimer()
+
+	s.idleTimer = time.AfterFunc(s.idleTimeout, func() {
+		slog.Info("idle timeout reached", "id", s.ID, "timeout", s.idleTimeout)
+		if err := s.stopSession(); err != nil {
+			slog.Warn("cannot stop session", "id", s.ID, "error", err)
+		}
 	})
 }
 
@@ -1068,10 +1351,10 @@ func resetIdleTimer() {
 // Called when:
 //   - A new message is sent (user is active again)
 //   - Session is shutting down
-func cancelIdleTimer() {
-	if session.idleTimer != nil {
-		session.idleTimer.Stop()
-		session.idleTimer = nil
+func (s *Session) cancelIdleTimer() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
 	}
 }
 
@@ -1081,44 +1364,43 @@ func cancelIdleTimer() {
 // doesn't exit within the configured timeout, sends SIGKILL to force termination.
 //
 // Only stops if session is in StateWaiting (idle but ready). If called
-// in any other state, logs a warning and returns.
+// in any other state, returns an error and leaves the session untouched.
 //
 // The session can be resumed later by spawning `claude --resume {session-id}`.
 // Session state is persisted by Claude in ~/.claude/, and code changes are
 // handled by git commits.
-func stopSession() {
-	session.mu.Lock()
-	defer session.mu.Unlock()
+func (s *Session) stopSession() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if session.State != StateWaiting {
-		slog.Warn("cannot stop session", "state", session.State, "expected", StateWaiting)
-		return
+	if s.State != StateWaiting {
+		return fmt.Errorf("cannot stop session in state %s (expected %s)", s.State, StateWaiting)
 	}
 
-	session.State = StateShuttingDown
-	broadcastState(StateShuttingDown)
+	s.setState(StateShuttingDown)
 
 	// Send SIGTERM to Claude process for graceful shutdown
-	if session.cmd != nil && session.cmd.Process != nil {
-		processToKill := session.cmd.Process // Capture the process we're shutting down
-		pid := processToKill.Pid
+	if s.proc != nil {
+		processToKill := s.proc // Capture the process we're shutting down
+		pid := processToKill.Pid()
 
 		slog.Info("sending SIGTERM to claude process", "pid", pid)
-		if err := processToKill.Signal(os.Interrupt); err != nil {
+		if err := processToKill.Stop(); err != nil {
 			slog.Error("failed to send SIGTERM", "error", err)
 			// Try SIGKILL immediately if SIGTERM fails
 			if killErr := processToKill.Kill(); killErr != nil {
 				slog.Error("failed to kill process immediately", "error", killErr)
 			}
-			return
+			return nil
 		}
 
 		// Give it time to shut down gracefully, then SIGKILL
 		// IMPORTANT: Capture the process pointer to avoid killing a resumed session
-		go func(proc *os.Process, pid int) {
-			time.Sleep(GracefulShutdownTimeout)
-			// Only kill THIS specific process, not whatever session.cmd points to now
-			slog.Warn("force killing process after timeout", "timeout", GracefulShutdownTimeout, "pid", pid)
+		grace := cfg.ShutdownGrace()
+		go func(proc Process, pid int) {
+			time.Sleep(grace)
+			// Only kill THIS specific process, not whatever s.proc points to now
+			slog.Warn("force killing process after timeout", "timeout", grace, "pid", pid)
 			if err := proc.Kill(); err != nil {
 				slog.Debug("failed to force kill process (may have already exited)", "error", err, "pid", pid)
 			}
@@ -1128,76 +1410,86 @@ func stopSession() {
 	// TODO: In the simplified architecture, we don't need Sprites checkpoints.
 	// Session state is persisted by Claude in ~/.claude/, and code changes
 	// are handled by git. Just stop the process and resume later with --resume.
+	return nil
 }
 
 // handleStream establishes a Server-Sent Events (SSE) connection for real-time updates.
 //
 // GET /stream
+// GET /sessions/{id}/stream
 //
 // This endpoint:
 //  1. Sets up SSE headers for streaming
 //  2. Registers the client to receive events
-//  3. Sends the current session state and recent output (for reconnection)
+//  3. Replays missed events (reconnect with Last-Event-ID), or sends the
+//     current session state and recent output (fresh connect)
 //  4. Streams events until the client disconnects
 //
+// Every event carries an "id:" field. Browsers send the last one back in the
+// Last-Event-ID header when EventSource reconnects; clients that reconnect
+// manually can pass ?last_event_id= instead. If the journal no longer holds
+// every missed event, the client gets the fresh-connect snapshot instead.
+//
+// A client that falls too far behind (its buffer fills up) is disconnected
+// rather than silently losing events, so it reconnects and replays.
+//
 // Events sent:
 //   - "output": Claude's response text (Content field)
 //   - "state": Session state changes (State field)
 //   - "error": Error messages (Content field)
 //
-// The connection stays open until the client disconnects or the server shuts down.
+// The connection stays open until the client disconnects, the session is
+// ended, or the server shuts down.
 func handleStream(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	// Set SSE headers
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	// Create client with unique ID (timestamp-based)
-	clientID := fmt.Sprintf("%d", time.Now().UnixNano())
-	client := &SSEClient{
-		id:     clientID,
-		events: make(chan SSEEvent, SSEClientBufferSize),
-		done:   make(chan struct{}),
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
 	}
 
-	// Register client
-	session.sseMu.Lock()
-	session.sseClients[clientID] = client
-	session.sseMu.Unlock()
-
-	slog.Info("sse client connected", "client_id", clientID)
+	client, initial := s.subscribe(lastEventID)
+	clientID := client.id
+	slog.Info("sse client connected", "id", s.ID, "client_id", clientID, "last_event_id", lastEventID)
 
-	// Send current state and recent output (for reconnection)
-	session.mu.RLock()
-	currentState := session.State
-	recentOutput := session.outputBuffer.String()
-	session.mu.RUnlock()
-
-	// Send recent output buffer so reconnecting clients see context
-	if recentOutput != "" {
-		sendSSE(w, SSEEvent{Type: EventTypeOutput, Content: recentOutput})
+	for _, event := range initial {
+		sendSSE(w, event)
 	}
 
-	// Send current state
-	sendSSE(w, SSEEvent{Type: EventTypeState, State: string(currentState)})
-
 	// Flush to ensure headers and initial events are sent
 	if f, ok := w.(http.Flusher); ok {
 		f.Flush()
 	}
 
-	// Stream events until client disconnects
+	// Stream events until client disconnects or the session is ended
 	ctx := r.Context()
 	for {
 		select {
 		case <-ctx.Done():
 			// Client disconnected (browser closed, network issue, etc.)
-			session.sseMu.Lock()
-			delete(session.sseClients, clientID)
-			session.sseMu.Unlock()
-			close(client.done)
-			slog.Info("sse client disconnected", "client_id", clientID)
+			s.removeSSEClient(client)
+			slog.Info("sse client disconnected", "id", s.ID, "client_id", clientID)
+			return
+
+		case <-s.ended:
+			// Session was ended - nothing more will be sent
+			s.removeSSEClient(client)
+			slog.Info("sse client closed, session ended", "id", s.ID, "client_id", clientID)
+			return
+
+		case <-client.lagged:
+			// Client fell behind - drop the connection so it reconnects
+			// with Last-Event-ID and replays from the journal
+			s.removeSSEClient(client)
+			slog.Warn("sse client lagged, closing for replay", "id", s.ID, "client_id", clientID)
 			return
 
 		case event := <-client.events:
@@ -1209,19 +1501,81 @@ func handleStream(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// subscribe registers a new client for the session's broadcast events and
+// returns the events to send it before the live stream.
+//
+// If lastEventID is a journal ID the client has already seen (a reconnect),
+// the initial events are exactly the ones it missed. Otherwise (a fresh
+// connect, or the journal no longer holds every missed event) they are the
+// recent output buffer and current state, tagged with the current journal ID
+// so the next reconnect replays from there.
+//
+// Used by both the SSE and WebSocket transports.
+func (s *Session) subscribe(lastEventID string) (*SSEClient, []SSEEvent) {
+	// Create client with unique ID (timestamp-based)
+	client := &SSEClient{
+		id:     fmt.Sprintf("%d", time.Now().UnixNano()),
+		events: make(chan SSEEvent, SSEClientBufferSize),
+		done:   make(chan struct{}),
+		lagged: make(chan struct{}),
+	}
+
+	// Snapshot state before registering so no state change is missed: any
+	// change after this point is broadcast to the registered client.
+	s.mu.RLock()
+	currentState := s.State
+	recentOutput := s.outputBuffer.String()
+	s.mu.RUnlock()
+
+	// Register client and read the journal atomically with respect to
+	// broadcasts, so the replay and the live stream neither overlap nor gap
+	s.sseMu.Lock()
+	replay, replayOK := s.journal.Since(parseEventID(lastEventID))
+	snapshotID := s.journal.LastID()
+	s.sseClients[client.id] = client
+	s.sseMu.Unlock()
+
+	if replayOK && lastEventID != "" {
+		// Reconnect: send exactly the events this client missed, in order
+		return client, replay
+	}
+
+	var initial []SSEEvent
+	if recentOutput != "" {
+		initial = append(initial, SSEEvent{ID: snapshotID, Type: EventTypeOutput, Content: recentOutput})
+	}
+	initial = append(initial, SSEEvent{ID: snapshotID, Type: EventTypeState, State: string(currentState)})
+	return client, initial
+}
+
+// removeSSEClient unregisters a client and signals that it is done.
+func (s *Session) removeSSEClient(client *SSEClient) {
+	s.sseMu.Lock()
+	delete(s.sseClients, client.id)
+	s.sseMu.Unlock()
+	close(client.done)
+}
+
 // sendSSE sends a single SSE event to the HTTP response writer.
 //
 // Events are JSON-encoded and formatted according to the SSE spec:
 //
-//	data: {"type":"output","content":"Hello"}\n\n
+//	id: 42\nevent: output\ndata: {"id":42,"type":"output","content":"Hello"}\n\n
 //
-// The double newline signals the end of the event.
+// The id line is omitted for events without a journal ID. The double newline
+// signals the end of the event.
 func sendSSE(w http.ResponseWriter, event SSEEvent) {
 	data, err := json.Marshal(event)
 	if err != nil {
 		slog.Error("failed to marshal sse event", "error", err)
 		return
 	}
+	if event.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.ID); err != nil {
+			slog.Error("failed to write sse event", "error", err)
+			return
+		}
+	}
 	// Send SSE event with explicit event type so frontend addEventListener works
 	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
 		slog.Error("failed to write sse event", "error", err)
@@ -1229,15 +1583,114 @@ func sendSSE(w http.ResponseWriter, event SSEEvent) {
 }
 
 // broadcastOutput broadcasts Claude's output text to all connected SSE clients.
-func broadcastOutput(content string) {
+func (s *Session) broadcastOutput(content string) {
 	event := SSEEvent{Type: EventTypeOutput, Content: content}
-	broadcastEvent(event)
+	s.broadcastEvent(event)
+}
+
+// setState transitions the session to a new state.
+//
+// The transition and an updated metadata record are written to the session
+// store (if any) and the new state is broadcast to SSE clients. The caller
+// must hold s.mu.
+func (s *Session) setState(state SessionState) {
+	from := s.State
+	s.State = state
+
+	if from != state {
+		s.recordSpan(from, time.Now())
+		if state == StateActive && s.limitsActiveTime() {
+			go s.armBudgetTimer()
+		}
+	}
+	if s.store != nil && from != state {
+		transition := StateTransition{ID: s.ID, From: from, To: state, At: time.Now()}
+		if err := s.store.RecordTransition(transition); err != nil {
+			slog.Error("failed to record state transition", "id", s.ID, "error", err)
+		}
+		s.persist()
+	}
+
+	s.broadcastState(state)
+}
+
+// setClaudeSessionID stores the Claude session ID used for --resume.
+//
+// The ID is persisted immediately when it changes so a server restart can
+// still resume the conversation. The caller must NOT hold s.mu.
+func (s *Session) setClaudeSessionID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ClaudeSessionID == id {
+		return
+	}
+	s.ClaudeSessionID = id
+	slog.Info("captured session id", "id", s.ID, "session_id", id)
+	s.persist()
+}
+
+// record returns the session's persistent metadata. The caller must hold s.mu.
+func (s *Session) record() SessionRecord {
+	usage := s.Usage
+	rec := SessionRecord{
+		ID:              s.ID,
+		ClaudeSessionID: s.ClaudeSessionID,
+		RepoPath:        s.RepoPath,
+		Branch:          s.Branch,
+		InitialPrompt:   s.InitialPrompt,
+		PermissionMode:  s.PermissionMode,
+		AllowRules:      s.AllowRules,
+		Model:           s.Model,
+		Usage:           &usage,
+		State:           s.State,
+		CreatedAt:       s.CreatedAt,
+		LastActivity:    s.LastActivity,
+		ActiveSeconds:   s.activeTime.Seconds(),
+		BudgetExemptDay: s.budgetExemptDay,
+		BudgetBlock:     s.budgetBlock,
+	}
+	if s.Budget != cfg.Budgets.Session {
+		budget := s.Budget
+		rec.Budget = &budget
+	}
+	if s.budgetBase != (BudgetUsage{}) {
+		base := s.budgetBase
+		rec.BudgetBase = &base
+	}
+	return rec
+}
+
+// persist writes the session's metadata to the store. The caller must hold s.mu.
+func (s *Session) persist() {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.SaveSession(s.record()); err != nil {
+		slog.Error("failed to persist session", "id", s.ID, "error", err)
+	}
+}
+
+// currentBranch returns the checked-out git branch in repoPath, or "" if it
+// can't be determined (not a git repo, detached HEAD, etc.).
+func currentBranch(repoPath string) string {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	branch := strings.TrimSpace(string(output))
+	if branch == "HEAD" {
+		return ""
+	}
+	return branch
 }
 
 // broadcastState broadcasts a session state change to all connected SSE clients.
-func broadcastState(state SessionState) {
+func (s *Session) broadcastState(state SessionState) {
 	event := SSEEvent{Type: EventTypeState, State: string(state)}
-	broadcastEvent(event)
+	s.broadcastEvent(event)
 }
 
 // formatToolUse formats a tool use event for display to the user.
@@ -1279,22 +1732,29 @@ func formatToolUse(name string, input map[string]interface{}) string {
 	return fmt.Sprintf("🔧 %s", name)
 }
 
-// broadcastEvent sends an event to all connected SSE clients.
+// broadcastEvent records an event in the journal and sends it to all
+// connected SSE clients.
 //
-// Uses a non-blocking send (select with default) to prevent slow clients from
-// blocking broadcasts. If a client's event buffer is full, the event is dropped
-// for that client only.
-func broadcastEvent(event SSEEvent) {
-	session.sseMu.RLock()
-	defer session.sseMu.RUnlock()
+// sseMu is held exclusively for the whole broadcast so every client sees
+// events in journal order. Sends are non-blocking to prevent slow clients
+// from blocking broadcasts: if a client's buffer is full, it is unregistered
+// and told to disconnect (via lagged), and replays the missed events from the
+// journal when it reconnects.
+func (s *Session) broadcastEvent(event SSEEvent) {
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
 
-	for _, client := range session.sseClients {
+	event = s.journal.Append(event)
+
+	for id, client := range s.sseClients {
 		select {
 		case client.events <- event:
 			// Event queued successfully
 		default:
-			// Client buffer full (client is slow or disconnected), skip this event
-			slog.Warn("client buffer full, skipping event", "client_id", client.id)
+			// Client buffer full (client is slow or disconnected)
+			slog.Warn("client buffer full, disconnecting for replay", "client_id", client.id, "event_id", event.ID)
+			delete(s.sseClients, id)
+			close(client.lagged)
 		}
 	}
 }
@@ -1308,10 +1768,10 @@ type FileChange struct {
 
 // FileEditEvent represents a real-time file edit operation from Claude's tool calls.
 type FileEditEvent struct {
-	Tool      string `json:"tool"`       // Tool name: "Edit", "Write", or "NotebookEdit"
-	FilePath  string `json:"file_path"`  // Absolute path to the file being edited
-	Operation string `json:"operation"`  // Type of operation: "edit", "write", "create"
-	Timestamp string `json:"timestamp"`  // ISO 8601 timestamp
+	Tool      string `json:"tool"`      // Tool name: "Edit", "Write", or "NotebookEdit"
+	FilePath  string `json:"file_path"` // Absolute path to the file being edited
+	Operation string `json:"operation"` // Type of operation: "edit", "write", "create"
+	Timestamp string `json:"timestamp"` // ISO 8601 timestamp
 }
 
 // trackFileEdit tracks file edit operations from Claude's tool calls in real-time.
@@ -1324,7 +1784,7 @@ type FileEditEvent struct {
 //   - Edit: Modifying existing file content
 //   - Write: Creating new files or overwriting existing ones
 //   - NotebookEdit: Editing Jupyter notebook cells
-func trackFileEdit(toolName string, input map[string]interface{}) {
+func (s *Session) trackFileEdit(toolName string, input map[string]interface{}) {
 	// Only track file editing tools
 	if toolName != "Edit" && toolName != "Write" && toolName != "NotebookEdit" {
 		return
@@ -1377,7 +1837,7 @@ func trackFileEdit(toolName string, input map[string]interface{}) {
 
 	// Broadcast to SSE clients
 	slog.Info("file edit tracked", "tool", toolName, "path", filePath, "operation", operation)
-	broadcastEvent(SSEEvent{
+	s.broadcastEvent(SSEEvent{
 		Type:    EventTypeFileChanges,
 		Content: string(eventJSON),
 	})
@@ -1391,23 +1851,16 @@ func trackFileEdit(toolName string, input map[string]interface{}) {
 //  3. Broadcasts the changes as a file_changes event
 //
 // This allows the frontend to show users what files Claude modified.
-func detectAndBroadcastFileChanges() {
-	// Get the repo path from session or env or current directory
-	session.mu.RLock()
-	repoPath := session.RepoPath
-	session.mu.RUnlock()
+func (s *Session) detectAndBroadcastFileChanges() {
+	// Get the repo path from session or config or current directory
+	s.mu.RLock()
+	repoPath := s.RepoPath
+	s.mu.RUnlock()
 
-	if repoPath == "" {
-		if envPath := os.Getenv("REPO_PATH"); envPath != "" {
-			repoPath = envPath
-		} else {
-			var err error
-			repoPath, err = os.Getwd()
-			if err != nil {
-				slog.Debug("failed to get current directory for git diff", "error", err)
-				return
-			}
-		}
+	repoPath, err := resolveRepoPath(repoPath)
+	if err != nil {
+		slog.Debug("failed to get current directory for git diff", "error", err)
+		return
 	}
 
 	// Run git status to detect changed files
@@ -1476,7 +1929,8 @@ func detectAndBroadcastFileChanges() {
 		}
 
 		slog.Info("detected file changes", "count", len(changes))
-		broadcastEvent(SSEEvent{
+		s.transcribe(TranscriptEntry{Kind: EntryKindFileChanges, Files: summarizeChanges(changes)})
+		s.broadcastEvent(SSEEvent{
 			Type:    EventTypeFileChanges,
 			Content: string(changesJSON),
 		})
@@ -1486,36 +1940,55 @@ func detectAndBroadcastFileChanges() {
 // handleMessage sends a user message to Claude.
 //
 // POST /message
+// POST /sessions/{id}/message
 // Request body:
 //
 //	{
 //	  "content": "Your message to Claude"
 //	}
 //
+// Messages are accepted in any state and queued in order. The oldest queued
+// message is delivered whenever Claude can take one (see deliverNext), so
+// each message gets its own turn.
+//
 // Response on success:
 //
 //	{
 //	  "success": true,
 //	  "queued": true,
+//	  "id": "9f2c...",  // Message ID (for DELETE /queue/{id})
+//	  "position": 0,    // Place in the queue, 0 once delivered
 //	  "state": "active"
 //	}
 //
-// Response on error:
-//
-//	{
-//	  "error": "session is starting, please wait"
-//	}
-//
 // State handling:
 //   - StateNone: Starts a new session and sends the message immediately
-//   - StateStopped: Triggers resume flow - spawns `claude --resume {session-id}`
-//   - StateStarting: Returns error (wait for session to be ready)
-//   - StateActive/StateWaiting: Sends message to Claude via stdin
+//   - StateStopped/StateCrashed: Triggers resume flow - spawns `claude --resume {session-id}`
+//   - StateWaiting: Sends message to Claude via stdin
+//   - StateStarting/StateActive/StateShuttingDown: Queues the message until
+//     Claude finishes its turn or the process stops
 //
 // When sending a message to a StateWaiting session:
 //   - Cancels the idle timer (user is active again)
 //   - Transitions to StateActive
 //   - Updates LastActivity timestamp
+//
+// Clients that retry should send an Idempotency-Key header. A message with a
+// key the session has already seen isn't sent again; the response has
+// "duplicate": true and the original message's ID.
+//
+// Doze slash commands (/status, /stop, /help, ...) are handled in any state
+// without reaching Claude or the queue. The result is broadcast as an info
+// event and returned as "command" (with "queued": false):
+//
+//	{
+//	  "success": true,
+//	  "queued": false,
+//	  "state": "waiting",
+//	  "command": {"command": "status", "text": "State: waiting ...", "data": {...}}
+//	}
+//
+// Unknown slash commands are sent to Claude like any other message.
 func handleMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1535,136 +2008,217 @@ func handleMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session.mu.Lock()
-	state := session.State
-	stdin := session.stdin
-	session.mu.Unlock()
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := s.sendMessage(req.Content, r.Header.Get("Idempotency-Key"))
+	if errors.Is(err, ErrQueueFull) {
+		respondError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	var exceeded *BudgetExceeded
+	if errors.As(err, &exceeded) {
+		respondJSON(w, http.StatusPaymentRequired, map[string]interface{}{
+			"error":           err.Error(),
+			"budget_exceeded": exceeded,
+		})
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"queued":  result.Command == nil,
+		"id":      result.ID,
+		"state":   result.State,
+	}
+	if result.Command != nil {
+		resp["command"] = result.Command
+	} else {
+		resp["position"] = result.Position
+	}
+	if result.Duplicate {
+		resp["duplicate"] = true
+	}
+	if result.Started {
+		resp["started"] = true
+	}
+	if result.Resumed {
+		resp["resumed"] = true
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// MessageResult describes how sendMessage handled a message.
+type MessageResult struct {
+	ID        string       // Message ID
+	Position  int          // Place in the queue (0 once delivered)
+	Duplicate bool         // The idempotency key was already used; nothing was sent
+	Started   bool         // A new Claude process was started
+	Resumed   bool         // A stopped session was resumed
+	State     SessionState // Session state after the message was handled
+
+	Command *CommandResult // Set if the message was a Doze slash command
+}
+
+// sendMessage queues a user message for the session's Claude process and
+// delivers it right away if Claude can take it, starting or resuming the
+// process as needed. key is the client's Idempotency-Key ("" for none).
+//
+// This is the message state machine shared by POST /message and the
+// WebSocket "message" frame. See handleMessage for the state handling.
+// Messages naming a registered slash command (see commands) are handled by
+// Doze instead.
+func (s *Session) sendMessage(content, key string) (MessageResult, error) {
+	id, duplicate := s.claimKey(key)
+	if duplicate {
+		slog.Info("duplicate message ignored", "id", s.ID, "message_id", id)
+		if s.queuePosition(id) > 0 {
+			// Still queued, e.g. after a failed delivery: try again
+			if result, err := s.deliverNext(); err != nil && result.ID == id {
+				return MessageResult{}, err
+			}
+		}
+		s.mu.RLock()
+		state := s.State
+		s.mu.RUnlock()
+		return MessageResult{ID: id, Position: s.queuePosition(id), Duplicate: true, State: state}, nil
+	}
+
+	// Doze's own slash commands never reach Claude (unless they pass through)
+	if cmd, args, ok := commands.Lookup(content); ok {
+		result := s.runCommand(commands, cmd, args)
+		if !cmd.PassThrough {
+			s.mu.RLock()
+			state := s.State
+			s.mu.RUnlock()
+			return MessageResult{ID: id, Command: &result, State: state}, nil
+		}
+	}
+
+	if exceeded := s.checkBudget(); exceeded != nil {
+		s.releaseKey(key)
+		return MessageResult{}, exceeded
+	}
+
+	msg := QueuedMessage{ID: id, Content: content, IdempotencyKey: key, QueuedAt: time.Now()}
+	if err := s.enqueue(msg); err != nil {
+		s.releaseKey(key)
+		return MessageResult{}, err
+	}
+	slog.Info("message queued", "id", s.ID, "message_id", id)
+
+	result, err := s.deliverNext()
+	if err != nil {
+		if result.ID == id {
+			return MessageResult{}, err // Requeued; a retry with the same key tries again
+		}
+		result = MessageResult{State: result.State} // Another message failed; this one waits
+	}
+	result.ID = id
+	result.Position = s.queuePosition(id)
+	return result, nil
+}
+
+// deliver sends msg to Claude from state, which must be one where Claude
+// can take a message. The caller must hold s.startMu but NOT s.mu.
+func (s *Session) deliver(state SessionState, msg QueuedMessage) (MessageResult, error) {
+	content := msg.Content
+	s.mu.RLock()
+	proc := s.proc
+	s.mu.RUnlock()
 
 	// Handle based on current state
 	switch state {
 	case StateNone:
 		// No session exists - start a new session with this message
-		slog.Info("starting new session from message", "message", req.Content)
+		slog.Info("starting new session from message", "id", s.ID, "message", content)
 
-		// Get repo path from environment or use current directory
-		repoPath := os.Getenv("REPO_PATH")
-		if repoPath == "" {
-			var err error
-			repoPath, err = os.Getwd()
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get working directory: %v", err))
-				return
-			}
+		// Reuse the session's previous repo path, falling back to env or current directory
+		s.mu.RLock()
+		repoPath := s.RepoPath
+		s.mu.RUnlock()
+		repoPath, err := resolveRepoPath(repoPath)
+		if err != nil {
+			return MessageResult{}, fmt.Errorf("failed to get working directory: %v", err)
 		}
 
 		// Start the session with the queued message
-		if err := startClaudeProcessWithMessage(repoPath, req.Content); err != nil {
+		if err := s.startClaudeProcessWithMessage(repoPath, content); err != nil {
 			slog.Error("failed to start session with message", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to start session: %v", err))
-			return
+			return MessageResult{}, fmt.Errorf("failed to start session: %v", err)
 		}
 
-		respondJSON(w, http.StatusOK, map[string]interface{}{
-			"success": true,
-			"queued":  true,
-			"started": true,
-			"state":   StateActive,
-		})
-		return
-
-	case StateStopped:
-		// Session was stopped due to idle timeout - trigger resume
-		slog.Info("resuming stopped session", "session_id", session.ClaudeSessionID, "message", req.Content)
+		return MessageResult{Started: true, State: StateActive}, nil
+
+	case StateStopped, StateCrashed:
+		// Session was stopped due to idle timeout (or crashed) - trigger resume
+		s.mu.Lock()
+		s.cancelRecovery() // Resuming now instead of after the backoff
+		blocker := s.resumeBlocker()
+		s.mu.Unlock()
+		if blocker != "" {
+			// --resume can't work; start over with what we know
+			return s.startFallback(msg, blocker)
+		}
+		slog.Info("resuming stopped session", "id", s.ID, "message", content)
 
 		// Resume the session with the queued message
-		if err := resumeClaudeProcess(req.Content); err != nil {
+		if err := s.resumeClaudeProcess(msg); err != nil {
 			slog.Error("failed to resume session", "error", err)
-			respondError(w, http.StatusInternalServerError, fmt.Sprintf("failed to resume: %v", err))
-			return
+			return MessageResult{}, fmt.Errorf("failed to resume: %v", err)
 		}
 
-		respondJSON(w, http.StatusOK, map[string]interface{}{
-			"success": true,
-			"queued":  true,
-			"resumed": true,
-			"state":   StateActive,
-		})
-		return
-
-	case StateStarting:
-		// Session is still starting up - user should wait and retry
-		respondJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
-			"error":  "session is starting, please wait",
-			"queued": false,
-		})
-		return
+		return MessageResult{Resumed: true, State: StateActive}, nil
 
-	case StateActive, StateWaiting:
+	case StateWaiting:
 		// Session is ready - send message to Claude
-		if stdin == nil {
-			slog.Error("stdin not available", "state", state)
-			respondError(w, http.StatusInternalServerError, "stdin not available")
-			return
-		}
-
-		// Handle /clear command - clear ring buffer
-		if strings.TrimSpace(req.Content) == "/clear" {
-			session.mu.Lock()
-			session.outputBuffer = NewRingBuffer(RingBufferSize)
-			session.mu.Unlock()
-			slog.Info("cleared ring buffer due to /clear command")
+		if proc == nil {
+			slog.Error("process not available", "state", state)
+			return MessageResult{}, errors.New("process not available")
 		}
 
-		// Format message as JSON for stream-json input
-		// Claude expects: {"type":"user","message":{"role":"user","content":"..."}}
-		inputMsg := map[string]interface{}{
-			"type": MessageTypeUser,
-			"message": map[string]interface{}{
-				"role":    MessageTypeUser,
-				"content": req.Content,
-			},
-		}
-		msgBytes, err := json.Marshal(inputMsg)
-		if err != nil {
-			slog.Error("failed to marshal input message", "error", err)
-			respondError(w, http.StatusInternalServerError, "failed to format message")
-			return
+		// Mark active and cancel the idle timer. This happens before sending so the "result" of a fast response
+		// can't arrive while we're still in StateWaiting.
+		s.mu.Lock()
+		s.LastActivity = time.Now()
+		if s.InitialPrompt == "" {
+			s.InitialPrompt = content
 		}
+		s.setState(StateActive)
+		s.cancelIdleTimer() // User is active again, don't stop session
+		s.mu.Unlock()
 
-		// Write JSON message to stdin (newline-delimited)
-		_, err = fmt.Fprintf(stdin, "%s\n", msgBytes)
-		if err != nil {
+		// Send as a stream-json user message
+		if err := proc.Send(content); err != nil {
 			slog.Error("failed to write to stdin", "error", err)
-			respondError(w, http.StatusInternalServerError, "failed to send message to Claude")
-			return
+			s.mu.Lock()
+			if s.State == StateActive && s.proc == proc {
+				// Claude never got it: back to waiting, idle timer and all
+				s.setState(StateWaiting)
+				s.resetIdleTimer()
+			}
+			s.mu.Unlock()
+			return MessageResult{}, errors.New("failed to send message to Claude")
 		}
 
-		// Update state if we were waiting (cancel idle timer, mark active)
-		session.mu.Lock()
-		session.LastActivity = time.Now()
-		if session.State == StateWaiting {
-			session.State = StateActive
-			cancelIdleTimer() // User is active again, don't stop session
-			go broadcastState(StateActive)
-		}
-		session.mu.Unlock()
-
-		respondJSON(w, http.StatusOK, map[string]interface{}{
-			"success": true,
-			"queued":  true,
-			"state":   session.State,
-		})
+		return MessageResult{State: StateActive}, nil
 
 	default:
-		// Unexpected state (should never happen)
-		slog.Error("unexpected state", "state", state)
-		respondError(w, http.StatusInternalServerError, fmt.Sprintf("unexpected state: %s", state))
+		// deliverNext only delivers in the states above
+		return MessageResult{}, fmt.Errorf("cannot deliver in state %s", state)
 	}
 }
 
 // handleDiff returns the git diff for a specific file.
 //
 // GET /diff?file=path/to/file
+// GET /sessions/{id}/diff?file=path/to/file
 //
 // Query parameters:
 //   - file: Path to the file (required)
@@ -1693,9 +2247,14 @@ func handleDiff(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session.mu.RLock()
-	repoPath := session.RepoPath
-	session.mu.RUnlock()
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	repoPath := s.RepoPath
+	s.mu.RUnlock()
 
 	if repoPath == "" {
 		respondError(w, http.StatusBadRequest, "no active session")
@@ -1735,14 +2294,11 @@ func handleDiff(w http.ResponseWriter, r *http.Request) {
 // GET /
 //
 // Serves static files from the Vite build directory (dist/). The path can be
-// configured via the WEB_PATH environment variable, defaulting to "../web/dist".
-// Falls back to index.html for client-side routing.
+// configured via server.web_path or the WEB_PATH environment variable,
+// defaulting to "../web/dist". Falls back to index.html for client-side routing.
 func handleIndex(w http.ResponseWriter, r *http.Request) {
 	// Get web directory path (Vite dist output)
-	webPath := os.Getenv("WEB_PATH")
-	if webPath == "" {
-		webPath = DefaultWebPath
-	}
+	webPath := cfg.Server.WebPath
 
 	// Construct file path
 	path := filepath.Join(webPath, r.URL.Path)
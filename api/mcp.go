@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// MCP server settings
+const (
+	MCPServerName         = "doze"
+	MCPPermissionToolName = "approve"
+	MCPProtocolVersion    = "2025-03-26" // Offered when the client doesn't ask for one
+
+	// PermissionPromptTool is the --permission-prompt-tool value for Claude
+	PermissionPromptTool = "mcp__" + MCPServerName + "__" + MCPPermissionToolName
+)
+
+// JSON-RPC error codes
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCMethodNotFound = -32601
+	jsonRPCInvalidParams  = -32602
+)
+
+// jsonRPCRequest is a JSON-RPC 2.0 request or notification (no ID).
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// jsonRPCResponse is a JSON-RPC 2.0 response.
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+}
+
+// jsonRPCError is a JSON-RPC 2.0 error object.
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// permissionToolSchema is the input schema of the permission prompt tool, as
+// called by Claude Code.
+var permissionToolSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"tool_name":   map[string]interface{}{"type": "string", "description": "Tool Claude wants to use"},
+		"input":       map[string]interface{}{"type": "object", "description": "Tool parameters"},
+		"tool_use_id": map[string]interface{}{"type": "string", "description": "ID of the tool_use block"},
+	},
+	"required": []string{"tool_name", "input"},
+}
+
+// handleMCP serves a minimal MCP server (streamable HTTP transport, JSON
+// responses only) exposing the permission prompt tool to a session's Claude
+// process.
+//
+// POST /sessions/{id}/mcp
+//
+// Claude is started with --permission-prompt-tool mcp__doze__approve and an
+// --mcp-config pointing here. Each tool call that needs permission becomes a
+// tools/call request that blocks in PermissionBroker.Request until a client
+// answers. The result is the decision as JSON text:
+//
+//	{"behavior": "allow", "updatedInput": {...}}
+//	{"behavior": "deny", "message": "denied by user"}
+//
+// This route bypasses the API token check; instead it requires the session's
+// MCP token (generated per session and handed to Claude in --mcp-config).
+// Since anyone can call it, the session is only looked up, never created: an
+// unknown session gets the same 401 as a wrong token.
+func handleMCP(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessions.Get(r.PathValue("id"))
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.mcpToken)) != 1 {
+		respondError(w, http.StatusUnauthorized, "invalid MCP token")
+		return
+	}
+
+	var req jsonRPCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondJSON(w, http.StatusOK, jsonRPCResponse{
+			JSONRPC: "2.0",
+			ID:      json.RawMessage("null"),
+			Error:   &jsonRPCError{Code: jsonRPCParseError, Message: "parse error"},
+		})
+		return
+	}
+
+	// Notifications (no ID) get no response body
+	if len(req.ID) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	resp := jsonRPCResponse{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(req.Params, &params)
+		version := params.ProtocolVersion
+		if version == "" {
+			version = MCPProtocolVersion
+		}
+		resp.Result = map[string]interface{}{
+			"protocolVersion": version,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]interface{}{"name": MCPServerName, "version": "1.0.0"},
+		}
+
+	case "ping":
+		resp.Result = map[string]interface{}{}
+
+	case "tools/list":
+		resp.Result = map[string]interface{}{
+			"tools": []interface{}{
+				map[string]interface{}{
+					"name":        MCPPermissionToolName,
+					"description": "Ask the Doze user to approve a tool call",
+					"inputSchema": permissionToolSchema,
+				},
+			},
+		}
+
+	case "tools/call":
+		var params struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				ToolName string                 `json:"tool_name"`
+				Input    map[string]interface{} `json:"input"`
+			} `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.Name != MCPPermissionToolName {
+			resp.Error = &jsonRPCError{Code: jsonRPCInvalidParams, Message: "unknown tool or invalid arguments"}
+			break
+		}
+
+		decision := permissions.Request(r.Context(), s, params.Arguments.ToolName, params.Arguments.Input)
+		text, err := json.Marshal(decision)
+		if err != nil {
+			slog.Error("failed to marshal permission decision", "error", err)
+			text = []byte(`{"behavior":"deny","message":"internal error"}`)
+		}
+		resp.Result = map[string]interface{}{
+			"content": []interface{}{
+				map[string]interface{}{"type": "text", "text": string(text)},
+			},
+		}
+
+	default:
+		resp.Error = &jsonRPCError{Code: jsonRPCMethodNotFound, Message: "method not found: " + req.Method}
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// mcpConfig returns the --mcp-config JSON that points Claude at the
+// session's permission prompt endpoint.
+func (s *Session) mcpConfig() string {
+	config := map[string]interface{}{
+		"mcpServers": map[string]interface{}{
+			MCPServerName: map[string]interface{}{
+				"type":    "http",
+				"url":     permissions.MCPURL(s.ID),
+				"headers": map[string]string{"Authorization": "Bearer " + s.mcpToken},
+			},
+		},
+	}
+	data, _ := json.Marshal(config)
+	return string(data)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/seamus/doze/notify"
+)
+
+// Notification settings
+const (
+	DefaultWebPushSubject     = "mailto:doze@localhost"
+	VAPIDKeysFileName         = "vapid.json"              // Generated VAPID keys, in the data directory
+	PushSubscriptionsFileName = "push_subscriptions.json" // Web Push subscriptions, in the data directory
+	NotificationBodyLimit     = 200                       // Characters of output in a notification body
+)
+
+// notifier delivers push notifications for session events.
+//
+// Replaced by main() from the notifications config; drops everything until
+// then (and in tests that don't set one).
+var notifier = notify.NewDispatcher(nil, nil, nil)
+
+// webPush holds the Web Push keys and subscriptions (nil when Web Push is
+// disabled).
+var webPush *webPushService
+
+// webPushService is the server side of Web Push: our VAPID identity and the
+// browsers that subscribed.
+type webPushService struct {
+	keys          *notify.VAPIDKeys
+	subscriptions *notify.FileSubscriptions
+}
+
+// setupNotifications builds the dispatcher (and Web Push service, if
+// enabled) described by the config. Generated keys and subscriptions live in
+// dataDir.
+func setupNotifications(nc NotificationsConfig, dataDir string) (*notify.Dispatcher, *webPushService, error) {
+	var notifiers []notify.Notifier
+	if nc.Ntfy.Topic != "" {
+		notifiers = append(notifiers, &notify.Ntfy{Server: nc.Ntfy.Server, Topic: nc.Ntfy.Topic, Token: nc.Ntfy.Token})
+	}
+	for _, wh := range nc.Webhooks {
+		notifiers = append(notifiers, &notify.Webhook{URL: wh.URL, Headers: wh.Headers})
+	}
+
+	var push *webPushService
+	if nc.WebPush.Enabled {
+		var keys *notify.VAPIDKeys
+		var err error
+		if nc.WebPush.VAPIDPrivateKey != "" {
+			keys, err = notify.ParseVAPIDKeys(nc.WebPush.VAPIDPrivateKey)
+		} else {
+			keys, err = notify.LoadOrCreateVAPIDKeys(filepath.Join(dataDir, VAPIDKeysFileName))
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load VAPID keys: %w", err)
+		}
+		subs, err := notify.OpenSubscriptions(filepath.Join(dataDir, PushSubscriptionsFileName))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load push subscriptions: %w", err)
+		}
+		push = &webPushService{keys: keys, subscriptions: subs}
+		notifiers = append(notifiers, &notify.WebPush{Keys: keys, Subject: nc.WebPush.Subject, Subscriptions: subs})
+	}
+
+	triggers := make([]notify.Event, len(nc.Triggers))
+	for i, trigger := range nc.Triggers {
+		triggers[i] = notify.Event(trigger)
+	}
+	except := make([]notify.Event, len(nc.QuietHours.Except))
+	for i, event := range nc.QuietHours.Except {
+		except[i] = notify.Event(event)
+	}
+	quiet, err := notify.ParseQuietHours(nc.QuietHours.Start, nc.QuietHours.End, nc.QuietHours.Timezone, except)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return notify.NewDispatcher(notifiers, triggers, quiet), push, nil
+}
+
+// sessionURL returns the web UI deep link for a session.
+func sessionURL(id string) string {
+	return publicBaseURL() + "/?session=" + url.QueryEscape(id)
+}
+
+// notify sends a push notification about the session. body is shortened to
+// its last NotificationBodyLimit characters. The caller must hold s.mu (read
+// or write).
+func (s *Session) notify(event notify.Event, title, body string) {
+	if !notifier.Enabled() {
+		return
+	}
+	if s.RepoPath != "" {
+		title += " · " + filepath.Base(s.RepoPath)
+	}
+	notifier.Notify(notify.Notification{
+		Event:     event,
+		SessionID: s.ID,
+		Title:     title,
+		Body:      tail(strings.TrimSpace(body), NotificationBodyLimit),
+		URL:       sessionURL(s.ID),
+	})
+}
+
+// tail returns the last n characters of s, prefixed with "…" if shortened.
+func tail(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return "…" + string(runes[len(runes)-n:])
+}
+
+// handleVAPIDKey returns the public key browsers need to subscribe.
+//
+// GET /push/vapid-key
+//
+// Response:
+//
+//	{
+//	  "public_key": "BNcR..."  // Pass as applicationServerKey to pushManager.subscribe()
+//	}
+//
+// Returns 404 if Web Push is disabled.
+func handleVAPIDKey(w http.ResponseWriter, r *http.Request) {
+	if webPush == nil {
+		respondError(w, http.StatusNotFound, "web push is not enabled")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"public_key": webPush.keys.PublicKey,
+	})
+}
+
+// handleSubscribePush registers a browser for Web Push notifications.
+//
+// POST /push/subscriptions
+// Request body: the PushSubscription as JSON
+//
+//	{
+//	  "endpoint": "https://fcm.googleapis.com/fcm/send/...",
+//	  "keys": {"p256dh": "BOr...", "auth": "k8J..."}
+//	}
+//
+// Subscribing the same endpoint again replaces its keys.
+func handleSubscribePush(w http.ResponseWriter, r *http.Request) {
+	if webPush == nil {
+		respondError(w, http.StatusNotFound, "web push is not enabled")
+		return
+	}
+
+	var sub notify.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if err := sub.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := webPush.subscriptions.Add(sub); err != nil {
+		slog.Error("failed to save push subscription", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to save subscription")
+		return
+	}
+
+	slog.Info("push subscription added", "endpoint", sub.Endpoint)
+	respondJSON(w, http.StatusCreated, map[string]interface{}{"success": true})
+}
+
+// handleUnsubscribePush removes a Web Push subscription.
+//
+// DELETE /push/subscriptions
+// Request body:
+//
+//	{
+//	  "endpoint": "https://fcm.googleapis.com/fcm/send/..."
+//	}
+func handleUnsubscribePush(w http.ResponseWriter, r *http.Request) {
+	if webPush == nil {
+		respondError(w, http.StatusNotFound, "web push is not enabled")
+		return
+	}
+
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Endpoint == "" {
+		respondError(w, http.StatusBadRequest, "endpoint is required")
+		return
+	}
+	if err := webPush.subscriptions.Remove(req.Endpoint); err != nil {
+		slog.Error("failed to remove push subscription", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to remove subscription")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// handleTestNotification sends a test notification through every notifier,
+// ignoring triggers and quiet hours.
+//
+// POST /notifications/test
+func handleTestNotification(w http.ResponseWriter, r *http.Request) {
+	if !notifier.Enabled() {
+		respondError(w, http.StatusConflict, "no notifiers configured")
+		return
+	}
+	notifier.Send(notify.Notification{
+		Event:     notify.EventTurnComplete,
+		SessionID: DefaultSessionID,
+		Title:     "Doze test notification",
+		Body:      "Notifications are working.",
+		URL:       sessionURL(DefaultSessionID),
+	})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
@@ -0,0 +1,222 @@
+// Package notify delivers push notifications about session events to phones
+// and other devices.
+//
+// A Dispatcher fans each Notification out to the configured Notifiers (ntfy,
+// HTTP webhooks, Web Push), after filtering by trigger and quiet hours.
+// Delivery is asynchronous: session code calls Notify and moves on.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a kind of session event that can trigger a notification.
+type Event string
+
+const (
+	EventTurnComplete Event = "turn_complete" // Claude finished responding
+	EventError        Event = "error"         // Claude reported an error or crashed
+	EventStopped      Event = "stopped"       // An idle session was stopped (hibernated)
+	EventPermission   Event = "permission"    // A tool call is waiting for approval
+)
+
+// Events lists every event, in the order they are documented.
+var Events = []Event{EventTurnComplete, EventError, EventStopped, EventPermission}
+
+// DefaultTimeout bounds each delivery attempt.
+const DefaultTimeout = 10 * time.Second
+
+// Notification is a single message to deliver.
+type Notification struct {
+	Event     Event     `json:"event"`
+	SessionID string    `json:"session_id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	URL       string    `json:"url,omitempty"` // Deep link to the session in the web UI
+	Time      time.Time `json:"time"`
+}
+
+// Urgent reports whether the notification needs the user's attention now
+// (rather than being informational).
+func (n Notification) Urgent() bool {
+	return n.Event == EventPermission || n.Event == EventError
+}
+
+// Notifier delivers notifications to one destination.
+type Notifier interface {
+	// Name identifies the notifier in logs.
+	Name() string
+
+	// Notify delivers n, returning once it was accepted or failed.
+	Notify(ctx context.Context, n Notification) error
+}
+
+// QuietHours is a daily window in which notifications are held back.
+//
+// The window may wrap midnight (22:00-07:00). Events listed in Except are
+// delivered anyway.
+type QuietHours struct {
+	Start    time.Duration  // Offset from local midnight
+	End      time.Duration  // Offset from local midnight
+	Location *time.Location // Time zone of Start and End (nil = local)
+	Except   []Event        // Events that are delivered during quiet hours
+}
+
+// ParseQuietHours parses "HH:MM" start and end times in the named time zone
+// ("" = local). Returns nil if start and end are both empty.
+func ParseQuietHours(start, end, timezone string, except []Event) (*QuietHours, error) {
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	q := &QuietHours{Except: except, Location: time.Local}
+	var err error
+	if q.Start, err = parseClock(start); err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+	if q.End, err = parseClock(end); err != nil {
+		return nil, fmt.Errorf("end: %w", err)
+	}
+	if timezone != "" {
+		if q.Location, err = time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// parseClock parses "HH:MM" into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || hours > 23 || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("invalid time %q (want HH:MM)", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Active reports whether t falls inside the quiet window.
+func (q *QuietHours) Active(t time.Time) bool {
+	if q == nil || q.Start == q.End {
+		return false
+	}
+	loc := q.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if q.Start < q.End {
+		return offset >= q.Start && offset < q.End
+	}
+	return offset >= q.Start || offset < q.End // Wraps midnight
+}
+
+// Dispatcher filters notifications and fans them out to notifiers.
+//
+// The nil Dispatcher and a Dispatcher without notifiers drop everything.
+type Dispatcher struct {
+	notifiers []Notifier
+	triggers  []Event
+	quiet     *QuietHours
+	timeout   time.Duration
+	now       func() time.Time
+
+	wg sync.WaitGroup // In-flight deliveries
+}
+
+// NewDispatcher creates a dispatcher that sends the given trigger events to
+// every notifier, except during quiet hours (which may be nil).
+func NewDispatcher(notifiers []Notifier, triggers []Event, quiet *QuietHours) *Dispatcher {
+	return &Dispatcher{
+		notifiers: notifiers,
+		triggers:  triggers,
+		quiet:     quiet,
+		timeout:   DefaultTimeout,
+		now:       time.Now,
+	}
+}
+
+// Enabled reports whether the dispatcher can deliver anything.
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.notifiers) > 0 && len(d.triggers) > 0
+}
+
+// Notify delivers n to every notifier in the background, unless its event is
+// not a trigger or quiet hours are active. Failures are logged.
+func (d *Dispatcher) Notify(n Notification) {
+	if !d.Enabled() || !slices.Contains(d.triggers, n.Event) {
+		return
+	}
+	if n.Time.IsZero() {
+		n.Time = d.now()
+	}
+	if d.quiet.Active(n.Time) && !slices.Contains(d.quiet.Except, n.Event) {
+		slog.Debug("notification suppressed by quiet hours", "event", n.Event, "session", n.SessionID)
+		return
+	}
+	d.Send(n)
+}
+
+// Send delivers n to every notifier in the background, bypassing triggers
+// and quiet hours (for test notifications).
+func (d *Dispatcher) Send(n Notification) {
+	if d == nil {
+		return
+	}
+	if n.Time.IsZero() {
+		n.Time = d.now()
+	}
+	for _, notifier := range d.notifiers {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, n); err != nil {
+				slog.Warn("notification failed", "notifier", notifier.Name(), "event", n.Event, "error", err)
+			} else {
+				slog.Debug("notification sent", "notifier", notifier.Name(), "event", n.Event)
+			}
+		}()
+	}
+}
+
+// Wait blocks until in-flight deliveries finish.
+func (d *Dispatcher) Wait() {
+	if d != nil {
+		d.wg.Wait()
+	}
+}
+
+// checkResponse turns a non-2xx response into an error.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &StatusError{StatusCode: resp.StatusCode}
+}
+
+// StatusError is returned when a push service rejects a request.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// isGone reports whether err means the destination no longer exists.
+func isGone(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && (se.StatusCode == http.StatusNotFound || se.StatusCode == http.StatusGone)
+}
@@ -0,0 +1,389 @@
+package notify
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captured is a request received by a stand-in push server.
+type captured struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// standIn starts a local HTTP server that records requests and answers with
+// status.
+func standIn(t *testing.T, status int) (*httptest.Server, <-chan captured) {
+	return startStandIn(t, httptest.NewServer, status)
+}
+
+// tlsStandIn is standIn over HTTPS, as push services must be. Requests have
+// to go through srv.Client().
+func tlsStandIn(t *testing.T, status int) (*httptest.Server, <-chan captured) {
+	return startStandIn(t, httptest.NewTLSServer, status)
+}
+
+func startStandIn(t *testing.T, start func(http.Handler) *httptest.Server, status int) (*httptest.Server, <-chan captured) {
+	t.Helper()
+	requests := make(chan captured, 10)
+	srv := start(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- captured{path: r.URL.Path, header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+var testNotification = Notification{
+	Event:     EventPermission,
+	SessionID: "abc123",
+	Title:     "Permission needed",
+	Body:      "Bash: go test ./...",
+	URL:       "https://doze.example.com/?session=abc123",
+}
+
+func TestNtfy(t *testing.T) {
+	srv, requests := standIn(t, http.StatusOK)
+	n := &Ntfy{Server: srv.URL + "/", Topic: "doze-test", Token: "tk_secret"}
+
+	if err := n.Notify(context.Background(), testNotification); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.path != "/doze-test" || string(req.body) != testNotification.Body {
+		t.Errorf("request = %s %q, want /doze-test with body", req.path, req.body)
+	}
+	for header, want := range map[string]string{
+		"Title":         testNotification.Title,
+		"Click":         testNotification.URL,
+		"Priority":      "high",
+		"Tags":          "permission",
+		"Authorization": "Bearer tk_secret",
+	} {
+		if got := req.header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	srv, requests := standIn(t, http.StatusNoContent)
+	w := &Webhook{URL: srv.URL + "/hook", Headers: map[string]string{"X-Doze-Secret": "s3cret"}}
+
+	if err := w.Notify(context.Background(), testNotification); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	var got Notification
+	if err := json.Unmarshal(req.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != testNotification {
+		t.Errorf("webhook body = %+v, want %+v", got, testNotification)
+	}
+	if req.header.Get("X-Doze-Secret") != "s3cret" || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers = %v, want secret and JSON content type", req.header)
+	}
+
+	failing, _ := standIn(t, http.StatusInternalServerError)
+	w.URL = failing.URL
+	if err := w.Notify(context.Background(), testNotification); err == nil {
+		t.Error("Notify succeeded against a failing server")
+	}
+}
+
+// subscriber is a browser push subscription with its private keys.
+type subscriber struct {
+	sub  Subscription
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func newSubscriber(t *testing.T, endpoint string) subscriber {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	var sub Subscription
+	sub.Endpoint = endpoint
+	sub.Keys.P256dh = b64.EncodeToString(key.PublicKey().Bytes())
+	sub.Keys.Auth = b64.EncodeToString(auth)
+	return subscriber{sub: sub, key: key, auth: auth}
+}
+
+// decrypt reverses encryptPayload the way a browser does (RFC 8291).
+func (s subscriber) decrypt(t *testing.T, body []byte) []byte {
+	t.Helper()
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != webPushRecordSize {
+		t.Fatalf("record size = %d", rs)
+	}
+	idLen := int(body[20])
+	asPublicBytes := body[21 : 21+idLen]
+	ciphertext := body[21+idLen:]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.key.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := "WebPush: info\x00" + string(s.key.PublicKey().Bytes()) + string(asPublicBytes)
+	ikm, _ := hkdf.Key(sha256.New, secret, s.auth, info, 32)
+	cek, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt payload: %v", err)
+	}
+	if plaintext[len(plaintext)-1] != 0x02 {
+		t.Fatalf("missing padding delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+// memorySubscriptions is an in-memory SubscriptionStore.
+type memorySubscriptions struct {
+	mu   sync.Mutex
+	subs []Subscription
+}
+
+func (m *memorySubscriptions) List() []Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.subs)
+}
+
+func (m *memorySubscriptions) Remove(endpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subs = slices.DeleteFunc(m.subs, func(s Subscription) bool { return s.Endpoint == endpoint })
+	return nil
+}
+
+func TestWebPush(t *testing.T) {
+	srv, requests := tlsStandIn(t, http.StatusCreated)
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := newSubscriber(t, srv.URL+"/push/device1")
+	w := &WebPush{
+		Keys:          keys,
+		Subject:       "mailto:ops@example.com",
+		Subscriptions: &memorySubscriptions{subs: []Subscription{browser.sub}},
+		Client:        srv.Client(),
+	}
+
+	if err := w.Notify(context.Background(), testNotification); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+
+	if req.path != "/push/device1" || req.header.Get("Content-Encoding") != "aes128gcm" || req.header.Get("Urgency") != "high" {
+		t.Errorf("request = %s %v, want encrypted urgent push", req.path, req.header)
+	}
+	var got Notification
+	if err := json.Unmarshal(browser.decrypt(t, req.body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != testNotification {
+		t.Errorf("payload = %+v, want %+v", got, testNotification)
+	}
+
+	// VAPID: "vapid t=<jwt>, k=<public key>", signed by our key for the
+	// push service's origin
+	auth, ok := strings.CutPrefix(req.header.Get("Authorization"), "vapid t=")
+	token, k, ok2 := strings.Cut(auth, ", k=")
+	if !ok || !ok2 || k != keys.PublicKey {
+		t.Fatalf("Authorization = %q, want vapid t=..., k=%s", req.header.Get("Authorization"), keys.PublicKey)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT has %d parts", len(parts))
+	}
+	sig, _ := b64.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&keys.signer.PublicKey, digest[:], r, s) {
+		t.Error("VAPID JWT signature does not verify")
+	}
+	claimsJSON, _ := b64.DecodeString(parts[1])
+	var claims struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub"`
+		Exp int64  `json:"exp"`
+	}
+	json.Unmarshal(claimsJSON, &claims)
+	if claims.Aud != srv.URL || claims.Sub != w.Subject || claims.Exp <= time.Now().Unix() {
+		t.Errorf("claims = %+v, want aud %s", claims, srv.URL)
+	}
+}
+
+func TestWebPushRemovesGoneSubscriptions(t *testing.T) {
+	gone, _ := tlsStandIn(t, http.StatusGone)
+	keys, _ := GenerateVAPIDKeys()
+	store := &memorySubscriptions{subs: []Subscription{newSubscriber(t, gone.URL+"/old").sub}}
+	w := &WebPush{Keys: keys, Subject: "mailto:ops@example.com", Subscriptions: store, Client: gone.Client()}
+
+	if err := w.Notify(context.Background(), testNotification); err != nil {
+		t.Fatal(err)
+	}
+	if subs := store.List(); len(subs) != 0 {
+		t.Errorf("subscriptions = %v, want expired one removed", subs)
+	}
+}
+
+func TestSubscriptionValidate(t *testing.T) {
+	valid := newSubscriber(t, "https://push.example/a").sub
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate(%s) = %v, want nil", valid.Endpoint, err)
+	}
+	for _, endpoint := range []string{"http://push.example/a", "/push/a", "https://", "ftp://push.example/a"} {
+		sub := valid
+		sub.Endpoint = endpoint
+		if err := sub.Validate(); err == nil {
+			t.Errorf("Validate(%s) = nil, want an error", endpoint)
+		}
+	}
+	short := valid
+	short.Keys.Auth = "AAAA"
+	if err := short.Validate(); err == nil {
+		t.Error("Validate with a short auth secret = nil, want an error")
+	}
+}
+
+func TestVAPIDKeysPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vapid.json")
+	first, err := LoadOrCreateVAPIDKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadOrCreateVAPIDKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.PublicKey != second.PublicKey || len(first.PublicKey) != 87 {
+		t.Errorf("public keys = %s, %s, want the same 65-byte key", first.PublicKey, second.PublicKey)
+	}
+}
+
+func TestFileSubscriptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subs.json")
+	store, err := OpenSubscriptions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := newSubscriber(t, "https://push.example/a").sub, newSubscriber(t, "https://push.example/b").sub
+	store.Add(a)
+	store.Add(b)
+	store.Add(a) // Replaces
+	store.Remove(b.Endpoint)
+
+	reopened, err := OpenSubscriptions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs := reopened.List(); len(subs) != 1 || subs[0].Endpoint != a.Endpoint {
+		t.Errorf("subscriptions = %v, want only %s", subs, a.Endpoint)
+	}
+}
+
+// recorder is a Notifier that remembers what it was sent.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Notify(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, n.Event)
+	return nil
+}
+
+func TestDispatcherFilters(t *testing.T) {
+	quiet, err := ParseQuietHours("22:00", "07:00", "UTC", []Event{EventPermission})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorder{}
+	d := NewDispatcher([]Notifier{rec}, []Event{EventTurnComplete, EventPermission}, quiet)
+
+	day := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2026, 1, 1, 23, 30, 0, 0, time.UTC)
+	d.Notify(Notification{Event: EventTurnComplete, Time: day})
+	d.Notify(Notification{Event: EventError, Time: day})          // Not a trigger
+	d.Notify(Notification{Event: EventTurnComplete, Time: night}) // Quiet hours
+	d.Notify(Notification{Event: EventPermission, Time: night})   // Excepted
+	d.Wait()
+
+	slices.Sort(rec.events)
+	if want := []Event{EventPermission, EventTurnComplete}; !slices.Equal(rec.events, want) {
+		t.Errorf("delivered = %v, want %v", rec.events, want)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2026, 1, 1, h, m, 0, 0, time.UTC) }
+
+	overnight, _ := ParseQuietHours("22:00", "07:00", "UTC", nil)
+	daytime, _ := ParseQuietHours("09:00", "17:30", "UTC", nil)
+	tests := []struct {
+		q    *QuietHours
+		t    time.Time
+		want bool
+	}{
+		{overnight, at(21, 59), false},
+		{overnight, at(22, 0), true},
+		{overnight, at(3, 0), true},
+		{overnight, at(7, 0), false},
+		{daytime, at(8, 59), false},
+		{daytime, at(12, 0), true},
+		{daytime, at(17, 30), false},
+		{nil, at(3, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.q.Active(tt.t); got != tt.want {
+			t.Errorf("%+v.Active(%s) = %v, want %v", tt.q, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+
+	if _, err := ParseQuietHours("25:00", "07:00", "", nil); err == nil {
+		t.Error("ParseQuietHours accepted 25:00")
+	}
+	if q, err := ParseQuietHours("", "", "", nil); q != nil || err != nil {
+		t.Errorf("empty quiet hours = %v, %v, want nil", q, err)
+	}
+}
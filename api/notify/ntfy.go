@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// DefaultNtfyServer is used when no server URL is configured.
+const DefaultNtfyServer = "https://ntfy.sh"
+
+// Ntfy publishes notifications to an ntfy topic (https://ntfy.sh), which the
+// ntfy app on the phone subscribes to.
+type Ntfy struct {
+	Server string       // Server base URL ("" = DefaultNtfyServer)
+	Topic  string       // Topic name; treat it like a password on public servers
+	Token  string       // Optional access token
+	Client *http.Client // nil = http.DefaultClient
+}
+
+func (n *Ntfy) Name() string { return "ntfy" }
+
+// Notify publishes the body as the message, with the title, deep link and
+// priority in headers.
+func (n *Ntfy) Notify(ctx context.Context, msg Notification) error {
+	server := strings.TrimSuffix(n.Server, "/")
+	if server == "" {
+		server = DefaultNtfyServer
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server+"/"+n.Topic, strings.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", msg.Title)
+	req.Header.Set("Tags", string(msg.Event))
+	if msg.URL != "" {
+		req.Header.Set("Click", msg.URL)
+	}
+	if msg.Urgent() {
+		req.Header.Set("Priority", "high")
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+
+	resp, err := client(n.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// client returns c, or http.DefaultClient if c is nil.
+func client(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return c
+}
@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Webhook POSTs each notification as JSON to a URL, for Slack-style
+// integrations, home automation, or custom relays.
+type Webhook struct {
+	URL     string            // Endpoint to POST to
+	Headers map[string]string // Extra headers (e.g. Authorization)
+	Client  *http.Client      // nil = http.DefaultClient
+}
+
+func (w *Webhook) Name() string { return "webhook" }
+
+// Notify POSTs the notification as a JSON object.
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client(w.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
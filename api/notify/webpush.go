@@ -0,0 +1,371 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Web Push settings
+const (
+	WebPushTTL        = 24 * time.Hour // How long the push service keeps undelivered messages
+	vapidTokenExpiry  = 12 * time.Hour // Lifetime of VAPID JWTs (24h max per RFC 8292)
+	webPushRecordSize = 4096           // aes128gcm record size
+)
+
+// b64 is the unpadded base64url encoding used throughout Web Push.
+var b64 = base64.RawURLEncoding
+
+// Subscription is a browser push subscription (PushSubscription.toJSON()).
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"` // Client public key, base64url
+		Auth   string `json:"auth"`   // Client auth secret, base64url
+	} `json:"keys"`
+}
+
+// Validate checks that the subscription has an https endpoint and
+// well-formed keys.
+func (s Subscription) Validate() error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint must be an absolute https URL")
+	}
+	if key, err := b64.DecodeString(s.Keys.P256dh); err != nil || len(key) != 65 {
+		return errors.New("keys.p256dh must be a base64url P-256 public key")
+	}
+	if auth, err := b64.DecodeString(s.Keys.Auth); err != nil || len(auth) != 16 {
+		return errors.New("keys.auth must be a base64url 16-byte secret")
+	}
+	return nil
+}
+
+// VAPIDKeys identify this server to push services (RFC 8292).
+type VAPIDKeys struct {
+	PublicKey  string `json:"public_key"`  // Uncompressed P-256 point, base64url (applicationServerKey)
+	PrivateKey string `json:"private_key"` // P-256 scalar, base64url
+
+	signer *ecdsa.PrivateKey
+}
+
+// GenerateVAPIDKeys creates a new VAPID key pair.
+func GenerateVAPIDKeys() (*VAPIDKeys, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return ParseVAPIDKeys(b64.EncodeToString(priv))
+}
+
+// ParseVAPIDKeys loads a key pair from its base64url private key.
+func ParseVAPIDKeys(privateKey string) (*VAPIDKeys, error) {
+	raw, err := b64.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+	pub, err := key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKeys{PublicKey: b64.EncodeToString(pub), PrivateKey: privateKey, signer: key}, nil
+}
+
+// LoadOrCreateVAPIDKeys reads the key pair stored at path, generating and
+// saving a new one if the file doesn't exist.
+func LoadOrCreateVAPIDKeys(path string) (*VAPIDKeys, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var stored VAPIDKeys
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("invalid VAPID key file %s: %w", path, err)
+		}
+		return ParseVAPIDKeys(stored.PrivateKey)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to save VAPID keys: %w", err)
+	}
+	return keys, nil
+}
+
+// authorization returns the VAPID Authorization header for a push endpoint.
+func (k *VAPIDKeys) authorization(endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenExpiry).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + b64.EncodeToString(claims)
+
+	// ES256 signatures are r || s, each padded to 32 bytes
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.signer, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return "vapid t=" + unsigned + "." + b64.EncodeToString(sig) + ", k=" + k.PublicKey, nil
+}
+
+// SubscriptionStore holds the Web Push subscriptions to notify.
+type SubscriptionStore interface {
+	List() []Subscription
+	Remove(endpoint string) error
+}
+
+// WebPush delivers notifications to browsers (including installed PWAs on
+// phones) through their push services, encrypted per RFC 8291.
+//
+// The payload is the Notification as JSON, for the web UI's service worker
+// to display.
+type WebPush struct {
+	Keys          *VAPIDKeys
+	Subject       string // Contact URL for push services ("mailto:..." or "https://...")
+	Subscriptions SubscriptionStore
+	Client        *http.Client // nil = http.DefaultClient
+}
+
+func (w *WebPush) Name() string { return "webpush" }
+
+// Notify sends n to every subscription. Subscriptions the push service
+// reports as gone (404/410) are removed.
+func (w *WebPush) Notify(ctx context.Context, n Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, sub := range w.Subscriptions.List() {
+		err := w.send(ctx, sub, payload, n.Urgent())
+		if isGone(err) {
+			slog.Info("removing expired push subscription", "endpoint", sub.Endpoint)
+			if err := w.Subscriptions.Remove(sub.Endpoint); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sub.Endpoint, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send encrypts payload for sub and POSTs it to the push service.
+func (w *WebPush) send(ctx context.Context, sub Subscription, payload []byte, urgent bool) error {
+	body, err := encryptPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := w.Keys.authorization(sub.Endpoint, w.Subject, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(WebPushTTL/time.Second)))
+	if urgent {
+		req.Header.Set("Urgency", "high")
+	}
+
+	resp, err := client(w.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// encryptPayload encrypts payload for a subscription as a single aes128gcm
+// record (RFC 8188), with keys derived per RFC 8291.
+func encryptPayload(sub Subscription, payload []byte) ([]byte, error) {
+	if err := sub.Validate(); err != nil {
+		return nil, err
+	}
+	uaPublicBytes, _ := b64.DecodeString(sub.Keys.P256dh)
+	authSecret, _ := b64.DecodeString(sub.Keys.Auth)
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ephemeral application server key pair
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := "WebPush: info\x00" + string(uaPublicBytes) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload)+1+gcm.Overhead() > webPushRecordSize {
+		return nil, fmt.Errorf("payload too large (%d bytes)", len(payload))
+	}
+	plaintext := append(slices.Clone(payload), 0x02) // Padding delimiter for the last record
+
+	// Header: salt | record size | key ID length | key ID (our public key)
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// FileSubscriptions is a SubscriptionStore persisted as a JSON file.
+type FileSubscriptions struct {
+	mu   sync.Mutex
+	path string
+	subs []Subscription
+}
+
+// OpenSubscriptions loads the subscriptions stored at path (if any).
+func OpenSubscriptions(path string) (*FileSubscriptions, error) {
+	fs := &FileSubscriptions{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fs.subs); err != nil {
+		return nil, fmt.Errorf("invalid subscriptions file %s: %w", path, err)
+	}
+	return fs, nil
+}
+
+// List returns a copy of the stored subscriptions.
+func (fs *FileSubscriptions) List() []Subscription {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return slices.Clone(fs.subs)
+}
+
+// Add stores a subscription, replacing any with the same endpoint.
+func (fs *FileSubscriptions) Add(sub Subscription) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.subs = slices.DeleteFunc(fs.subs, func(s Subscription) bool { return s.Endpoint == sub.Endpoint })
+	fs.subs = append(fs.subs, sub)
+	return fs.save()
+}
+
+// Remove deletes the subscription with the given endpoint.
+func (fs *FileSubscriptions) Remove(endpoint string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.subs = slices.DeleteFunc(fs.subs, func(s Subscription) bool { return s.Endpoint == endpoint })
+	return fs.save()
+}
+
+// save writes the subscriptions atomically. The caller must hold fs.mu.
+func (fs *FileSubscriptions) save() error {
+	data, err := json.MarshalIndent(fs.subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), ".subscriptions-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Pairing constants
+const (
+	PairingCodeLength      = 8                                  // Characters in a pairing code (excluding the dash)
+	PairingCodeAlphabet    = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // No 0/O or 1/I to avoid typos
+	DefaultPairingTTL      = 5 * time.Minute                    // How long a pairing code stays valid
+	PairingMaxFailures     = 10                                 // Failed attempts per address within PairingFailureWindow
+	PairingFailureWindow   = 15 * time.Minute                   // How long a failed attempt counts against its address
+	PairingQRSize          = 320                                // PNG size in pixels
+	PairingQueryParam      = "pair"                             // Query parameter carrying the code in the QR URL
+	pairingCodeGroupLength = PairingCodeLength / 2
+)
+
+// pairingCode is an outstanding one-time pairing code.
+type pairingCode struct {
+	code      string    // Normalized code (uppercase, no dash)
+	expiresAt time.Time // Code is rejected after this time
+}
+
+// PairingManager issues short-lived, single-use pairing codes that can be
+// exchanged for a device token.
+//
+// Codes live in memory only: a server restart invalidates them. To limit
+// guessing, an address that fails PairingMaxFailures exchanges within
+// PairingFailureWindow is refused until its oldest failure ages out. Other
+// clients (and the outstanding codes) are unaffected.
+type PairingManager struct {
+	mu       sync.Mutex
+	codes    map[string]*pairingCode // Outstanding codes by normalized code
+	failures map[string][]time.Time  // Recent failed exchanges by remote address, oldest first
+	ttl      time.Duration           // Lifetime of new codes
+}
+
+// PairingResult is the outcome of redeeming a pairing code.
+type PairingResult int
+
+// Pairing redemption results
+const (
+	PairingOK      PairingResult = iota // Code exchanged
+	PairingInvalid                      // Unknown, expired or already used code
+	PairingLimited                      // Too many recent failures from this address
+)
+
+// pairing is the global pairing manager.
+var pairing = NewPairingManager(DefaultPairingTTL)
+
+// NewPairingManager creates a pairing manager whose codes expire after ttl.
+func NewPairingManager(ttl time.Duration) *PairingManager {
+	return &PairingManager{
+		codes:    make(map[string]*pairingCode),
+		failures: make(map[string][]time.Time),
+		ttl:      ttl,
+	}
+}
+
+// NewCode generates a new pairing code.
+//
+// Returns the display form ("ABCD-EFGH") and its expiry time.
+func (pm *PairingManager) NewCode() (string, time.Time, error) {
+	raw := make([]byte, PairingCodeLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate pairing code: %w", err)
+	}
+	for i, b := range raw {
+		raw[i] = PairingCodeAlphabet[int(b)%len(PairingCodeAlphabet)]
+	}
+	code := string(raw)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.pruneLocked()
+	entry := &pairingCode{code: code, expiresAt: time.Now().Add(pm.ttl)}
+	pm.codes[code] = entry
+
+	return formatPairingCode(code), entry.expiresAt, nil
+}
+
+// Redeem consumes a pairing code on behalf of the client at addr. Returns
+// PairingInvalid if the code is unknown, expired, or already used, and
+// PairingLimited (without looking at the code) if addr failed too often
+// recently.
+func (pm *PairingManager) Redeem(code, addr string) PairingResult {
+	code = normalizePairingCode(code)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.pruneLocked()
+	if len(pm.failures[addr]) >= PairingMaxFailures {
+		return PairingLimited
+	}
+	if _, ok := pm.codes[code]; !ok {
+		pm.failures[addr] = append(pm.failures[addr], time.Now())
+		if len(pm.failures[addr]) == PairingMaxFailures {
+			slog.Warn("too many failed pairing attempts, refusing address", "remote_addr", addr, "window", PairingFailureWindow)
+		}
+		return PairingInvalid
+	}
+
+	delete(pm.codes, code) // Single use
+	return PairingOK
+}
+
+// pruneLocked drops expired codes and failures older than
+// PairingFailureWindow. The caller must hold pm.mu.
+func (pm *PairingManager) pruneLocked() {
+	now := time.Now()
+	for code, entry := range pm.codes {
+		if now.After(entry.expiresAt) {
+			delete(pm.codes, code)
+		}
+	}
+	for addr, times := range pm.failures {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) > PairingFailureWindow {
+			i++
+		}
+		if i == len(times) {
+			delete(pm.failures, addr)
+		} else if i > 0 {
+			pm.failures[addr] = times[i:]
+		}
+	}
+}
+
+// remoteHost returns the client address of a request without its port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// normalizePairingCode uppercases a code and strips dashes and spaces so
+// "abcd-efgh" and "ABCD EFGH" match "ABCDEFGH".
+func normalizePairingCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// formatPairingCode splits a code into two dash-separated groups.
+func formatPairingCode(code string) string {
+	return code[:pairingCodeGroupLength] + "-" + code[pairingCodeGroupLength:]
+}
+
+// pairingURL returns the web UI link encoded in the QR code. Opening it on a
+// phone lets the UI redeem the code automatically.
+func pairingURL(code string) string {
+	return publicBaseURL() + "/?" + PairingQueryParam + "=" + url.QueryEscape(code)
+}
+
+// publicBaseURL returns the externally reachable base URL of the web UI,
+// without a trailing slash.
+func publicBaseURL() string {
+	base := strings.TrimSuffix(cfg.Server.PublicURL, "/")
+	if base == "" {
+		base = fmt.Sprintf("http://localhost:%d", cfg.Server.Port)
+	}
+	return base
+}
+
+// printPairingCode writes a pairing code, its link, and a terminal QR code to w.
+func printPairingCode(w io.Writer, code string, expiresAt time.Time, link string) error {
+	qr, err := qrcode.New(link, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("failed to render QR code: %w", err)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprint(w, qr.ToSmallString(false))
+	fmt.Fprintf(w, "\nPairing code: %s (expires %s)\n", code, expiresAt.Format(time.Kitchen))
+	fmt.Fprintf(w, "Scan the QR code or open: %s\n\n", link)
+	return nil
+}
+
+// handleCreatePairingCode issues a new pairing code. Refused while auth is
+// disabled (see requireCredential).
+//
+// POST /pair/codes
+//
+// Response:
+//
+//	{
+//	  "code": "ABCD-EFGH",
+//	  "expires_at": "2025-01-01T12:05:00Z",
+//	  "url": "https://doze.example.com/?pair=ABCD-EFGH"
+//	}
+func handleCreatePairingCode(w http.ResponseWriter, r *http.Request) {
+	if !requireCredential(w, r) {
+		return
+	}
+
+	code, expiresAt, err := pairing.NewCode()
+	if err != nil {
+		slog.Error("failed to create pairing code", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to create pairing code")
+		return
+	}
+
+	slog.Info("pairing code created", "expires_at", expiresAt)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"code":       code,
+		"expires_at": expiresAt,
+		"url":        pairingURL(code),
+	})
+}
+
+// handlePairingQR issues a new pairing code and returns it as a QR code PNG.
+//
+// GET /pair/qr
+//
+// The QR code encodes the web UI URL with ?pair=CODE. The code is also sent
+// in the X-Pairing-Code header for display next to the image. Refused while
+// auth is disabled (see requireCredential).
+func handlePairingQR(w http.ResponseWriter, r *http.Request) {
+	if !requireCredential(w, r) {
+		return
+	}
+
+	code, expiresAt, err := pairing.NewCode()
+	if err != nil {
+		slog.Error("failed to create pairing code", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to create pairing code")
+		return
+	}
+
+	png, err := qrcode.Encode(pairingURL(code), qrcode.Medium, PairingQRSize)
+	if err != nil {
+		slog.Error("failed to render pairing QR code", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to render QR code")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Pairing-Code", code)
+	w.Header().Set("X-Pairing-Expires", expiresAt.Format(time.RFC3339))
+	if _, err := w.Write(png); err != nil {
+		slog.Error("failed to write pairing QR code", "error", err)
+	}
+}
+
+// handlePair exchanges a pairing code for a long-lived device token.
+//
+// POST /pair (public)
+// Request body:
+//
+//	{
+//	  "code": "ABCD-EFGH",
+//	  "name": "iPhone"  // Optional device name
+//	}
+//
+// Response (201):
+//
+//	{
+//	  "device_id": "3f9a1c2b4d5e6f70",
+//	  "token": "doze_..."
+//	}
+//
+// Returns 401 for a bad code, and 429 once the client's address has failed
+// PairingMaxFailures times within PairingFailureWindow.
+func handlePair(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if req.Code == "" {
+		respondError(w, http.StatusBadRequest, "code is required")
+		return
+	}
+
+	switch pairing.Redeem(req.Code, remoteHost(r)) {
+	case PairingLimited:
+		slog.Warn("pairing refused, too many failures", "remote_addr", r.RemoteAddr)
+		respondError(w, http.StatusTooManyRequests, "too many failed pairing attempts, try again later")
+		return
+	case PairingInvalid:
+		slog.Warn("pairing failed", "remote_addr", r.RemoteAddr)
+		respondError(w, http.StatusUnauthorized, "invalid or expired pairing code")
+		return
+	}
+
+	token, device, err := authenticator.IssueDeviceToken(req.Name)
+	if err != nil {
+		slog.Error("failed to issue device token", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to issue device token")
+		return
+	}
+
+	slog.Info("device paired", "device_id", device.ID, "name", device.Name)
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"device_id": device.ID,
+		"name":      device.Name,
+		"token":     token,
+	})
+}
+
+// runPairCommand implements the `doze pair` subcommand.
+//
+// It asks a running server for a pairing code (authenticating with an API
+// token) and prints the code and a QR code to the terminal. Returns the
+// process exit code.
+func runPairCommand(args []string) int {
+	fs := flag.NewFlagSet("doze pair", flag.ContinueOnError)
+	server := fs.String("server", fmt.Sprintf("http://localhost:%d", cfg.Server.Port), "URL of the running doze server")
+	token := fs.String("token", os.Getenv("DOZE_AUTH_TOKEN"), "API token (default $DOZE_AUTH_TOKEN)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*server, "/")+"/pair/codes", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doze pair: %v\n", err)
+		return 1
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doze pair: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "doze pair: server returned %s: %s\n", resp.Status, bytes.TrimSpace(body))
+		return 1
+	}
+
+	var result struct {
+		Code      string    `json:"code"`
+		ExpiresAt time.Time `json:"expires_at"`
+		URL       string    `json:"url"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "doze pair: invalid response: %v\n", err)
+		return 1
+	}
+
+	if err := printPairingCode(os.Stdout, result.Code, result.ExpiresAt, result.URL); err != nil {
+		fmt.Fprintf(os.Stderr, "doze pair: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seamus/doze/notify"
+	"github.com/seamus/doze/policy"
+)
+
+// PermissionMode controls how a session's Claude process gets permission to
+// use tools.
+type PermissionMode string
+
+const (
+	// PermissionModeSkip runs Claude with --dangerously-skip-permissions:
+	// every tool call is allowed without asking.
+	PermissionModeSkip PermissionMode = "skip"
+
+	// PermissionModePrompt forwards every tool call that needs permission to
+	// connected clients as a permission_request event and waits for
+	// POST /permissions/{id}.
+	PermissionModePrompt PermissionMode = "prompt"
+
+	// PermissionModePlan runs Claude in plan mode (read-only; no edits or
+	// commands). Anything that still needs permission is prompted for.
+	PermissionModePlan PermissionMode = "plan"
+)
+
+// Permission defaults
+const (
+	DefaultPermissionMode    = PermissionModePrompt
+	DefaultPermissionTimeout = 5 * time.Minute // Unanswered requests are denied after this
+
+	PermissionBehaviorAllow = "allow"
+	PermissionBehaviorDeny  = "deny"
+)
+
+// SSE event types for permission requests
+const (
+	EventTypePermissionRequest  = "permission_request"
+	EventTypePermissionResolved = "permission_resolved"
+)
+
+// ParsePermissionMode validates a permission mode name.
+func ParsePermissionMode(mode string) (PermissionMode, error) {
+	switch m := PermissionMode(mode); m {
+	case PermissionModeSkip, PermissionModePrompt, PermissionModePlan:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown permission mode %q (want %s, %s or %s)",
+			mode, PermissionModeSkip, PermissionModePrompt, PermissionModePlan)
+	}
+}
+
+// PermissionDecision is the answer to a permission request, in the shape
+// Claude's permission prompt tool expects.
+type PermissionDecision struct {
+	Behavior     string                 `json:"behavior"`               // "allow" or "deny"
+	Message      string                 `json:"message,omitempty"`      // Reason shown to Claude on deny
+	UpdatedInput map[string]interface{} `json:"updatedInput,omitempty"` // Tool input to run with on allow
+}
+
+// PermissionRequest is a tool call waiting for approval.
+type PermissionRequest struct {
+	ID        string                 `json:"id"`
+	SessionID string                 `json:"session_id"`     // Doze session ID
+	ToolName  string                 `json:"tool_name"`      // e.g. "Bash", "Edit"
+	Input     map[string]interface{} `json:"input"`          // Tool parameters
+	Summary   string                 `json:"summary"`        // Human-readable description (formatToolUse)
+	Rule      string                 `json:"rule,omitempty"` // Policy rule that required approval, if any
+	CreatedAt time.Time              `json:"created_at"`
+	ExpiresAt time.Time              `json:"expires_at"` // Denied automatically after this
+
+	decision chan PermissionDecision // Receives the answer (buffered, one send)
+}
+
+// PermissionBroker tracks pending permission requests across all sessions.
+//
+// Request blocks the permission prompt tool call until a client answers
+// through Resolve, the request times out, or the Claude process goes away.
+type PermissionBroker struct {
+	mu      sync.Mutex
+	pending map[string]*PermissionRequest // Pending requests by ID
+	timeout time.Duration                 // How long to wait for an answer
+	baseURL string                        // Base URL the Claude process uses to reach this server
+	policy  *policy.Engine                // Server-enforced rules, checked before asking (nil = none)
+}
+
+// permissions is the global permission broker.
+var permissions = NewPermissionBroker(DefaultPermissionTimeout, fmt.Sprintf("http://127.0.0.1:%d", DefaultPort), nil)
+
+// NewPermissionBroker creates a broker that denies unanswered requests after
+// timeout. baseURL is where Claude processes reach the MCP endpoint. Tool
+// calls are checked against engine (which may be nil) before anyone is asked.
+func NewPermissionBroker(timeout time.Duration, baseURL string, engine *policy.Engine) *PermissionBroker {
+	return &PermissionBroker{
+		pending: make(map[string]*PermissionRequest),
+		timeout: timeout,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		policy:  engine,
+	}
+}
+
+// Enforcing reports whether the broker has policy rules. Sessions in skip
+// mode still route tool calls through the permission prompt tool when it
+// does, so the rules apply to them too.
+func (b *PermissionBroker) Enforcing() bool {
+	return b.policy.Enabled()
+}
+
+// MCPURL returns the URL of the permission prompt MCP endpoint for a session.
+func (b *PermissionBroker) MCPURL(sessionID string) string {
+	return b.baseURL + "/sessions/" + sessionID + "/mcp"
+}
+
+// Request asks connected clients to approve a tool call and waits for the
+// answer.
+//
+// Policy rules are checked first: a deny rule rejects the call and an allow
+// rule accepts it without asking; both are final. Otherwise returns allow
+// immediately if the session is in skip mode or one of its always-allow rules
+// matches, unless a policy ask rule requires approval. Returns deny if nobody
+// answers within the timeout or ctx is cancelled (the Claude process went
+// away).
+func (b *PermissionBroker) Request(ctx context.Context, s *Session, toolName string, input map[string]interface{}) PermissionDecision {
+	s.mu.RLock()
+	mode := s.PermissionMode
+	repoPath := s.RepoPath
+	rule, allowed := s.matchAllowRule(toolName, input)
+	s.mu.RUnlock()
+
+	verdict, matched := b.policy.Evaluate(policy.Call{Tool: toolName, Input: input, RepoPath: repoPath})
+	if matched {
+		switch verdict.Action {
+		case policy.ActionDeny:
+			s.recordViolation(toolName, verdict)
+			return PermissionDecision{Behavior: PermissionBehaviorDeny, Message: verdict.Message}
+		case policy.ActionAllow:
+			slog.Info("permission allowed by policy", "id", s.ID, "tool", toolName, "rule", verdict.Rule)
+			return PermissionDecision{Behavior: PermissionBehaviorAllow, UpdatedInput: input}
+		case policy.ActionAsk:
+			s.recordViolation(toolName, verdict)
+		}
+	}
+	mustAsk := matched && verdict.Action == policy.ActionAsk
+
+	if mode == PermissionModeSkip && !mustAsk {
+		return PermissionDecision{Behavior: PermissionBehaviorAllow, UpdatedInput: input}
+	}
+	if allowed && !mustAsk {
+		slog.Info("permission allowed by rule", "id", s.ID, "tool", toolName, "rule", rule)
+		return PermissionDecision{Behavior: PermissionBehaviorAllow, UpdatedInput: input}
+	}
+
+	now := time.Now()
+	req := &PermissionRequest{
+		ID:        newSessionID(),
+		SessionID: s.ID,
+		ToolName:  toolName,
+		Input:     input,
+		Summary:   formatToolUse(toolName, input),
+		Rule:      verdict.Rule,
+		CreatedAt: now,
+		ExpiresAt: now.Add(b.timeout),
+		decision:  make(chan PermissionDecision, 1),
+	}
+
+	b.mu.Lock()
+	b.pending[req.ID] = req
+	b.mu.Unlock()
+
+	slog.Info("permission requested", "id", s.ID, "request_id", req.ID, "tool", toolName)
+	if data, err := json.Marshal(req); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypePermissionRequest, Content: string(data)})
+	}
+	s.mu.RLock()
+	s.notify(notify.EventPermission, "Permission needed", req.Summary)
+	s.mu.RUnlock()
+
+	timer := time.NewTimer(b.timeout)
+	defer timer.Stop()
+
+	var decision PermissionDecision
+	select {
+	case decision = <-req.decision:
+	case <-timer.C:
+		decision = PermissionDecision{Behavior: PermissionBehaviorDeny, Message: "permission request timed out"}
+	case <-ctx.Done():
+		decision = PermissionDecision{Behavior: PermissionBehaviorDeny, Message: "permission request cancelled"}
+	case <-s.ended:
+		decision = PermissionDecision{Behavior: PermissionBehaviorDeny, Message: "session ended"}
+	}
+
+	b.mu.Lock()
+	delete(b.pending, req.ID)
+	b.mu.Unlock()
+
+	if decision.Behavior == PermissionBehaviorAllow && decision.UpdatedInput == nil {
+		decision.UpdatedInput = input
+	}
+
+	slog.Info("permission resolved", "id", s.ID, "request_id", req.ID, "tool", toolName, "behavior", decision.Behavior)
+	if data, err := json.Marshal(map[string]interface{}{
+		"id":       req.ID,
+		"behavior": decision.Behavior,
+		"message":  decision.Message,
+	}); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypePermissionResolved, Content: string(data)})
+	}
+	return decision
+}
+
+// Resolve answers a pending request. Returns false if the request is unknown
+// (already answered, timed out, or never existed).
+func (b *PermissionBroker) Resolve(id string, decision PermissionDecision) (*PermissionRequest, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	req, ok := b.pending[id]
+	if !ok {
+		return nil, false
+	}
+	delete(b.pending, id)
+	req.decision <- decision
+	return req, true
+}
+
+// Pending returns pending requests (for one session, or all if sessionID is
+// empty), oldest first.
+func (b *PermissionBroker) Pending(sessionID string) []*PermissionRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := make([]*PermissionRequest, 0, len(b.pending))
+	for _, req := range b.pending {
+		if sessionID == "" || req.SessionID == sessionID {
+			list = append(list, req)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// matchAllowRule reports whether one of the session's always-allow rules
+// matches a tool call, and which. The caller must hold s.mu.
+func (s *Session) matchAllowRule(toolName string, input map[string]interface{}) (string, bool) {
+	for _, rule := range s.AllowRules {
+		if matchPermissionRule(rule, toolName, input) {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
+// addAllowRule adds an always-allow rule to the session (if new) and
+// persists it. The caller must hold s.mu.
+func (s *Session) addAllowRule(rule string) {
+	for _, existing := range s.AllowRules {
+		if existing == rule {
+			return
+		}
+	}
+	s.AllowRules = append(s.AllowRules, rule)
+	s.persist()
+}
+
+// matchPermissionRule reports whether rule matches a tool call.
+//
+// Rules use Claude Code's permission rule syntax:
+//   - "Read" matches every call to the Read tool
+//   - "Bash(go test *)" matches Bash calls whose command matches the glob
+//   - "Edit(src/*)" matches Edit calls whose file_path matches the glob
+//
+// In globs, "*" matches any sequence of characters (including "/").
+func matchPermissionRule(rule, toolName string, input map[string]interface{}) bool {
+	name, pattern, hasPattern := strings.Cut(rule, "(")
+	if name != toolName {
+		return false
+	}
+	if !hasPattern {
+		return true
+	}
+	pattern, ok := strings.CutSuffix(pattern, ")")
+	if !ok {
+		return false
+	}
+	return globMatch(pattern, policy.Subject(toolName, input))
+}
+
+// suggestAllowRule returns the always-allow rule for "allow this exact call
+// from now on": the exact command/path for tools with a subject, or the bare
+// tool name otherwise.
+func suggestAllowRule(toolName string, input map[string]interface{}) string {
+	subject := policy.Subject(toolName, input)
+	if strings.HasPrefix(subject, "{") {
+		return toolName
+	}
+	return toolName + "(" + subject + ")"
+}
+
+// globMatch matches s against a glob where "*" matches any sequence of
+// characters. All other characters match literally.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+// handleListPermissions lists pending permission requests.
+//
+// GET /permissions
+// GET /sessions/{id}/permissions
+//
+// Response:
+//
+//	{
+//	  "requests": [{"id": "...", "session_id": "default", "tool_name": "Bash", "input": {...}, ...}]
+//	}
+func handleListPermissions(w http.ResponseWriter, r *http.Request) {
+	sessionID := ""
+	if r.PathValue("id") != "" {
+		s, ok := sessionFromRequest(w, r)
+		if !ok {
+			return
+		}
+		sessionID = s.ID
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"requests": permissions.Pending(sessionID),
+	})
+}
+
+// handleResolvePermission answers a pending permission request.
+//
+// POST /permissions/{id}
+// Request body:
+//
+//	{
+//	  "behavior": "allow",          // "allow" or "deny"
+//	  "message": "Not now",         // Optional reason (deny)
+//	  "always": true,               // Optional: also allow matching calls from now on
+//	  "pattern": "Bash(go test *)"  // Optional rule for "always" (default: this exact call)
+//	}
+//
+// Response:
+//
+//	{
+//	  "success": true,
+//	  "rule": "Bash(go test *)"  // Present when an always-allow rule was added
+//	}
+//
+// Returns 404 if the request is unknown (already answered or timed out).
+func handleResolvePermission(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Behavior string `json:"behavior"`
+		Message  string `json:"message"`
+		Always   bool   `json:"always"`
+		Pattern  string `json:"pattern"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if req.Behavior != PermissionBehaviorAllow && req.Behavior != PermissionBehaviorDeny {
+		respondError(w, http.StatusBadRequest, `behavior must be "allow" or "deny"`)
+		return
+	}
+	if req.Always && req.Behavior != PermissionBehaviorAllow {
+		respondError(w, http.StatusBadRequest, "always is only valid with allow")
+		return
+	}
+
+	decision := PermissionDecision{Behavior: req.Behavior, Message: req.Message}
+	if decision.Behavior == PermissionBehaviorDeny && decision.Message == "" {
+		decision.Message = "denied by user"
+	}
+
+	pending, ok := permissions.Resolve(r.PathValue("id"), decision)
+	if !ok {
+		respondError(w, http.StatusNotFound, "permission request not found")
+		return
+	}
+
+	resp := map[string]interface{}{"success": true}
+	if req.Always {
+		rule := req.Pattern
+		if rule == "" {
+			rule = suggestAllowRule(pending.ToolName, pending.Input)
+		}
+		if s, ok := sessions.Get(pending.SessionID); ok {
+			s.mu.Lock()
+			s.addAllowRule(rule)
+			s.mu.Unlock()
+			slog.Info("always-allow rule added", "id", s.ID, "rule", rule)
+		}
+		resp["rule"] = rule
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// handleSetPermissionMode changes a session's permission mode.
+//
+// POST /sessions/{id}/permission-mode
+// Request body:
+//
+//	{
+//	  "mode": "prompt"  // "skip", "prompt" or "plan"
+//	}
+//
+// The mode is passed to Claude when its process starts, so a change applies
+// from the next start or resume ("restart_required" is true if a process is
+// running). Switching a running prompt-mode session to skip takes effect
+// immediately: further requests are allowed without asking.
+func handleSetPermissionMode(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	mode, err := ParsePermissionMode(req.Mode)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	changed := s.PermissionMode != mode
+	s.PermissionMode = mode
+	running := s.proc != nil
+	s.persist()
+	s.mu.Unlock()
+
+	slog.Info("permission mode set", "id", s.ID, "mode", mode)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success":          true,
+		"permission_mode":  mode,
+		"restart_required": changed && running,
+	})
+}
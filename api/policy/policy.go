@@ -0,0 +1,234 @@
+// Package policy evaluates declarative rules against Claude's tool calls.
+//
+// Rules are loaded from config and checked for every tool call that reaches
+// the permission prompt hook, before the user is asked. A rule can deny a
+// call outright, force a prompt even when the session would otherwise allow
+// it, or allow it without asking:
+//
+//	policy:
+//	  rules:
+//	    - name: no-force-push
+//	      tools: [Bash]
+//	      match: 'git\s+push\s+.*(--force|-f\b)'
+//	      action: deny
+//	    - name: stay-in-repo
+//	      tools: [Write, Edit]
+//	      outside_repo: true
+//	      action: deny
+//
+// When several rules match, the strictest action wins (deny, then ask, then
+// allow).
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Action is what happens to a tool call that matches a rule.
+type Action string
+
+const (
+	// ActionAllow lets the call through without asking.
+	ActionAllow Action = "allow"
+
+	// ActionAsk requires the user to approve the call, even in skip mode or
+	// when an always-allow rule matches.
+	ActionAsk Action = "ask"
+
+	// ActionDeny rejects the call.
+	ActionDeny Action = "deny"
+)
+
+// strictness orders actions for conflict resolution.
+var strictness = map[Action]int{ActionAllow: 1, ActionAsk: 2, ActionDeny: 3}
+
+// Rule is a single policy rule.
+//
+// A rule matches a call when the tool is listed in Tools (or Tools is empty),
+// and every condition that is set holds: Match matches the call's subject
+// (the Bash command or the file path), and OutsideRepo finds the path outside
+// the session's repository.
+type Rule struct {
+	Name        string   `yaml:"name" json:"name"`                 // Identifies the rule in violations
+	Tools       []string `yaml:"tools" json:"tools"`               // Tool names the rule applies to (empty = all)
+	Match       string   `yaml:"match" json:"match"`               // Regexp matched against the command or path
+	OutsideRepo bool     `yaml:"outside_repo" json:"outside_repo"` // Match file paths outside the repository
+	Action      Action   `yaml:"action" json:"action"`             // allow, ask or deny
+	Message     string   `yaml:"message" json:"message"`           // Reason shown to Claude and the user
+
+	re *regexp.Regexp // Compiled Match
+}
+
+// Call is a tool call to evaluate.
+type Call struct {
+	Tool     string                 // Tool name, e.g. "Bash"
+	Input    map[string]interface{} // Tool input as sent by Claude
+	RepoPath string                 // Session working directory (for relative paths and OutsideRepo)
+}
+
+// Decision is the outcome of evaluating a call against the rules.
+type Decision struct {
+	Action  Action `json:"action"`  // Strictest action among matching rules
+	Rule    string `json:"rule"`    // Name of the rule that decided
+	Message string `json:"message"` // Rule message, or a generated reason
+	Subject string `json:"subject"` // Command or path the rule matched
+}
+
+// Engine evaluates tool calls against a fixed set of rules.
+//
+// An Engine is immutable and safe for concurrent use. The nil Engine has no
+// rules.
+type Engine struct {
+	rules []Rule
+}
+
+// New compiles and validates rules.
+func New(rules []Rule) (*Engine, error) {
+	var errs []error
+	compiled := make([]Rule, 0, len(rules))
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			rule.Name = name
+		}
+		if _, ok := strictness[rule.Action]; !ok {
+			errs = append(errs, fmt.Errorf("rule %s: action must be allow, ask or deny, got %q", name, rule.Action))
+		}
+		if rule.Match == "" && !rule.OutsideRepo && len(rule.Tools) == 0 {
+			errs = append(errs, fmt.Errorf("rule %s: needs tools, match or outside_repo", name))
+		}
+		if rule.Match != "" {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rule %s: invalid match: %w", name, err))
+			}
+			rule.re = re
+		}
+		compiled = append(compiled, rule)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &Engine{rules: compiled}, nil
+}
+
+// Rules returns the engine's rules.
+func (e *Engine) Rules() []Rule {
+	if e == nil {
+		return nil
+	}
+	return slices.Clone(e.rules)
+}
+
+// Enabled reports whether the engine has any rules.
+func (e *Engine) Enabled() bool {
+	return e != nil && len(e.rules) > 0
+}
+
+// Evaluate checks a call against every rule. Returns false if no rule
+// matches, in which case the call goes through the normal permission flow.
+func (e *Engine) Evaluate(call Call) (Decision, bool) {
+	if e == nil {
+		return Decision{}, false
+	}
+
+	subject := Subject(call.Tool, call.Input)
+	path := filePath(call.Input)
+	var best *Rule
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !rule.matches(call, subject, path) {
+			continue
+		}
+		if best == nil || strictness[rule.Action] > strictness[best.Action] {
+			best = rule
+		}
+	}
+	if best == nil {
+		return Decision{}, false
+	}
+
+	message := best.Message
+	if message == "" {
+		message = fmt.Sprintf("%s %s by policy rule %s", call.Tool, actionVerb(best.Action), best.Name)
+	}
+	return Decision{Action: best.Action, Rule: best.Name, Message: message, Subject: subject}, true
+}
+
+// matches reports whether the rule applies to a call.
+func (r *Rule) matches(call Call, subject, path string) bool {
+	if len(r.Tools) > 0 && !slices.Contains(r.Tools, call.Tool) {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(subject) {
+		return false
+	}
+	if r.OutsideRepo && (path == "" || !outside(path, call.RepoPath)) {
+		return false
+	}
+	return true
+}
+
+// Subject returns the part of a tool call that rules match against: the
+// command for Bash, the path for file tools, the URL for WebFetch, and the
+// JSON-encoded input otherwise.
+func Subject(tool string, input map[string]interface{}) string {
+	if cmd, ok := input["command"].(string); ok {
+		return cmd
+	}
+	if path := filePath(input); path != "" {
+		return path
+	}
+	for _, key := range []string{"url", "pattern"} {
+		if v, ok := input[key].(string); ok {
+			return v
+		}
+	}
+	data, _ := json.Marshal(input)
+	return string(data)
+}
+
+// filePath returns the file a tool call reads or writes, if any.
+func filePath(input map[string]interface{}) string {
+	for _, key := range []string{"file_path", "notebook_path", "path"} {
+		if v, ok := input[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// outside reports whether path lies outside repo. Relative paths are
+// resolved against repo.
+func outside(path, repo string) bool {
+	if repo == "" {
+		return false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(repo, path)
+	}
+	rel, err := filepath.Rel(filepath.Clean(repo), filepath.Clean(path))
+	if err != nil {
+		return true
+	}
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// actionVerb describes an action for generated messages.
+func actionVerb(a Action) string {
+	switch a {
+	case ActionDeny:
+		return "denied"
+	case ActionAsk:
+		return "requires approval"
+	default:
+		return "allowed"
+	}
+}
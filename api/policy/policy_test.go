@@ -0,0 +1,100 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+var testRules = []Rule{
+	{Name: "no-force-push", Tools: []string{"Bash"}, Match: `git\s+push\s+.*(--force|-f\b)`, Action: ActionDeny},
+	{Name: "no-rm-root", Tools: []string{"Bash"}, Match: `rm\s+-rf\s+/(\s|$)`, Action: ActionDeny},
+	{Name: "stay-in-repo", Tools: []string{"Write", "Edit"}, OutsideRepo: true, Action: ActionDeny, Message: "stay in the repo"},
+	{Name: "env-files", Match: `(^|[/\s])\.env\b`, Action: ActionAsk},
+	{Name: "go-test", Tools: []string{"Bash"}, Match: `^go test`, Action: ActionAllow},
+}
+
+func TestEvaluate(t *testing.T) {
+	engine, err := New(testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tool   string
+		input  map[string]interface{}
+		action Action // "" = no rule matches
+		rule   string
+	}{
+		{"Bash", map[string]interface{}{"command": "git push --force origin main"}, ActionDeny, "no-force-push"},
+		{"Bash", map[string]interface{}{"command": "git push -f"}, ActionDeny, "no-force-push"},
+		{"Bash", map[string]interface{}{"command": "git push origin main"}, "", ""},
+		{"Bash", map[string]interface{}{"command": "rm -rf /"}, ActionDeny, "no-rm-root"},
+		{"Bash", map[string]interface{}{"command": "rm -rf /tmp/build"}, "", ""},
+		{"Write", map[string]interface{}{"file_path": "/etc/passwd"}, ActionDeny, "stay-in-repo"},
+		{"Edit", map[string]interface{}{"file_path": "../other/main.go"}, ActionDeny, "stay-in-repo"},
+		{"Edit", map[string]interface{}{"file_path": "/repo/main.go"}, "", ""},
+		{"Write", map[string]interface{}{"file_path": "cmd/main.go"}, "", ""},
+		{"Read", map[string]interface{}{"file_path": "/etc/passwd"}, "", ""},
+		{"Read", map[string]interface{}{"file_path": "/repo/.env"}, ActionAsk, "env-files"},
+		{"Bash", map[string]interface{}{"command": "cat .env.local"}, ActionAsk, "env-files"},
+		{"Edit", map[string]interface{}{"file_path": "/repo/environment.go"}, "", ""},
+		{"Bash", map[string]interface{}{"command": "go test ./..."}, ActionAllow, "go-test"},
+		// Strictest action wins
+		{"Bash", map[string]interface{}{"command": "go test ./... && cat .env"}, ActionAsk, "env-files"},
+		{"Write", map[string]interface{}{"file_path": "/elsewhere/.env"}, ActionDeny, "stay-in-repo"},
+	}
+	for _, tt := range tests {
+		decision, ok := engine.Evaluate(Call{Tool: tt.tool, Input: tt.input, RepoPath: "/repo"})
+		if !ok {
+			if tt.action != "" {
+				t.Errorf("%s %v: no match, want %s by %s", tt.tool, tt.input, tt.action, tt.rule)
+			}
+			continue
+		}
+		if decision.Action != tt.action || decision.Rule != tt.rule {
+			t.Errorf("%s %v = %s by %s, want %s by %s", tt.tool, tt.input, decision.Action, decision.Rule, tt.action, tt.rule)
+		}
+	}
+}
+
+func TestEvaluateMessage(t *testing.T) {
+	engine, err := New(testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decision, _ := engine.Evaluate(Call{Tool: "Write", Input: map[string]interface{}{"file_path": "/tmp/x"}, RepoPath: "/repo"})
+	if decision.Message != "stay in the repo" || decision.Subject != "/tmp/x" {
+		t.Errorf("decision = %+v, want rule message and path subject", decision)
+	}
+	decision, _ = engine.Evaluate(Call{Tool: "Bash", Input: map[string]interface{}{"command": "rm -rf /"}})
+	if !strings.Contains(decision.Message, "no-rm-root") {
+		t.Errorf("message = %q, want generated message naming the rule", decision.Message)
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	_, err := New([]Rule{
+		{Name: "bad-action", Tools: []string{"Bash"}, Action: "maybe"},
+		{Name: "bad-regexp", Match: "(", Action: ActionDeny},
+		{Name: "matches-everything", Action: ActionDeny},
+	})
+	if err == nil {
+		t.Fatal("New accepted invalid rules")
+	}
+	for _, name := range []string{"bad-action", "bad-regexp", "matches-everything"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not mention %s", err, name)
+		}
+	}
+}
+
+func TestNilEngine(t *testing.T) {
+	var engine *Engine
+	if engine.Enabled() {
+		t.Error("nil engine is enabled")
+	}
+	if _, ok := engine.Evaluate(Call{Tool: "Bash", Input: map[string]interface{}{"command": "ls"}}); ok {
+		t.Error("nil engine matched a call")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Queue settings
+const (
+	EventTypeQueue     = "queue"
+	MaxQueuedMessages  = 100  // Messages waiting per session before new ones are rejected
+	MaxIdempotencyKeys = 1000 // Idempotency keys remembered per session (oldest dropped first)
+)
+
+// ErrQueueFull is returned by sendMessage when MaxQueuedMessages are waiting.
+var ErrQueueFull = errors.New("message queue is full")
+
+// draining is set once the server starts shutting down, so queued messages
+// don't resume the sessions being stopped.
+var draining atomic.Bool
+
+// QueuedMessage is a user message waiting for Claude to finish its turn.
+type QueuedMessage struct {
+	ID             string    `json:"id"`
+	Content        string    `json:"content"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"` // Client-supplied Idempotency-Key
+	QueuedAt       time.Time `json:"queued_at"`
+}
+
+// claimKey reserves an idempotency key for a new message and returns the
+// message's ID. If the key was already used, it returns the ID of the message
+// sent with it and duplicate=true. An empty key never matches.
+func (s *Session) claimKey(key string) (id string, duplicate bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key != "" {
+		if id, ok := s.idempotencyKeys[key]; ok {
+			return id, true
+		}
+	}
+
+	id = newSessionID()
+	if key != "" {
+		if s.idempotencyKeys == nil {
+			s.idempotencyKeys = make(map[string]string)
+		}
+		s.idempotencyKeys[key] = id
+		s.keyOrder = append(s.keyOrder, key)
+		if len(s.keyOrder) > MaxIdempotencyKeys {
+			delete(s.idempotencyKeys, s.keyOrder[0])
+			s.keyOrder = slices.Clone(s.keyOrder[1:])
+		}
+	}
+	return id, false
+}
+
+// releaseKey forgets a key claimed for a message that wasn't accepted, so a
+// retry isn't mistaken for a duplicate.
+func (s *Session) releaseKey(key string) {
+	if key == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.idempotencyKeys, key)
+	s.keyOrder = slices.DeleteFunc(s.keyOrder, func(k string) bool { return k == key })
+}
+
+// enqueue appends msg to the session's queue and broadcasts the new queue.
+func (s *Session) enqueue(msg QueuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) >= MaxQueuedMessages {
+		return ErrQueueFull
+	}
+	s.queue = append(s.queue, msg)
+	s.broadcastQueue()
+	return nil
+}
+
+// requeue puts a message that couldn't be delivered back at the head of the
+// queue, so it's the next one tried. The caller must hold s.mu.
+func (s *Session) requeue(msg QueuedMessage) {
+	s.queue = append([]QueuedMessage{msg}, s.queue...)
+	s.broadcastQueue()
+}
+
+// queuePosition returns the 1-based position of message id in the queue, or
+// 0 if it isn't queued (i.e. it was delivered or cancelled).
+func (s *Session) queuePosition(id string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.IndexFunc(s.queue, func(m QueuedMessage) bool { return m.ID == id }) + 1
+}
+
+// dequeue removes a queued message before it's delivered. Returns false if
+// it isn't queued.
+func (s *Session) dequeue(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.queue, func(m QueuedMessage) bool { return m.ID == id })
+	if i < 0 {
+		return false
+	}
+	s.queue = slices.Delete(s.queue, i, i+1)
+	s.broadcastQueue()
+	return true
+}
+
+// broadcastQueue sends the current queue to clients as a queue event. The
+// caller must hold s.mu.
+func (s *Session) broadcastQueue() {
+	queue := s.queue
+	if queue == nil {
+		queue = []QueuedMessage{}
+	}
+	if data, err := json.Marshal(queue); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypeQueue, Content: string(data)})
+	}
+}
+
+// deliverNext sends the oldest queued message to Claude if the session can
+// take one, starting or resuming the process as needed. Messages stay queued
+// while Claude is mid-turn, starting or shutting down; handleStdout and
+// waitForExit call this again when the turn ends or the process stops.
+//
+// Nothing is delivered while the session is over budget (see checkBudget).
+//
+// Returns how the message was delivered (a zero result with the current
+// state if nothing was); result.ID is the message tried. A message that
+// fails to deliver goes back to the head of the queue, unless the session
+// has ended. The caller must NOT hold s.mu or s.startMu.
+func (s *Session) deliverNext() (MessageResult, error) {
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	if s.checkBudget() != nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return MessageResult{State: s.State}, nil // Queued messages wait for an override
+	}
+
+	s.mu.Lock()
+	state := s.State
+	ready := state == StateNone || state == StateStopped || state == StateCrashed || state == StateWaiting
+	select {
+	case <-s.ended:
+		ready = false // Ended sessions never start again
+	default:
+	}
+	if !ready || len(s.queue) == 0 || draining.Load() {
+		s.mu.Unlock()
+		return MessageResult{State: state}, nil
+	}
+	msg := s.queue[0]
+	s.queue = slices.Clone(s.queue[1:])
+	s.broadcastQueue()
+	s.mu.Unlock()
+
+	s.transcribe(TranscriptEntry{Kind: EntryKindUser, Text: msg.Content, MessageID: msg.ID, At: msg.QueuedAt})
+
+	result, err := s.deliver(state, msg)
+	result.ID = msg.ID
+	if err != nil {
+		slog.Error("failed to deliver message", "id", s.ID, "message_id", msg.ID, "error", err)
+		s.broadcastEvent(SSEEvent{Type: EventTypeError, Content: "Failed to deliver message: " + err.Error()})
+
+		s.mu.Lock()
+		dropped := false
+		select {
+		case <-s.ended:
+			dropped = true
+		default:
+			s.requeue(msg)
+		}
+		result.State = s.State
+		s.mu.Unlock()
+		if dropped {
+			s.releaseKey(msg.IdempotencyKey)
+		}
+	}
+	return result, err
+}
+
+// handleQueue lists a session's queued messages, oldest (next) first.
+//
+// GET /queue
+// GET /sessions/{id}/queue
+//
+// Response:
+//
+//	{
+//	  "messages": [{"id": "9f2c...", "content": "Now run the tests", "queued_at": "..."}]
+//	}
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	queue := slices.Clone(s.queue)
+	s.mu.RUnlock()
+	if queue == nil {
+		queue = []QueuedMessage{}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"messages": queue,
+	})
+}
+
+// handleCancelQueued removes a message from the queue before Claude sees it.
+//
+// DELETE /queue/{message}
+// DELETE /sessions/{id}/queue/{message}
+//
+// Returns 404 if the message isn't queued (it may already have been
+// delivered).
+func handleCancelQueued(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("message")
+	if !s.dequeue(id) {
+		respondError(w, http.StatusNotFound, "message not queued")
+		return
+	}
+	slog.Info("queued message cancelled", "id", s.ID, "message_id", id)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"id":      id,
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/seamus/doze/notify"
+)
+
+// Crash recovery defaults
+const (
+	DefaultCrashRetries = 3                // --resume attempts after a crash before giving up
+	DefaultCrashBackoff = time.Second      // Delay before the first attempt (doubles each time)
+	MaxCrashBackoff     = 30 * time.Second // Default cap on the delay between attempts
+)
+
+// recoverAfterCrash handles an unexpected process exit by scheduling a
+// --resume with exponential backoff. The session waits in StateCrashed
+// meanwhile; a message sent in the meantime resumes it straight away (see
+// deliver). Returns false, leaving the state alone, if the conversation
+// can't be recovered: Claude never reported a session ID, or
+// recovery.max_retries consecutive attempts have already failed.
+//
+// The caller must hold s.mu.
+func (s *Session) recoverAfterCrash() bool {
+	if s.ClaudeSessionID == "" || s.crashRetries >= cfg.Recovery.MaxRetries {
+		return false
+	}
+
+	s.crashRetries++
+	delay := cfg.CrashBackoff(s.crashRetries)
+	s.setState(StateCrashed)
+	slog.Warn("claude crashed, scheduling resume", "id", s.ID, "session_id", s.ClaudeSessionID,
+		"attempt", s.crashRetries, "max", cfg.Recovery.MaxRetries, "delay", delay)
+	s.broadcastEvent(SSEEvent{
+		Type: EventTypeError,
+		Content: fmt.Sprintf("Claude process exited unexpectedly; resuming in %s (attempt %d of %d)",
+			delay, s.crashRetries, cfg.Recovery.MaxRetries),
+	})
+
+	s.cancelRecovery()
+	s.recoveryTimer = time.AfterFunc(delay, s.recover)
+	return true
+}
+
+// cancelRecovery stops a scheduled crash recovery. The caller must hold s.mu.
+func (s *Session) cancelRecovery() {
+	if s.recoveryTimer != nil {
+		s.recoveryTimer.Stop()
+		s.recoveryTimer = nil
+	}
+}
+
+// giveUpAfterCrash moves a crashed session to StateNone, so the next message
+// starts a new conversation. The caller must hold s.mu.
+func (s *Session) giveUpAfterCrash() {
+	s.cancelRecovery()
+	s.setState(StateNone)
+
+	msg := "Claude process exited unexpectedly"
+	if s.crashRetries > 0 {
+		msg = fmt.Sprintf("Claude process exited unexpectedly; gave up after %d resume attempts", s.crashRetries)
+	}
+	s.crashRetries = 0
+	slog.Error("unexpected process exit", "id", s.ID, "session_id", s.ClaudeSessionID, "crashes", s.Crashes)
+	s.broadcastEvent(SSEEvent{Type: EventTypeError, Content: msg})
+	s.notify(notify.EventError, "Claude crashed", msg)
+}
+
+// recover resumes a crashed session once its backoff has elapsed.
+//
+// Without queued messages the resumed process waits for input like a freshly
+// started one. With queued messages (or when --resume can't work, see
+// resumeBlocker) the session is handed to deliverNext as StateStopped, which
+// resumes with the next message or falls back to a fresh session.
+func (s *Session) recover() {
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	s.mu.Lock()
+	s.recoveryTimer = nil
+	ended := false
+	select {
+	case <-s.ended:
+		ended = true
+	default:
+	}
+	if s.State != StateCrashed || ended || draining.Load() {
+		s.mu.Unlock()
+		return
+	}
+	if len(s.queue) > 0 || s.resumeBlocker() != "" {
+		s.setState(StateStopped)
+		queued := len(s.queue) > 0
+		s.mu.Unlock()
+		if queued {
+			go s.deliverNext()
+		}
+		return
+	}
+	s.mu.Unlock()
+
+	if err := s.resumeIdle(); err != nil {
+		slog.Error("failed to resume crashed session", "id", s.ID, "error", err)
+		s.mu.Lock()
+		if !s.recoverAfterCrash() {
+			s.giveUpAfterCrash()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// resumeIdle resumes the session with --resume and waits for input, like
+// startClaudeProcess does for a new conversation. If the resumed process
+// exits early, waitForExit treats it as another crash.
+//
+// The s.mu lock must NOT be held when calling this function.
+func (s *Session) resumeIdle() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repoPath, err := resolveRepoPath(s.RepoPath)
+	if err != nil {
+		s.setState(StateCrashed)
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	s.setState(StateStarting)
+	proc, err := s.runner.Resume(s.ClaudeSessionID, s.runOptions(repoPath))
+	if err != nil {
+		s.setState(StateCrashed)
+		return fmt.Errorf("failed to resume claude: %w", err)
+	}
+	s.attach(proc)
+
+	slog.Info("crashed session resumed", "id", s.ID, "pid", proc.Pid(), "session_id", s.ClaudeSessionID)
+	s.setState(StateWaiting)
+	s.resetIdleTimer()
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Resume settings
+const (
+	EventTypeResume = "resume"
+
+	// How a stopped session came back (the "path" of a resume event)
+	ResumePathResumed    = "resumed"    // claude --resume worked
+	ResumePathTranscript = "transcript" // Fresh session seeded with Claude's transcript
+	ResumePathSummary    = "summary"    // Fresh session seeded with what Doze recorded
+
+	MaxSeedBytes = 32 * 1024 // Longest transcript passed to --append-system-prompt
+)
+
+// resumeFailurePatterns are stderr messages Claude prints when --resume
+// can't find or load the conversation.
+var resumeFailurePatterns = []string{
+	"No conversation found",
+	"Session not found",
+	"Invalid session ID",
+}
+
+// resumeAttempt tracks a --resume process until it shows it's working (any
+// stream-json output) or fails (see waitForExit).
+type resumeAttempt struct {
+	proc    Process
+	msg     QueuedMessage // Message sent with the resume, re-sent by the fallback
+	failure string        // Why the attempt failed, if known before exit
+	started time.Time     // When the process was started
+}
+
+// ResumeEvent is the content of a resume event.
+type ResumeEvent struct {
+	Path              string `json:"path"`                          // See ResumePath*
+	Reason            string `json:"reason,omitempty"`              // Why --resume wasn't used or failed
+	PreviousSessionID string `json:"previous_session_id,omitempty"` // Claude session that couldn't be resumed
+}
+
+// broadcastResume tells clients how a stopped session came back.
+func (s *Session) broadcastResume(ev ResumeEvent) {
+	if data, err := json.Marshal(ev); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypeResume, Content: string(data)})
+	}
+}
+
+// nonAlphanumeric matches the characters Claude replaces with "-" when it
+// names a project directory after its working directory.
+var nonAlphanumeric = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// claudeProjectsDir returns the directory where Claude keeps session
+// transcripts ($CLAUDE_CONFIG_DIR/projects, or ~/.claude/projects).
+func claudeProjectsDir() string {
+	if dir := os.Getenv("CLAUDE_CONFIG_DIR"); dir != "" {
+		return filepath.Join(dir, "projects")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".claude", "projects")
+}
+
+// claudeTranscriptPath returns where Claude keeps the transcript of a
+// session started in repoPath.
+func claudeTranscriptPath(repoPath, claudeSessionID string) string {
+	dir := claudeProjectsDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, nonAlphanumeric.ReplaceAllString(repoPath, "-"), claudeSessionID+".jsonl")
+}
+
+// resumeBlocker returns why --resume can't work for this session, or "" if
+// it's worth trying. The caller must hold s.mu.
+//
+// A missing transcript only counts when the projects directory exists (and
+// the repo path is known), so runners that keep Claude's files elsewhere
+// still attempt the resume.
+func (s *Session) resumeBlocker() string {
+	if s.resumeFailure != "" {
+		return s.resumeFailure
+	}
+	if s.ClaudeSessionID == "" {
+		return "no Claude session ID"
+	}
+	if _, err := os.Stat(claudeProjectsDir()); err != nil || s.RepoPath == "" {
+		return ""
+	}
+	path := claudeTranscriptPath(s.RepoPath, s.ClaudeSessionID)
+	if _, err := os.Stat(path); err != nil {
+		return "transcript not found: " + path
+	}
+	return ""
+}
+
+// confirmResume marks a pending resume as working.
+func (s *Session) confirmResume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.resume == nil {
+		return
+	}
+	latency := time.Since(s.resume.started)
+	s.resume = nil
+	slog.Info("resume confirmed", "id", s.ID, "session_id", s.ClaudeSessionID, "latency", latency)
+	s.recordResume(ResumePathResumed, latency)
+	s.broadcastResume(ResumeEvent{Path: ResumePathResumed})
+}
+
+// noteResumeStderr records a resume failure message from Claude's stderr.
+// The caller must hold s.mu.
+func (s *Session) noteResumeStderr(output string) {
+	if s.resume == nil || s.resume.failure != "" {
+		return
+	}
+	for _, line := range strings.Split(output, "\n") {
+		for _, pattern := range resumeFailurePatterns {
+			if strings.Contains(line, pattern) {
+				s.resume.failure = strings.TrimSpace(line)
+				return
+			}
+		}
+	}
+}
+
+// watchResume fails attempt if Claude hasn't produced any output within
+// cfg.ResumeTimeout(), killing the process so waitForExit falls back.
+func (s *Session) watchResume(attempt *resumeAttempt) {
+	timeout := cfg.ResumeTimeout()
+	time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.resume != attempt {
+			return
+		}
+		attempt.failure = fmt.Sprintf("no response after %s", timeout)
+		slog.Warn("resume timed out, killing process", "id", s.ID, "pid", attempt.proc.Pid())
+		if err := attempt.proc.Kill(); err != nil {
+			slog.Debug("failed to kill process (may have already exited)", "error", err)
+		}
+	})
+}
+
+// resumeFailed handles the exit of a --resume process that never worked:
+// the message it was sent goes back to the front of the queue and the
+// session stops, so the next delivery takes the fallback path. Returns false
+// if proc wasn't a pending resume. The caller must hold s.mu.
+func (s *Session) resumeFailed(proc Process, exitErr error) bool {
+	attempt := s.resume
+	if attempt == nil || attempt.proc != proc {
+		return false
+	}
+	s.resume = nil
+
+	reason := attempt.failure
+	if reason == "" {
+		reason = "Claude exited before responding"
+		if exitErr != nil {
+			reason += " (" + exitErr.Error() + ")"
+		}
+	}
+	slog.Warn("resume failed", "id", s.ID, "session_id", s.ClaudeSessionID, "reason", reason)
+
+	s.resumeFailure = reason
+	s.requeue(attempt.msg)
+	s.setState(StateStopped)
+	return true
+}
+
+// startFallback starts a fresh Claude session in place of one that can't be
+// resumed. The new session is seeded through --append-system-prompt with
+// Claude's transcript of the old one if it can be read, or else with what
+// Doze recorded (the first prompt and recent output), and msg is sent to it.
+//
+// The caller must hold s.startMu but NOT s.mu.
+func (s *Session) startFallback(msg QueuedMessage, reason string) (MessageResult, error) {
+	s.mu.RLock()
+	previous := s.ClaudeSessionID
+	repoPath := s.RepoPath
+	s.mu.RUnlock()
+
+	repoPath, err := resolveRepoPath(repoPath)
+	if err != nil {
+		return MessageResult{}, fmt.Errorf("failed to get working directory: %v", err)
+	}
+
+	ev := ResumeEvent{Path: ResumePathTranscript, Reason: reason, PreviousSessionID: previous}
+	seed, err := readClaudeTranscript(claudeTranscriptPath(repoPath, previous))
+	if err != nil || seed == "" {
+		ev.Path = ResumePathSummary
+		seed = s.summary()
+	}
+	slog.Info("starting fresh session in place of resume", "id", s.ID, "path", ev.Path, "reason", reason)
+
+	prompt := "This conversation continues an earlier Claude Code session in the same repository, " +
+		"which could not be resumed (" + reason + "). "
+	if ev.Path == ResumePathTranscript {
+		prompt += "Its transcript, most recent last:\n\n" + seed
+	} else {
+		prompt += "Its transcript is unavailable; this is what was recorded of it:\n\n" + seed
+	}
+
+	if err := s.startWithMessage(repoPath, msg.Content, prompt); err != nil {
+		return MessageResult{}, fmt.Errorf("failed to start session: %v", err)
+	}
+
+	s.mu.Lock()
+	s.resumeFailure = ""
+	s.recordResume(ev.Path, 0)
+	s.mu.Unlock()
+	s.broadcastResume(ev)
+
+	return MessageResult{Started: true, State: StateActive}, nil
+}
+
+// summary describes the session from Doze's own records, for seeding a
+// fresh session when Claude's transcript is gone.
+func (s *Session) summary() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var b strings.Builder
+	if s.InitialPrompt != "" {
+		fmt.Fprintf(&b, "First request from the user:\n%s\n\n", s.InitialPrompt)
+	}
+	if output := strings.TrimSpace(s.outputBuffer.String()); output != "" {
+		fmt.Fprintf(&b, "Most recent output:\n%s\n", output)
+	}
+	if b.Len() == 0 {
+		return "(nothing recorded)"
+	}
+	return b.String()
+}
+
+// readClaudeTranscript renders the user and assistant messages of a Claude
+// session transcript as plain text, keeping the last MaxSeedBytes.
+func readClaudeTranscript(path string) (string, error) {
+	if path == "" {
+		return "", os.ErrNotExist
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, ScannerInitialBuffer), ScannerMaxBuffer)
+	for scanner.Scan() {
+		var line struct {
+			Type    string `json:"type"`
+			Message struct {
+				Content json.RawMessage `json:"content"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue // Skip lines we don't understand
+		}
+		var speaker string
+		switch line.Type {
+		case MessageTypeUser:
+			speaker = "User"
+		case MessageTypeAssistant:
+			speaker = "Claude"
+		default:
+			continue
+		}
+		if text := transcriptText(line.Message.Content); text != "" {
+			entries = append(entries, speaker+": "+text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	// Keep the most recent entries that fit
+	size, start := 0, len(entries)
+	for start > 0 && size+len(entries[start-1]) <= MaxSeedBytes {
+		start--
+		size += len(entries[start]) + 2
+	}
+	return strings.Join(entries[start:], "\n\n"), nil
+}
+
+// transcriptText extracts readable text from a message's content, which is
+// either a string or a list of content blocks. Tool calls are summarized and
+// tool results left out.
+func transcriptText(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return strings.TrimSpace(text)
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return ""
+	}
+	var parts []string
+	for _, block := range blocks {
+		switch block.Type {
+		case ContentTypeText:
+			if t := strings.TrimSpace(block.Text); t != "" {
+				parts = append(parts, t)
+			}
+		case ContentTypeToolUse:
+			parts = append(parts, "[used "+block.Name+"]")
+		}
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// Runner types
+const (
+	RunnerTypeLocal   = "local" // Spawn the Claude CLI as a local child process
+	DefaultClaudePath = "claude"
+)
+
+// RunOptions describes how to launch an agent process.
+type RunOptions struct {
+	Dir                    string         // Working directory (the repository)
+	PermissionMode         PermissionMode // skip, prompt or plan
+	MCPConfig              string         // --mcp-config JSON (prompt and plan modes)
+	PermissionPromptTool   string         // MCP tool that answers permission prompts
+	Model                  string         // --model ("" = Claude's default)
+	AppendSystemPrompt     string         // --append-system-prompt ("" = none)
+	MaxTurns               int            // --max-turns (0 = Claude's default)
+	IncludePartialMessages bool           // --include-partial-messages (stream_event lines)
+}
+
+// Runner launches agent processes for sessions.
+//
+// Session logic only talks to Runner and Process, so other backends (a remote
+// sandbox, a different CLI build, a scripted fake for tests) can be swapped
+// in without touching the session state machine.
+type Runner interface {
+	// Start launches a fresh agent conversation.
+	Start(opts RunOptions) (Process, error)
+
+	// Resume launches an agent that continues the conversation with the
+	// given Claude session ID.
+	Resume(sessionID string, opts RunOptions) (Process, error)
+}
+
+// Process is a running agent started by a Runner.
+//
+// Stdout carries stream-json messages, one per line (see ClaudeStreamMessage).
+// Stderr carries free-form diagnostic output.
+type Process interface {
+	// Send delivers a user message to the agent.
+	Send(content string) error
+
+	// Interrupt asks the agent to abandon the current turn without exiting.
+	Interrupt() error
+
+	// Stop asks the agent to exit gracefully.
+	Stop() error
+
+	// Kill terminates the agent immediately.
+	Kill() error
+
+	// Wait blocks until the agent exits.
+	Wait() error
+
+	// Stdout returns the agent's stream-json output.
+	Stdout() io.Reader
+
+	// Stderr returns the agent's diagnostic output.
+	Stderr() io.Reader
+
+	// Pid returns an identifier for logging (the OS pid for local processes).
+	Pid() int
+}
+
+// NewRunner creates the runner described by the config.
+func NewRunner(rc RunnerConfig) (Runner, error) {
+	switch rc.Type {
+	case RunnerTypeLocal, "":
+		return NewLocalRunner(rc.Path, rc.Args), nil
+	default:
+		return nil, fmt.Errorf("unknown runner type %q", rc.Type)
+	}
+}
+
+// LocalRunner runs the Claude CLI as a child process, speaking stream-json
+// over stdin/stdout.
+type LocalRunner struct {
+	path string   // Claude binary (name on PATH or absolute path)
+	args []string // Extra arguments appended to every invocation
+}
+
+// NewLocalRunner creates a runner for the Claude binary at path. An empty
+// path uses "claude" from PATH.
+func NewLocalRunner(path string, args []string) *LocalRunner {
+	if path == "" {
+		path = DefaultClaudePath
+	}
+	return &LocalRunner{path: path, args: args}
+}
+
+// Start launches `claude --print --input-format=stream-json ...` in opts.Dir.
+func (lr *LocalRunner) Start(opts RunOptions) (Process, error) {
+	return lr.run(nil, opts)
+}
+
+// Resume launches `claude --resume {sessionID} ...` in opts.Dir.
+func (lr *LocalRunner) Resume(sessionID string, opts RunOptions) (Process, error) {
+	return lr.run([]string{"--resume", sessionID}, opts)
+}
+
+// run builds the command line and starts the process.
+//
+// Uses stream-json for bidirectional streaming:
+//   - --print: Show output (don't suppress)
+//   - --input-format=stream-json: Accept JSON messages on stdin
+//   - --output-format=stream-json: Emit JSON messages on stdout
+//   - --verbose: Include session metadata in output
+func (lr *LocalRunner) run(prefix []string, opts RunOptions) (Process, error) {
+	args := append([]string{}, prefix...)
+	args = append(args,
+		"--print",
+		"--input-format=stream-json",
+		"--output-format=stream-json",
+		"--verbose",
+	)
+	switch opts.PermissionMode {
+	case PermissionModeSkip:
+		args = append(args, "--dangerously-skip-permissions")
+	case PermissionModePlan:
+		args = append(args, "--permission-mode", "plan")
+	}
+	if opts.MCPConfig != "" {
+		args = append(args, "--mcp-config", opts.MCPConfig)
+	}
+	if opts.PermissionPromptTool != "" {
+		args = append(args, "--permission-prompt-tool", opts.PermissionPromptTool)
+	}
+	if opts.Model != "" {
+		args = append(args, "--model", opts.Model)
+	}
+	if opts.AppendSystemPrompt != "" {
+		args = append(args, "--append-system-prompt", opts.AppendSystemPrompt)
+	}
+	if opts.MaxTurns > 0 {
+		args = append(args, "--max-turns", strconv.Itoa(opts.MaxTurns))
+	}
+	if opts.IncludePartialMessages {
+		args = append(args, "--include-partial-messages")
+	}
+	args = append(args, lr.args...)
+
+	cmd := exec.Command(lr.path, args...)
+	cmd.Dir = opts.Dir
+
+	// Get pipes for stdin/stdout/stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdin pipe: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &localProcess{cmd: cmd, stdin: stdin, stdout: stdout, stderr: stderr}, nil
+}
+
+// localProcess is a Claude CLI child process.
+type localProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	stderr  io.ReadCloser
+	stdinMu sync.Mutex // Serializes writes so JSON lines don't interleave
+}
+
+// Send writes a stream-json user message to stdin.
+//
+// Claude expects: {"type":"user","message":{"role":"user","content":"..."}}
+func (p *localProcess) Send(content string) error {
+	return p.writeJSON(map[string]interface{}{
+		"type": MessageTypeUser,
+		"message": map[string]interface{}{
+			"role":    MessageTypeUser,
+			"content": content,
+		},
+	})
+}
+
+// Interrupt writes a stream-json interrupt control request to stdin.
+func (p *localProcess) Interrupt() error {
+	return p.writeJSON(map[string]interface{}{
+		"type":       "control_request",
+		"request_id": fmt.Sprintf("interrupt-%d", p.Pid()),
+		"request":    map[string]interface{}{"subtype": "interrupt"},
+	})
+}
+
+// writeJSON writes v to stdin as a single newline-delimited JSON line.
+func (p *localProcess) writeJSON(v interface{}) error {
+	msgBytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to format message: %w", err)
+	}
+
+	p.stdinMu.Lock()
+	defer p.stdinMu.Unlock()
+	if _, err := fmt.Fprintf(p.stdin, "%s\n", msgBytes); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Stop sends SIGINT, which Claude handles as a graceful shutdown.
+func (p *localProcess) Stop() error {
+	return p.cmd.Process.Signal(os.Interrupt)
+}
+
+func (p *localProcess) Kill() error       { return p.cmd.Process.Kill() }
+func (p *localProcess) Wait() error       { return p.cmd.Wait() }
+func (p *localProcess) Stdout() io.Reader { return p.stdout }
+func (p *localProcess) Stderr() io.Reader { return p.stderr }
+func (p *localProcess) Pid() int          { return p.cmd.Process.Pid }
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSessionID is the ID of the session used by the legacy single-session
+// endpoints (/start, /message, /stream, /status, /diff).
+const DefaultSessionID = "default"
+
+// SessionRegistry holds all sessions known to the server, keyed by ID.
+//
+// Each session owns its own Claude process, output buffer, SSE clients, and
+// idle timer, so sessions can run concurrently without sharing state.
+type SessionRegistry struct {
+	mu       sync.RWMutex        // Protects sessions map
+	sessions map[string]*Session // Sessions by Doze session ID
+	store    SessionStore        // Persists session metadata (nil disables persistence)
+	runner   Runner              // Launches Claude processes for new sessions
+}
+
+// sessions is the global session registry.
+var sessions = NewSessionRegistry(nil, NewLocalRunner(DefaultClaudePath, nil))
+
+// NewSessionRegistry creates an empty session registry backed by store whose
+// sessions launch Claude through runner.
+//
+// A nil store keeps sessions in memory only.
+func NewSessionRegistry(store SessionStore, runner Runner) *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*Session),
+		store:    store,
+		runner:   runner,
+	}
+}
+
+// Restore loads persisted sessions from the store into the registry.
+//
+// The Claude processes didn't survive the restart, so sessions with a known
+// Claude session ID come back as StateStopped (the next message resumes them
+// through resumeClaudeProcess). Sessions that never captured an ID come back
+// as StateNone and start fresh.
+func (reg *SessionRegistry) Restore() error {
+	if reg.store == nil {
+		return nil
+	}
+
+	records, err := reg.store.LoadSessions()
+	if err != nil {
+		return err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, rec := range records {
+		s := reg.newSession(rec.ID)
+		s.CreatedAt = rec.CreatedAt
+		s.ClaudeSessionID = rec.ClaudeSessionID
+		s.RepoPath = rec.RepoPath
+		s.Branch = rec.Branch
+		s.InitialPrompt = rec.InitialPrompt
+		s.LastActivity = rec.LastActivity
+		s.AllowRules = rec.AllowRules
+		s.Model = rec.Model
+		if rec.Usage != nil {
+			s.Usage = *rec.Usage
+		}
+		if rec.PermissionMode != "" {
+			s.PermissionMode = rec.PermissionMode
+		}
+		s.activeTime = time.Duration(rec.ActiveSeconds * float64(time.Second))
+		if rec.Budget != nil {
+			s.Budget = *rec.Budget
+		}
+		if rec.BudgetBase != nil {
+			s.budgetBase = *rec.BudgetBase
+		}
+		s.budgetExemptDay = rec.BudgetExemptDay
+		s.budgetBlock = rec.BudgetBlock
+
+		s.mu.Lock()
+		s.State = rec.State
+		if rec.ClaudeSessionID != "" {
+			s.setState(StateStopped) // Records and persists the change, if any
+		} else {
+			s.setState(StateNone)
+		}
+		s.stateSince = time.Now() // Set after, so no compute span is recorded for the downtime
+		s.mu.Unlock()
+
+		reg.sessions[s.ID] = s
+		slog.Info("restored session", "id", s.ID, "state", s.State, "session_id", s.ClaudeSessionID)
+	}
+	return nil
+}
+
+// newSession creates a session wired to the registry's store. The caller
+// must hold reg.mu.
+func (reg *SessionRegistry) newSession(id string) *Session {
+	s := NewSession(id)
+	s.store = reg.store
+	s.runner = reg.runner
+	return s
+}
+
+// Get returns the session with the given ID, if it exists.
+func (reg *SessionRegistry) Get(id string) (*Session, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	s, ok := reg.sessions[id]
+	return s, ok
+}
+
+// Default returns the default session, creating it if necessary.
+//
+// The default session backs the legacy endpoints so the existing web UI keeps
+// working unchanged. It is recreated lazily if it has been ended.
+func (reg *SessionRegistry) Default() *Session {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	s, ok := reg.sessions[DefaultSessionID]
+	if !ok {
+		s = reg.newSession(DefaultSessionID)
+		s.mu.Lock()
+		s.persist()
+		s.mu.Unlock()
+		reg.sessions[DefaultSessionID] = s
+	}
+	return s
+}
+
+// Create registers a new idle session with a random ID.
+func (reg *SessionRegistry) Create() *Session {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	s := reg.newSession(newSessionID())
+	s.mu.Lock()
+	s.persist()
+	s.mu.Unlock()
+	reg.sessions[s.ID] = s
+	return s
+}
+
+// Remove deletes a session from the registry and the store.
+func (reg *SessionRegistry) Remove(id string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if s, ok := reg.sessions[id]; ok {
+		if err := s.transcript().Remove(); err != nil {
+			slog.Error("failed to delete transcript", "id", id, "error", err)
+		}
+	}
+	delete(reg.sessions, id)
+	if reg.store != nil {
+		if err := reg.store.DeleteSession(id); err != nil {
+			slog.Error("failed to delete persisted session", "id", id, "error", err)
+		}
+	}
+}
+
+// List returns all sessions ordered by creation time (oldest first).
+func (reg *SessionRegistry) List() []*Session {
+	reg.mu.RLock()
+	list := make([]*Session, 0, len(reg.sessions))
+	for _, s := range reg.sessions {
+		list = append(list, s)
+	}
+	reg.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// newSessionID generates a random 16-character hex session ID.
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms; fall back to time
+		return hex.EncodeToString([]byte(time.Now().Format("150405.000000")))
+	}
+	return hex.EncodeToString(b)
+}
+
+// sessionFromRequest resolves the session targeted by a request.
+//
+// Requests routed through /sessions/{id}/... use the path ID; legacy routes
+// without an ID use the default session. Writes a 404 and returns false if
+// the ID is unknown.
+func sessionFromRequest(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	id := r.PathValue("id")
+	if id == "" || id == DefaultSessionID {
+		return sessions.Default(), true
+	}
+
+	s, ok := sessions.Get(id)
+	if !ok {
+		respondError(w, http.StatusNotFound, "session not found")
+		return nil, false
+	}
+	return s, true
+}
+
+// handleListSessions lists all sessions.
+//
+// GET /sessions
+//
+// Response:
+//
+//	{
+//	  "sessions": [{"id": "default", "state": "waiting", ...}]
+//	}
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	list := sessions.List()
+	result := make([]map[string]interface{}, 0, len(list))
+	for _, s := range list {
+		result = append(result, s.statusSnapshot())
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": result,
+	})
+}
+
+// handleCreateSession creates a new session and starts its Claude process.
+//
+// POST /sessions
+// Request body (optional):
+//
+//	{
+//	  "repo_path": "/path/to/repo",  // Optional, uses REPO_PATH env or default
+//	  "content": "Fix the bug",      // Optional initial message
+//	  "permission_mode": "plan"      // Optional, defaults to permissions.mode
+//	}
+//
+// Response on success (201):
+//
+//	{
+//	  "id": "3f9a1c2b4d5e6f70",
+//	  "state": "waiting",
+//	  "repo_path": "/path/to/repo"
+//	}
+func handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RepoPath       string `json:"repo_path"`
+		Content        string `json:"content"`
+		PermissionMode string `json:"permission_mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Warn("failed to decode create session request body", "error", err)
+		// Continue with empty req - all fields are optional
+	}
+
+	repoPath, err := resolveRepoPath(req.RepoPath)
+	if err != nil {
+		slog.Error("failed to get current directory", "error", err)
+		respondError(w, http.StatusInternalServerError, "failed to determine working directory")
+		return
+	}
+
+	if info, err := os.Stat(repoPath); err != nil || !info.IsDir() {
+		respondError(w, http.StatusBadRequest, "repo_path is not a directory")
+		return
+	}
+
+	var mode PermissionMode
+	if req.PermissionMode != "" {
+		if mode, err = ParsePermissionMode(req.PermissionMode); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	s := sessions.Create()
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	if mode != "" {
+		s.mu.Lock()
+		s.PermissionMode = mode
+		s.mu.Unlock()
+	}
+
+	if req.Content != "" {
+		s.transcribe(TranscriptEntry{Kind: EntryKindUser, Text: req.Content})
+		err = s.startClaudeProcessWithMessage(repoPath, req.Content)
+	} else {
+		err = s.startClaudeProcess(repoPath)
+	}
+	if err != nil {
+		slog.Error("failed to start claude process", "id", s.ID, "error", err)
+		sessions.Remove(s.ID)
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	slog.Info("session created", "id", s.ID, "repo_path", repoPath)
+	respondJSON(w, http.StatusCreated, s.statusSnapshot())
+}
+
+// handleStopSession stops an idle session's Claude process.
+//
+// POST /sessions/{id}/stop
+//
+// The session moves to StateShuttingDown and then StateStopped, and resumes
+// on the next message just like an idle timeout. Only sessions in
+// StateWaiting can be stopped; other states return 409.
+func handleStopSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+
+	if err := s.stopSession(); err != nil {
+		s.mu.RLock()
+		state := s.State
+		s.mu.RUnlock()
+		respondJSON(w, http.StatusConflict, map[string]interface{}{
+			"error": err.Error(),
+			"state": state,
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"state":   StateShuttingDown,
+	})
+}
+
+// handleEndSession terminates a session and removes it from the registry.
+//
+// POST /sessions/{id}/end
+//
+// Any running Claude process is terminated regardless of state, connected
+// SSE clients are disconnected, and the session ID becomes unknown. Ending the
+// default session resets it; a fresh default session is created on next use.
+func handleEndSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.startMu.Lock()
+	s.end()
+	s.startMu.Unlock()
+
+	sessions.Remove(s.ID)
+	slog.Info("session ended", "id", s.ID)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"id":      s.ID,
+	})
+}
+
+// end terminates the session's Claude process (if any) and disconnects
+// SSE clients.
+//
+// Unlike stopSession, this works in any state and the session is not meant
+// to be resumed. SIGTERM is sent first, followed by SIGKILL after the
+// graceful shutdown timeout.
+func (s *Session) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancelIdleTimer()
+	s.cancelRecovery()
+	s.cancelBudgetTimer()
+	s.cancelInterruptTimer()
+	s.queue = nil
+
+	if s.proc != nil {
+		s.setState(StateShuttingDown)
+		proc := s.proc
+		if err := proc.Stop(); err != nil {
+			slog.Debug("failed to send SIGTERM (may have already exited)", "error", err, "pid", proc.Pid())
+		}
+		grace := cfg.ShutdownGrace()
+		go func() {
+			time.Sleep(grace)
+			if err := proc.Kill(); err != nil {
+				slog.Debug("failed to force kill process (may have already exited)", "error", err, "pid", proc.Pid())
+			}
+		}()
+	}
+
+	select {
+	case <-s.ended:
+		// Already ended
+	default:
+		close(s.ended)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Session log settings
+const (
+	SessionsFileName     = "sessions.jsonl" // Session log inside the data directory
+	MaxStoredTransitions = 100              // State changes kept per session when the log is compacted
+)
+
+// SessionRecord is the persisted metadata for a session.
+//
+// It holds everything needed to bring a session back after a server restart:
+// the Claude session ID for --resume, where it was running, and how it started.
+type SessionRecord struct {
+	ID              string         `json:"id"`                          // Doze session ID
+	ClaudeSessionID string         `json:"claude_session_id,omitempty"` // Session ID for --resume
+	RepoPath        string         `json:"repo_path,omitempty"`         // Working directory of the Claude process
+	Branch          string         `json:"branch,omitempty"`            // Git branch when the session started
+	InitialPrompt   string         `json:"initial_prompt,omitempty"`    // First message sent in the session
+	PermissionMode  PermissionMode `json:"permission_mode,omitempty"`   // How Claude gets tool permissions
+	AllowRules      []string       `json:"allow_rules,omitempty"`       // Always-allow permission rules
+	Model           string         `json:"model,omitempty"`             // --model for new processes
+	Usage           *UsageTotals   `json:"usage,omitempty"`             // Tokens and cost so far
+	State           SessionState   `json:"state"`                       // Last known state
+	CreatedAt       time.Time      `json:"created_at"`                  // When the session was registered
+	LastActivity    time.Time      `json:"last_activity"`               // Last user message or Claude output
+
+	// Budget state (see checkBudget), so an over-budget session stays
+	// blocked and an override survives a restart
+	ActiveSeconds   float64         `json:"active_seconds,omitempty"`    // Time spent in StateActive
+	Budget          *BudgetLimits   `json:"budget,omitempty"`            // Session limits, if overridden
+	BudgetBase      *BudgetUsage    `json:"budget_base,omitempty"`       // Usage when the session budget last started over
+	BudgetExemptDay string          `json:"budget_exempt_day,omitempty"` // Day the daily budget was overridden for
+	BudgetBlock     *BudgetExceeded `json:"budget_block,omitempty"`      // Limit blocking new messages
+}
+
+// StateTransition records a single session state change.
+type StateTransition struct {
+	ID   string       `json:"id"`   // Doze session ID
+	From SessionState `json:"from"` // Previous state
+	To   SessionState `json:"to"`   // New state
+	At   time.Time    `json:"at"`   // When the transition happened
+}
+
+// SessionStore persists session metadata across server restarts.
+//
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+	// SaveSession inserts or replaces the record for rec.ID.
+	SaveSession(rec SessionRecord) error
+
+	// RecordTransition appends a state change to the session's history.
+	RecordTransition(t StateTransition) error
+
+	// DeleteSession removes a session and its history.
+	DeleteSession(id string) error
+
+	// LoadSessions returns the latest record of every stored session.
+	LoadSessions() ([]SessionRecord, error)
+
+	// Close flushes and releases the underlying storage.
+	Close() error
+}
+
+// storeEntry is a single line in the append-only session log.
+//
+// Op determines which other fields are populated:
+//   - "session": Session contains a full record (replaces any previous one)
+//   - "transition": Transition contains a state change
+//   - "delete": ID names the session to remove
+type storeEntry struct {
+	Op         string           `json:"op"`
+	ID         string           `json:"id,omitempty"`
+	Session    *SessionRecord   `json:"session,omitempty"`
+	Transition *StateTransition `json:"transition,omitempty"`
+}
+
+// Store log operations
+const (
+	storeOpSession    = "session"
+	storeOpTransition = "transition"
+	storeOpDelete     = "delete"
+)
+
+// FileStore is a SessionStore backed by an append-only JSONL file.
+//
+// Every change is appended as one JSON line, so a crash can lose at most the
+// line being written. The log is compacted when the store is opened: deleted
+// sessions, superseded records and all but the last MaxStoredTransitions
+// state changes of each session are dropped.
+type FileStore struct {
+	mu   sync.Mutex // Serializes appends
+	path string     // Path to the JSONL log
+	file *os.File   // Log opened for appending
+}
+
+// OpenFileStore opens (or creates) the session log in dir.
+//
+// The directory is created if it doesn't exist. The existing log is compacted
+// before it is reopened for appending.
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	fs := &FileStore{path: filepath.Join(dir, SessionsFileName)}
+	if err := fs.compact(); err != nil {
+		return nil, fmt.Errorf("failed to compact session log: %w", err)
+	}
+
+	file, err := os.OpenFile(fs.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session log: %w", err)
+	}
+	fs.file = file
+	return fs, nil
+}
+
+// SaveSession appends a full session record to the log.
+func (fs *FileStore) SaveSession(rec SessionRecord) error {
+	return fs.append(storeEntry{Op: storeOpSession, ID: rec.ID, Session: &rec})
+}
+
+// RecordTransition appends a state change to the log.
+func (fs *FileStore) RecordTransition(t StateTransition) error {
+	return fs.append(storeEntry{Op: storeOpTransition, ID: t.ID, Transition: &t})
+}
+
+// DeleteSession appends a delete marker to the log.
+func (fs *FileStore) DeleteSession(id string) error {
+	return fs.append(storeEntry{Op: storeOpDelete, ID: id})
+}
+
+// LoadSessions replays the log and returns the latest record of each session.
+func (fs *FileStore) LoadSessions() ([]SessionRecord, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	records, order, _, err := replayLog(fs.path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]SessionRecord, 0, len(order))
+	for _, id := range order {
+		result = append(result, records[id])
+	}
+	return result, nil
+}
+
+// Close closes the log file.
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+// append writes one entry to the log and syncs it to disk.
+func (fs *FileStore) append(entry storeEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal store entry: %w", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		return fmt.Errorf("session store is closed")
+	}
+	if _, err := fs.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write store entry: %w", err)
+	}
+	return fs.file.Sync()
+}
+
+// compact rewrites the log keeping only the latest record and the recent
+// transition history (MaxStoredTransitions) of each live session.
+//
+// The new log is written to a temporary file and renamed into place so a
+// crash mid-compaction leaves the original intact.
+func (fs *FileStore) compact() error {
+	records, order, transitions, err := replayLog(fs.path)
+	if err != nil {
+		return err
+	}
+	if len(order) == 0 && len(transitions) == 0 {
+		return nil
+	}
+
+	tmpPath := fs.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, id := range order {
+		rec := records[id]
+		if err := enc.Encode(storeEntry{Op: storeOpSession, ID: id, Session: &rec}); err != nil {
+			tmp.Close()
+			return err
+		}
+		history := transitions[id]
+		if len(history) > MaxStoredTransitions {
+			history = history[len(history)-MaxStoredTransitions:]
+		}
+		for i := range history {
+			if err := enc.Encode(storeEntry{Op: storeOpTransition, ID: id, Transition: &history[i]}); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, fs.path)
+}
+
+// replayLog reads the session log and folds it into the current view.
+//
+// Returns the latest record per session, session IDs in first-seen order, and
+// each live session's transition history. A missing log is not an error.
+// Malformed lines (e.g. a torn final write) are logged and skipped.
+func replayLog(path string) (map[string]SessionRecord, []string, map[string][]StateTransition, error) {
+	records := make(map[string]SessionRecord)
+	transitions := make(map[string][]StateTransition)
+	var order []string
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, order, transitions, nil
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open session log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, ScannerInitialBuffer), ScannerMaxBuffer)
+	for scanner.Scan() {
+		var entry storeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("skipping malformed session log line", "path", path, "error", err)
+			continue
+		}
+
+		switch entry.Op {
+		case storeOpSession:
+			if entry.Session == nil {
+				continue
+			}
+			if _, ok := records[entry.ID]; !ok {
+				order = append(order, entry.ID)
+			}
+			records[entry.ID] = *entry.Session
+
+		case storeOpTransition:
+			if entry.Transition == nil {
+				continue
+			}
+			transitions[entry.ID] = append(transitions[entry.ID], *entry.Transition)
+
+		case storeOpDelete:
+			delete(records, entry.ID)
+			delete(transitions, entry.ID)
+			for i, id := range order {
+				if id == entry.ID {
+					order = append(order[:i], order[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read session log: %w", err)
+	}
+
+	// Drop history for sessions that never got a record
+	for id := range transitions {
+		if _, ok := records[id]; !ok {
+			delete(transitions, id)
+		}
+	}
+
+	return records, order, transitions, nil
+}
+
+// openLedger replays the JSONL log name in dir through replay, then opens it
+// for appending. Used by the append-only logs other than the session store
+// (see UsageLedger). The directory is created if it doesn't exist and a
+// missing log is not an error. Lines replay rejects (e.g. a torn final write)
+// are logged and skipped.
+func openLedger(dir, name string, replay func(line []byte) error) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	path := filepath.Join(dir, name)
+
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, ScannerInitialBuffer), ScannerMaxBuffer)
+		for scanner.Scan() {
+			if err := replay(scanner.Bytes()); err != nil {
+				slog.Warn("skipping malformed log line", "path", path, "error", err)
+			}
+		}
+		err := scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return file, nil
+}
+
+// appendLine writes v to file as one JSON line. A nil file (an in-memory
+// ledger) is skipped.
+func appendLine(file *os.File, v interface{}) error {
+	if file == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
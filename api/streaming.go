@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Partial message streaming settings
+const (
+	EventTypeOutputDelta   = "output_delta"
+	MessageTypeStreamEvent = "stream_event"         // Partial message event (--include-partial-messages)
+	DefaultDeltaInterval   = 100 * time.Millisecond // How long streamed text is coalesced before it's sent
+
+	// Stream event types (the Anthropic API's streaming events)
+	StreamEventMessageStart = "message_start"
+	StreamEventBlockDelta   = "content_block_delta"
+	StreamEventMessageStop  = "message_stop"
+	StreamDeltaText         = "text_delta"
+)
+
+// StreamEvent is the event a stream_event message carries. Only the fields
+// Doze uses are decoded.
+type StreamEvent struct {
+	Type    string `json:"type"` // See StreamEvent*
+	Message struct {
+		ID string `json:"id"`
+	} `json:"message"` // message_start
+	Delta struct {
+		Type string `json:"type"` // text_delta, input_json_delta, thinking_delta, ...
+		Text string `json:"text"`
+	} `json:"delta"` // content_block_delta
+}
+
+// outputDeltas coalesces streamed text so clients get a few output_delta
+// events a second rather than one per token.
+type outputDeltas struct {
+	messageID string          // Message being streamed (from message_start)
+	pending   strings.Builder // Text not yet broadcast
+	timer     *time.Timer     // Flushes pending after cfg.DeltaInterval()
+}
+
+// handleStreamEvent handles a partial message event from Claude. Text deltas
+// are collected and sent as output_delta events keyed by the message ID; a
+// subagent's (Task) text isn't streamed, just as it isn't shown as output.
+func (s *Session) handleStreamEvent(msg ClaudeStreamMessage) {
+	var ev StreamEvent
+	if err := json.Unmarshal(msg.Event, &ev); err != nil {
+		slog.Debug("failed to parse stream event", "error", err)
+		return
+	}
+	if msg.ParentToolUseID != "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch ev.Type {
+	case StreamEventMessageStart:
+		s.flushDeltas()
+		s.deltas.messageID = ev.Message.ID
+	case StreamEventBlockDelta:
+		if ev.Delta.Type != StreamDeltaText || ev.Delta.Text == "" {
+			return
+		}
+		s.deltas.pending.WriteString(ev.Delta.Text)
+		interval := cfg.DeltaInterval()
+		if interval <= 0 {
+			s.flushDeltas()
+		} else if s.deltas.timer == nil {
+			s.deltas.timer = time.AfterFunc(interval, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.flushDeltas()
+			})
+		}
+	case StreamEventMessageStop:
+		s.flushDeltas()
+	}
+}
+
+// flushDeltas broadcasts the text collected since the last output_delta
+// event. The caller must hold s.mu.
+func (s *Session) flushDeltas() {
+	if s.deltas.timer != nil {
+		s.deltas.timer.Stop()
+		s.deltas.timer = nil
+	}
+	if s.deltas.pending.Len() == 0 {
+		return
+	}
+	s.broadcastEvent(SSEEvent{Type: EventTypeOutputDelta, Content: s.deltas.pending.String(), MessageID: s.deltas.messageID})
+	s.deltas.pending.Reset()
+}
+
+// dropDeltas discards streamed text that hasn't been sent yet: the complete
+// message it belongs to has arrived, and its output event replaces the
+// deltas. The caller must hold s.mu.
+func (s *Session) dropDeltas() {
+	if s.deltas.timer != nil {
+		s.deltas.timer.Stop()
+		s.deltas.timer = nil
+	}
+	s.deltas.pending.Reset()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventTypeToolResult is the SSE event a tool's result is sent as.
+const EventTypeToolResult = "tool_result"
+
+// SubagentPrefix marks info lines for tools a subagent (Task) calls.
+const SubagentPrefix = "↳ "
+
+// pendingTool is a tool call waiting for its result.
+type pendingTool struct {
+	Name    string
+	Parent  string    // parent_tool_use_id: the Task call that made it, if any
+	Started time.Time // When the tool_use arrived
+}
+
+// ToolUseEvent is the content of a tool_use event.
+type ToolUseEvent struct {
+	ID              string                 `json:"id"`
+	Tool            string                 `json:"tool"`
+	Input           map[string]interface{} `json:"input"`
+	ParentToolUseID string                 `json:"parent_tool_use_id,omitempty"` // Task call a subagent made this from
+}
+
+// ToolResultEvent is the content of a tool_result event.
+type ToolResultEvent struct {
+	ToolUseID       string `json:"tool_use_id"`                  // Matches ToolUseEvent.ID
+	Tool            string `json:"tool,omitempty"`               // Name from the matching tool_use, if seen
+	Content         string `json:"content"`                      // Text of the result (first MaxToolResultBytes)
+	Truncated       bool   `json:"truncated,omitempty"`          // Content was cut to MaxToolResultBytes
+	IsError         bool   `json:"is_error,omitempty"`           // The tool failed or was denied
+	DurationMS      int64  `json:"duration_ms,omitempty"`        // Since the tool_use arrived
+	ParentToolUseID string `json:"parent_tool_use_id,omitempty"` // Task call a subagent made this from
+}
+
+// toolResultBlock is a tool_result content block in a user message.
+type toolResultBlock struct {
+	Type      string          `json:"type"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+// startTool records a tool call and sends it to clients as a tool_use event
+// (plus the formatted info line older clients show).
+func (s *Session) startTool(block ContentBlock, parent string) {
+	s.transcribe(TranscriptEntry{
+		Kind:            EntryKindToolUse,
+		ToolUseID:       block.ID,
+		Tool:            block.Name,
+		Input:           block.Input,
+		ParentToolUseID: parent,
+	})
+
+	s.mu.Lock()
+	if s.pendingTools == nil {
+		s.pendingTools = make(map[string]pendingTool)
+	}
+	s.pendingTools[block.ID] = pendingTool{Name: block.Name, Parent: parent, Started: time.Now()}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(ToolUseEvent{ID: block.ID, Tool: block.Name, Input: block.Input, ParentToolUseID: parent})
+	if err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypeToolUse, Content: string(data)})
+	}
+	info := formatToolUse(block.Name, block.Input)
+	if parent != "" {
+		info = SubagentPrefix + info
+	}
+	s.broadcastEvent(SSEEvent{Type: EventTypeInfo, Content: info})
+}
+
+// finishTool matches a tool_result block with its tool_use, records it and
+// sends it to clients as a tool_result event. parent is the message's
+// parent_tool_use_id, used if the tool_use wasn't seen (e.g. it arrived
+// before a restart).
+func (s *Session) finishTool(block toolResultBlock, parent string) {
+	text, truncated := toolResultText(block.Content)
+	ev := ToolResultEvent{
+		ToolUseID:       block.ToolUseID,
+		Content:         text,
+		Truncated:       truncated,
+		IsError:         block.IsError,
+		ParentToolUseID: parent,
+	}
+
+	s.mu.Lock()
+	if call, ok := s.pendingTools[block.ToolUseID]; ok {
+		delete(s.pendingTools, block.ToolUseID)
+		ev.Tool = call.Name
+		ev.DurationMS = time.Since(call.Started).Milliseconds()
+		if ev.ParentToolUseID == "" {
+			ev.ParentToolUseID = call.Parent
+		}
+	}
+	s.mu.Unlock()
+
+	s.transcribe(TranscriptEntry{
+		Kind:            EntryKindToolResult,
+		ToolUseID:       ev.ToolUseID,
+		Text:            ev.Content,
+		IsError:         ev.IsError,
+		ParentToolUseID: ev.ParentToolUseID,
+	})
+	if data, err := json.Marshal(ev); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypeToolResult, Content: string(data)})
+	}
+}
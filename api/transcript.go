@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transcript settings
+const (
+	TranscriptDirName     = "transcripts" // Per-session transcripts inside the data directory
+	DefaultTranscriptPage = 50            // Entries per page of GET /sessions/{id}/messages
+	MaxTranscriptPage     = 500           // Largest page a client can ask for
+	MaxToolResultBytes    = 16 * 1024     // Longest tool result kept (Read output can be huge)
+
+	// Transcript entry kinds
+	EntryKindUser        = "user"         // Message sent to Claude
+	EntryKindText        = "text"         // Assistant text block
+	EntryKindToolUse     = "tool_use"     // Tool call with its input
+	EntryKindToolResult  = "tool_result"  // What the tool returned
+	EntryKindError       = "error"        // Error reported by Claude
+	EntryKindUsage       = "usage"        // What the turn that just ended used
+	EntryKindFileChanges = "file_changes" // Uncommitted changes after a turn
+)
+
+// transcriptDir is where session transcripts are persisted ("" = memory
+// only). Set by main() from the data directory.
+var transcriptDir string
+
+// TranscriptEntry is one item of a session's conversation.
+type TranscriptEntry struct {
+	Seq       int64                  `json:"seq"`  // Position in the transcript, from 1
+	Kind      string                 `json:"kind"` // See EntryKind*
+	At        time.Time              `json:"at"`
+	Text      string                 `json:"text,omitempty"`        // Message, text block, tool result or error
+	MessageID string                 `json:"message_id,omitempty"`  // Queued message ID (user entries)
+	ToolUseID string                 `json:"tool_use_id,omitempty"` // Links a tool_result to its tool_use
+	Tool      string                 `json:"tool,omitempty"`        // Tool name (tool_use entries)
+	Input     map[string]interface{} `json:"input,omitempty"`       // Tool input (tool_use entries)
+	IsError   bool                   `json:"is_error,omitempty"`    // The tool failed or was denied
+	Usage     *TurnUsage             `json:"usage,omitempty"`       // Turn usage (usage entries)
+	Files     []FileSummary          `json:"files,omitempty"`       // Changed files (file_changes entries)
+
+	ParentToolUseID string `json:"parent_tool_use_id,omitempty"` // Task call, for a subagent's entries
+}
+
+// FileSummary is a changed file without its diff, as kept in transcripts.
+type FileSummary struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`  // See FileChange
+	Added   int    `json:"added"`   // Lines added
+	Removed int    `json:"removed"` // Lines removed
+}
+
+// summarizeChanges counts the added and removed lines in each change's diff.
+func summarizeChanges(changes []FileChange) []FileSummary {
+	summaries := make([]FileSummary, 0, len(changes))
+	for _, c := range changes {
+		summary := FileSummary{Path: c.Path, Status: c.Status}
+		for _, line := range strings.Split(c.Diff, "\n") {
+			switch {
+			case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			case strings.HasPrefix(line, "+"):
+				summary.Added++
+			case strings.HasPrefix(line, "-"):
+				summary.Removed++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// Transcript is a session's structured conversation history, optionally
+// persisted as append-only JSONL so it survives restarts.
+//
+// Unlike the output ring buffer it keeps every entry, so clients can page
+// back through the whole conversation. Safe for concurrent use.
+type Transcript struct {
+	mu         sync.Mutex
+	path       string              // JSONL file ("" = memory only)
+	file       *os.File            // Opened for appending
+	entries    []TranscriptEntry   // All entries, oldest first
+	messageIDs map[string]struct{} // User messages already recorded
+}
+
+// OpenTranscript loads the transcript at path (if any) and opens it for
+// appending. An empty path gives an in-memory transcript.
+func OpenTranscript(path string) (*Transcript, error) {
+	t := &Transcript{path: path, messageIDs: make(map[string]struct{})}
+	if path == "" {
+		return t, nil
+	}
+	file, err := openLedger(filepath.Dir(path), filepath.Base(path), func(line []byte) error {
+		var entry TranscriptEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		t.add(entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.file = file
+	return t, nil
+}
+
+// add appends an entry in memory. The caller must hold t.mu (or own t).
+func (t *Transcript) add(entry TranscriptEntry) {
+	t.entries = append(t.entries, entry)
+	if entry.MessageID != "" {
+		t.messageIDs[entry.MessageID] = struct{}{}
+	}
+}
+
+// Append numbers entry, records it and writes it to disk. A user entry whose
+// message ID was already recorded (a message re-sent after a failed
+// --resume) is skipped.
+func (t *Transcript) Append(entry TranscriptEntry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry.MessageID != "" {
+		if _, ok := t.messageIDs[entry.MessageID]; ok {
+			return nil
+		}
+	}
+	entry.Seq = 1
+	if n := len(t.entries); n > 0 {
+		entry.Seq = t.entries[n-1].Seq + 1
+	}
+	if entry.At.IsZero() {
+		entry.At = time.Now()
+	}
+	t.add(entry)
+	return appendLine(t.file, entry)
+}
+
+// Page returns up to limit entries with Seq below before (0 = from the end),
+// oldest first, and whether there are earlier entries.
+func (t *Transcript) Page(before int64, limit int) ([]TranscriptEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	end := len(t.entries)
+	if before > 0 {
+		end, _ = slices.BinarySearchFunc(t.entries, before, func(e TranscriptEntry, seq int64) int {
+			return int(e.Seq - seq)
+		})
+	}
+	start := max(end-limit, 0)
+	return slices.Clone(t.entries[start:end]), start > 0
+}
+
+// Entries returns the whole transcript, oldest first.
+func (t *Transcript) Entries() []TranscriptEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.entries)
+}
+
+// Remove closes the transcript and deletes its file.
+func (t *Transcript) Remove() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	if t.path == "" {
+		return nil
+	}
+	if err := os.Remove(t.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// transcriptPath returns where a session's transcript is kept.
+func transcriptPath(id string) string {
+	if transcriptDir == "" {
+		return ""
+	}
+	return filepath.Join(transcriptDir, id+".jsonl")
+}
+
+// transcript returns the session's transcript, loading it on first use. If
+// the file can't be opened, the transcript is kept in memory only.
+func (s *Session) transcript() *Transcript {
+	s.transcriptOnce.Do(func() {
+		t, err := OpenTranscript(transcriptPath(s.ID))
+		if err != nil {
+			slog.Error("failed to open transcript, keeping it in memory", "id", s.ID, "error", err)
+			t, _ = OpenTranscript("")
+		}
+		s.transcriptLog = t
+	})
+	return s.transcriptLog
+}
+
+// transcribe adds an entry to the session's transcript.
+func (s *Session) transcribe(entry TranscriptEntry) {
+	if err := s.transcript().Append(entry); err != nil {
+		slog.Error("failed to write transcript", "id", s.ID, "error", err)
+	}
+}
+
+// toolResultText extracts the text of a tool_result's content, which is
+// either a string or a list of content blocks, keeping the first
+// MaxToolResultBytes. truncated reports whether anything was cut.
+func toolResultText(raw json.RawMessage) (text string, truncated bool) {
+	if err := json.Unmarshal(raw, &text); err != nil {
+		var blocks []ContentBlock
+		if err := json.Unmarshal(raw, &blocks); err != nil {
+			return "", false
+		}
+		var parts []string
+		for _, block := range blocks {
+			if block.Type == ContentTypeText {
+				parts = append(parts, block.Text)
+			}
+		}
+		text = strings.Join(parts, "\n")
+	}
+	if len(text) > MaxToolResultBytes {
+		text = strings.ToValidUTF8(text[:MaxToolResultBytes], "") + fmt.Sprintf("\n… (%d bytes truncated)", len(text)-MaxToolResultBytes)
+		truncated = true
+	}
+	return text, truncated
+}
+
+// handleMessages returns a page of the session's transcript, oldest first.
+//
+// GET /messages?before=&limit=
+// GET /sessions/{id}/messages?before=&limit=
+//
+// Without before, the page ends with the latest entry; pass next_before to
+// load the page before it. limit defaults to 50 (max 500).
+//
+// Response:
+//
+//	{
+//	  "messages": [
+//	    {"seq": 41, "kind": "user", "at": "...", "text": "Run the tests", "message_id": "9f2c..."},
+//	    {"seq": 42, "kind": "tool_use", "at": "...", "tool_use_id": "toolu_01", "tool": "Bash", "input": {"command": "go test ./..."}},
+//	    {"seq": 43, "kind": "tool_result", "at": "...", "tool_use_id": "toolu_01", "text": "ok  ..."},
+//	    {"seq": 44, "kind": "text", "at": "...", "text": "All tests pass."}
+//	  ],
+//	  "has_more": true,
+//	  "next_before": 41
+//	}
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	var before int64
+	if v := query.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, "before must be a positive sequence number")
+			return
+		}
+		before = n
+	}
+	limit := DefaultTranscriptPage
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxTranscriptPage {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", MaxTranscriptPage))
+			return
+		}
+		limit = n
+	}
+
+	entries, more := s.transcript().Page(before, limit)
+	if entries == nil {
+		entries = []TranscriptEntry{}
+	}
+	resp := map[string]interface{}{
+		"messages": entries,
+		"has_more": more,
+	}
+	if more {
+		resp["next_before"] = entries[0].Seq
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
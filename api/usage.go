@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage settings
+const (
+	EventTypeUsage = "usage"
+	UsageFileName  = "usage.jsonl" // Per-turn usage log inside the data directory
+	MaxTurnUsage   = 100           // Recent turns kept per session (oldest dropped first)
+)
+
+// TokenUsage is the token count Claude reports in a result message.
+type TokenUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// add adds o's token counts to u.
+func (u *TokenUsage) add(o TokenUsage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheCreationInputTokens += o.CacheCreationInputTokens
+	u.CacheReadInputTokens += o.CacheReadInputTokens
+}
+
+// TurnUsage is what a single turn (one user message through to its result)
+// cost.
+type TurnUsage struct {
+	SessionID string    `json:"session_id"` // Doze session ID
+	Repo      string    `json:"repo"`       // Repository the session works in
+	Model     string    `json:"model,omitempty"`
+	At        time.Time `json:"at"` // When the result arrived
+	TokenUsage
+	CostUSD    float64 `json:"cost_usd"`    // Derived from the process's running total_cost_usd
+	DurationMS int64   `json:"duration_ms"` // Wall time Claude reported for the turn
+	NumTurns   int     `json:"num_turns"`   // Agent round trips Claude took
+}
+
+// UsageTotals adds up TurnUsage.
+type UsageTotals struct {
+	Turns int `json:"turns"` // Completed turns (result messages)
+	TokenUsage
+	CostUSD    float64 `json:"cost_usd"`
+	DurationMS int64   `json:"duration_ms"`
+	NumTurns   int     `json:"num_turns"`
+}
+
+// add counts a turn.
+func (t *UsageTotals) add(u TurnUsage) {
+	t.Turns++
+	t.TokenUsage.add(u.TokenUsage)
+	t.CostUSD += u.CostUSD
+	t.DurationMS += u.DurationMS
+	t.NumTurns += u.NumTurns
+}
+
+// recordUsage accounts for a result message: the turn is added to the
+// session's totals and recent turns, logged in usageLedger, and broadcast as
+// a usage event. The caller must hold s.mu.
+//
+// Claude reports total_cost_usd as a running total for the process, so the
+// turn's cost is the difference from the previous result.
+func (s *Session) recordUsage(msg ClaudeStreamMessage) {
+	turn := TurnUsage{
+		SessionID:  s.ID,
+		Repo:       s.RepoPath,
+		Model:      s.Model,
+		At:         time.Now(),
+		DurationMS: msg.DurationMS,
+		NumTurns:   msg.NumTurns,
+	}
+	if msg.Usage != nil {
+		turn.TokenUsage = *msg.Usage
+	}
+	if msg.CostUSD > s.processCost {
+		turn.CostUSD = msg.CostUSD - s.processCost
+		s.processCost = msg.CostUSD
+	}
+
+	s.Usage.add(turn)
+	s.turnUsage = append(s.turnUsage, turn)
+	if len(s.turnUsage) > MaxTurnUsage {
+		s.turnUsage = slices.Clone(s.turnUsage[len(s.turnUsage)-MaxTurnUsage:])
+	}
+	s.persist()
+
+	if err := usageLedger.Record(turn); err != nil {
+		slog.Error("failed to record usage", "id", s.ID, "error", err)
+	}
+	s.transcribe(TranscriptEntry{Kind: EntryKindUsage, At: turn.At, Usage: &turn})
+	data, err := json.Marshal(map[string]interface{}{"turn": turn, "session": s.Usage})
+	if err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypeUsage, Content: string(data)})
+	}
+}
+
+// usageLedger logs every turn's usage for the per-day and per-repo totals at
+// GET /usage. Replaced by main() with one backed by the data directory.
+var usageLedger = NewUsageLedger()
+
+// UsageLedger aggregates turn usage by day and repo, optionally backed by an
+// append-only JSONL log so the totals survive restarts.
+//
+// Safe for concurrent use. A nil ledger records nothing.
+type UsageLedger struct {
+	mu     sync.Mutex
+	file   *os.File                  // Log opened for appending (nil = memory only)
+	totals map[usageKey]*UsageTotals // Totals by local day and repo
+}
+
+// usageKey groups usage by local calendar day and repo.
+type usageKey struct {
+	Day  string // YYYY-MM-DD in the server's time zone
+	Repo string
+}
+
+// NewUsageLedger creates an in-memory ledger.
+func NewUsageLedger() *UsageLedger {
+	return &UsageLedger{totals: make(map[usageKey]*UsageTotals)}
+}
+
+// OpenUsageLedger opens (or creates) the usage log in dir and loads its
+// totals.
+func OpenUsageLedger(dir string) (*UsageLedger, error) {
+	l := NewUsageLedger()
+	file, err := openLedger(dir, UsageFileName, func(line []byte) error {
+		var turn TurnUsage
+		if err := json.Unmarshal(line, &turn); err != nil {
+			return err
+		}
+		l.add(turn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// Record adds a turn to the totals and appends it to the log.
+func (l *UsageLedger) Record(turn TurnUsage) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.add(turn)
+	return appendLine(l.file, turn)
+}
+
+// add folds a turn into the totals. The caller must hold l.mu (or own l).
+func (l *UsageLedger) add(turn TurnUsage) {
+	key := usageKey{Day: turn.At.Local().Format(time.DateOnly), Repo: turn.Repo}
+	totals, ok := l.totals[key]
+	if !ok {
+		totals = &UsageTotals{}
+		l.totals[key] = totals
+	}
+	totals.add(turn)
+}
+
+// Day returns the totals across repos for a local day (YYYY-MM-DD).
+func (l *UsageLedger) Day(day string) UsageTotals {
+	var total UsageTotals
+	if l == nil {
+		return total
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, totals := range l.totals {
+		if key.Day == day {
+			total.merge(*totals)
+		}
+	}
+	return total
+}
+
+// UsageSummary is one row of GET /usage.
+type UsageSummary struct {
+	Day  string `json:"day,omitempty"`
+	Repo string `json:"repo,omitempty"`
+	UsageTotals
+}
+
+// Summary returns the totals grouped by day and/or repo, sorted by day and
+// then repo, along with the grand total.
+func (l *UsageLedger) Summary(byDay, byRepo bool) ([]UsageSummary, UsageTotals) {
+	rows := []UsageSummary{}
+	var total UsageTotals
+	if l == nil {
+		return rows, total
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	grouped := make(map[usageKey]*UsageSummary)
+	for key, totals := range l.totals {
+		var group usageKey
+		if byDay {
+			group.Day = key.Day
+		}
+		if byRepo {
+			group.Repo = key.Repo
+		}
+		row, ok := grouped[group]
+		if !ok {
+			row = &UsageSummary{Day: group.Day, Repo: group.Repo}
+			grouped[group] = row
+		}
+		row.merge(*totals)
+		total.merge(*totals)
+	}
+
+	for _, row := range grouped {
+		rows = append(rows, *row)
+	}
+	slices.SortFunc(rows, func(a, b UsageSummary) int {
+		if c := strings.Compare(a.Day, b.Day); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Repo, b.Repo)
+	})
+	return rows, total
+}
+
+// merge adds o's totals to t.
+func (t *UsageTotals) merge(o UsageTotals) {
+	t.Turns += o.Turns
+	t.TokenUsage.add(o.TokenUsage)
+	t.CostUSD += o.CostUSD
+	t.DurationMS += o.DurationMS
+	t.NumTurns += o.NumTurns
+}
+
+// Close closes the log file.
+func (l *UsageLedger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// handleSessionUsage reports a session's usage totals and recent turns.
+//
+// GET /sessions/{id}/usage
+//
+// Response:
+//
+//	{
+//	  "usage": {"turns": 2, "input_tokens": 1200, "output_tokens": 340, "cost_usd": 0.75, ...},
+//	  "turns": [{"at": "...", "input_tokens": 600, "cost_usd": 0.25, "duration_ms": 5400, ...}]
+//	}
+func handleSessionUsage(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	totals := s.Usage
+	turns := slices.Clone(s.turnUsage)
+	s.mu.RUnlock()
+	if turns == nil {
+		turns = []TurnUsage{}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"usage": totals,
+		"turns": turns,
+	})
+}
+
+// handleUsage reports usage across all sessions, grouped by day and repo.
+//
+// GET /usage?group=day,repo
+//
+// group is "day", "repo" or "day,repo" (the default). Days are in the
+// server's time zone.
+//
+// Response:
+//
+//	{
+//	  "usage": [{"day": "2026-02-14", "repo": "/workspace/app", "turns": 12, "cost_usd": 1.93, ...}],
+//	  "total": {"turns": 12, "cost_usd": 1.93, ...}
+//	}
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	byDay, byRepo := true, true
+	if group := r.URL.Query().Get("group"); group != "" {
+		byDay, byRepo = false, false
+		for _, g := range strings.Split(group, ",") {
+			switch strings.TrimSpace(g) {
+			case "day":
+				byDay = true
+			case "repo":
+				byRepo = true
+			default:
+				respondError(w, http.StatusBadRequest, "group must be day, repo or day,repo")
+				return
+			}
+		}
+	}
+
+	rows, total := usageLedger.Summary(byDay, byRepo)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"usage": rows,
+		"total": total,
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/seamus/doze/policy"
+)
+
+// Policy settings
+const (
+	EventTypePolicyViolation = "policy_violation"
+	MaxPolicyViolations      = 100 // Violations kept per session (oldest dropped first)
+)
+
+// PolicyViolation is a tool call that matched a deny or ask policy rule.
+type PolicyViolation struct {
+	SessionID string        `json:"session_id"` // Doze session ID
+	Rule      string        `json:"rule"`       // Name of the matching rule
+	Action    policy.Action `json:"action"`     // "deny" (rejected) or "ask" (sent for approval)
+	Tool      string        `json:"tool"`       // e.g. "Bash"
+	Subject   string        `json:"subject"`    // Command or path the rule matched
+	Message   string        `json:"message"`    // Reason given to Claude and the user
+	At        time.Time     `json:"at"`
+}
+
+// recordViolation logs a policy match, keeps it in the session's violation
+// history, and broadcasts it as a policy_violation event. The caller must NOT
+// hold s.mu.
+func (s *Session) recordViolation(tool string, d policy.Decision) {
+	v := PolicyViolation{
+		SessionID: s.ID,
+		Rule:      d.Rule,
+		Action:    d.Action,
+		Tool:      tool,
+		Subject:   d.Subject,
+		Message:   d.Message,
+		At:        time.Now(),
+	}
+
+	s.mu.Lock()
+	s.violations = append(s.violations, v)
+	if len(s.violations) > MaxPolicyViolations {
+		s.violations = slices.Clone(s.violations[len(s.violations)-MaxPolicyViolations:])
+	}
+	s.mu.Unlock()
+
+	slog.Warn("policy violation", "id", s.ID, "rule", d.Rule, "action", d.Action, "tool", tool, "subject", d.Subject)
+	if data, err := json.Marshal(v); err == nil {
+		s.broadcastEvent(SSEEvent{Type: EventTypePolicyViolation, Content: string(data)})
+	}
+}
+
+// handleListViolations lists a session's policy violations, oldest first.
+//
+// GET /sessions/{id}/violations
+//
+// Response:
+//
+//	{
+//	  "violations": [{"rule": "no-force-push", "action": "deny", "tool": "Bash", "subject": "git push -f", ...}]
+//	}
+func handleListViolations(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.RLock()
+	violations := slices.Clone(s.violations)
+	s.mu.RUnlock()
+	if violations == nil {
+		violations = []PolicyViolation{}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"violations": violations,
+	})
+}
+
+// handlePolicy returns the policy rules in effect.
+//
+// GET /policy
+//
+// Response:
+//
+//	{
+//	  "rules": [{"name": "no-force-push", "tools": ["Bash"], "match": "...", "action": "deny"}]
+//	}
+func handlePolicy(w http.ResponseWriter, r *http.Request) {
+	rules := permissions.policy.Rules()
+	if rules == nil {
+		rules = []policy.Rule{}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"rules": rules,
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// WebSocket settings
+const (
+	WSHelloTimeout = 10 * time.Second // Max time to wait for the client's hello frame
+	WSWriteTimeout = 10 * time.Second // Max time to write a single frame
+	WSReadLimit    = 1024 * 1024      // Max size of a client frame (1MB)
+)
+
+// WebSocket frame types
+const (
+	FrameTypeHello     = "hello"     // Client → server first frame; server replies with session info
+	FrameTypeMessage   = "message"   // Client → server: send a message to Claude
+	FrameTypeAck       = "ack"       // Server → client: result of a message/interrupt frame
+	FrameTypeEvent     = "event"     // Server → client: a broadcast event (same as SSE)
+	FrameTypeInterrupt = "interrupt" // Client → server: interrupt the current turn
+	FrameTypePing      = "ping"      // Client → server keepalive
+	FrameTypePong      = "pong"      // Server → client reply to ping
+)
+
+// WSFrame is a single JSON frame on the /ws connection.
+//
+// The Type field determines which other fields are populated:
+//   - "hello" (client): LastEventID to replay from (optional)
+//   - "hello" (server): SessionID, State
+//   - "message" (client): ID (optional, echoed in the ack), Content
+//   - "ack" (server): ID, plus State/Started/Resumed on success or Error
+//   - "event" (server): Event
+//   - "interrupt" (client): ID (optional)
+//   - "ping" (client), "pong" (server): ID (optional, echoed)
+type WSFrame struct {
+	Type           string         `json:"type"`
+	ID             string         `json:"id,omitempty"`              // Client-chosen frame ID, echoed in the reply
+	Content        string         `json:"content,omitempty"`         // Message text
+	IdempotencyKey string         `json:"idempotency_key,omitempty"` // Dedupes retried messages (see sendMessage)
+	MessageID      string         `json:"message_id,omitempty"`      // ID of the queued message (message ack)
+	Position       int            `json:"position,omitempty"`        // Place in the queue (message ack)
+	Duplicate      bool           `json:"duplicate,omitempty"`       // Message was already sent with this key (message ack)
+	LastEventID    uint64         `json:"last_event_id,omitempty"`   // Last event ID the client has seen
+	SessionID      string         `json:"session_id,omitempty"`      // Doze session ID
+	State          string         `json:"state,omitempty"`           // Session state
+	Started        bool           `json:"started,omitempty"`         // Message started a new Claude process
+	Resumed        bool           `json:"resumed,omitempty"`         // Message resumed a stopped session
+	Error          string         `json:"error,omitempty"`           // Why a frame was rejected
+	Event          *SSEEvent      `json:"event,omitempty"`           // Broadcast event
+	Command        *CommandResult `json:"command,omitempty"`         // Slash command result (message ack)
+}
+
+// handleWebSocket upgrades to a WebSocket speaking the JSON frame protocol
+// described by WSFrame.
+//
+// GET /ws
+// GET /sessions/{id}/ws
+//
+// The client's first frame must be hello:
+//
+//	{"type": "hello", "last_event_id": 1739000000000042}
+//
+// The server replies with hello and then streams events exactly like
+// GET /stream: missed events are replayed if last_event_id is still in the
+// journal, otherwise the recent output and current state are sent first.
+//
+//	{"type": "hello", "session_id": "default", "state": "waiting"}
+//	{"type": "event", "event": {"id": 1739000000000043, "type": "state", "state": "active"}}
+//
+// Messages go through the same state machine as POST /message and are
+// acknowledged with the client's frame ID:
+//
+//	{"type": "message", "id": "m1", "content": "Fix the bug", "idempotency_key": "3b0c..."}
+//	{"type": "ack", "id": "m1", "state": "active", "message_id": "9f2c..."}
+//	{"type": "ack", "id": "m2", "state": "active", "message_id": "a41d...", "position": 1}
+//	{"type": "ack", "id": "m3", "error": "message queue is full"}
+//
+// A client that falls behind is closed with StatusTryAgainLater and should
+// reconnect with the last event ID it saw.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: cfg.Auth.CORSOrigins,
+	})
+	if err != nil {
+		slog.Warn("failed to accept websocket", "id", s.ID, "error", err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(WSReadLimit)
+
+	// The request context is unreliable once the connection is hijacked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Wait for hello
+	helloCtx, helloCancel := context.WithTimeout(ctx, WSHelloTimeout)
+	var hello WSFrame
+	err = wsjson.Read(helloCtx, conn, &hello)
+	helloCancel()
+	if err != nil || hello.Type != FrameTypeHello {
+		slog.Warn("websocket client did not send hello", "id", s.ID, "error", err)
+		conn.Close(websocket.StatusPolicyViolation, "expected hello frame")
+		return
+	}
+
+	lastEventID := ""
+	if hello.LastEventID != 0 {
+		lastEventID = strconv.FormatUint(hello.LastEventID, 10)
+	}
+	client, initial := s.subscribe(lastEventID)
+	defer s.removeSSEClient(client)
+	slog.Info("websocket client connected", "id", s.ID, "client_id", client.id, "last_event_id", lastEventID)
+
+	s.mu.RLock()
+	state := s.State
+	s.mu.RUnlock()
+	if err := writeFrame(ctx, conn, WSFrame{Type: FrameTypeHello, SessionID: s.ID, State: string(state)}); err != nil {
+		return
+	}
+	for _, event := range initial {
+		if err := writeFrame(ctx, conn, WSFrame{Type: FrameTypeEvent, Event: &event}); err != nil {
+			return
+		}
+	}
+
+	// Read client frames until the connection closes
+	go func() {
+		defer cancel()
+		for {
+			var frame WSFrame
+			if err := wsjson.Read(ctx, conn, &frame); err != nil {
+				if websocket.CloseStatus(err) == -1 && !errors.Is(err, context.Canceled) {
+					slog.Debug("websocket read failed", "id", s.ID, "client_id", client.id, "error", err)
+				}
+				return
+			}
+			if err := writeFrame(ctx, conn, s.handleFrame(frame)); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Stream events until disconnect
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("websocket client disconnected", "id", s.ID, "client_id", client.id)
+			return
+
+		case <-s.ended:
+			slog.Info("websocket client closed, session ended", "id", s.ID, "client_id", client.id)
+			conn.Close(websocket.StatusGoingAway, "session ended")
+			return
+
+		case <-client.lagged:
+			slog.Warn("websocket client lagged, closing for replay", "id", s.ID, "client_id", client.id)
+			conn.Close(websocket.StatusTryAgainLater, "client fell behind, reconnect with last_event_id")
+			return
+
+		case event := <-client.events:
+			if err := writeFrame(ctx, conn, WSFrame{Type: FrameTypeEvent, Event: &event}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleFrame handles a client frame and returns the reply.
+func (s *Session) handleFrame(frame WSFrame) WSFrame {
+	switch frame.Type {
+	case FrameTypeMessage:
+		if frame.Content == "" {
+			return WSFrame{Type: FrameTypeAck, ID: frame.ID, Error: "content is required"}
+		}
+		result, err := s.sendMessage(frame.Content, frame.IdempotencyKey)
+		if err != nil {
+			return WSFrame{Type: FrameTypeAck, ID: frame.ID, Error: err.Error()}
+		}
+		return WSFrame{
+			Type:      FrameTypeAck,
+			ID:        frame.ID,
+			State:     string(result.State),
+			Started:   result.Started,
+			Resumed:   result.Resumed,
+			Command:   result.Command,
+			MessageID: result.ID,
+			Position:  result.Position,
+			Duplicate: result.Duplicate,
+		}
+
+	case FrameTypeInterrupt:
+		if err := s.interrupt(); err != nil {
+			return WSFrame{Type: FrameTypeAck, ID: frame.ID, Error: err.Error()}
+		}
+		s.mu.RLock()
+		state := s.State
+		s.mu.RUnlock()
+		return WSFrame{Type: FrameTypeAck, ID: frame.ID, State: string(state)}
+
+	case FrameTypePing:
+		return WSFrame{Type: FrameTypePong, ID: frame.ID}
+
+	case FrameTypeHello:
+		return WSFrame{Type: FrameTypeAck, ID: frame.ID, Error: "already said hello"}
+
+	default:
+		return WSFrame{Type: FrameTypeAck, ID: frame.ID, Error: "unknown frame type: " + frame.Type}
+	}
+}
+
+// writeFrame writes a single JSON frame with a timeout. Safe to call from
+// multiple goroutines.
+func writeFrame(ctx context.Context, conn *websocket.Conn, frame WSFrame) error {
+	ctx, cancel := context.WithTimeout(ctx, WSWriteTimeout)
+	defer cancel()
+
+	if err := wsjson.Write(ctx, conn, frame); err != nil {
+		slog.Debug("failed to write websocket frame", "type", frame.Type, "error", err)
+		return err
+	}
+	return nil
+}
@@ -1,5 +1,6 @@
 import { createContext, useContext, useState, useEffect, useCallback, type ReactNode } from 'react';
-import { SessionState, type SessionStateType, type Message, type FileChange } from './types';
+import { SessionState, type SessionStateType, type Message, type FileChange, type CommandResult } from './types';
+import { authHeaders, pairing, streamUrl } from './auth';
 
 interface SessionContextType {
   state: SessionStateType;
@@ -21,7 +22,7 @@ export function SessionProvider({ children }: { children: ReactNode }) {
   const [currentAssistantMessage, setCurrentAssistantMessage] = useState<string>('');
 
   const connect = useCallback(() => {
-    const es = new EventSource('/stream');
+    const es = new EventSource(streamUrl('/stream'));
 
     es.addEventListener('state', (e) => {
       const data = JSON.parse(e.data);
@@ -72,6 +73,25 @@ export function SessionProvider({ children }: { children: ReactNode }) {
       console.log('Tool info:', data.content);
     });
 
+    es.addEventListener('command', (e) => {
+      const data = JSON.parse(e.data);
+      // Slash commands Doze handles itself produce no output or state change,
+      // only their result: {command: "status", text: "State: waiting", ...}
+      try {
+        const result: CommandResult = JSON.parse(data.content);
+        setIsTyping(false);
+        setMessages(prev => [...prev, {
+          id: Date.now().toString() + Math.random(),
+          role: 'command',
+          content: result.text,
+          isError: !!result.error,
+          timestamp: Date.now(),
+        }]);
+      } catch (err) {
+        console.error('Failed to parse command result:', err);
+      }
+    });
+
     es.addEventListener('file_changes', (e) => {
       const data = JSON.parse(e.data);
       // Backend sends JSON in content field
@@ -117,8 +137,16 @@ export function SessionProvider({ children }: { children: ReactNode }) {
   }, []);
 
   useEffect(() => {
-    const es = connect();
-    return () => es.close();
+    let es: EventSource | null = null;
+    let cancelled = false;
+    // Wait for pairing (if any) so the stream connects with the new token
+    pairing.finally(() => {
+      if (!cancelled) es = connect();
+    });
+    return () => {
+      cancelled = true;
+      es?.close();
+    };
   }, [connect]);
 
   useEffect(() => {
@@ -143,7 +171,7 @@ export function SessionProvider({ children }: { children: ReactNode }) {
   }, [currentAssistantMessage, isTyping]);
 
   const startSession = async () => {
-    const res = await fetch('/start', { method: 'POST' });
+    const res = await fetch('/start', { method: 'POST', headers: authHeaders() });
     if (!res.ok) throw new Error('Failed to start session');
   };
 
@@ -159,7 +187,7 @@ export function SessionProvider({ children }: { children: ReactNode }) {
       // Still send to backend to reset session state
       const res = await fetch('/message', {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: { 'Content-Type': 'application/json', ...authHeaders() },
         body: JSON.stringify({ content: text }),
       });
       if (!res.ok) {
@@ -180,7 +208,7 @@ export function SessionProvider({ children }: { children: ReactNode }) {
 
     const res = await fetch('/message', {
       method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
+      headers: { 'Content-Type': 'application/json', ...authHeaders() },
       body: JSON.stringify({ content: text }),
     });
 
@@ -188,6 +216,12 @@ export function SessionProvider({ children }: { children: ReactNode }) {
       setIsTyping(false);
       throw new Error('Failed to send message');
     }
+
+    // Doze ran it as a slash command; the result arrives as a command event
+    const body = await res.json().catch(() => null);
+    if (body?.command) {
+      setIsTyping(false);
+    }
   };
 
   const clearMessages = () => {
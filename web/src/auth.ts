@@ -0,0 +1,65 @@
+// Auth token handling.
+//
+// The token is picked up once from a `?token=` query parameter (so it can be
+// shared as a link), or obtained by redeeming a `?pair=` pairing code from
+// the server's QR code, and then kept in localStorage. It is sent as a bearer
+// token on fetch requests and as a query parameter on EventSource streams,
+// which can't set headers.
+
+const TOKEN_KEY = 'doze_token';
+
+function captureTokenFromUrl() {
+  const url = new URL(window.location.href);
+  const token = url.searchParams.get('token');
+  if (token) {
+    localStorage.setItem(TOKEN_KEY, token);
+    url.searchParams.delete('token');
+    window.history.replaceState(null, '', url.toString());
+  }
+}
+
+async function redeemPairingCodeFromUrl() {
+  const url = new URL(window.location.href);
+  const code = url.searchParams.get('pair');
+  if (!code) return;
+
+  url.searchParams.delete('pair');
+  window.history.replaceState(null, '', url.toString());
+
+  const res = await fetch('/pair', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ code, name: navigator.userAgent.slice(0, 64) }),
+  });
+  if (!res.ok) {
+    console.error('Pairing failed:', res.status);
+    return;
+  }
+  const data = await res.json();
+  localStorage.setItem(TOKEN_KEY, data.token);
+}
+
+captureTokenFromUrl();
+
+// Resolves once any pairing code in the URL has been exchanged for a token
+export const pairing = redeemPairingCodeFromUrl().catch((err) => {
+  console.error('Pairing failed:', err);
+});
+
+export function getToken(): string | null {
+  return localStorage.getItem(TOKEN_KEY);
+}
+
+export function setToken(token: string) {
+  localStorage.setItem(TOKEN_KEY, token);
+}
+
+export function authHeaders(): Record<string, string> {
+  const token = getToken();
+  return token ? { Authorization: `Bearer ${token}` } : {};
+}
+
+export function streamUrl(path: string): string {
+  const token = getToken();
+  return token ? `${path}?token=${encodeURIComponent(token)}` : path;
+}
@@ -90,6 +90,22 @@ export function MessageList() {
               );
             }
 
+            if (msg.role === 'command') {
+              return (
+                <div key={msg.id} className="flex self-start max-w-[85%] animate-slideInLeft">
+                  <div
+                    className={`px-3 py-2 text-xs rounded-md border font-mono whitespace-pre-wrap ${
+                      msg.isError
+                        ? 'bg-red-900/30 border-red-500/50 text-red-200'
+                        : 'bg-purple-600/10 border-purple-500/30 text-text-secondary'
+                    }`}
+                  >
+                    {msg.content}
+                  </div>
+                </div>
+              );
+            }
+
             // Check if user message is a slash command
             const isSlashCommand = msg.role === 'user' && msg.content.trim().startsWith('/');
 
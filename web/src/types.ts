@@ -16,15 +16,26 @@ export const EventType = {
   INFO: 'info',
   FILE_CHANGES: 'file_changes',
   TOOL_USE: 'tool_use',
+  COMMAND: 'command',
 } as const;
 
 export interface Message {
   id: string;
-  role: 'user' | 'assistant' | 'tool';
+  role: 'user' | 'assistant' | 'tool' | 'command';
   content: string;
   timestamp: number;
   toolName?: string; // For tool messages
   toolInput?: Record<string, any>; // Tool parameters
+  isError?: boolean; // For command messages: the command failed
+}
+
+// Result of a slash command Doze handled itself (command event content and
+// the "command" field of the POST /message response)
+export interface CommandResult {
+  command: string;
+  text: string;
+  data?: Record<string, any>;
+  error?: string;
 }
 
 export interface FileChange {